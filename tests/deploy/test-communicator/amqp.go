@@ -0,0 +1,1121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQP 0-9-1 frame types and the frame-end octet
+const (
+	amqpFrameMethod    byte = 1
+	amqpFrameHeader    byte = 2
+	amqpFrameBody      byte = 3
+	amqpFrameHeartbeat byte = 8
+	amqpFrameEnd       byte = 0xce
+)
+
+// amqpFrameMax is the largest frame either end sends or accepts, and
+// amqpFrameMin the smallest frame-max a peer may negotiate.
+const (
+	amqpFrameMax = 131072
+	amqpFrameMin = 4096
+)
+
+var amqpProtocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
+
+// AMQP class and method identifiers, encoded as class<<16 | method
+const (
+	amqpConnectionStart     uint32 = 10<<16 | 10
+	amqpConnectionStartOk   uint32 = 10<<16 | 11
+	amqpConnectionTune      uint32 = 10<<16 | 30
+	amqpConnectionTuneOk    uint32 = 10<<16 | 31
+	amqpConnectionOpen      uint32 = 10<<16 | 40
+	amqpConnectionOpenOk    uint32 = 10<<16 | 41
+	amqpConnectionClose     uint32 = 10<<16 | 50
+	amqpConnectionCloseOk   uint32 = 10<<16 | 51
+	amqpChannelOpen         uint32 = 20<<16 | 10
+	amqpChannelOpenOk       uint32 = 20<<16 | 11
+	amqpChannelClose        uint32 = 20<<16 | 40
+	amqpChannelCloseOk      uint32 = 20<<16 | 41
+	amqpExchangeDeclare     uint32 = 40<<16 | 10
+	amqpExchangeDeclareOk   uint32 = 40<<16 | 11
+	amqpQueueDeclare        uint32 = 50<<16 | 10
+	amqpQueueDeclareOk      uint32 = 50<<16 | 11
+	amqpQueueBind           uint32 = 50<<16 | 20
+	amqpQueueBindOk         uint32 = 50<<16 | 21
+	amqpBasicQos            uint32 = 60<<16 | 10
+	amqpBasicQosOk          uint32 = 60<<16 | 11
+	amqpBasicConsume        uint32 = 60<<16 | 20
+	amqpBasicConsumeOk      uint32 = 60<<16 | 21
+	amqpBasicCancel         uint32 = 60<<16 | 30
+	amqpBasicCancelOk       uint32 = 60<<16 | 31
+	amqpBasicPublish        uint32 = 60<<16 | 40
+	amqpBasicDeliver        uint32 = 60<<16 | 60
+	amqpBasicAck            uint32 = 60<<16 | 80
+	amqpBasicReject         uint32 = 60<<16 | 90
+	amqpBasicNack           uint32 = 60<<16 | 120
+	amqpConfirmSelect       uint32 = 85<<16 | 10
+	amqpConfirmSelectOk     uint32 = 85<<16 | 11
+	amqpReplySuccess        uint16 = 200
+	amqpReplyNotFound       uint16 = 404
+	amqpReplyCommandInvalid uint16 = 503
+)
+
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+type amqpMessage struct {
+	exchange   string
+	routingKey string
+	properties []byte // content header property flags and list, forwarded verbatim
+	body       []byte
+}
+
+// amqpBroker is a minimal in-memory broker supporting the default, direct,
+// fanout and topic exchanges. It ignores durability, prefetch limits and
+// mandatory/immediate flags; unacknowledged deliveries are requeued when the
+// consuming channel closes.
+type amqpBroker struct {
+	mu          sync.Mutex
+	exchanges   map[string]*amqpExchange
+	queues      map[string]*amqpQueue
+	consumerSeq int
+	conns       *connTracker // Marks connections idle between frames for draining
+}
+
+type amqpExchange struct {
+	kind     string
+	bindings []amqpBinding
+}
+
+type amqpBinding struct {
+	queue string
+	key   string
+}
+
+type amqpQueue struct {
+	name      string
+	messages  []amqpMessage
+	consumers []*amqpConsumer
+	next      int
+}
+
+type amqpConsumer struct {
+	tag     string
+	queue   *amqpQueue
+	channel *amqpChannel
+	noAck   bool
+}
+
+type amqpDelivery struct {
+	queue   *amqpQueue
+	message amqpMessage
+}
+
+// amqpClientStep is a synchronous method the client sends during setup,
+// together with the reply it waits for.
+type amqpClientStep struct {
+	method uint32
+	args   amqpArgs
+	reply  uint32
+}
+
+// amqpServerConn is one client connection of the broker. Frames are
+// written by a goroutine of their own, so dispatching a message under the
+// broker lock only queues it and a slow consumer never holds up the others.
+type amqpServerConn struct {
+	broker   *amqpBroker
+	conn     net.Conn
+	frameMax int
+	channels map[uint16]*amqpChannel
+
+	outMu  sync.Mutex
+	out    [][]byte // Encoded frames waiting to be written
+	outErr error    // First write error; later writes fail with it
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+type amqpChannel struct {
+	id          uint16
+	conn        *amqpServerConn
+	deliveryTag uint64
+	unacked     map[uint64]amqpDelivery
+	consumers   map[string]*amqpConsumer
+	confirm     bool
+	publishSeq  uint64
+	publishing  *amqpMessage // basic.publish waiting for its content
+	bodySize    uint64
+}
+
+func newAMQPBroker(conns *connTracker) *amqpBroker {
+	return &amqpBroker{
+		exchanges: map[string]*amqpExchange{
+			"":           {kind: "direct"},
+			"amq.direct": {kind: "direct"},
+			"amq.fanout": {kind: "fanout"},
+			"amq.topic":  {kind: "topic"},
+		},
+		queues: make(map[string]*amqpQueue),
+		conns:  conns,
+	}
+}
+
+func (a *App) startAMQPServer() error {
+	broker := newAMQPBroker(a.tcpConns)
+	if err := a.serveTCP("AMQP", func(conn net.Conn) {
+		a.requests.Inc()
+		broker.handleConnection(conn)
+	}); err != nil {
+		return err
+	}
+
+	// Start the publisher/consumer client if a broker target is configured
+	if a.config.TargetHost != "" {
+		go a.startAMQPClient()
+	}
+
+	return nil
+}
+
+func (b *amqpBroker) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if string(header) != string(amqpProtocolHeader) {
+		// Tell the client which protocol version we speak, then close
+		conn.Write(amqpProtocolHeader)
+		log.Printf("AMQP unsupported protocol header from %s: %q", conn.RemoteAddr(), header)
+		return
+	}
+
+	c := &amqpServerConn{
+		broker:   b,
+		conn:     conn,
+		frameMax: amqpFrameMax,
+		channels: make(map[uint16]*amqpChannel),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go c.writeLoop()
+	defer c.closeWriter()
+	defer c.closeChannels()
+
+	if err := c.handshake(reader); err != nil {
+		log.Printf("AMQP handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("AMQP client connected: %s", conn.RemoteAddr())
+
+	for {
+		b.conns.setIdle(conn, reader.Buffered() == 0)
+		frame, err := readAMQPFrame(reader)
+		b.conns.setIdle(conn, false)
+		if err != nil {
+			if b.conns.woken(err) {
+				log.Printf("AMQP client %s closed for shutdown", conn.RemoteAddr())
+			} else if err != io.EOF {
+				log.Printf("AMQP error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		done, err := c.handleFrame(frame)
+		if err != nil {
+			log.Printf("AMQP connection error from %s: %v", conn.RemoteAddr(), err)
+			c.writeMethod(0, amqpConnectionClose, amqpArgs{}.short(amqpReplyCommandInvalid).shortstr(err.Error()).short(0).short(0))
+			return
+		}
+		if done {
+			log.Printf("AMQP client disconnected: %s", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+func (c *amqpServerConn) handshake(reader *bufio.Reader) error {
+	properties := amqpArgs{}.tableEntry("product", "test-communicator").tableEntry("version", "0.9.1")
+	start := amqpArgs{}.octet(0).octet(9).table(properties).longstr("PLAIN AMQPLAIN").longstr("en_US")
+	if err := c.writeMethod(0, amqpConnectionStart, start); err != nil {
+		return err
+	}
+	if _, err := expectAMQPMethod(reader, amqpConnectionStartOk); err != nil {
+		return err
+	}
+
+	tune := amqpArgs{}.short(2047).long(amqpFrameMax).short(0)
+	if err := c.writeMethod(0, amqpConnectionTune, tune); err != nil {
+		return err
+	}
+	args, err := expectAMQPMethod(reader, amqpConnectionTuneOk)
+	if err != nil {
+		return err
+	}
+	args.short()
+	frameMax := int(args.long())
+	if frameMax != 0 && frameMax < amqpFrameMin {
+		return fmt.Errorf("frame-max %d is below the minimum of %d", frameMax, amqpFrameMin)
+	}
+	if frameMax > 0 && frameMax < c.frameMax {
+		c.frameMax = frameMax
+	}
+
+	if _, err := expectAMQPMethod(reader, amqpConnectionOpen); err != nil {
+		return err
+	}
+	return c.writeMethod(0, amqpConnectionOpenOk, amqpArgs{}.shortstr(""))
+}
+
+// handleFrame processes a frame received after the handshake and reports
+// whether the connection was closed by the client.
+func (c *amqpServerConn) handleFrame(frame amqpFrame) (bool, error) {
+	switch frame.kind {
+	case amqpFrameHeartbeat:
+		return false, nil
+	case amqpFrameHeader, amqpFrameBody:
+		return false, c.handleContent(frame)
+	case amqpFrameMethod:
+	default:
+		return false, fmt.Errorf("unexpected frame type %d", frame.kind)
+	}
+
+	method, args, err := parseAMQPMethod(frame.payload)
+	if err != nil {
+		return false, err
+	}
+
+	if frame.channel == 0 {
+		switch method {
+		case amqpConnectionClose:
+			return true, c.writeMethod(0, amqpConnectionCloseOk, amqpArgs{})
+		case amqpConnectionCloseOk:
+			return true, nil
+		default:
+			return false, fmt.Errorf("unexpected method %d.%d on channel 0", method>>16, method&0xffff)
+		}
+	}
+
+	if method == amqpChannelOpen {
+		c.broker.mu.Lock()
+		if _, open := c.channels[frame.channel]; open {
+			c.broker.mu.Unlock()
+			return false, fmt.Errorf("channel %d is already open", frame.channel)
+		}
+		c.channels[frame.channel] = &amqpChannel{
+			id:        frame.channel,
+			conn:      c,
+			unacked:   make(map[uint64]amqpDelivery),
+			consumers: make(map[string]*amqpConsumer),
+		}
+		c.broker.mu.Unlock()
+		return false, c.writeMethod(frame.channel, amqpChannelOpenOk, amqpArgs{}.longstr(""))
+	}
+
+	c.broker.mu.Lock()
+	channel, ok := c.channels[frame.channel]
+	c.broker.mu.Unlock()
+	if !ok {
+		return false, fmt.Errorf("channel %d is not open", frame.channel)
+	}
+
+	return false, channel.handleMethod(method, args)
+}
+
+func (ch *amqpChannel) handleMethod(method uint32, args *amqpReader) error {
+	b := ch.conn.broker
+
+	switch method {
+	case amqpChannelClose:
+		b.mu.Lock()
+		ch.close()
+		delete(ch.conn.channels, ch.id)
+		b.mu.Unlock()
+		return ch.conn.writeMethod(ch.id, amqpChannelCloseOk, amqpArgs{})
+
+	case amqpExchangeDeclare:
+		args.short()
+		name, kind := args.shortstr(), args.shortstr()
+		passive := args.octet()&0x01 != 0
+		if args.err != nil {
+			return args.err
+		}
+
+		b.mu.Lock()
+		_, exists := b.exchanges[name]
+		if !exists && !passive {
+			b.exchanges[name] = &amqpExchange{kind: kind}
+		}
+		b.mu.Unlock()
+		if !exists && passive {
+			return ch.closeWithError(amqpReplyNotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", name), method)
+		}
+		return ch.conn.writeMethod(ch.id, amqpExchangeDeclareOk, amqpArgs{})
+
+	case amqpQueueDeclare:
+		args.short()
+		name := args.shortstr()
+		passive := args.octet()&0x01 != 0
+		if args.err != nil {
+			return args.err
+		}
+
+		b.mu.Lock()
+		if name == "" {
+			name = fmt.Sprintf("amq.gen-%d", len(b.queues)+1)
+		}
+		queue, exists := b.queues[name]
+		if !exists && !passive {
+			queue = &amqpQueue{name: name}
+			b.queues[name] = queue
+		}
+		var messages, consumers uint32
+		if queue != nil {
+			messages, consumers = uint32(len(queue.messages)), uint32(len(queue.consumers))
+		}
+		b.mu.Unlock()
+		if queue == nil {
+			return ch.closeWithError(amqpReplyNotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name), method)
+		}
+		return ch.conn.writeMethod(ch.id, amqpQueueDeclareOk, amqpArgs{}.shortstr(name).long(messages).long(consumers))
+
+	case amqpQueueBind:
+		args.short()
+		queue, exchange, key := args.shortstr(), args.shortstr(), args.shortstr()
+		if args.err != nil {
+			return args.err
+		}
+
+		b.mu.Lock()
+		target, ok := b.exchanges[exchange]
+		if ok {
+			target.bindings = append(target.bindings, amqpBinding{queue: queue, key: key})
+		}
+		b.mu.Unlock()
+		if !ok {
+			return ch.closeWithError(amqpReplyNotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange), method)
+		}
+		return ch.conn.writeMethod(ch.id, amqpQueueBindOk, amqpArgs{})
+
+	case amqpBasicQos:
+		return ch.conn.writeMethod(ch.id, amqpBasicQosOk, amqpArgs{})
+
+	case amqpConfirmSelect:
+		b.mu.Lock()
+		ch.confirm = true
+		b.mu.Unlock()
+		return ch.conn.writeMethod(ch.id, amqpConfirmSelectOk, amqpArgs{})
+
+	case amqpBasicConsume:
+		args.short()
+		queueName, tag := args.shortstr(), args.shortstr()
+		noAck := args.octet()&0x02 != 0
+		if args.err != nil {
+			return args.err
+		}
+
+		b.mu.Lock()
+		queue, ok := b.queues[queueName]
+		b.mu.Unlock()
+		if !ok {
+			return ch.closeWithError(amqpReplyNotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queueName), method)
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if tag == "" {
+			b.consumerSeq++
+			tag = fmt.Sprintf("amq.ctag-%d", b.consumerSeq)
+		}
+		consumer := &amqpConsumer{tag: tag, queue: queue, channel: ch, noAck: noAck}
+		queue.consumers = append(queue.consumers, consumer)
+		ch.consumers[tag] = consumer
+		if err := ch.conn.writeMethod(ch.id, amqpBasicConsumeOk, amqpArgs{}.shortstr(tag)); err != nil {
+			return err
+		}
+		log.Printf("AMQP consumer %s attached to queue %s", tag, queueName)
+		b.dispatch(queue)
+		return nil
+
+	case amqpBasicCancel:
+		tag := args.shortstr()
+		if args.err != nil {
+			return args.err
+		}
+		b.mu.Lock()
+		if consumer, ok := ch.consumers[tag]; ok {
+			consumer.detach()
+			delete(ch.consumers, tag)
+		}
+		b.mu.Unlock()
+		return ch.conn.writeMethod(ch.id, amqpBasicCancelOk, amqpArgs{}.shortstr(tag))
+
+	case amqpBasicPublish:
+		args.short()
+		exchange, routingKey := args.shortstr(), args.shortstr()
+		if args.err != nil {
+			return args.err
+		}
+		ch.publishing = &amqpMessage{exchange: exchange, routingKey: routingKey}
+		return nil
+
+	case amqpBasicAck, amqpBasicReject, amqpBasicNack:
+		tag := args.longlong()
+		flags := args.octet()
+		if args.err != nil {
+			return args.err
+		}
+		multiple := method != amqpBasicReject && flags&0x01 != 0
+		requeue := method == amqpBasicReject && flags&0x01 != 0 || method == amqpBasicNack && flags&0x02 != 0
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for deliveryTag, delivery := range ch.unacked {
+			if deliveryTag == tag || multiple && deliveryTag <= tag {
+				delete(ch.unacked, deliveryTag)
+				if requeue {
+					delivery.queue.messages = append(delivery.queue.messages, delivery.message)
+					b.dispatch(delivery.queue)
+				}
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported method %d.%d", method>>16, method&0xffff)
+	}
+}
+
+func (c *amqpServerConn) handleContent(frame amqpFrame) error {
+	c.broker.mu.Lock()
+	ch, ok := c.channels[frame.channel]
+	c.broker.mu.Unlock()
+	if !ok || ch.publishing == nil {
+		return fmt.Errorf("unexpected content frame on channel %d", frame.channel)
+	}
+
+	message := ch.publishing
+	if frame.kind == amqpFrameHeader {
+		if len(frame.payload) < 14 {
+			return errors.New("truncated content header")
+		}
+		ch.bodySize = binary.BigEndian.Uint64(frame.payload[4:12])
+		message.properties = frame.payload[12:]
+	} else {
+		if message.properties == nil {
+			return fmt.Errorf("content body before its header on channel %d", frame.channel)
+		}
+		message.body = append(message.body, frame.payload...)
+	}
+
+	if uint64(len(message.body)) < ch.bodySize {
+		return nil
+	}
+	if uint64(len(message.body)) > ch.bodySize {
+		return fmt.Errorf("content body of %d bytes exceeds the %d in its header", len(message.body), ch.bodySize)
+	}
+
+	ch.publishing = nil
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.broker.publish(*message)
+
+	if ch.confirm {
+		ch.publishSeq++
+		return c.writeMethod(ch.id, amqpBasicAck, amqpArgs{}.longlong(ch.publishSeq).octet(0))
+	}
+	return nil
+}
+
+// publish routes message to the bound queues. The caller must hold b.mu.
+func (b *amqpBroker) publish(message amqpMessage) {
+	exchange, ok := b.exchanges[message.exchange]
+	if !ok {
+		log.Printf("AMQP dropping message for unknown exchange %q", message.exchange)
+		return
+	}
+
+	var targets []string
+	if message.exchange == "" {
+		// The default exchange routes by queue name
+		targets = []string{message.routingKey}
+	}
+	for _, binding := range exchange.bindings {
+		switch {
+		case exchange.kind == "fanout",
+			exchange.kind == "direct" && binding.key == message.routingKey,
+			exchange.kind == "topic" && amqpTopicMatches(binding.key, message.routingKey):
+			targets = append(targets, binding.queue)
+		}
+	}
+
+	for _, name := range targets {
+		if queue, ok := b.queues[name]; ok {
+			queue.messages = append(queue.messages, message)
+			b.dispatch(queue)
+		}
+	}
+}
+
+// dispatch hands queued messages to the queue's consumers round-robin. The
+// caller must hold b.mu.
+func (b *amqpBroker) dispatch(queue *amqpQueue) {
+	for len(queue.messages) > 0 && len(queue.consumers) > 0 {
+		message := queue.messages[0]
+		queue.messages = queue.messages[1:]
+
+		consumer := queue.consumers[queue.next%len(queue.consumers)]
+		queue.next++
+
+		ch := consumer.channel
+		ch.deliveryTag++
+		if !consumer.noAck {
+			ch.unacked[ch.deliveryTag] = amqpDelivery{queue: queue, message: message}
+		}
+
+		deliver := amqpArgs{}.shortstr(consumer.tag).longlong(ch.deliveryTag).octet(0).shortstr(message.exchange).shortstr(message.routingKey)
+		if err := ch.conn.writeContent(ch.id, amqpBasicDeliver, deliver, message); err != nil {
+			log.Printf("AMQP error delivering to consumer %s: %v", consumer.tag, err)
+		}
+	}
+}
+
+// close detaches the channel's consumers and requeues its unacknowledged
+// deliveries. The caller must hold the broker lock.
+func (ch *amqpChannel) close() {
+	for _, consumer := range ch.consumers {
+		consumer.detach()
+	}
+	for _, delivery := range ch.unacked {
+		delivery.queue.messages = append(delivery.queue.messages, delivery.message)
+		ch.conn.broker.dispatch(delivery.queue)
+	}
+	ch.unacked = nil
+}
+
+func (ch *amqpChannel) closeWithError(code uint16, text string, method uint32) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	ch.close()
+	delete(ch.conn.channels, ch.id)
+	b.mu.Unlock()
+
+	close := amqpArgs{}.short(code).shortstr(text).short(uint16(method >> 16)).short(uint16(method))
+	return ch.conn.writeMethod(ch.id, amqpChannelClose, close)
+}
+
+func (consumer *amqpConsumer) detach() {
+	queue := consumer.queue
+	for i, c := range queue.consumers {
+		if c == consumer {
+			queue.consumers = append(queue.consumers[:i], queue.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *amqpServerConn) closeChannels() {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	for _, ch := range c.channels {
+		ch.close()
+	}
+}
+
+func (c *amqpServerConn) writeMethod(channel uint16, method uint32, args amqpArgs) error {
+	var frame bytes.Buffer
+	writeAMQPFrame(&frame, amqpFrameMethod, channel, amqpMethodPayload(method, args))
+	return c.queueFrames(frame.Bytes())
+}
+
+func (c *amqpServerConn) writeContent(channel uint16, method uint32, args amqpArgs, message amqpMessage) error {
+	var frames bytes.Buffer
+	writeAMQPContent(&frames, channel, c.frameMax, method, args, message)
+	return c.queueFrames(frames.Bytes())
+}
+
+// queueFrames hands frames to the writer without waiting for the write. It
+// fails once a write has failed.
+func (c *amqpServerConn) queueFrames(frames []byte) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.outErr != nil {
+		return c.outErr
+	}
+	c.out = append(c.out, frames)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop writes the queued frames in order until closeWriter is called
+// and the queue is empty. A failed write closes the connection, which ends
+// the reading side as well.
+func (c *amqpServerConn) writeLoop() {
+	defer close(c.done)
+	for {
+		c.outMu.Lock()
+		frames, closed := c.out, c.closed
+		c.out = nil
+		c.outMu.Unlock()
+
+		if len(frames) == 0 {
+			if closed {
+				return
+			}
+			<-c.wake
+			continue
+		}
+		for _, frame := range frames {
+			if _, err := c.conn.Write(frame); err != nil {
+				c.outMu.Lock()
+				c.outErr = err
+				c.outMu.Unlock()
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// closeWriter waits a few seconds at most for the queued frames, such as
+// the reply to connection.close, to be written.
+func (c *amqpServerConn) closeWriter() {
+	c.outMu.Lock()
+	c.closed = true
+	c.outMu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	<-c.done
+}
+
+// amqpTopicMatches matches a dot-separated routing key against a binding
+// pattern where "*" matches one word and "#" zero or more words.
+func amqpTopicMatches(pattern, key string) bool {
+	return matchAMQPWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchAMQPWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchAMQPWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || pattern[0] != "*" && pattern[0] != words[0] {
+		return false
+	}
+	return matchAMQPWords(pattern[1:], words[1:])
+}
+
+func (a *App) startAMQPClient() {
+	log.Printf("Starting AMQP %s client for %s:%d, exchange: %q, queue: %s", a.config.AMQPRole, a.config.TargetHost, a.config.TargetPort, a.config.AMQPExchange, a.config.AMQPQueue)
+
+	// Give the broker time to start to avoid startup race conditions
+	time.Sleep(periodicInitialDelay)
+
+	for {
+		if err := a.runAMQPClient(); err != nil {
+			log.Printf("AMQP client error: %v", err)
+		}
+
+		select {
+		case <-a.stopCh:
+			log.Println("Stopping AMQP client")
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// amqpHandshakeMethods is the number of methods the client sends in the
+// connection handshake: Start-Ok and Tune-Ok.
+const amqpHandshakeMethods = 2
+
+// amqpSetupSteps returns the synchronous methods that follow the handshake,
+// for sending them and for the dry run: opening the connection and channel,
+// declaring the topology and starting the consumer when the role consumes.
+func (a *App) amqpSetupSteps() []amqpClientStep {
+	steps := []amqpClientStep{
+		{amqpConnectionOpen, amqpArgs{}.shortstr("/").shortstr("").octet(0), amqpConnectionOpenOk},
+		{amqpChannelOpen, amqpArgs{}.shortstr(""), amqpChannelOpenOk},
+	}
+	if a.config.AMQPExchange != "" {
+		steps = append(steps, amqpClientStep{amqpExchangeDeclare, amqpArgs{}.short(0).shortstr(a.config.AMQPExchange).shortstr(a.config.AMQPExchangeType).octet(0).table(nil), amqpExchangeDeclareOk})
+	}
+	steps = append(steps, amqpClientStep{amqpQueueDeclare, amqpArgs{}.short(0).shortstr(a.config.AMQPQueue).octet(0).table(nil), amqpQueueDeclareOk})
+	if a.config.AMQPExchange != "" {
+		steps = append(steps, amqpClientStep{amqpQueueBind, amqpArgs{}.short(0).shortstr(a.config.AMQPQueue).shortstr(a.config.AMQPExchange).shortstr(a.config.AMQPRoutingKey).octet(0).table(nil), amqpQueueBindOk})
+	}
+	if a.config.AMQPRole == "consumer" || a.config.AMQPRole == "both" {
+		steps = append(steps, amqpClientStep{amqpBasicConsume, amqpArgs{}.short(0).shortstr(a.config.AMQPQueue).shortstr(a.config.ServiceName).octet(0).table(nil), amqpBasicConsumeOk})
+	}
+	return steps
+}
+
+// amqpPublishes reports whether the client publishes a message on every
+// tick of AMQP_PUBLISH_INTERVAL.
+func (a *App) amqpPublishes() bool {
+	return a.config.AMQPRole == "publisher" || a.config.AMQPRole == "both"
+}
+
+func (a *App) runAMQPClient() error {
+	address := net.JoinHostPort(a.config.TargetHost, strconv.Itoa(a.config.TargetPort))
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to broker %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var writeMu sync.Mutex
+	send := func(channel uint16, method uint32, args amqpArgs) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeAMQPFrame(conn, amqpFrameMethod, channel, amqpMethodPayload(method, args))
+	}
+
+	// Handshake and topology setup are synchronous request/response pairs
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+	if _, err := expectAMQPMethod(reader, amqpConnectionStart); err != nil {
+		return err
+	}
+	startOk := amqpArgs{}.table(amqpArgs{}.tableEntry("product", "test-communicator")).shortstr("PLAIN").longstr("\x00guest\x00guest").shortstr("en_US")
+	if err := send(0, amqpConnectionStartOk, startOk); err != nil {
+		return err
+	}
+	tune, err := expectAMQPMethod(reader, amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	channelMax := tune.short()
+	frameMax := int(tune.long())
+	if frameMax != 0 && frameMax < amqpFrameMin {
+		return fmt.Errorf("broker frame-max %d is below the minimum of %d", frameMax, amqpFrameMin)
+	}
+	if frameMax == 0 || frameMax > amqpFrameMax {
+		frameMax = amqpFrameMax
+	}
+	if err := send(0, amqpConnectionTuneOk, amqpArgs{}.short(channelMax).long(uint32(frameMax)).short(0)); err != nil {
+		return err
+	}
+
+	for _, step := range a.amqpSetupSteps() {
+		channel := uint16(1)
+		if step.method>>16 == 10 {
+			channel = 0
+		}
+		if err := send(channel, step.method, step.args); err != nil {
+			return err
+		}
+		if _, err := expectAMQPMethod(reader, step.reply); err != nil {
+			return err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("AMQP client connected to broker %s", address)
+
+	// Reader loop: log deliveries and acknowledge them
+	readErr := make(chan error, 1)
+	go func() {
+		var deliveryTag uint64
+		var routingKey string
+		var bodySize uint64
+		var body []byte
+		for {
+			frame, err := readAMQPFrame(reader)
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			switch frame.kind {
+			case amqpFrameMethod:
+				method, args, err := parseAMQPMethod(frame.payload)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				switch method {
+				case amqpBasicDeliver:
+					args.shortstr()
+					deliveryTag = args.longlong()
+					args.octet()
+					args.shortstr()
+					routingKey = args.shortstr()
+				case amqpChannelClose, amqpConnectionClose:
+					code, text := args.short(), args.shortstr()
+					readErr <- fmt.Errorf("closed by broker: %d %s", code, text)
+					return
+				}
+				continue
+			case amqpFrameHeader:
+				if len(frame.payload) >= 12 {
+					bodySize = binary.BigEndian.Uint64(frame.payload[4:12])
+				}
+				body = nil
+			case amqpFrameBody:
+				body = append(body, frame.payload...)
+			default:
+				continue
+			}
+
+			if uint64(len(body)) == bodySize {
+				log.Printf("AMQP message received on %s: %s", routingKey, body)
+				send(1, amqpBasicAck, amqpArgs{}.longlong(deliveryTag).octet(0))
+			}
+		}
+	}()
+
+	publishTicker := time.NewTicker(a.config.AMQPPublishInterval)
+	defer publishTicker.Stop()
+
+	routingKey := a.config.AMQPRoutingKey
+	if a.config.AMQPExchange == "" {
+		routingKey = a.config.AMQPQueue
+	}
+	properties := amqpArgs{}.short(0x8000).shortstr("application/json") // content-type
+
+	for {
+		select {
+		case <-publishTicker.C:
+			if !a.amqpPublishes() {
+				continue
+			}
+			body := fmt.Sprintf(`{"service":"%s","exchange":"%s","routing_key":"%s","timestamp":"%s"}`,
+				a.config.ServiceName, a.config.AMQPExchange, routingKey, time.Now().UTC().Format(time.RFC3339))
+			message := amqpMessage{properties: properties, body: []byte(body)}
+			args := amqpArgs{}.short(0).shortstr(a.config.AMQPExchange).shortstr(routingKey).octet(0)
+
+			writeMu.Lock()
+			err := writeAMQPContent(conn, 1, frameMax, amqpBasicPublish, args, message)
+			writeMu.Unlock()
+			if err != nil {
+				return fmt.Errorf("publishing: %v", err)
+			}
+			log.Printf("AMQP message published to exchange %q with routing key %s", a.config.AMQPExchange, routingKey)
+		case err := <-readErr:
+			return fmt.Errorf("reading from broker: %v", err)
+		case <-a.stopCh:
+			send(0, amqpConnectionClose, amqpArgs{}.short(amqpReplySuccess).shortstr("shutdown").short(0).short(0))
+			return nil
+		}
+	}
+}
+
+func readAMQPFrame(reader *bufio.Reader) (amqpFrame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return amqpFrame{}, err
+	}
+	size := binary.BigEndian.Uint32(header[3:7])
+	if size > amqpFrameMax {
+		return amqpFrame{}, fmt.Errorf("frame size %d exceeds maximum", size)
+	}
+
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return amqpFrame{}, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return amqpFrame{}, errors.New("missing frame-end octet")
+	}
+
+	return amqpFrame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:3]), payload: payload[:size]}, nil
+}
+
+func writeAMQPFrame(w io.Writer, kind byte, channel uint16, payload []byte) error {
+	frame := []byte{kind}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = append(frame, amqpFrameEnd)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeAMQPContent writes a content-carrying method followed by its content
+// header and body frames, splitting the body to fit frameMax.
+func writeAMQPContent(w io.Writer, channel uint16, frameMax int, method uint32, args amqpArgs, message amqpMessage) error {
+	if err := writeAMQPFrame(w, amqpFrameMethod, channel, amqpMethodPayload(method, args)); err != nil {
+		return err
+	}
+
+	header := binary.BigEndian.AppendUint16(nil, uint16(method>>16))
+	header = binary.BigEndian.AppendUint16(header, 0) // weight
+	header = binary.BigEndian.AppendUint64(header, uint64(len(message.body)))
+	if len(message.properties) == 0 {
+		header = append(header, 0, 0)
+	} else {
+		header = append(header, message.properties...)
+	}
+	if err := writeAMQPFrame(w, amqpFrameHeader, channel, header); err != nil {
+		return err
+	}
+
+	chunk := frameMax - 8
+	for body := message.body; len(body) > 0; {
+		n := min(chunk, len(body))
+		if err := writeAMQPFrame(w, amqpFrameBody, channel, body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+func amqpMethodPayload(method uint32, args amqpArgs) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, method)
+	return append(payload, args...)
+}
+
+func parseAMQPMethod(payload []byte) (uint32, *amqpReader, error) {
+	if len(payload) < 4 {
+		return 0, nil, errors.New("truncated method frame")
+	}
+	return binary.BigEndian.Uint32(payload), &amqpReader{b: payload[4:]}, nil
+}
+
+// expectAMQPMethod reads frames until the next method frame, skipping
+// heartbeats, and checks that it is the expected method.
+func expectAMQPMethod(reader *bufio.Reader, expected uint32) (*amqpReader, error) {
+	for {
+		frame, err := readAMQPFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		if frame.kind == amqpFrameHeartbeat {
+			continue
+		}
+		if frame.kind != amqpFrameMethod {
+			return nil, fmt.Errorf("expected method frame, got type %d", frame.kind)
+		}
+
+		method, args, err := parseAMQPMethod(frame.payload)
+		if err != nil {
+			return nil, err
+		}
+		if method == amqpConnectionClose || method == amqpChannelClose {
+			code, text := args.short(), args.shortstr()
+			return nil, fmt.Errorf("closed by peer: %d %s", code, text)
+		}
+		if method != expected {
+			return nil, fmt.Errorf("expected method %d.%d, got %d.%d", expected>>16, expected&0xffff, method>>16, method&0xffff)
+		}
+		return args, nil
+	}
+}
+
+// amqpArgs builds method arguments and field tables.
+type amqpArgs []byte
+
+func (a amqpArgs) octet(v byte) amqpArgs { return append(a, v) }
+
+func (a amqpArgs) short(v uint16) amqpArgs { return binary.BigEndian.AppendUint16(a, v) }
+
+func (a amqpArgs) long(v uint32) amqpArgs { return binary.BigEndian.AppendUint32(a, v) }
+
+func (a amqpArgs) longlong(v uint64) amqpArgs { return binary.BigEndian.AppendUint64(a, v) }
+
+func (a amqpArgs) shortstr(s string) amqpArgs {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append(append(a, byte(len(s))), s...)
+}
+
+func (a amqpArgs) longstr(s string) amqpArgs {
+	return append(a.long(uint32(len(s))), s...)
+}
+
+// table appends a field table whose entries were built with tableEntry.
+func (a amqpArgs) table(entries amqpArgs) amqpArgs {
+	return append(a.long(uint32(len(entries))), entries...)
+}
+
+func (a amqpArgs) tableEntry(name, value string) amqpArgs {
+	return a.shortstr(name).octet('S').longstr(value)
+}
+
+// amqpReader decodes method arguments; the first error sticks and makes
+// later reads return zero values.
+type amqpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *amqpReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("truncated method arguments")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *amqpReader) octet() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *amqpReader) short() uint16 {
+	if v := r.take(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *amqpReader) long() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *amqpReader) longlong() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *amqpReader) shortstr() string {
+	return string(r.take(int(r.octet())))
+}
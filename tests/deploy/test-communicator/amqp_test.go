@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMQPFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    byte
+		channel uint16
+		payload []byte
+	}{
+		{"method", amqpFrameMethod, 1, amqpMethodPayload(amqpChannelOpen, amqpArgs{}.shortstr(""))},
+		{"heartbeat", amqpFrameHeartbeat, 0, nil},
+		{"largest body", amqpFrameBody, 65535, bytes.Repeat([]byte{0xce}, amqpFrameMax)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeAMQPFrame(&buf, test.kind, test.channel, test.payload); err != nil {
+				t.Fatal(err)
+			}
+			frame, err := readAMQPFrame(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.kind != test.kind || frame.channel != test.channel || !bytes.Equal(frame.payload, test.payload) {
+				t.Errorf("got frame %d on channel %d with %d bytes", frame.kind, frame.channel, len(frame.payload))
+			}
+		})
+	}
+}
+
+func TestReadAMQPFrameInvalid(t *testing.T) {
+	frame := func(size uint32, rest ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32([]byte{amqpFrameMethod, 0, 1}, size), rest...)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{amqpFrameMethod, 0, 1, 0}},
+		{"too large", frame(amqpFrameMax + 1)},
+		{"largest size", frame(0xffffffff)},
+		{"truncated payload", frame(4, 1, 2)},
+		{"missing frame end", frame(1, 0xaa, 0x00)},
+		{"no frame end", frame(0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if frame, err := readAMQPFrame(bufio.NewReader(bytes.NewReader(test.input))); err == nil {
+				t.Errorf("got %+v, want an error", frame)
+			}
+		})
+	}
+}
+
+func TestWriteAMQPContent(t *testing.T) {
+	properties := amqpArgs{}.short(0x8000).shortstr("text/plain")
+	tests := []struct {
+		name       string
+		bodySize   int
+		properties []byte
+		bodyFrames int
+	}{
+		{"empty body", 0, nil, 0},
+		{"one frame", 100, properties, 1},
+		{"exactly one frame", amqpFrameMin - 8, properties, 1},
+		{"split", 10000, properties, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("x"), test.bodySize)
+			args := amqpArgs{}.short(0).shortstr("exchange").shortstr("key").octet(0)
+			var buf bytes.Buffer
+			err := writeAMQPContent(&buf, 3, amqpFrameMin, amqpBasicPublish, args, amqpMessage{properties: test.properties, body: body})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := bufio.NewReader(&buf)
+			method, err := expectAMQPMethod(reader, amqpBasicPublish)
+			if err != nil {
+				t.Fatal(err)
+			}
+			method.short()
+			if exchange, key := method.shortstr(), method.shortstr(); exchange != "exchange" || key != "key" {
+				t.Errorf("publish to %q with key %q", exchange, key)
+			}
+
+			header, err := readAMQPFrame(reader)
+			if err != nil || header.kind != amqpFrameHeader || header.channel != 3 {
+				t.Fatalf("header frame %+v, %v", header, err)
+			}
+			if size := binary.BigEndian.Uint64(header.payload[4:12]); size != uint64(test.bodySize) {
+				t.Errorf("header body size %d, want %d", size, test.bodySize)
+			}
+			if want := []byte(test.properties); len(want) == 0 && !bytes.Equal(header.payload[12:], []byte{0, 0}) || len(want) > 0 && !bytes.Equal(header.payload[12:], want) {
+				t.Errorf("properties %x, want %x", header.payload[12:], want)
+			}
+
+			var received []byte
+			frames := 0
+			for buf.Len() > 0 || reader.Buffered() > 0 {
+				frame, err := readAMQPFrame(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame.kind != amqpFrameBody || len(frame.payload)+8 > amqpFrameMin {
+					t.Errorf("body frame of type %d with %d bytes", frame.kind, len(frame.payload))
+				}
+				received = append(received, frame.payload...)
+				frames++
+			}
+			if frames != test.bodyFrames || !bytes.Equal(received, body) {
+				t.Errorf("got %d body frames with %d bytes, want %d frames with %d bytes", frames, len(received), test.bodyFrames, len(body))
+			}
+		})
+	}
+}
+
+func TestAMQPArgsRoundTrip(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	args := amqpArgs{}.octet(7).short(0xbeef).long(0xdeadbeef).longlong(1<<63 + 1).shortstr("queue").shortstr(long).longstr(long)
+	r := &amqpReader{b: args}
+	if v := r.octet(); v != 7 {
+		t.Errorf("octet = %d", v)
+	}
+	if v := r.short(); v != 0xbeef {
+		t.Errorf("short = %x", v)
+	}
+	if v := r.long(); v != 0xdeadbeef {
+		t.Errorf("long = %x", v)
+	}
+	if v := r.longlong(); v != 1<<63+1 {
+		t.Errorf("longlong = %x", v)
+	}
+	if v := r.shortstr(); v != "queue" {
+		t.Errorf("shortstr = %q", v)
+	}
+	// Short strings are cut to 255 bytes
+	if v := r.shortstr(); v != long[:255] {
+		t.Errorf("long shortstr has %d bytes", len(v))
+	}
+	if n := r.long(); n != uint32(len(long)) || string(r.take(int(n))) != long {
+		t.Errorf("longstr length %d", n)
+	}
+	if r.err != nil || len(r.b) != 0 {
+		t.Errorf("err %v, %d bytes left", r.err, len(r.b))
+	}
+}
+
+func TestAMQPReaderTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		args amqpArgs
+		read func(r *amqpReader)
+	}{
+		{"octet", nil, func(r *amqpReader) { r.octet() }},
+		{"short", amqpArgs{1}, func(r *amqpReader) { r.short() }},
+		{"long", amqpArgs{1, 2, 3}, func(r *amqpReader) { r.long() }},
+		{"longlong", amqpArgs{1, 2, 3, 4, 5, 6, 7}, func(r *amqpReader) { r.longlong() }},
+		{"shortstr", amqpArgs{5, 'a', 'b'}, func(r *amqpReader) { r.shortstr() }},
+		{"shortstr length", nil, func(r *amqpReader) { r.shortstr() }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &amqpReader{b: test.args}
+			test.read(r)
+			if r.err == nil {
+				t.Fatal("want an error")
+			}
+			// The error sticks and later reads return zero values
+			if v := r.short(); v != 0 || r.err == nil {
+				t.Errorf("read after error = %d, %v", v, r.err)
+			}
+		})
+	}
+
+	if _, _, err := parseAMQPMethod([]byte{0, 10, 0}); err == nil {
+		t.Error("parseAMQPMethod of 3 bytes: want an error")
+	}
+}
+
+func TestAMQPTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.created.eu", true},
+		{"#", "", true},
+		{"#", "a.b.c", true},
+		{"#.eu", "orders.created.eu", true},
+		{"#.eu", "orders.created.us", false},
+		{"*.*.eu", "orders.created.eu", true},
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.c.z", true},
+		{"a.#.#.z", "a.b.c.d.e.f.g.h.i.j.k.l.m.n.o.p.q.r.s.t.u.v.w.x.y", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, test := range tests {
+		if got := amqpTopicMatches(test.pattern, test.key); got != test.want {
+			t.Errorf("amqpTopicMatches(%q, %q) = %t, want %t", test.pattern, test.key, got, test.want)
+		}
+	}
+}
+
+// amqpTestClient speaks to a broker over an in-memory connection.
+type amqpTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newAMQPTestClient(t *testing.T, frameMax uint32) (*amqpTestClient, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	go newAMQPBroker(nil).handleConnection(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &amqpTestClient{t: t, conn: client, reader: bufio.NewReader(client)}
+	if _, err := client.Write(amqpProtocolHeader); err != nil {
+		return nil, err
+	}
+	if _, err := expectAMQPMethod(c.reader, amqpConnectionStart); err != nil {
+		return nil, err
+	}
+	send := func(method uint32, args amqpArgs) error {
+		return writeAMQPFrame(client, amqpFrameMethod, 0, amqpMethodPayload(method, args))
+	}
+	if err := send(amqpConnectionStartOk, amqpArgs{}.table(nil).shortstr("PLAIN").longstr("\x00guest\x00guest").shortstr("en_US")); err != nil {
+		return nil, err
+	}
+	if _, err := expectAMQPMethod(c.reader, amqpConnectionTune); err != nil {
+		return nil, err
+	}
+	if err := send(amqpConnectionTuneOk, amqpArgs{}.short(2047).long(frameMax).short(0)); err != nil {
+		return nil, err
+	}
+	if err := send(amqpConnectionOpen, amqpArgs{}.shortstr("/").shortstr("").octet(0)); err != nil {
+		return nil, err
+	}
+	if _, err := expectAMQPMethod(c.reader, amqpConnectionOpenOk); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *amqpTestClient) send(channel uint16, method uint32, args amqpArgs) {
+	c.t.Helper()
+	if err := writeAMQPFrame(c.conn, amqpFrameMethod, channel, amqpMethodPayload(method, args)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *amqpTestClient) call(channel uint16, method uint32, args amqpArgs, reply uint32) *amqpReader {
+	c.t.Helper()
+	c.send(channel, method, args)
+	r, err := expectAMQPMethod(c.reader, reply)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return r
+}
+
+func TestAMQPBrokerRoundTrip(t *testing.T) {
+	c, err := newAMQPTestClient(t, amqpFrameMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.call(1, amqpChannelOpen, amqpArgs{}.shortstr(""), amqpChannelOpenOk)
+	c.call(1, amqpExchangeDeclare, amqpArgs{}.short(0).shortstr("events").shortstr("topic").octet(0).table(nil), amqpExchangeDeclareOk)
+	c.call(1, amqpQueueDeclare, amqpArgs{}.short(0).shortstr("orders").octet(0).table(nil), amqpQueueDeclareOk)
+	c.call(1, amqpQueueBind, amqpArgs{}.short(0).shortstr("orders").shortstr("events").shortstr("orders.#").octet(0).table(nil), amqpQueueBindOk)
+	c.call(1, amqpConfirmSelect, amqpArgs{}.octet(0), amqpConfirmSelectOk)
+	consume := c.call(1, amqpBasicConsume, amqpArgs{}.short(0).shortstr("orders").shortstr("").octet(0).table(nil), amqpBasicConsumeOk)
+	if tag := consume.shortstr(); tag == "" {
+		t.Error("empty consumer tag")
+	}
+
+	// Larger than a frame, so the broker splits the delivery
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	properties := amqpArgs{}.short(0x8000).shortstr("text/plain")
+	publish := amqpArgs{}.short(0).shortstr("events").shortstr("orders.created.eu").octet(0)
+	if err := writeAMQPContent(c.conn, 1, amqpFrameMin, amqpBasicPublish, publish, amqpMessage{properties: properties, body: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The publish confirm and the delivery may come in either order
+	var deliveryTag uint64
+	var received []byte
+	confirmed := false
+	for !confirmed || deliveryTag == 0 || len(received) < len(body) {
+		frame, err := readAMQPFrame(c.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frame.kind {
+		case amqpFrameMethod:
+			method, args, err := parseAMQPMethod(frame.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch method {
+			case amqpBasicAck:
+				confirmed = args.longlong() == 1
+			case amqpBasicDeliver:
+				args.shortstr()
+				deliveryTag = args.longlong()
+				args.octet()
+				if exchange, key := args.shortstr(), args.shortstr(); exchange != "events" || key != "orders.created.eu" {
+					t.Errorf("delivered from %q with key %q", exchange, key)
+				}
+			default:
+				t.Fatalf("unexpected method %d.%d", method>>16, method&0xffff)
+			}
+		case amqpFrameHeader:
+			if !bytes.Equal(frame.payload[12:], properties) {
+				t.Errorf("properties %x, want %x", frame.payload[12:], properties)
+			}
+		case amqpFrameBody:
+			if len(frame.payload)+8 > amqpFrameMin {
+				t.Errorf("body frame of %d bytes exceeds the negotiated frame-max", len(frame.payload))
+			}
+			received = append(received, frame.payload...)
+		}
+	}
+	if !bytes.Equal(received, body) {
+		t.Errorf("received %d bytes, want %d", len(received), len(body))
+	}
+
+	c.send(1, amqpBasicAck, amqpArgs{}.longlong(deliveryTag).octet(0))
+	c.call(1, amqpChannelClose, amqpArgs{}.short(amqpReplySuccess).shortstr("").short(0).short(0), amqpChannelCloseOk)
+	c.call(0, amqpConnectionClose, amqpArgs{}.short(amqpReplySuccess).shortstr("").short(0).short(0), amqpConnectionCloseOk)
+}
+
+func TestAMQPBrokerRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *amqpTestClient)
+	}{
+		{"channel opened twice", func(c *amqpTestClient) {
+			c.send(1, amqpChannelOpen, amqpArgs{}.shortstr(""))
+		}},
+		{"method on closed channel", func(c *amqpTestClient) {
+			c.send(2, amqpBasicQos, amqpArgs{}.long(0).short(1).octet(0))
+		}},
+		{"truncated arguments", func(c *amqpTestClient) {
+			c.send(1, amqpQueueDeclare, amqpArgs{}.short(0).octet(200))
+		}},
+		{"body before header", func(c *amqpTestClient) {
+			c.send(1, amqpBasicPublish, amqpArgs{}.short(0).shortstr("").shortstr("q").octet(0))
+			writeAMQPFrame(c.conn, amqpFrameBody, 1, []byte("body"))
+		}},
+		{"body beyond its size", func(c *amqpTestClient) {
+			c.send(1, amqpBasicPublish, amqpArgs{}.short(0).shortstr("").shortstr("q").octet(0))
+			header := binary.BigEndian.AppendUint64([]byte{0, 60, 0, 0}, 2)
+			writeAMQPFrame(c.conn, amqpFrameHeader, 1, append(header, 0, 0))
+			writeAMQPFrame(c.conn, amqpFrameBody, 1, []byte("body"))
+		}},
+		{"truncated content header", func(c *amqpTestClient) {
+			c.send(1, amqpBasicPublish, amqpArgs{}.short(0).shortstr("").shortstr("q").octet(0))
+			writeAMQPFrame(c.conn, amqpFrameHeader, 1, []byte{0, 60, 0, 0})
+		}},
+		{"unknown frame type", func(c *amqpTestClient) {
+			writeAMQPFrame(c.conn, 9, 1, nil)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newAMQPTestClient(t, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.call(1, amqpChannelOpen, amqpArgs{}.shortstr(""), amqpChannelOpenOk)
+			test.run(c)
+			// The broker answers with connection.close
+			if _, err := expectAMQPMethod(c.reader, amqpConnectionCloseOk); err == nil || !strings.Contains(err.Error(), "closed by peer") {
+				t.Errorf("error = %v, want the connection closed by the broker", err)
+			}
+		})
+	}
+}
+
+func TestAMQPBrokerRejectsSmallFrameMax(t *testing.T) {
+	if _, err := newAMQPTestClient(t, 8); err == nil {
+		t.Error("handshake with frame-max 8: want an error")
+	}
+}
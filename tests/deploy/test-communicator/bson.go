@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Minimal BSON (https://bsonspec.org) support for the MongoDB stand-in.
+// Documents keep their element order, which matters for command documents
+// where the first key names the command.
+
+type bsonElement struct {
+	Key   string
+	Value interface{}
+}
+
+// bsonDoc values are float64, string, bsonDoc, bsonArray, bsonObjectID,
+// bool, time.Time, nil, int32 or int64.
+type bsonDoc []bsonElement
+
+type bsonArray []interface{}
+
+type bsonObjectID [12]byte
+
+func newBSONObjectID(random *seededRand) bsonObjectID {
+	var id bsonObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(time.Now().Unix()))
+	random.Read(id[4:])
+	return id
+}
+
+func (id bsonObjectID) String() string {
+	return fmt.Sprintf("ObjectId(%x)", id[:])
+}
+
+func (d bsonDoc) Lookup(key string) (interface{}, bool) {
+	for _, element := range d {
+		if element.Key == key {
+			return element.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (d bsonDoc) String(key string) string {
+	value, _ := d.Lookup(key)
+	s, _ := value.(string)
+	return s
+}
+
+func (d bsonDoc) Doc(key string) bsonDoc {
+	value, _ := d.Lookup(key)
+	doc, _ := value.(bsonDoc)
+	return doc
+}
+
+func (d bsonDoc) Array(key string) bsonArray {
+	value, _ := d.Lookup(key)
+	array, _ := value.(bsonArray)
+	return array
+}
+
+// Set replaces the value of key, appending it if it is not present.
+func (d bsonDoc) Set(key string, value interface{}) bsonDoc {
+	for i, element := range d {
+		if element.Key == key {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, bsonElement{Key: key, Value: value})
+}
+
+func marshalBSON(doc bsonDoc) ([]byte, error) {
+	var body bytes.Buffer
+	for _, element := range doc {
+		if err := appendBSONElement(&body, element.Key, element.Value); err != nil {
+			return nil, err
+		}
+	}
+	body.WriteByte(0)
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(body.Len()+4))
+	return append(out, body.Bytes()...), nil
+}
+
+func appendBSONElement(buf *bytes.Buffer, key string, value interface{}) error {
+	writeKey := func(kind byte) {
+		buf.WriteByte(kind)
+		buf.WriteString(key)
+		buf.WriteByte(0)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		writeKey(0x01)
+		buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+	case string:
+		writeKey(0x02)
+		buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(v)+1)))
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	case bsonDoc:
+		encoded, err := marshalBSON(v)
+		if err != nil {
+			return err
+		}
+		writeKey(0x03)
+		buf.Write(encoded)
+	case bsonArray:
+		doc := make(bsonDoc, len(v))
+		for i, item := range v {
+			doc[i] = bsonElement{Key: fmt.Sprint(i), Value: item}
+		}
+		encoded, err := marshalBSON(doc)
+		if err != nil {
+			return err
+		}
+		writeKey(0x04)
+		buf.Write(encoded)
+	case bsonObjectID:
+		writeKey(0x07)
+		buf.Write(v[:])
+	case bool:
+		writeKey(0x08)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case time.Time:
+		writeKey(0x09)
+		buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(v.UnixMilli())))
+	case nil:
+		writeKey(0x0a)
+	case int32:
+		writeKey(0x10)
+		buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(v)))
+	case int64:
+		writeKey(0x12)
+		buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+	case int:
+		return appendBSONElement(buf, key, int64(v))
+	default:
+		return fmt.Errorf("unsupported BSON value type %T for key %q", value, key)
+	}
+	return nil
+}
+
+// bsonMaxDepth bounds the nesting of decoded documents and arrays, as
+// MongoDB does, so hostile input cannot exhaust the stack.
+const bsonMaxDepth = 100
+
+// unmarshalBSON decodes one document from the start of b and returns the
+// remaining bytes.
+func unmarshalBSON(b []byte) (bsonDoc, []byte, error) {
+	return unmarshalBSONDepth(b, 1)
+}
+
+func unmarshalBSONDepth(b []byte, depth int) (bsonDoc, []byte, error) {
+	if depth > bsonMaxDepth {
+		return nil, nil, errors.New("BSON document nested too deeply")
+	}
+	if len(b) < 5 {
+		return nil, nil, errors.New("truncated BSON document")
+	}
+	length := int(binary.LittleEndian.Uint32(b))
+	if length < 5 || length > len(b) || b[length-1] != 0 {
+		return nil, nil, errors.New("invalid BSON document length")
+	}
+
+	doc := bsonDoc{}
+	body := b[4 : length-1]
+	for len(body) > 0 {
+		kind := body[0]
+		key, rest, err := readCString(body[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var value interface{}
+		if value, body, err = readBSONValue(kind, rest, depth); err != nil {
+			return nil, nil, fmt.Errorf("key %q: %v", key, err)
+		}
+		doc = append(doc, bsonElement{Key: key, Value: value})
+	}
+
+	return doc, b[length:], nil
+}
+
+func readBSONValue(kind byte, b []byte, depth int) (interface{}, []byte, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errors.New("truncated BSON value")
+		}
+		return nil
+	}
+
+	switch kind {
+	case 0x01:
+		if err := need(8); err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), b[8:], nil
+	case 0x02:
+		if err := need(4); err != nil {
+			return nil, nil, err
+		}
+		length := int(binary.LittleEndian.Uint32(b))
+		if length < 1 || len(b) < 4+length {
+			return nil, nil, errors.New("invalid BSON string length")
+		}
+		return string(b[4 : 4+length-1]), b[4+length:], nil
+	case 0x03:
+		return unmarshalBSONDepth(b, depth+1)
+	case 0x04:
+		doc, rest, err := unmarshalBSONDepth(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		array := make(bsonArray, len(doc))
+		for i, element := range doc {
+			array[i] = element.Value
+		}
+		return array, rest, nil
+	case 0x07:
+		if err := need(12); err != nil {
+			return nil, nil, err
+		}
+		var id bsonObjectID
+		copy(id[:], b)
+		return id, b[12:], nil
+	case 0x08:
+		if err := need(1); err != nil {
+			return nil, nil, err
+		}
+		return b[0] != 0, b[1:], nil
+	case 0x09:
+		if err := need(8); err != nil {
+			return nil, nil, err
+		}
+		return time.UnixMilli(int64(binary.LittleEndian.Uint64(b))).UTC(), b[8:], nil
+	case 0x0a:
+		return nil, b, nil
+	case 0x10:
+		if err := need(4); err != nil {
+			return nil, nil, err
+		}
+		return int32(binary.LittleEndian.Uint32(b)), b[4:], nil
+	case 0x11, 0x12:
+		// Timestamps are only seen in driver metadata; read them as int64
+		if err := need(8); err != nil {
+			return nil, nil, err
+		}
+		return int64(binary.LittleEndian.Uint64(b)), b[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported BSON type 0x%02x", kind)
+	}
+}
+
+func readCString(b []byte) (string, []byte, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, errors.New("unterminated C string")
+	}
+	return string(b[:i]), b[i+1:], nil
+}
+
+// bsonNumber returns numeric BSON values as float64.
+func bsonNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
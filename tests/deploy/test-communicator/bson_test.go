@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBSONRoundTrip(t *testing.T) {
+	id := bsonObjectID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	tests := []struct {
+		name string
+		doc  bsonDoc
+	}{
+		{"empty", bsonDoc{}},
+		{"scalars", bsonDoc{
+			{Key: "double", Value: 1.5},
+			{Key: "string", Value: "héllo"},
+			{Key: "empty string", Value: ""},
+			{Key: "id", Value: id},
+			{Key: "true", Value: true},
+			{Key: "false", Value: false},
+			{Key: "time", Value: time.UnixMilli(1700000000123).UTC()},
+			{Key: "null", Value: nil},
+			{Key: "int32", Value: int32(-7)},
+			{Key: "int64", Value: int64(math.MaxInt64)},
+		}},
+		{"nested", bsonDoc{
+			{Key: "find", Value: "items"},
+			{Key: "filter", Value: bsonDoc{{Key: "n", Value: bsonDoc{{Key: "$gte", Value: int32(3)}}}}},
+			{Key: "list", Value: bsonArray{int32(1), "two", bsonDoc{{Key: "three", Value: 3.0}}, bsonArray{}}},
+		}},
+		{"order kept", bsonDoc{{Key: "z", Value: int32(1)}, {Key: "a", Value: int32(2)}, {Key: "m", Value: int32(3)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := marshalBSON(test.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if length := binary.LittleEndian.Uint32(encoded); int(length) != len(encoded) {
+				t.Errorf("length prefix %d, encoded %d bytes", length, len(encoded))
+			}
+			// Trailing bytes belong to whatever follows the document
+			decoded, rest, err := unmarshalBSON(append(encoded, 0xff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, []byte{0xff}) {
+				t.Errorf("rest = %x, want ff", rest)
+			}
+			if !reflect.DeepEqual(decoded, test.doc) {
+				t.Errorf("decoded %v, want %v", decoded, test.doc)
+			}
+		})
+	}
+}
+
+func TestMarshalBSONInt(t *testing.T) {
+	encoded, err := marshalBSON(bsonDoc{{Key: "n", Value: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := unmarshalBSON(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := decoded.Lookup("n"); value != int64(42) {
+		t.Errorf("n = %#v, want int64(42)", value)
+	}
+}
+
+func TestMarshalBSONUnsupported(t *testing.T) {
+	if _, err := marshalBSON(bsonDoc{{Key: "c", Value: complex(1, 2)}}); err == nil {
+		t.Error("want an error for a complex value")
+	}
+	if _, err := marshalBSON(bsonDoc{{Key: "d", Value: bsonDoc{{Key: "u", Value: uint8(1)}}}}); err == nil {
+		t.Error("want an error for a nested unsupported value")
+	}
+}
+
+// bsonRaw builds a document from raw element bytes with a correct length.
+func bsonRaw(elements ...byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(elements)+5))
+	return append(append(out, elements...), 0)
+}
+
+// bsonNested returns depth documents nested in each other.
+func bsonNested(depth int) []byte {
+	doc := bsonRaw()
+	for i := 1; i < depth; i++ {
+		doc = bsonRaw(append([]byte{0x03, 'a', 0}, doc...)...)
+	}
+	return doc
+}
+
+func TestUnmarshalBSONInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"nil", nil},
+		{"short", []byte{5, 0, 0}},
+		{"length below minimum", []byte{4, 0, 0, 0, 0}},
+		{"length beyond input", []byte{9, 0, 0, 0, 0}},
+		{"length negative", []byte{0xff, 0xff, 0xff, 0xff, 0}},
+		{"missing terminator", []byte{5, 0, 0, 0, 1}},
+		{"unterminated key", bsonRaw(0x10, 'a', 'b')},
+		{"truncated double", bsonRaw(0x01, 'x', 0, 1, 2)},
+		{"truncated int32", bsonRaw(0x10, 'x', 0, 1)},
+		{"truncated int64", bsonRaw(0x12, 'x', 0, 1, 2, 3)},
+		{"truncated object id", bsonRaw(0x07, 'x', 0, 1, 2, 3)},
+		{"truncated bool", bsonRaw(0x08, 'x', 0)},
+		{"truncated time", bsonRaw(0x09, 'x', 0, 1)},
+		{"truncated string length", bsonRaw(0x02, 'x', 0, 1, 0)},
+		{"zero string length", bsonRaw(0x02, 'x', 0, 0, 0, 0, 0)},
+		{"string beyond input", bsonRaw(0x02, 'x', 0, 0xff, 0xff, 0xff, 0x7f, 'a', 0)},
+		{"string length overflow", bsonRaw(0x02, 'x', 0, 0xff, 0xff, 0xff, 0xff, 'a', 0)},
+		{"truncated nested document", bsonRaw(0x03, 'x', 0, 9, 0, 0, 0, 0)},
+		{"truncated array", bsonRaw(0x04, 'x', 0, 3, 0, 0, 0)},
+		{"unsupported type", bsonRaw(0x05, 'x', 0, 0, 0, 0, 0, 0)},
+		{"nested too deeply", bsonNested(bsonMaxDepth + 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if doc, _, err := unmarshalBSON(test.input); err == nil {
+				t.Errorf("decoded %v, want an error", doc)
+			}
+		})
+	}
+
+	if _, _, err := unmarshalBSON(bsonNested(bsonMaxDepth)); err != nil {
+		t.Errorf("nesting at the limit: %v", err)
+	}
+}
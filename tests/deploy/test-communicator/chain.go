@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChainHop is one communicator's entry in a chain response.
+type ChainHop struct {
+	Service   string `json:"service"`
+	Hop       int    `json:"hop"`
+	Next      string `json:"next,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+type ChainResponse struct {
+	Hops     []ChainHop `json:"hops"`
+	Complete bool       `json:"complete"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// chainHandler forwards a request along a chain of communicators. The route
+// is either an explicit list (?hops=svc-a,svc-b:8081,http://svc-c:8082) or a
+// hop budget (?budget=3) that follows TARGET_URL from each communicator.
+// Every hop adds itself to ?visited=, which is used for loop detection.
+func (a *App) chainHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	hops := splitChainList(query.Get("hops"))
+	visited := splitChainList(query.Get("visited"))
+	depth := len(visited)
+
+	self := ChainHop{
+		Service:   a.config.ServiceName,
+		Hop:       depth,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if slices.Contains(visited, a.config.ServiceName) {
+		log.Printf("Chain loop detected at %s, visited: %v", a.config.ServiceName, visited)
+		a.writeChainResponse(w, http.StatusLoopDetected, ChainResponse{
+			Hops:  []ChainHop{self},
+			Error: fmt.Sprintf("loop detected: %s already visited via %s", a.config.ServiceName, strings.Join(visited, " -> ")),
+		})
+		return
+	}
+
+	budget := 0
+	if value := query.Get("budget"); value != "" && len(hops) == 0 {
+		var err error
+		if budget, err = strconv.Atoi(value); err != nil || budget < 0 {
+			a.writeChainResponse(w, http.StatusBadRequest, ChainResponse{Hops: []ChainHop{self}, Error: "budget must be a non-negative integer"})
+			return
+		}
+	}
+
+	remaining := max(len(hops), budget)
+	if depth+remaining >= a.config.ChainMaxDepth {
+		a.writeChainResponse(w, http.StatusBadRequest, ChainResponse{
+			Hops:  []ChainHop{self},
+			Error: fmt.Sprintf("chain of %d communicators exceeds maximum depth %d", depth+remaining+1, a.config.ChainMaxDepth),
+		})
+		return
+	}
+
+	// End of the chain
+	if remaining == 0 || (len(hops) == 0 && a.config.TargetURL == "") {
+		a.writeChainResponse(w, http.StatusOK, ChainResponse{Hops: []ChainHop{self}, Complete: true})
+		return
+	}
+
+	next := url.Values{}
+	next.Set("visited", strings.Join(append(visited, a.config.ServiceName), ","))
+	var base string
+	if len(hops) > 0 {
+		base = a.chainHopURL(hops[0])
+		if len(hops) > 1 {
+			next.Set("hops", strings.Join(hops[1:], ","))
+		}
+	} else {
+		base = a.config.TargetURL
+		next.Set("budget", strconv.Itoa(budget-1))
+	}
+	self.Next = base
+
+	nextURL := strings.TrimSuffix(base, "/") + "/api/chain?" + next.Encode()
+	log.Printf("Forwarding chain hop %d to %s", depth, nextURL)
+
+	status, downstream := a.forwardChain(r, nextURL)
+	downstream.Hops = append([]ChainHop{self}, downstream.Hops...)
+	a.writeChainResponse(w, status, downstream)
+}
+
+func (a *App) forwardChain(r *http.Request, nextURL string) (int, ChainResponse) {
+	resp, err := a.fetchHTTP(r.Context(), nextURL, a.config.Retry)
+	if err != nil && resp.status == 0 {
+		return http.StatusBadGateway, ChainResponse{Error: fmt.Sprintf("calling next hop: %v", err)}
+	}
+
+	var downstream ChainResponse
+	if err := json.Unmarshal(resp.body, &downstream); err != nil {
+		return http.StatusBadGateway, ChainResponse{Error: fmt.Sprintf("next hop returned status %d with non-chain response", resp.status)}
+	}
+	return resp.status, downstream
+}
+
+// chainHopURL turns a hop into a base URL. Hops may be full URLs, host:port
+// pairs or bare hosts, which use CHAIN_DEFAULT_PORT.
+func (a *App) chainHopURL(hop string) string {
+	if strings.Contains(hop, "://") {
+		return hop
+	}
+	if !strings.Contains(hop, ":") {
+		hop = fmt.Sprintf("%s:%d", hop, a.config.ChainDefaultPort)
+	}
+	return "http://" + hop
+}
+
+func (a *App) writeChainResponse(w http.ResponseWriter, status int, response ChainResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func splitChainList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestChain starts one communicator per name, each forwarding budget
+// chains to the next one in order, and returns their base URLs by name.
+func newTestChain(t *testing.T, maxDepth int, names ...string) map[string]string {
+	t.Helper()
+	apps := make([]*App, len(names))
+	urls := map[string]string{}
+	var servers []*httptest.Server
+	for i := range names {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apps[i].chainHandler(w, r)
+		}))
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+		urls[names[i]] = server.URL
+	}
+	for i, name := range names {
+		config := defaultConfig()
+		config.ServiceName, config.ChainMaxDepth = name, maxDepth
+		if i+1 < len(names) {
+			config.TargetURL = servers[i+1].URL
+		}
+		apps[i] = newTestApp(config)
+	}
+	return urls
+}
+
+func TestChain(t *testing.T) {
+	urls := newTestChain(t, 4, "a", "b", "c")
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		query     url.Values
+		want      []string // Services of the hops, in order
+		wantNext  []string
+		wantCode  int
+		wantError string
+		complete  bool
+	}{
+		{
+			name:     "explicit hops",
+			query:    url.Values{"hops": {urls["c"] + "," + urls["b"]}},
+			want:     []string{"a", "c", "b"},
+			wantNext: []string{urls["c"], urls["b"], ""},
+			wantCode: http.StatusOK,
+			complete: true,
+		},
+		{
+			name:     "budget follows the target URL",
+			query:    url.Values{"budget": {"1"}},
+			want:     []string{"a", "b"},
+			wantNext: []string{urls["b"], ""},
+			wantCode: http.StatusOK,
+			complete: true,
+		},
+		{
+			name:     "budget ends at the last communicator",
+			query:    url.Values{"budget": {"3"}},
+			want:     []string{"a", "b", "c"},
+			wantNext: []string{urls["b"], urls["c"], ""},
+			wantCode: http.StatusOK,
+			complete: true,
+		},
+		{
+			name:     "no budget",
+			query:    url.Values{},
+			want:     []string{"a"},
+			wantNext: []string{""},
+			wantCode: http.StatusOK,
+			complete: true,
+		},
+		{
+			name:      "loop",
+			query:     url.Values{"hops": {urls["b"] + "," + urls["a"]}},
+			want:      []string{"a", "b", "a"},
+			wantNext:  []string{urls["b"], urls["a"], ""},
+			wantCode:  http.StatusLoopDetected,
+			wantError: "loop detected: a already visited via a -> b",
+		},
+		{
+			name:      "too deep",
+			query:     url.Values{"hops": {"b,c,d,e"}},
+			want:      []string{"a"},
+			wantNext:  []string{""},
+			wantCode:  http.StatusBadRequest,
+			wantError: "chain of 5 communicators exceeds maximum depth 4",
+		},
+		{
+			name:      "too deep after earlier hops",
+			query:     url.Values{"visited": {"x,y"}, "budget": {"2"}},
+			want:      []string{"a"},
+			wantNext:  []string{""},
+			wantCode:  http.StatusBadRequest,
+			wantError: "chain of 5 communicators exceeds maximum depth 4",
+		},
+		{
+			name:      "invalid budget",
+			query:     url.Values{"budget": {"-1"}},
+			want:      []string{"a"},
+			wantNext:  []string{""},
+			wantCode:  http.StatusBadRequest,
+			wantError: "budget must be a non-negative integer",
+		},
+		{
+			name:      "unreachable hop",
+			query:     url.Values{"hops": {closed.URL}},
+			want:      []string{"a"},
+			wantNext:  []string{closed.URL},
+			wantCode:  http.StatusBadGateway,
+			wantError: "calling next hop",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Get(urls["a"] + "/api/chain?" + test.query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var chain ChainResponse
+			if err := json.NewDecoder(resp.Body).Decode(&chain); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.wantCode || chain.Complete != test.complete || !strings.Contains(chain.Error, test.wantError) {
+				t.Errorf("status %d, complete %t, error %q, want %d, %t, %q", resp.StatusCode, chain.Complete, chain.Error, test.wantCode, test.complete, test.wantError)
+			}
+			var services, next []string
+			depth := len(splitChainList(test.query.Get("visited")))
+			for i, hop := range chain.Hops {
+				services, next = append(services, hop.Service), append(next, hop.Next)
+				if hop.Hop != depth+i {
+					t.Errorf("hop %d of %s numbered %d, want %d", i, hop.Service, hop.Hop, depth+i)
+				}
+			}
+			if !reflect.DeepEqual(services, test.want) || !reflect.DeepEqual(next, test.wantNext) {
+				t.Errorf("hops %v to %v, want %v to %v", services, next, test.want, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestChainHopURL(t *testing.T) {
+	app := &App{config: Config{ChainDefaultPort: 8080}}
+	for hop, want := range map[string]string{
+		"svc":                "http://svc:8080",
+		"svc:9000":           "http://svc:9000",
+		"https://svc.ns:443": "https://svc.ns:443",
+	} {
+		if got := app.chainHopURL(hop); got != want {
+			t.Errorf("chainHopURL(%q) = %q, want %q", hop, got, want)
+		}
+	}
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Configuration is read from four sources, each overriding the previous one:
+// built-in defaults, a YAML or JSON config file, environment variables and
+// command-line flags. Every setting is named after its environment variable:
+// PORT is `port` in the config file and --port on the command line.
+
+func defaultConfig() Config {
+	return Config{
+		Port:        8080,
+		ServiceName: "test-communicator",
+		Protocol:    "http",
+		TargetPort:  8080,
+
+		Discovery: DiscoveryConfig{
+			Addressing: "pod-ip",
+			Policy:     "round-robin",
+			Refresh:    30 * time.Second,
+		},
+
+		ShutdownTimeout:     30 * time.Second,
+		TerminationBehavior: "graceful",
+		TerminationExitCode: 1,
+
+		SyntheticMetrics: SyntheticMetricsConfig{
+			Port:     8081,
+			Path:     "/custom_metrics",
+			Prefix:   "synthetic",
+			Types:    syntheticTypes,
+			Families: 1,
+			Series:   10,
+			Labels:   1,
+			Interval: 15 * time.Second,
+		},
+
+		Push: PushConfig{
+			Source:   "default",
+			Interval: 15 * time.Second,
+			Timeout:  10 * time.Second,
+		},
+
+		StatsD: StatsDConfig{
+			Flavor:     "dogstatsd",
+			Prefix:     "test_communicator",
+			SampleRate: 1,
+		},
+
+		Tracing: TracingConfig{
+			Propagation:    "w3c",
+			SampleRatio:    1,
+			ExportInterval: 5 * time.Second,
+		},
+
+		LogEmit: LogEmitConfig{
+			Transport:      "tcp",
+			SyslogFormat:   "rfc5424",
+			SyslogFacility: 16, // local0
+			AppLogs:        true,
+			Rate:           1,
+			Severities:     []string{"info"},
+		},
+
+		DryRunDuration: 10 * time.Minute,
+
+		HTTPClient: HTTPClientPolicy{
+			Connection:          "pool",
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+			PipelineDepth:       4,
+			RequestsPerInterval: 1,
+			Concurrency:         1,
+		},
+
+		Retry: RetryPolicy{
+			MaxAttempts:    1,
+			Backoff:        100 * time.Millisecond,
+			MaxBackoff:     2 * time.Second,
+			Jitter:         0.2,
+			RetryOn:        []string{"error", "timeout", "502", "503", "504", "unavailable"},
+			AttemptTimeout: 10 * time.Second,
+			MaxHedges:      1,
+		},
+		Breaker: BreakerPolicy{
+			OpenDuration:     30 * time.Second,
+			HalfOpenRequests: 1,
+		},
+
+		CallMode:          "parallel",
+		CallFailurePolicy: "all",
+		CallTimeout:       10 * time.Second,
+
+		ChainMaxDepth:    10,
+		ChainDefaultPort: 8080,
+
+		TCPFraming:               "newline",
+		TCPRecordSize:            256,
+		TCPStreamBytes:           1024 * 1024,
+		TCPRequestsPerConnection: 1,
+
+		MQTTRole:            "both",
+		MQTTTopics:          []string{"test-communicator/events"},
+		MQTTVersion:         4,
+		MQTTPublishInterval: 10 * time.Second,
+
+		MemcachedMaxItems:   1024,
+		MemcachedProtocol:   "text",
+		MemcachedOperations: 10,
+		MemcachedHitRatio:   80,
+		MemcachedKeyCount:   5,
+
+		MongoDatabase:   "test",
+		MongoCollection: "events",
+		MongoOperations: []string{"insert", "find", "update", "aggregate", "delete"},
+
+		AMQPRole:            "both",
+		AMQPExchangeType:    "direct",
+		AMQPQueue:           "test-communicator",
+		AMQPRoutingKey:      "test-communicator",
+		AMQPPublishInterval: 10 * time.Second,
+	}
+}
+
+// ConfigSetting is one effective setting as reported by /config.
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Env    string `json:"env"`
+	Flag   string `json:"flag"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // "default", "file", "env", "flag", or "random"
+}
+
+// settingValue parses a setting into its Config field and formats it back.
+type settingValue interface {
+	set(value string) error
+	String() string
+}
+
+type setting struct {
+	env    string
+	value  settingValue
+	kind   string // "json" for structured settings, "list" for comma-separated lists
+	source string
+	redact func(value string) string // Hides secrets in /config, flag help and errors
+}
+
+func (s *setting) key() string  { return strings.ToLower(s.env) }
+func (s *setting) flag() string { return strings.ReplaceAll(s.key(), "_", "-") }
+
+// display returns value as it may be shown outside the process.
+func (s *setting) display(value string) string {
+	if s.redact == nil {
+		return value
+	}
+	return s.redact(value)
+}
+
+// redactedValue replaces secrets that are set.
+const redactedValue = "[redacted]"
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// userinfoPattern matches the scheme and userinfo of URLs, also inside
+// JSON settings.
+var userinfoPattern = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://)[^/?#@\s"]*@`)
+
+// redactUserinfo strips the user name and password from every URL in value.
+func redactUserinfo(value string) string {
+	return userinfoPattern.ReplaceAllString(value, "$1")
+}
+
+// redactEndpoints hides the token and password of every METRICS_ENDPOINTS
+// entry, keeping the rest of the JSON readable.
+func redactEndpoints(value string) string {
+	var endpoints []map[string]any
+	if err := json.Unmarshal([]byte(value), &endpoints); err != nil {
+		return redactSecret(value)
+	}
+	for _, endpoint := range endpoints {
+		for _, field := range []string{"token", "password"} {
+			if secret, ok := endpoint[field].(string); ok && secret != "" {
+				endpoint[field] = redactedValue
+			}
+		}
+	}
+	redacted, _ := json.Marshal(endpoints)
+	return string(redacted)
+}
+
+// configSettings binds every setting to its field in c. Structured settings
+// are collected as JSON in raw and parsed once all sources are applied.
+func configSettings(c *Config, raw *rawConfig) []*setting {
+	return []*setting{
+		{env: "PORT", value: intValue{&c.Port}},
+		{env: "SERVICE_NAME", value: stringValue{&c.ServiceName}},
+		{env: "TARGET_URL", value: stringValue{&c.TargetURL}},
+		{env: "PROTOCOL", value: stringValue{&c.Protocol}},
+		{env: "TARGET_HOST", value: stringValue{&c.TargetHost}},
+		{env: "TARGET_PORT", value: intValue{&c.TargetPort}},
+		{env: "POD_NAMESPACE", value: stringValue{&c.Namespace}},
+		{env: "FLOWS", value: stringValue{&raw.flows}, kind: "json", redact: redactUserinfo},
+
+		{env: "DISCOVERY_MODE", value: stringValue{&c.Discovery.Mode}},
+		{env: "DISCOVERY_SERVICE", value: stringValue{&c.Discovery.Service}},
+		{env: "DISCOVERY_SELECTOR", value: stringValue{&c.Discovery.Selector}},
+		{env: "DISCOVERY_NAMESPACE", value: stringValue{&c.Discovery.Namespace}},
+		{env: "DISCOVERY_ADDRESSING", value: stringValue{&c.Discovery.Addressing}},
+		{env: "DISCOVERY_POLICY", value: stringValue{&c.Discovery.Policy}},
+		{env: "DISCOVERY_PORT", value: intValue{&c.Discovery.Port}},
+		{env: "DISCOVERY_REFRESH", value: durationValue{&c.Discovery.Refresh}},
+
+		{env: "SEED", value: stringValue{&c.Seed}},
+		{env: "PHASES", value: stringValue{&raw.phases}, kind: "json"},
+		{env: "PHASES_REPEAT", value: boolValue{&c.PhasesRepeat}},
+
+		{env: "ADMIN_ENDPOINTS", value: boolValue{&c.AdminEndpoints}},
+		{env: "ACTIONS", value: stringValue{&raw.actions}, kind: "json"},
+
+		{env: "SHUTDOWN_TIMEOUT", value: durationValue{&c.ShutdownTimeout}},
+		{env: "PRESTOP_DELAY", value: durationValue{&c.PreStopDelay}},
+		{env: "TERMINATION_BEHAVIOR", value: stringValue{&c.TerminationBehavior}},
+		{env: "TERMINATION_EXIT_CODE", value: intValue{&c.TerminationExitCode}},
+
+		{env: "METRICS_OPENMETRICS", value: boolValue{&c.OpenMetrics}},
+		{env: "EXEMPLAR_SAMPLE_RATIO", value: floatValue{&c.ExemplarSampleRatio}},
+
+		{env: "SYNTHETIC_METRICS", value: boolValue{&c.SyntheticMetrics.Enabled}},
+		{env: "SYNTHETIC_METRICS_PORT", value: intValue{&c.SyntheticMetrics.Port}},
+		{env: "SYNTHETIC_METRICS_PATH", value: stringValue{&c.SyntheticMetrics.Path}},
+		{env: "SYNTHETIC_METRICS_PREFIX", value: stringValue{&c.SyntheticMetrics.Prefix}},
+		{env: "SYNTHETIC_METRICS_TYPES", value: listValue{&c.SyntheticMetrics.Types}, kind: "list"},
+		{env: "SYNTHETIC_METRICS_FAMILIES", value: intValue{&c.SyntheticMetrics.Families}},
+		{env: "SYNTHETIC_METRICS_SERIES", value: intValue{&c.SyntheticMetrics.Series}},
+		{env: "SYNTHETIC_METRICS_LABELS", value: intValue{&c.SyntheticMetrics.Labels}},
+		{env: "SYNTHETIC_METRICS_INTERVAL", value: durationValue{&c.SyntheticMetrics.Interval}},
+		{env: "SYNTHETIC_METRICS_CHURN", value: floatValue{&c.SyntheticMetrics.Churn}},
+		{env: "SYNTHETIC_METRICS_FLAP", value: floatValue{&c.SyntheticMetrics.Flap}},
+		{env: "SYNTHETIC_METRICS_RESET_INTERVAL", value: durationValue{&c.SyntheticMetrics.ResetInterval}},
+		{env: "SYNTHETIC_METRICS_SPECIAL_VALUES", value: boolValue{&c.SyntheticMetrics.SpecialValues}},
+
+		{env: "METRICS_ENDPOINTS", value: stringValue{&raw.endpoints}, kind: "json", redact: redactEndpoints},
+
+		{env: "REMOTE_WRITE_URL", value: stringValue{&c.Push.RemoteWriteURL}, redact: redactUserinfo},
+		{env: "PUSHGATEWAY_URL", value: stringValue{&c.Push.PushgatewayURL}, redact: redactUserinfo},
+		{env: "PUSHGATEWAY_JOB", value: stringValue{&c.Push.PushgatewayJob}},
+		{env: "PUSH_SOURCE", value: stringValue{&c.Push.Source}},
+		{env: "PUSH_INTERVAL", value: durationValue{&c.Push.Interval}},
+		{env: "PUSH_TIMEOUT", value: durationValue{&c.Push.Timeout}},
+		{env: "PUSH_BEARER_TOKEN", value: stringValue{&c.Push.BearerToken}, redact: redactSecret},
+		{env: "PUSH_USERNAME", value: stringValue{&c.Push.Username}},
+		{env: "PUSH_PASSWORD", value: stringValue{&c.Push.Password}, redact: redactSecret},
+
+		{env: "STATSD_ADDRESS", value: stringValue{&c.StatsD.Address}},
+		{env: "STATSD_FLAVOR", value: stringValue{&c.StatsD.Flavor}},
+		{env: "STATSD_PREFIX", value: stringValue{&c.StatsD.Prefix}},
+		{env: "STATSD_TAGS", value: listValue{&c.StatsD.Tags}, kind: "list"},
+		{env: "STATSD_SAMPLE_RATE", value: floatValue{&c.StatsD.SampleRate}},
+
+		{env: "TRACE_EXPORTER", value: stringValue{&c.Tracing.Exporter}},
+		{env: "TRACE_ENCODING", value: stringValue{&c.Tracing.Encoding}},
+		{env: "TRACE_ENDPOINT", value: stringValue{&c.Tracing.Endpoint}, redact: redactUserinfo},
+		{env: "TRACE_PROPAGATION", value: stringValue{&c.Tracing.Propagation}},
+		{env: "TRACE_SAMPLE_RATIO", value: floatValue{&c.Tracing.SampleRatio}},
+		{env: "TRACE_EXPORT_INTERVAL", value: durationValue{&c.Tracing.ExportInterval}},
+
+		{env: "LOG_EMIT_PROTOCOL", value: stringValue{&c.LogEmit.Protocol}},
+		{env: "LOG_EMIT_ADDRESS", value: stringValue{&c.LogEmit.Address}},
+		{env: "LOG_EMIT_TRANSPORT", value: stringValue{&c.LogEmit.Transport}},
+		{env: "LOG_EMIT_TLS_INSECURE", value: boolValue{&c.LogEmit.TLSInsecure}},
+		{env: "LOG_EMIT_SYSLOG_FORMAT", value: stringValue{&c.LogEmit.SyslogFormat}},
+		{env: "LOG_EMIT_SYSLOG_FACILITY", value: intValue{&c.LogEmit.SyslogFacility}},
+		{env: "LOG_EMIT_TAG", value: stringValue{&c.LogEmit.Tag}},
+		{env: "LOG_EMIT_APP_LOGS", value: boolValue{&c.LogEmit.AppLogs}},
+		{env: "LOG_EMIT_RATE", value: floatValue{&c.LogEmit.Rate}},
+		{env: "LOG_EMIT_SEVERITIES", value: listValue{&c.LogEmit.Severities}, kind: "list"},
+		{env: "LOG_EMIT_MIN_SIZE", value: intValue{&c.LogEmit.MinSize}},
+		{env: "LOG_EMIT_MAX_SIZE", value: intValue{&c.LogEmit.MaxSize}},
+
+		{env: "DRY_RUN", value: boolValue{&c.DryRun}},
+		{env: "DRY_RUN_DURATION", value: durationValue{&c.DryRunDuration}},
+
+		{env: "HTTP_CONNECTION_POLICY", value: stringValue{&c.HTTPClient.Connection}},
+		{env: "HTTP_MAX_IDLE_CONNS", value: intValue{&c.HTTPClient.MaxIdleConns}},
+		{env: "HTTP_MAX_IDLE_CONNS_PER_HOST", value: intValue{&c.HTTPClient.MaxIdleConnsPerHost}},
+		{env: "HTTP_MAX_CONNS_PER_HOST", value: intValue{&c.HTTPClient.MaxConnsPerHost}},
+		{env: "HTTP_IDLE_CONN_TIMEOUT", value: durationValue{&c.HTTPClient.IdleConnTimeout}},
+		{env: "HTTP_PIPELINE_DEPTH", value: intValue{&c.HTTPClient.PipelineDepth}},
+		{env: "HTTP_REQUESTS_PER_INTERVAL", value: intValue{&c.HTTPClient.RequestsPerInterval}},
+		{env: "HTTP_CONCURRENCY", value: intValue{&c.HTTPClient.Concurrency}},
+
+		{env: "RETRY_MAX_ATTEMPTS", value: intValue{&c.Retry.MaxAttempts}},
+		{env: "RETRY_BACKOFF", value: durationValue{&c.Retry.Backoff}},
+		{env: "RETRY_MAX_BACKOFF", value: durationValue{&c.Retry.MaxBackoff}},
+		{env: "RETRY_JITTER", value: floatValue{&c.Retry.Jitter}},
+		{env: "RETRY_ON", value: listValue{&c.Retry.RetryOn}, kind: "list"},
+		{env: "ATTEMPT_TIMEOUT", value: durationValue{&c.Retry.AttemptTimeout}},
+		{env: "REQUEST_DEADLINE", value: durationValue{&c.Retry.Deadline}},
+		{env: "HEDGE_DELAY", value: durationValue{&c.Retry.HedgeDelay}},
+		{env: "HEDGE_MAX", value: intValue{&c.Retry.MaxHedges}},
+		{env: "BREAKER_FAILURE_THRESHOLD", value: intValue{&c.Breaker.FailureThreshold}},
+		{env: "BREAKER_OPEN_DURATION", value: durationValue{&c.Breaker.OpenDuration}},
+		{env: "BREAKER_HALF_OPEN_REQUESTS", value: intValue{&c.Breaker.HalfOpenRequests}},
+
+		{env: "CALL_TARGETS", value: stringValue{&raw.callTargets}, kind: "json", redact: redactUserinfo},
+		{env: "CALL_MODE", value: stringValue{&c.CallMode}},
+		{env: "CALL_FAILURE_POLICY", value: stringValue{&c.CallFailurePolicy}},
+		{env: "CALL_TIMEOUT", value: durationValue{&c.CallTimeout}},
+
+		{env: "CHAIN_MAX_DEPTH", value: intValue{&c.ChainMaxDepth}},
+		{env: "CHAIN_DEFAULT_PORT", value: intValue{&c.ChainDefaultPort}},
+
+		{env: "TCP_FRAMING", value: stringValue{&c.TCPFraming}},
+		{env: "TCP_RECORD_SIZE", value: intValue{&c.TCPRecordSize}},
+		{env: "TCP_STREAM_BYTES", value: intValue{&c.TCPStreamBytes}},
+		{env: "TCP_REQUESTS_PER_CONNECTION", value: intValue{&c.TCPRequestsPerConnection}},
+		{env: "TCP_POOL_SIZE", value: intValue{&c.TCPPoolSize}},
+		{env: "TCP_IDLE_TIMEOUT", value: durationValue{&c.TCPIdleTimeout}},
+		{env: "TCP_HALF_CLOSE", value: boolValue{&c.TCPHalfClose}},
+		{env: "TCP_KEEP_ALIVE", value: durationValue{&c.TCPKeepAlive}},
+
+		{env: "MQTT_ROLE", value: stringValue{&c.MQTTRole}},
+		{env: "MQTT_TOPICS", value: listValue{&c.MQTTTopics}, kind: "list"},
+		{env: "MQTT_QOS", value: intValue{&c.MQTTQoS}},
+		{env: "MQTT_VERSION", value: intValue{&c.MQTTVersion}},
+		{env: "MQTT_PUBLISH_INTERVAL", value: durationValue{&c.MQTTPublishInterval}},
+
+		{env: "MEMCACHED_MAX_ITEMS", value: intValue{&c.MemcachedMaxItems}},
+		{env: "MEMCACHED_PROTOCOL", value: stringValue{&c.MemcachedProtocol}},
+		{env: "MEMCACHED_OPERATIONS", value: intValue{&c.MemcachedOperations}},
+		{env: "MEMCACHED_HIT_RATIO", value: intValue{&c.MemcachedHitRatio}},
+		{env: "MEMCACHED_KEY_COUNT", value: intValue{&c.MemcachedKeyCount}},
+
+		{env: "MONGO_DATABASE", value: stringValue{&c.MongoDatabase}},
+		{env: "MONGO_COLLECTION", value: stringValue{&c.MongoCollection}},
+		{env: "MONGO_OPERATIONS", value: listValue{&c.MongoOperations}, kind: "list"},
+
+		{env: "AMQP_ROLE", value: stringValue{&c.AMQPRole}},
+		{env: "AMQP_EXCHANGE", value: stringValue{&c.AMQPExchange}},
+		{env: "AMQP_EXCHANGE_TYPE", value: stringValue{&c.AMQPExchangeType}},
+		{env: "AMQP_QUEUE", value: stringValue{&c.AMQPQueue}},
+		{env: "AMQP_ROUTING_KEY", value: stringValue{&c.AMQPRoutingKey}},
+		{env: "AMQP_PUBLISH_INTERVAL", value: durationValue{&c.AMQPPublishInterval}},
+	}
+}
+
+// rawConfig holds structured settings as JSON until every source is applied,
+// since parsing CALL_TARGETS depends on CALL_TIMEOUT and the retry policy.
+type rawConfig struct {
+	callTargets string
+	phases      string
+	actions     string
+	endpoints   string
+	flows       string
+}
+
+// loadConfig builds the configuration from defaults, the config file given
+// by --config or CONFIG_FILE, the environment and args. All invalid values
+// are reported together.
+func loadConfig(args []string) (Config, []ConfigSetting, error) {
+	config := defaultConfig()
+	var raw rawConfig
+	settings := configSettings(&config, &raw)
+	for _, s := range settings {
+		s.source = "default"
+	}
+
+	// Flags are parsed first to find --config, and applied last
+	flags := flag.NewFlagSet("test-communicator", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config file (env CONFIG_FILE)")
+	flagValues := make(map[*setting]*flagValue)
+	for _, s := range settings {
+		value := &flagValue{boolean: isBoolSetting(s)}
+		flagValues[s] = value
+		flags.Var(value, s.flag(), fmt.Sprintf("overrides %s (default %q)", s.env, s.display(s.value.String())))
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, nil, err
+	}
+	if flags.NArg() > 0 {
+		return config, nil, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	var problems []string
+	apply := func(s *setting, value, source string) {
+		if err := s.value.set(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q (%s): %v", s.env, s.display(value), source, err))
+			return
+		}
+		s.source = source
+	}
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile, settings)
+		if err != nil {
+			return config, nil, err
+		}
+		for _, s := range settings {
+			if value, ok := values[s.key()]; ok {
+				apply(s, value, "file")
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			apply(s, value, "env")
+		}
+	}
+
+	for _, s := range settings {
+		if value := flagValues[s]; value.set {
+			apply(s, value.value, "flag")
+		}
+	}
+
+	problems = append(problems, validateConfig(&config, raw)...)
+	if len(problems) > 0 {
+		return config, nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	effective := make([]ConfigSetting, 0, len(settings))
+	for _, s := range settings {
+		if s.env == "SEED" {
+			if config.Seed == "" {
+				config.Seed = randomSeed()
+				s.source = "random"
+				log.Printf("Random seed: %s (set SEED=%s to reproduce)", config.Seed, config.Seed)
+			} else {
+				log.Printf("Random seed: %s", config.Seed)
+			}
+		}
+		effective = append(effective, ConfigSetting{Key: s.key(), Env: s.env, Flag: "--" + s.flag(), Value: s.display(s.value.String()), Source: s.source})
+	}
+	return config, effective, nil
+}
+
+// readConfigFile reads a YAML or JSON file of settings keyed by their
+// lowercase names. Lists may be given as sequences and structured settings
+// as nested YAML; unknown keys are errors.
+func readConfigFile(path string, settings []*setting) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+	var problems []string
+	for key, value := range document {
+		i := slices.IndexFunc(settings, func(s *setting) bool { return s.key() == key })
+		if i < 0 {
+			problems = append(problems, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		if value == nil {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case []interface{}, map[string]interface{}:
+			switch settings[i].kind {
+			case "json":
+				encoded, err := json.Marshal(v)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+					continue
+				}
+				values[key] = string(encoded)
+			case "list":
+				list, ok := v.([]interface{})
+				if !ok {
+					problems = append(problems, fmt.Sprintf("%s: expected a list", key))
+					continue
+				}
+				items := make([]string, len(list))
+				for j, item := range list {
+					items[j] = fmt.Sprint(item)
+				}
+				values[key] = strings.Join(items, ",")
+			default:
+				problems = append(problems, fmt.Sprintf("%s: expected a single value", key))
+			}
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return nil, fmt.Errorf("invalid config file %s:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return values, nil
+}
+
+// validateConfig checks values that parse but are not allowed, and parses
+// the structured settings.
+func validateConfig(c *Config, raw rawConfig) []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	oneOf := func(env, value string, allowed ...string) {
+		check(slices.Contains(allowed, value), "%s=%q: must be one of %s", env, value, strings.Join(allowed, ", "))
+	}
+	port := func(env string, value int) {
+		check(value > 0 && value < 65536, "%s=%d: must be a port between 1 and 65535", env, value)
+	}
+
+	oneOf("PROTOCOL", c.Protocol, "http", "grpc", "tcp", "mqtt", "memcached", "mongo", "amqp", "http3", "all")
+	port("PORT", c.Port)
+	port("TARGET_PORT", c.TargetPort)
+	port("CHAIN_DEFAULT_PORT", c.ChainDefaultPort)
+	oneOf("DISCOVERY_MODE", c.Discovery.Mode, "", "kubernetes", "dns")
+	oneOf("DISCOVERY_ADDRESSING", c.Discovery.Addressing, addressingModes...)
+	oneOf("DISCOVERY_POLICY", c.Discovery.Policy, "round-robin", "random", "all")
+	check(c.Discovery.Port >= 0 && c.Discovery.Port < 65536, "DISCOVERY_PORT=%d: must be 0 or a port", c.Discovery.Port)
+	check(c.Discovery.Refresh > 0, "DISCOVERY_REFRESH=%s: must be positive", c.Discovery.Refresh)
+	switch c.Discovery.Mode {
+	case "kubernetes":
+		check((c.Discovery.Service == "") != (c.Discovery.Selector == ""), "DISCOVERY_SERVICE or DISCOVERY_SELECTOR must be set, but not both")
+		check(c.Discovery.Addressing == "pod-ip" || c.Discovery.Selector == "", "DISCOVERY_ADDRESSING=%s needs DISCOVERY_SERVICE", c.Discovery.Addressing)
+	case "dns":
+		check(c.Discovery.Service != "", "DISCOVERY_SERVICE must be set to a DNS name")
+		check(c.Discovery.Selector == "", "DISCOVERY_SELECTOR is only supported with DISCOVERY_MODE=kubernetes")
+		check(c.Discovery.Addressing != "node-port", "DISCOVERY_ADDRESSING=node-port is only supported with DISCOVERY_MODE=kubernetes")
+	}
+	oneOf("TERMINATION_BEHAVIOR", c.TerminationBehavior, "graceful", "ignore-sigterm", "exit-nonzero", "crash-mid-request")
+	check(c.TerminationExitCode >= 1 && c.TerminationExitCode <= 255, "TERMINATION_EXIT_CODE=%d: must be between 1 and 255", c.TerminationExitCode)
+	oneOf("HTTP_CONNECTION_POLICY", c.HTTPClient.Connection, httpConnectionPolicies...)
+	oneOf("CALL_MODE", c.CallMode, "parallel", "sequential")
+	oneOf("CALL_FAILURE_POLICY", c.CallFailurePolicy, "all", "any", "best-effort")
+	oneOf("TCP_FRAMING", c.TCPFraming, "newline", "length-prefixed", "fixed", "stream")
+	oneOf("MQTT_ROLE", c.MQTTRole, "publisher", "subscriber", "both")
+	oneOf("MEMCACHED_PROTOCOL", c.MemcachedProtocol, "text", "binary")
+	oneOf("AMQP_ROLE", c.AMQPRole, "publisher", "consumer", "both")
+	for _, operation := range c.MongoOperations {
+		oneOf("MONGO_OPERATIONS", operation, "insert", "find", "update", "delete", "aggregate")
+	}
+	oneOf("AMQP_EXCHANGE_TYPE", c.AMQPExchangeType, "direct", "fanout", "topic")
+	check(c.MQTTQoS == 0 || c.MQTTQoS == 1, "MQTT_QOS=%d: must be 0 or 1", c.MQTTQoS)
+	check(c.MQTTVersion == 4 || c.MQTTVersion == 5, "MQTT_VERSION=%d: must be 4 or 5", c.MQTTVersion)
+	check(len(c.MQTTTopics) > 0, "MQTT_TOPICS must list at least one topic")
+	check(c.MQTTPublishInterval > 0, "MQTT_PUBLISH_INTERVAL=%s: must be positive", c.MQTTPublishInterval)
+	check(c.AMQPPublishInterval > 0, "AMQP_PUBLISH_INTERVAL=%s: must be positive", c.AMQPPublishInterval)
+	check(c.MemcachedHitRatio >= 0 && c.MemcachedHitRatio <= 100, "MEMCACHED_HIT_RATIO=%d: must be between 0 and 100", c.MemcachedHitRatio)
+	check(c.MemcachedOperations > 0, "MEMCACHED_OPERATIONS=%d: must be positive", c.MemcachedOperations)
+	check(c.MemcachedKeyCount > 0, "MEMCACHED_KEY_COUNT=%d: must be positive", c.MemcachedKeyCount)
+	check(c.TCPRecordSize > 0, "TCP_RECORD_SIZE=%d: must be positive", c.TCPRecordSize)
+	check(c.TCPStreamBytes > 0, "TCP_STREAM_BYTES=%d: must be positive", c.TCPStreamBytes)
+	check(c.TCPRequestsPerConnection > 0, "TCP_REQUESTS_PER_CONNECTION=%d: must be positive", c.TCPRequestsPerConnection)
+	check(c.TCPPoolSize >= 0, "TCP_POOL_SIZE=%d: must not be negative", c.TCPPoolSize)
+	check(c.TCPIdleTimeout >= 0, "TCP_IDLE_TIMEOUT=%s: must not be negative", c.TCPIdleTimeout)
+	check(c.HTTPClient.RequestsPerInterval > 0, "HTTP_REQUESTS_PER_INTERVAL=%d: must be positive", c.HTTPClient.RequestsPerInterval)
+	check(c.HTTPClient.Concurrency > 0, "HTTP_CONCURRENCY=%d: must be positive", c.HTTPClient.Concurrency)
+	check(c.HTTPClient.PipelineDepth > 0, "HTTP_PIPELINE_DEPTH=%d: must be positive", c.HTTPClient.PipelineDepth)
+	check(c.HTTPClient.MaxIdleConns >= 0, "HTTP_MAX_IDLE_CONNS=%d: must not be negative", c.HTTPClient.MaxIdleConns)
+	check(c.HTTPClient.MaxIdleConnsPerHost >= 0, "HTTP_MAX_IDLE_CONNS_PER_HOST=%d: must not be negative", c.HTTPClient.MaxIdleConnsPerHost)
+	check(c.HTTPClient.MaxConnsPerHost >= 0, "HTTP_MAX_CONNS_PER_HOST=%d: must not be negative", c.HTTPClient.MaxConnsPerHost)
+	check(c.HTTPClient.IdleConnTimeout >= 0, "HTTP_IDLE_CONN_TIMEOUT=%s: must not be negative", c.HTTPClient.IdleConnTimeout)
+	check(c.Retry.MaxAttempts >= 1, "RETRY_MAX_ATTEMPTS=%d: must be at least 1", c.Retry.MaxAttempts)
+	check(c.Retry.AttemptTimeout > 0 || c.Retry.Deadline > 0, "ATTEMPT_TIMEOUT=%s: needs a REQUEST_DEADLINE when disabled, or requests are never bounded", c.Retry.AttemptTimeout)
+	check(c.CallTimeout >= 0, "CALL_TIMEOUT=%s: must not be negative", c.CallTimeout)
+	check(c.Breaker.FailureThreshold >= 0, "BREAKER_FAILURE_THRESHOLD=%d: must not be negative", c.Breaker.FailureThreshold)
+	check(c.Breaker.OpenDuration > 0, "BREAKER_OPEN_DURATION=%s: must be positive", c.Breaker.OpenDuration)
+	check(c.Breaker.HalfOpenRequests > 0, "BREAKER_HALF_OPEN_REQUESTS=%d: must be positive", c.Breaker.HalfOpenRequests)
+	check(c.ExemplarSampleRatio >= 0 && c.ExemplarSampleRatio <= 1, "EXEMPLAR_SAMPLE_RATIO=%g: must be between 0 and 1", c.ExemplarSampleRatio)
+	if c.SyntheticMetrics.Enabled {
+		port("SYNTHETIC_METRICS_PORT", c.SyntheticMetrics.Port)
+		check(c.SyntheticMetrics.Port != c.Port, "SYNTHETIC_METRICS_PORT=%d: must differ from PORT", c.SyntheticMetrics.Port)
+		check(strings.HasPrefix(c.SyntheticMetrics.Path, "/"), "SYNTHETIC_METRICS_PATH=%q: must start with /", c.SyntheticMetrics.Path)
+		check(metricNamePattern.MatchString(c.SyntheticMetrics.Prefix), "SYNTHETIC_METRICS_PREFIX=%q: must be a valid metric name", c.SyntheticMetrics.Prefix)
+		check(len(c.SyntheticMetrics.Types) > 0, "SYNTHETIC_METRICS_TYPES must list at least one type")
+		for i, kind := range c.SyntheticMetrics.Types {
+			oneOf("SYNTHETIC_METRICS_TYPES", kind, syntheticTypes...)
+			check(!slices.Contains(c.SyntheticMetrics.Types[:i], kind), "SYNTHETIC_METRICS_TYPES: %s is listed more than once", kind)
+		}
+		check(c.SyntheticMetrics.Families > 0, "SYNTHETIC_METRICS_FAMILIES=%d: must be positive", c.SyntheticMetrics.Families)
+		check(c.SyntheticMetrics.Series > 0, "SYNTHETIC_METRICS_SERIES=%d: must be positive", c.SyntheticMetrics.Series)
+		check(c.SyntheticMetrics.Labels > 0, "SYNTHETIC_METRICS_LABELS=%d: must be positive", c.SyntheticMetrics.Labels)
+		check(c.SyntheticMetrics.Interval > 0, "SYNTHETIC_METRICS_INTERVAL=%s: must be positive", c.SyntheticMetrics.Interval)
+		check(c.SyntheticMetrics.Churn >= 0 && c.SyntheticMetrics.Churn <= 1, "SYNTHETIC_METRICS_CHURN=%g: must be between 0 and 1", c.SyntheticMetrics.Churn)
+		check(c.SyntheticMetrics.Flap >= 0 && c.SyntheticMetrics.Flap <= 1, "SYNTHETIC_METRICS_FLAP=%g: must be between 0 and 1", c.SyntheticMetrics.Flap)
+		check(c.SyntheticMetrics.ResetInterval >= 0, "SYNTHETIC_METRICS_RESET_INTERVAL=%s: must not be negative", c.SyntheticMetrics.ResetInterval)
+	}
+	for _, setting := range [][2]string{{"REMOTE_WRITE_URL", c.Push.RemoteWriteURL}, {"PUSHGATEWAY_URL", c.Push.PushgatewayURL}} {
+		if setting[1] != "" {
+			target, err := url.Parse(setting[1])
+			check(err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "", "%s=%q: must be an http or https URL", setting[0], redactUserinfo(setting[1]))
+		}
+	}
+	oneOf("PUSH_SOURCE", c.Push.Source, "default", "synthetic")
+	check(c.Push.Source != "synthetic" || c.SyntheticMetrics.Enabled, "PUSH_SOURCE=synthetic needs SYNTHETIC_METRICS")
+	check(c.Push.Interval > 0, "PUSH_INTERVAL=%s: must be positive", c.Push.Interval)
+	check(c.Push.Timeout > 0, "PUSH_TIMEOUT=%s: must be positive", c.Push.Timeout)
+	if c.StatsD.Address != "" {
+		_, _, err := net.SplitHostPort(c.StatsD.Address)
+		check(err == nil, "STATSD_ADDRESS=%q: must be host:port", c.StatsD.Address)
+	}
+	oneOf("STATSD_FLAVOR", c.StatsD.Flavor, "dogstatsd", "statsd")
+	check(c.StatsD.SampleRate > 0 && c.StatsD.SampleRate <= 1, "STATSD_SAMPLE_RATE=%g: must be above 0 and at most 1", c.StatsD.SampleRate)
+	oneOf("TRACE_EXPORTER", c.Tracing.Exporter, "", "otlp", "zipkin", "jaeger")
+	if encodings := traceEncodings[c.Tracing.Exporter]; encodings != nil {
+		if c.Tracing.Encoding == "" {
+			c.Tracing.Encoding = encodings[0]
+		}
+		oneOf("TRACE_ENCODING", c.Tracing.Encoding, encodings...)
+		check(c.Tracing.Endpoint != "", "TRACE_ENDPOINT must be set for TRACE_EXPORTER=%s", c.Tracing.Exporter)
+	}
+	oneOf("TRACE_PROPAGATION", c.Tracing.Propagation, "w3c", "b3", "b3multi")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "TRACE_SAMPLE_RATIO=%g: must be between 0 and 1", c.Tracing.SampleRatio)
+	check(c.Tracing.ExportInterval > 0, "TRACE_EXPORT_INTERVAL=%s: must be positive", c.Tracing.ExportInterval)
+	oneOf("LOG_EMIT_PROTOCOL", c.LogEmit.Protocol, "", "syslog", "fluent")
+	if c.LogEmit.Protocol != "" {
+		_, _, err := net.SplitHostPort(c.LogEmit.Address)
+		check(err == nil, "LOG_EMIT_ADDRESS=%q: must be host:port", c.LogEmit.Address)
+		if c.LogEmit.Protocol == "fluent" {
+			oneOf("LOG_EMIT_TRANSPORT", c.LogEmit.Transport, "tcp", "tls")
+		} else {
+			oneOf("LOG_EMIT_TRANSPORT", c.LogEmit.Transport, "udp", "tcp", "tls")
+		}
+		if c.LogEmit.Tag == "" {
+			c.LogEmit.Tag = c.ServiceName
+		}
+		if c.LogEmit.MaxSize == 0 {
+			c.LogEmit.MaxSize = c.LogEmit.MinSize
+		}
+	}
+	oneOf("LOG_EMIT_SYSLOG_FORMAT", c.LogEmit.SyslogFormat, "rfc5424", "rfc3164")
+	check(c.LogEmit.SyslogFacility >= 0 && c.LogEmit.SyslogFacility <= 23, "LOG_EMIT_SYSLOG_FACILITY=%d: must be between 0 and 23", c.LogEmit.SyslogFacility)
+	check(c.LogEmit.Rate >= 0 && c.LogEmit.Rate <= maxLogEmitRate, "LOG_EMIT_RATE=%g: must be between 0 and %g", c.LogEmit.Rate, maxLogEmitRate)
+	if _, err := parseLogSeverities(c.LogEmit.Severities); err != nil {
+		problems = append(problems, "LOG_EMIT_SEVERITIES: "+err.Error())
+	}
+	check(c.LogEmit.MinSize >= 0, "LOG_EMIT_MIN_SIZE=%d: must not be negative", c.LogEmit.MinSize)
+	check(c.LogEmit.MaxSize >= c.LogEmit.MinSize, "LOG_EMIT_MAX_SIZE=%d: must be at least LOG_EMIT_MIN_SIZE", c.LogEmit.MaxSize)
+	check(c.Retry.Jitter >= 0 && c.Retry.Jitter <= 1, "RETRY_JITTER=%g: must be between 0 and 1", c.Retry.Jitter)
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT=%s: must be positive", c.ShutdownTimeout)
+	check(c.ChainMaxDepth > 0, "CHAIN_MAX_DEPTH=%d: must be positive", c.ChainMaxDepth)
+
+	var err error
+	if c.CallTargets, err = parseDownstreamCalls(raw.callTargets, c.CallTimeout, c.Retry, c.HTTPClient); err != nil {
+		problems = append(problems, "CALL_TARGETS: "+err.Error())
+	}
+	if c.Phases, err = parsePhases(raw.phases); err != nil {
+		problems = append(problems, "PHASES: "+err.Error())
+	}
+	if c.Actions, err = parseScheduledActions(raw.actions); err != nil {
+		problems = append(problems, "ACTIONS: "+err.Error())
+	}
+	if c.MetricsEndpoints, err = parseMetricsEndpoints(raw.endpoints); err != nil {
+		problems = append(problems, "METRICS_ENDPOINTS: "+err.Error())
+	}
+	if c.Flows, err = parseFlows(raw.flows, c.HTTPClient, c.Namespace, c.Discovery.Namespace); err != nil {
+		problems = append(problems, "FLOWS: "+err.Error())
+	}
+	check(len(c.Flows) == 0 || c.Protocol == "http" || c.Protocol == "all", "FLOWS needs PROTOCOL http or all")
+	for _, endpoint := range c.MetricsEndpoints {
+		check(endpoint.Port != c.Port, "METRICS_ENDPOINTS: endpoint %s must not use PORT", endpoint.Name)
+		check(!c.SyntheticMetrics.Enabled || endpoint.Port != c.SyntheticMetrics.Port, "METRICS_ENDPOINTS: endpoint %s must not use SYNTHETIC_METRICS_PORT", endpoint.Name)
+		check(endpoint.Source != "synthetic" || c.SyntheticMetrics.Enabled, "METRICS_ENDPOINTS: endpoint %s needs SYNTHETIC_METRICS", endpoint.Name)
+	}
+	return problems
+}
+
+func isBoolSetting(s *setting) bool {
+	_, ok := s.value.(boolValue)
+	return ok
+}
+
+// flagValue records a command-line flag so it can be applied after the
+// config file and the environment.
+type flagValue struct {
+	value   string
+	set     bool
+	boolean bool
+}
+
+func (f *flagValue) String() string   { return f.value }
+func (f *flagValue) IsBoolFlag() bool { return f.boolean }
+
+func (f *flagValue) Set(value string) error {
+	f.value, f.set = value, true
+	return nil
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) set(value string) error { *v.p = value; return nil }
+func (v stringValue) String() string         { return *v.p }
+
+type intValue struct{ p *int }
+
+func (v intValue) set(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	*v.p = n
+	return nil
+}
+
+func (v intValue) String() string { return strconv.Itoa(*v.p) }
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("not a boolean")
+	}
+	*v.p = b
+	return nil
+}
+
+func (v boolValue) String() string { return strconv.FormatBool(*v.p) }
+
+type floatValue struct{ p *float64 }
+
+func (v floatValue) set(value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return errors.New("not a number")
+	}
+	*v.p = f
+	return nil
+}
+
+func (v floatValue) String() string { return strconv.FormatFloat(*v.p, 'g', -1, 64) }
+
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New("not a duration such as \"30s\" or \"5m\"")
+	}
+	*v.p = d
+	return nil
+}
+
+func (v durationValue) String() string { return v.p.String() }
+
+type listValue struct{ p *[]string }
+
+func (v listValue) set(value string) error {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*v.p = items
+	return nil
+}
+
+func (v listValue) String() string { return strings.Join(*v.p, ",") }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a config file to a temporary directory and returns
+// its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// settingSource returns the effective value and source of env.
+func settingSource(settings []ConfigSetting, env string) (string, string) {
+	i := slices.IndexFunc(settings, func(s ConfigSetting) bool { return s.Env == env })
+	if i < 0 {
+		return "", ""
+	}
+	return settings[i].Value, settings[i].Source
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv("SEED", "fixed")
+	config, settings, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 8080 || config.Protocol != "http" || config.Seed != "fixed" {
+		t.Errorf("config = port %d, protocol %s, seed %s", config.Port, config.Protocol, config.Seed)
+	}
+	if value, source := settingSource(settings, "PORT"); value != "8080" || source != "default" {
+		t.Errorf("PORT = %s from %s, want 8080 from default", value, source)
+	}
+	if _, source := settingSource(settings, "SEED"); source != "env" {
+		t.Errorf("SEED source %s, want env", source)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", `
+port: 9000
+service_name: from-file
+target_port: 9001
+protocol: tcp
+tcp_record_size: 64
+mqtt_topics:
+  - a
+  - b
+phases:
+  - name: warmup
+    duration: 1m
+`)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("SERVICE_NAME", "from-env")
+	t.Setenv("TARGET_PORT", "9002")
+	t.Setenv("TCP_RECORD_SIZE", "")
+
+	config, settings, err := loadConfig([]string{"--target-port=9003", "--tcp-half-close"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env, value, source string
+	}{
+		{"PORT", "9000", "file"},
+		{"PROTOCOL", "tcp", "file"},
+		{"TCP_RECORD_SIZE", "64", "file"},
+		{"MQTT_TOPICS", "a,b", "file"},
+		{"SERVICE_NAME", "from-env", "env"},
+		{"TARGET_PORT", "9003", "flag"},
+		{"TCP_HALF_CLOSE", "true", "flag"},
+		{"TCP_FRAMING", "newline", "default"},
+	}
+	for _, test := range tests {
+		if value, source := settingSource(settings, test.env); value != test.value || source != test.source {
+			t.Errorf("%s = %s from %s, want %s from %s", test.env, value, source, test.value, test.source)
+		}
+	}
+	if len(config.Phases) != 1 || config.Phases[0].Name != "warmup" || config.Phases[0].duration != time.Minute {
+		t.Errorf("phases from the config file = %+v", config.Phases)
+	}
+
+	// --config overrides CONFIG_FILE
+	other := writeConfigFile(t, "other.json", `{"port": 7000}`)
+	config, _, err = loadConfig([]string{"--config", other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 7000 || config.Protocol != "http" {
+		t.Errorf("--config: port %d, protocol %s; want 7000, http", config.Port, config.Protocol)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{name: "not an integer", env: map[string]string{"PORT": "eighty"}, want: []string{`PORT="eighty" (env): not an integer`}},
+		{name: "not a duration", args: []string{"--call-timeout=5"}, want: []string{"CALL_TIMEOUT", "(flag): not a duration"}},
+		{name: "not a boolean", env: map[string]string{"DRY_RUN": "maybe"}, want: []string{"DRY_RUN", "not a boolean"}},
+		{name: "port out of range", env: map[string]string{"PORT": "70000"}, want: []string{"PORT=70000: must be a port"}},
+		{name: "unknown protocol", env: map[string]string{"PROTOCOL": "smtp"}, want: []string{`PROTOCOL="smtp": must be one of`}},
+		{name: "zero memcached key count", env: map[string]string{"MEMCACHED_KEY_COUNT": "0"}, want: []string{"MEMCACHED_KEY_COUNT=0: must be positive"}},
+		{name: "zero memcached operations", env: map[string]string{"MEMCACHED_OPERATIONS": "0"}, want: []string{"MEMCACHED_OPERATIONS=0: must be positive"}},
+		{name: "memcached hit ratio", env: map[string]string{"MEMCACHED_HIT_RATIO": "101"}, want: []string{"MEMCACHED_HIT_RATIO=101"}},
+		{name: "zero TCP record size", env: map[string]string{"TCP_RECORD_SIZE": "0"}, want: []string{"TCP_RECORD_SIZE=0: must be positive"}},
+		{name: "zero HTTP concurrency", env: map[string]string{"HTTP_CONCURRENCY": "0"}, want: []string{"HTTP_CONCURRENCY=0: must be positive"}},
+		{name: "zero HTTP requests per interval", env: map[string]string{"HTTP_REQUESTS_PER_INTERVAL": "0"}, want: []string{"HTTP_REQUESTS_PER_INTERVAL=0: must be positive"}},
+		{name: "zero pipeline depth", env: map[string]string{"HTTP_PIPELINE_DEPTH": "0"}, want: []string{"HTTP_PIPELINE_DEPTH=0: must be positive"}},
+		{name: "zero TCP requests per connection", env: map[string]string{"TCP_REQUESTS_PER_CONNECTION": "0"}, want: []string{"TCP_REQUESTS_PER_CONNECTION=0: must be positive"}},
+		{name: "negative TCP requests per connection", env: map[string]string{"TCP_REQUESTS_PER_CONNECTION": "-2"}, want: []string{"TCP_REQUESTS_PER_CONNECTION=-2: must be positive"}},
+		{name: "zero TCP stream bytes", env: map[string]string{"TCP_STREAM_BYTES": "0"}, want: []string{"TCP_STREAM_BYTES=0: must be positive"}},
+		{name: "negative TCP pool size", env: map[string]string{"TCP_POOL_SIZE": "-1"}, want: []string{"TCP_POOL_SIZE=-1: must not be negative"}},
+		{name: "negative TCP idle timeout", env: map[string]string{"TCP_IDLE_TIMEOUT": "-1s"}, want: []string{"TCP_IDLE_TIMEOUT=-1s: must not be negative"}},
+		{name: "zero exit code", env: map[string]string{"TERMINATION_EXIT_CODE": "0"}, want: []string{"TERMINATION_EXIT_CODE=0: must be between 1 and 255"}},
+		{name: "exit code too large", env: map[string]string{"TERMINATION_EXIT_CODE": "256"}, want: []string{"TERMINATION_EXIT_CODE=256"}},
+		{name: "negative call timeout", env: map[string]string{"CALL_TIMEOUT": "-5s"}, want: []string{"CALL_TIMEOUT=-5s: must not be negative"}},
+		{name: "negative breaker threshold", env: map[string]string{"BREAKER_FAILURE_THRESHOLD": "-1"}, want: []string{"BREAKER_FAILURE_THRESHOLD=-1: must not be negative"}},
+		{name: "zero breaker open duration", env: map[string]string{"BREAKER_OPEN_DURATION": "0s"}, want: []string{"BREAKER_OPEN_DURATION=0s: must be positive"}},
+		{name: "zero breaker probes", env: map[string]string{"BREAKER_HALF_OPEN_REQUESTS": "0"}, want: []string{"BREAKER_HALF_OPEN_REQUESTS=0: must be positive"}},
+		{name: "negative max idle conns", env: map[string]string{"HTTP_MAX_IDLE_CONNS": "-1"}, want: []string{"HTTP_MAX_IDLE_CONNS=-1: must not be negative"}},
+		{name: "negative max idle conns per host", env: map[string]string{"HTTP_MAX_IDLE_CONNS_PER_HOST": "-1"}, want: []string{"HTTP_MAX_IDLE_CONNS_PER_HOST=-1: must not be negative"}},
+		{name: "negative max conns per host", env: map[string]string{"HTTP_MAX_CONNS_PER_HOST": "-1"}, want: []string{"HTTP_MAX_CONNS_PER_HOST=-1: must not be negative"}},
+		{name: "negative idle conn timeout", env: map[string]string{"HTTP_IDLE_CONN_TIMEOUT": "-1s"}, want: []string{"HTTP_IDLE_CONN_TIMEOUT=-1s: must not be negative"}},
+		{name: "no MQTT topics", args: []string{"--mqtt-topics="}, want: []string{"MQTT_TOPICS must list at least one topic"}},
+		{name: "blank MQTT topics", env: map[string]string{"MQTT_TOPICS": " , "}, want: []string{"MQTT_TOPICS must list at least one topic"}},
+		{name: "zero chain depth", env: map[string]string{"CHAIN_MAX_DEPTH": "0"}, want: []string{"CHAIN_MAX_DEPTH=0: must be positive"}},
+		{name: "huge log rate", env: map[string]string{"LOG_EMIT_RATE": "2e9"}, want: []string{"LOG_EMIT_RATE=2e+09: must be between 0"}},
+		{name: "infinite log rate", env: map[string]string{"LOG_EMIT_RATE": "Inf"}, want: []string{"LOG_EMIT_RATE=+Inf"}},
+		{name: "negative log rate", env: map[string]string{"LOG_EMIT_RATE": "-1"}, want: []string{"LOG_EMIT_RATE=-1"}},
+		{name: "unbounded requests", env: map[string]string{"ATTEMPT_TIMEOUT": "0s"}, want: []string{"ATTEMPT_TIMEOUT=0s: needs a REQUEST_DEADLINE"}},
+		{name: "invalid phases", env: map[string]string{"PHASES": "[{}]"}, want: []string{"PHASES: "}},
+		{name: "invalid call targets", env: map[string]string{"CALL_TARGETS": "{"}, want: []string{"CALL_TARGETS: "}},
+		{name: "duplicate synthetic types", env: map[string]string{"SYNTHETIC_METRICS": "true", "SYNTHETIC_METRICS_TYPES": "counter,gauge,counter"}, want: []string{"SYNTHETIC_METRICS_TYPES: counter is listed more than once"}},
+		{name: "flows need http", env: map[string]string{"PROTOCOL": "tcp", "FLOWS": `[{"name":"f","url":"http://a/"}]`}, want: []string{"FLOWS needs PROTOCOL http or all"}},
+		{name: "every problem reported", env: map[string]string{"PORT": "0", "MQTT_QOS": "2", "STATSD_SAMPLE_RATE": "0"}, want: []string{"PORT=0", "MQTT_QOS=2", "STATSD_SAMPLE_RATE=0"}},
+		{name: "unknown flag", args: []string{"--no-such-setting"}, want: []string{"no-such-setting"}},
+		{name: "unexpected argument", args: []string{"extra"}, want: []string{"unexpected arguments"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for env, value := range test.env {
+				t.Setenv(env, value)
+			}
+			_, _, err := loadConfig(test.args)
+			if err == nil {
+				t.Fatal("want an error")
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "no_such_setting: 1\n", `unknown key "no_such_setting"`},
+		{"list for a single value", "port: [1, 2]\n", "port: expected a single value"},
+		{"map for a list", "mqtt_topics: {a: b}\n", "mqtt_topics: expected a list"},
+		{"not YAML", "port: [\n", "parsing config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := loadConfig([]string{"--config", writeConfigFile(t, "config.yaml", test.content)})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+
+	if _, _, err := loadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("missing config file: want an error")
+	}
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DiscoveryConfig finds the targets of periodic requests at runtime instead
+// of using TARGET_URL and TARGET_HOST as they are. Discovered addresses
+// replace the host of TARGET_URL and TARGET_HOST, so scheme, path and
+// protocol settings still apply.
+type DiscoveryConfig struct {
+	Mode       string        `json:"mode"`       // "", "kubernetes", or "dns"
+	Service    string        `json:"service"`    // Service name, or a DNS name for "dns" (SRV when it starts with "_")
+	Selector   string        `json:"selector"`   // Pod label selector for "kubernetes"
+	Namespace  string        `json:"namespace"`  // Defaults to the pod's own namespace
+	Addressing string        `json:"addressing"` // "pod-ip", "cluster-ip", "node-port", "headless", or "external-name"
+	Policy     string        `json:"policy"`     // "round-robin", "random", or "all"
+	Port       int           `json:"port"`       // Port of discovered targets, 0 for the port of TARGET_URL or TARGET_PORT; the Service port for "node-port"
+	Refresh    time.Duration `json:"refresh"`
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Addressing modes select which address of a Service traffic goes to, so
+// every way of resolving a Service can be exercised:
+//
+//   - pod-ip: the ready pod IPs, from the API (EndpointSlices, with the
+//     target port of the Service port, or a label selector) or from DNS (SRV
+//     records or any name resolving to pods)
+//   - cluster-ip: the Service VIP, from the API or from DNS. A headless
+//     Service has none: the API lookup fails, and the pod IPs DNS returns
+//     for it are reported as pod-ip
+//   - node-port: every node's InternalIP with the Service's node port (API only)
+//   - headless: the pod IPs returned by DNS for a headless Service
+//   - external-name: the host name an ExternalName Service points to, from
+//     the API or the DNS CNAME record, resolved when connecting
+var addressingModes = []string{"pod-ip", "cluster-ip", "node-port", "headless", "external-name"}
+
+// discoveredTarget is one address found by discovery. Port is 0 unless the
+// lookup returned one (DNS SRV, node ports). Addressing is set when the
+// address is not what the configured mode asked for.
+type discoveredTarget struct {
+	host       string
+	port       int
+	addressing string
+}
+
+func (t discoveredTarget) String() string {
+	if t.port == 0 {
+		return t.host
+	}
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+// targetDiscovery refreshes the discovered targets periodically and hands
+// them out according to the policy.
+type targetDiscovery struct {
+	config  DiscoveryConfig
+	lookup  func(ctx context.Context) ([]discoveredTarget, error)
+	random  *seededRand
+	targets prometheus.Gauge
+
+	mu         sync.Mutex
+	discovered []discoveredTarget
+	addressing string // Addressing of the discovered targets
+	next       int
+}
+
+func newTargetDiscovery(config DiscoveryConfig, random *seededRand, targets prometheus.Gauge) (*targetDiscovery, error) {
+	d := &targetDiscovery{config: config, random: random, targets: targets, addressing: config.Addressing}
+
+	switch config.Mode {
+	case "kubernetes":
+		client, err := newKubernetesClient(config.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		switch config.Addressing {
+		case "cluster-ip":
+			d.lookup = client.clusterIP(config.Service)
+		case "node-port":
+			d.lookup = client.nodePorts(config.Service, config.Port)
+		case "headless":
+			d.lookup = client.headless(config.Service)
+		case "external-name":
+			d.lookup = client.externalName(config.Service)
+		default:
+			if config.Selector != "" {
+				d.lookup = client.pods(config.Selector)
+			} else {
+				d.lookup = client.serviceEndpoints(config.Service, config.Port)
+			}
+		}
+	case "dns":
+		switch config.Addressing {
+		case "node-port":
+			return nil, errors.New("node-port addressing needs kubernetes discovery")
+		case "external-name":
+			d.lookup = lookupCNAME(net.DefaultResolver, config.Service)
+		case "pod-ip":
+			d.lookup = lookupPodIPs(net.DefaultResolver, config.Service)
+		case "cluster-ip":
+			d.lookup = lookupClusterIP(net.DefaultResolver, config.Service)
+		default:
+			d.lookup = lookupDNS(net.DefaultResolver, config.Service)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported discovery mode: %s", config.Mode)
+	}
+	return d, nil
+}
+
+func (d *targetDiscovery) String() string {
+	source := "service " + d.config.Service
+	switch {
+	case d.config.Mode == "dns":
+		source = d.config.Service
+	case d.config.Selector != "":
+		source = "pods " + d.config.Selector
+	}
+	return fmt.Sprintf("%s %s, %s addressing, %s", d.config.Mode, source, d.config.Addressing, d.config.Policy)
+}
+
+// mode returns the addressing of the current targets, which is the
+// configured one unless the lookup found otherwise.
+func (d *targetDiscovery) mode() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addressing
+}
+
+// run refreshes the targets until stop is closed. The first lookup happens
+// right away so targets are known before the first periodic request.
+func (d *targetDiscovery) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.config.Refresh)
+	defer ticker.Stop()
+	for {
+		d.refresh()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (d *targetDiscovery) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	found, err := d.lookup(ctx)
+	if err != nil {
+		// Keep the last known targets, discovery may only be briefly unavailable
+		log.Printf("Target discovery (%s) failed: %v", d, err)
+		return
+	}
+	slices.SortFunc(found, func(a, b discoveredTarget) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !slices.Equal(found, d.discovered) {
+		log.Printf("Discovered %d targets (%s): %v", len(found), d, found)
+	}
+	d.discovered = found
+	d.addressing = d.config.Addressing
+	if len(found) > 0 && found[0].addressing != "" {
+		d.addressing = found[0].addressing
+	}
+	d.targets.Set(float64(len(found)))
+}
+
+// pick returns the targets for one request: all of them for the "all"
+// policy, otherwise one chosen in turn or at random.
+func (d *targetDiscovery) pick() []discoveredTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.discovered) == 0 {
+		return nil
+	}
+	switch d.config.Policy {
+	case "all":
+		return slices.Clone(d.discovered)
+	case "random":
+		return []discoveredTarget{d.discovered[d.random.IntN(len(d.discovered))]}
+	default:
+		target := d.discovered[d.next%len(d.discovered)]
+		d.next++
+		return []discoveredTarget{target}
+	}
+}
+
+// hostTargets returns the addresses for host based protocols.
+func (a *App) hostTargets() []string {
+	if a.discovery == nil {
+		return []string{net.JoinHostPort(a.config.TargetHost, strconv.Itoa(a.config.TargetPort))}
+	}
+
+	var addresses []string
+	for _, target := range a.discovery.pick() {
+		port := cmp.Or(target.port, a.config.Discovery.Port, a.config.TargetPort)
+		addresses = append(addresses, net.JoinHostPort(target.host, strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+// urlTargets returns the base URLs for HTTP based protocols. Discovered
+// addresses replace the host of TARGET_URL, or use plain HTTP without one.
+func (a *App) urlTargets() []string {
+	if a.discovery == nil {
+		return []string{a.config.TargetURL}
+	}
+
+	base := &url.URL{Scheme: "http"}
+	if a.config.TargetURL != "" {
+		base, _ = url.Parse(a.config.TargetURL)
+	}
+	defaultPort, _ := strconv.Atoi(base.Port())
+
+	var urls []string
+	for _, target := range a.discovery.pick() {
+		port := cmp.Or(target.port, a.config.Discovery.Port, defaultPort, a.config.TargetPort)
+		u := *base
+		u.Host = net.JoinHostPort(target.host, strconv.Itoa(port))
+		urls = append(urls, strings.TrimSuffix(u.String(), "/"))
+	}
+	return urls
+}
+
+func (a *App) hasURLTarget() bool  { return a.config.TargetURL != "" || a.discovery != nil }
+func (a *App) hasHostTarget() bool { return a.config.TargetHost != "" || a.discovery != nil }
+
+// lookupDNS resolves name to its A/AAAA records, which are the pod IPs of a
+// headless Service and the ClusterIP otherwise, or to its SRV records when
+// the name starts with an underscore.
+func lookupDNS(resolver *net.Resolver, name string) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		var targets []discoveredTarget
+		if strings.HasPrefix(name, "_") {
+			_, records, err := resolver.LookupSRV(ctx, "", "", name)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range records {
+				targets = append(targets, discoveredTarget{host: strings.TrimSuffix(record.Target, "."), port: int(record.Port)})
+			}
+			return targets, nil
+		}
+
+		addresses, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			targets = append(targets, discoveredTarget{host: address})
+		}
+		return targets, nil
+	}
+}
+
+// reverseAddressing tells a ClusterIP from a pod IP of the Service name by
+// the reverse records of address: "cluster-ip" when one names the Service
+// itself (<service>.<namespace>.svc.<domain>), "pod-ip" when one names a
+// pod of it (<pod>.<service>.<namespace>.svc.<domain>), and "" otherwise.
+func reverseAddressing(ctx context.Context, resolver *net.Resolver, name, address string) string {
+	service, _, _ := strings.Cut(name, ".")
+	names, _ := resolver.LookupAddr(ctx, address)
+	for _, ptr := range names {
+		labels := strings.Split(ptr, ".")
+		switch {
+		case len(labels) > 3 && labels[0] == service && labels[2] == "svc":
+			return "cluster-ip"
+		case len(labels) > 4 && labels[1] == service && labels[3] == "svc":
+			return "pod-ip"
+		}
+	}
+	return ""
+}
+
+// lookupPodIPs resolves name like lookupDNS for "pod-ip" addressing. A
+// Service that is not headless resolves to its ClusterIP rather than pod
+// IPs, which is recognized by its reverse record; that address is labelled
+// "service".
+func lookupPodIPs(resolver *net.Resolver, name string) func(ctx context.Context) ([]discoveredTarget, error) {
+	lookup := lookupDNS(resolver, name)
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		targets, err := lookup(ctx)
+		if err != nil || len(targets) != 1 || strings.HasPrefix(name, "_") {
+			return targets, err
+		}
+		if reverseAddressing(ctx, resolver, name, targets[0].host) == "cluster-ip" {
+			targets[0].addressing = "service"
+		}
+		return targets, nil
+	}
+}
+
+// lookupClusterIP resolves name like lookupDNS for "cluster-ip" addressing.
+// A headless Service resolves to the IPs of its ready pods instead of a
+// ClusterIP, so several addresses, or one whose reverse record names a pod
+// of the Service, are labelled "pod-ip".
+func lookupClusterIP(resolver *net.Resolver, name string) func(ctx context.Context) ([]discoveredTarget, error) {
+	lookup := lookupDNS(resolver, name)
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		targets, err := lookup(ctx)
+		if err != nil || len(targets) == 0 || strings.HasPrefix(name, "_") {
+			return targets, err
+		}
+		if len(targets) > 1 || reverseAddressing(ctx, resolver, name, targets[0].host) == "pod-ip" {
+			for i := range targets {
+				targets[i].addressing = "pod-ip"
+			}
+		}
+		return targets, nil
+	}
+}
+
+// lookupCNAME resolves the CNAME record of name, which is how DNS answers
+// for an ExternalName Service.
+func lookupCNAME(resolver *net.Resolver, name string) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if cname = strings.TrimSuffix(cname, "."); cname == strings.TrimSuffix(name, ".") {
+			return nil, fmt.Errorf("%s has no CNAME record", name)
+		}
+		return []discoveredTarget{{host: cname}}, nil
+	}
+}
+
+// serviceAccountNamespace returns the pod's own namespace.
+func serviceAccountNamespace() (string, error) {
+	own, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", fmt.Errorf("reading service account namespace: %v", err)
+	}
+	return strings.TrimSpace(string(own)), nil
+}
+
+// kubernetesClient reads from the Kubernetes API with the pod's service
+// account, which needs get and list on pods, services and endpointslices.
+type kubernetesClient struct {
+	server    string
+	namespace string
+	token     string // Path of the service account token
+	client    *http.Client
+	resolver  *net.Resolver // Resolves headless Services
+}
+
+func newKubernetesClient(namespace string) (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes discovery needs to run in a pod (KUBERNETES_SERVICE_HOST is not set)")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account CA")
+	}
+
+	if namespace == "" {
+		if namespace, err = serviceAccountNamespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		token:     serviceAccountDir + "/token",
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+			Timeout:   10 * time.Second,
+		},
+		resolver: net.DefaultResolver,
+	}, nil
+}
+
+// get decodes the JSON object at path. The token is read on every call
+// because projected service account tokens are rotated.
+func (k *kubernetesClient) get(ctx context.Context, path string, query url.Values, into interface{}) error {
+	token, err := os.ReadFile(k.token)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %v", err)
+	}
+
+	endpoint := k.server + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// pods finds the ready pods matching selector, leaving out this pod.
+func (k *kubernetesClient) pods(selector string) func(ctx context.Context) ([]discoveredTarget, error) {
+	self, _ := os.Hostname()
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		var list struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Status struct {
+					Phase      string `json:"phase"`
+					PodIP      string `json:"podIP"`
+					Conditions []struct {
+						Type   string `json:"type"`
+						Status string `json:"status"`
+					} `json:"conditions"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		path := fmt.Sprintf("/api/v1/namespaces/%s/pods", k.namespace)
+		if err := k.get(ctx, path, url.Values{"labelSelector": {selector}}, &list); err != nil {
+			return nil, err
+		}
+
+		var targets []discoveredTarget
+		for _, pod := range list.Items {
+			if pod.Metadata.Name == self || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+				continue
+			}
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == "Ready" && condition.Status == "True" {
+					targets = append(targets, discoveredTarget{host: pod.Status.PodIP})
+				}
+			}
+		}
+		return targets, nil
+	}
+}
+
+// serviceEndpoints finds the ready endpoints of a Service from its
+// EndpointSlices. The pods listen on the target port of the Service port
+// servicePort (or of its only port when servicePort is 0), which the slices
+// list under the name of the Service port.
+func (k *kubernetesClient) serviceEndpoints(service string, servicePort int) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		svc, err := k.service(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		portName, found := "", false
+		for _, port := range svc.Spec.Ports {
+			if port.Port == servicePort || (servicePort == 0 && len(svc.Spec.Ports) == 1) {
+				portName, found = port.Name, true
+			}
+		}
+		if !found && servicePort == 0 {
+			return nil, fmt.Errorf("service %s has %d ports, set the port to use", service, len(svc.Spec.Ports))
+		}
+		if !found {
+			return nil, fmt.Errorf("service %s has no port %d", service, servicePort)
+		}
+
+		var list struct {
+			Items []struct {
+				Ports []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"ports"`
+				Endpoints []struct {
+					Addresses  []string `json:"addresses"`
+					Conditions struct {
+						Ready *bool `json:"ready"`
+					} `json:"conditions"`
+				} `json:"endpoints"`
+			} `json:"items"`
+		}
+		path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", k.namespace)
+		if err := k.get(ctx, path, url.Values{"labelSelector": {"kubernetes.io/service-name=" + service}}, &list); err != nil {
+			return nil, err
+		}
+
+		var targets []discoveredTarget
+		for _, slice := range list.Items {
+			port := 0
+			for _, slicePort := range slice.Ports {
+				if slicePort.Name == portName {
+					port = slicePort.Port
+				}
+			}
+			if port == 0 {
+				continue
+			}
+			for _, endpoint := range slice.Endpoints {
+				// A missing ready condition means ready
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+				for _, address := range endpoint.Addresses {
+					targets = append(targets, discoveredTarget{host: address, port: port})
+				}
+			}
+		}
+		return targets, nil
+	}
+}
+
+// kubernetesService is the part of a Service the addressing modes need.
+type kubernetesService struct {
+	Spec struct {
+		Type         string `json:"type"`
+		ClusterIP    string `json:"clusterIP"`
+		ExternalName string `json:"externalName"`
+		Ports        []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			NodePort int    `json:"nodePort"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+func (k *kubernetesClient) service(ctx context.Context, name string) (*kubernetesService, error) {
+	var svc kubernetesService
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", k.namespace, name)
+	if err := k.get(ctx, path, nil, &svc); err != nil {
+		return nil, err
+	}
+	return &svc, nil
+}
+
+// clusterIP finds the ClusterIP of a Service.
+func (k *kubernetesClient) clusterIP(service string) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		svc, err := k.service(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		if svc.Spec.ClusterIP == "None" {
+			return nil, fmt.Errorf("service %s is headless and has no ClusterIP", service)
+		}
+		if svc.Spec.ClusterIP == "" {
+			return nil, fmt.Errorf("service %s has no ClusterIP", service)
+		}
+		return []discoveredTarget{{host: svc.Spec.ClusterIP}}, nil
+	}
+}
+
+// headless checks that a Service is headless and resolves its cluster DNS
+// name, which returns the ready pod IPs.
+func (k *kubernetesClient) headless(service string) func(ctx context.Context) ([]discoveredTarget, error) {
+	resolve := lookupDNS(k.resolver, fmt.Sprintf("%s.%s.svc", service, k.namespace))
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		svc, err := k.service(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		if svc.Spec.ClusterIP != "None" {
+			return nil, fmt.Errorf("service %s is not headless", service)
+		}
+		return resolve(ctx)
+	}
+}
+
+// nodePorts finds the node port of a Service for its port servicePort (or
+// its only port when servicePort is 0) and pairs it with every node's
+// InternalIP. Listing nodes needs a ClusterRole.
+func (k *kubernetesClient) nodePorts(service string, servicePort int) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		svc, err := k.service(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+
+		nodePort := 0
+		for _, port := range svc.Spec.Ports {
+			if port.Port == servicePort || (servicePort == 0 && len(svc.Spec.Ports) == 1) {
+				nodePort = port.NodePort
+			}
+		}
+		if nodePort == 0 {
+			return nil, fmt.Errorf("service %s has no node port for port %d", service, servicePort)
+		}
+
+		var nodes struct {
+			Items []struct {
+				Status struct {
+					Addresses []struct {
+						Type    string `json:"type"`
+						Address string `json:"address"`
+					} `json:"addresses"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		if err := k.get(ctx, "/api/v1/nodes", nil, &nodes); err != nil {
+			return nil, err
+		}
+
+		var targets []discoveredTarget
+		for _, node := range nodes.Items {
+			for _, address := range node.Status.Addresses {
+				if address.Type == "InternalIP" {
+					targets = append(targets, discoveredTarget{host: address.Address, port: nodePort})
+				}
+			}
+		}
+		return targets, nil
+	}
+}
+
+// externalName finds the host name an ExternalName Service points to.
+func (k *kubernetesClient) externalName(service string) func(ctx context.Context) ([]discoveredTarget, error) {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		svc, err := k.service(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		if svc.Spec.Type != "ExternalName" || svc.Spec.ExternalName == "" {
+			return nil, fmt.Errorf("service %s is not an ExternalName service", service)
+		}
+		return []discoveredTarget{{host: svc.Spec.ExternalName}}, nil
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newFakeKubernetes returns a client for an API server that answers GET
+// requests for the paths in objects with their JSON, and records the label
+// selectors it was asked for.
+func newFakeKubernetes(t *testing.T, objects map[string]string) (*kubernetesClient, *[]string) {
+	t.Helper()
+	var selectors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if selector := r.URL.Query().Get("labelSelector"); selector != "" {
+			selectors = append(selectors, selector)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &kubernetesClient{server: server.URL, namespace: "ns", token: token, client: server.Client(), resolver: net.DefaultResolver}, &selectors
+}
+
+// fakeDNS holds the records a fake DNS server answers with. Names are fully
+// qualified, with the trailing dot.
+type fakeDNS struct {
+	a     map[string][]string
+	srv   map[string][]net.SRV
+	cname map[string]string
+	ptr   map[string][]string
+}
+
+// resolver starts a DNS server for the records on a loopback UDP port and
+// returns a resolver that sends every query to it.
+func (d fakeDNS) resolver(t *testing.T) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if answer, err := d.answer(buf[:n]); err == nil {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+	}}
+}
+
+func (d fakeDNS) answer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := question.Name.String()
+	_, known := d.a[name]
+	_, isCNAME := d.cname[name]
+	known = known || isCNAME || d.srv[name] != nil || d.ptr[name] != nil
+
+	response := dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, RecursionAvailable: true}
+	if !known {
+		response.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, response)
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	resource := func(name string, kind dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: kind, Class: dnsmessage.ClassINET, TTL: 5}
+	}
+
+	if target, ok := d.cname[name]; ok {
+		builder.CNAMEResource(resource(name, dnsmessage.TypeCNAME), dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+	}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		for _, address := range d.a[name] {
+			builder.AResource(resource(name, dnsmessage.TypeA), dnsmessage.AResource{A: [4]byte(net.ParseIP(address).To4())})
+		}
+	case dnsmessage.TypeSRV:
+		for _, srv := range d.srv[name] {
+			builder.SRVResource(resource(name, dnsmessage.TypeSRV), dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dnsmessage.MustNewName(srv.Target)})
+		}
+	case dnsmessage.TypePTR:
+		for _, ptr := range d.ptr[name] {
+			builder.PTRResource(resource(name, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(ptr)})
+		}
+	}
+	return builder.Finish()
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	k, selectors := newFakeKubernetes(t, map[string]string{
+		"/api/v1/namespaces/ns/services/backend": `{"spec":{"type":"ClusterIP","clusterIP":"10.96.0.10","ports":[
+			{"name":"http","port":80,"targetPort":8080},
+			{"name":"metrics","port":9090,"targetPort":"metrics"}]}}`,
+		"/api/v1/namespaces/ns/services/single": `{"spec":{"ports":[{"port":80,"targetPort":8081}]}}`,
+		"/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices": `{"items":[
+			{"ports":[{"name":"http","port":8080},{"name":"metrics","port":9100}],"endpoints":[
+				{"addresses":["10.0.0.1"],"conditions":{"ready":true}},
+				{"addresses":["10.0.0.2"],"conditions":{"ready":false}},
+				{"addresses":["10.0.0.3"]}]},
+			{"ports":[{"name":"metrics","port":9101}],"endpoints":[
+				{"addresses":["10.0.1.1"],"conditions":{"ready":true}}]},
+			{"ports":[{"port":8081}],"endpoints":[
+				{"addresses":["10.0.2.1"]}]}]}`,
+	})
+
+	tests := []struct {
+		name    string
+		service string
+		port    int
+		want    []discoveredTarget
+		wantErr string
+	}{
+		{
+			name: "target port of a named port", service: "backend", port: 80,
+			want: []discoveredTarget{{host: "10.0.0.1", port: 8080}, {host: "10.0.0.3", port: 8080}},
+		},
+		{
+			name: "slices with different ports", service: "backend", port: 9090,
+			want: []discoveredTarget{{host: "10.0.0.1", port: 9100}, {host: "10.0.0.3", port: 9100}, {host: "10.0.1.1", port: 9101}},
+		},
+		{
+			name: "only port, unnamed", service: "single",
+			want: []discoveredTarget{{host: "10.0.2.1", port: 8081}},
+		},
+		{name: "ambiguous port", service: "backend", wantErr: "has 2 ports"},
+		{name: "unknown port", service: "backend", port: 81, wantErr: "has no port 81"},
+		{name: "unknown service", service: "missing", port: 80, wantErr: "404"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := k.serviceEndpoints(test.service, test.port)(context.Background())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("targets %v, want %v", got, test.want)
+			}
+		})
+	}
+	if (*selectors)[0] != "kubernetes.io/service-name=backend" {
+		t.Errorf("listed EndpointSlices with selector %q", (*selectors)[0])
+	}
+}
+
+func TestLookupDNS(t *testing.T) {
+	resolver := fakeDNS{
+		a: map[string][]string{
+			"backend.ns.svc.": {"10.0.0.1", "10.0.0.2"},
+			"web.ns.svc.":     {"10.96.0.10"},
+			"db.ns.svc.":      {"10.0.3.1"},
+			"external.test.":  {"192.0.2.1"},
+		},
+		srv: map[string][]net.SRV{
+			"_http._tcp.backend.ns.svc.": {
+				{Target: "backend-0.backend.ns.svc.", Port: 8080},
+				{Target: "backend-1.backend.ns.svc.", Port: 8080},
+			},
+		},
+		cname: map[string]string{"mail.ns.svc.": "external.test."},
+		ptr: map[string][]string{
+			"10.0.96.10.in-addr.arpa.": {"web.ns.svc.cluster.local."},
+			"1.3.0.10.in-addr.arpa.":   {"10-0-3-1.db.ns.svc.cluster.local."},
+		},
+	}.resolver(t)
+
+	tests := []struct {
+		name    string
+		lookup  func(ctx context.Context) ([]discoveredTarget, error)
+		want    []discoveredTarget
+		wantErr bool
+	}{
+		{
+			name:   "A records",
+			lookup: lookupDNS(resolver, "backend.ns.svc"),
+			want:   []discoveredTarget{{host: "10.0.0.1"}, {host: "10.0.0.2"}},
+		},
+		{
+			name:   "SRV records",
+			lookup: lookupDNS(resolver, "_http._tcp.backend.ns.svc"),
+			want:   []discoveredTarget{{host: "backend-0.backend.ns.svc", port: 8080}, {host: "backend-1.backend.ns.svc", port: 8080}},
+		},
+		{
+			name:   "pod IPs",
+			lookup: lookupPodIPs(resolver, "db.ns.svc"),
+			want:   []discoveredTarget{{host: "10.0.3.1"}},
+		},
+		{
+			name:   "pod IPs find a ClusterIP",
+			lookup: lookupPodIPs(resolver, "web.ns.svc"),
+			want:   []discoveredTarget{{host: "10.96.0.10", addressing: "service"}},
+		},
+		{
+			name:   "CNAME",
+			lookup: lookupCNAME(resolver, "mail.ns.svc"),
+			want:   []discoveredTarget{{host: "external.test"}},
+		},
+		{name: "no CNAME", lookup: lookupCNAME(resolver, "web.ns.svc"), wantErr: true},
+		{name: "unknown name", lookup: lookupDNS(resolver, "missing.ns.svc"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := test.lookup(ctx)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("found %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("targets %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddressingModes(t *testing.T) {
+	resolver := fakeDNS{
+		a: map[string][]string{
+			"web.ns.svc.":      {"10.96.0.10"},
+			"pods.ns.svc.":     {"10.0.0.1", "10.0.0.2"},
+			"one-pod.ns.svc.":  {"10.0.0.3"},
+			"unnamed.ns.svc.":  {"10.96.0.11"},
+			"headless.ns.svc.": {"10.0.1.1", "10.0.1.2"},
+		},
+		ptr: map[string][]string{
+			"10.0.96.10.in-addr.arpa.": {"web.ns.svc.cluster.local."},
+			"3.0.0.10.in-addr.arpa.":   {"10-0-0-3.one-pod.ns.svc.cluster.local."},
+		},
+	}.resolver(t)
+	k, _ := newFakeKubernetes(t, map[string]string{
+		"/api/v1/namespaces/ns/services/web":      `{"spec":{"type":"NodePort","clusterIP":"10.96.0.10","ports":[{"port":80,"nodePort":30080},{"port":443,"nodePort":30443}]}}`,
+		"/api/v1/namespaces/ns/services/headless": `{"spec":{"type":"ClusterIP","clusterIP":"None","ports":[{"port":80}]}}`,
+		"/api/v1/namespaces/ns/services/mail":     `{"spec":{"type":"ExternalName","externalName":"mail.example.com"}}`,
+		"/api/v1/nodes": `{"items":[
+			{"status":{"addresses":[{"type":"Hostname","address":"node-a"},{"type":"InternalIP","address":"192.168.0.1"}]}},
+			{"status":{"addresses":[{"type":"InternalIP","address":"192.168.0.2"}]}}]}`,
+	})
+	k.resolver = resolver
+
+	tests := []struct {
+		name       string
+		addressing string
+		lookup     func(ctx context.Context) ([]discoveredTarget, error)
+		want       []discoveredTarget
+		wantMode   string
+		wantErr    string
+	}{
+		{
+			name:       "api cluster-ip",
+			addressing: "cluster-ip",
+			lookup:     k.clusterIP("web"),
+			want:       []discoveredTarget{{host: "10.96.0.10"}},
+			wantMode:   "cluster-ip",
+		},
+		{name: "api cluster-ip of a headless service", addressing: "cluster-ip", lookup: k.clusterIP("headless"), wantErr: "is headless"},
+		{
+			name:       "api headless",
+			addressing: "headless",
+			lookup:     k.headless("headless"),
+			want:       []discoveredTarget{{host: "10.0.1.1"}, {host: "10.0.1.2"}},
+			wantMode:   "headless",
+		},
+		{name: "api headless of a service with a ClusterIP", addressing: "headless", lookup: k.headless("web"), wantErr: "is not headless"},
+		{
+			name:       "api node-port",
+			addressing: "node-port",
+			lookup:     k.nodePorts("web", 443),
+			want:       []discoveredTarget{{host: "192.168.0.1", port: 30443}, {host: "192.168.0.2", port: 30443}},
+			wantMode:   "node-port",
+		},
+		{name: "api node-port of a service without one", addressing: "node-port", lookup: k.nodePorts("headless", 80), wantErr: "no node port"},
+		{
+			name:       "api external-name",
+			addressing: "external-name",
+			lookup:     k.externalName("mail"),
+			want:       []discoveredTarget{{host: "mail.example.com"}},
+			wantMode:   "external-name",
+		},
+		{name: "api external-name of another service", addressing: "external-name", lookup: k.externalName("web"), wantErr: "not an ExternalName"},
+		{
+			name:       "dns cluster-ip",
+			addressing: "cluster-ip",
+			lookup:     lookupClusterIP(resolver, "web.ns.svc"),
+			want:       []discoveredTarget{{host: "10.96.0.10"}},
+			wantMode:   "cluster-ip",
+		},
+		{
+			name:       "dns cluster-ip without a reverse record",
+			addressing: "cluster-ip",
+			lookup:     lookupClusterIP(resolver, "unnamed.ns.svc"),
+			want:       []discoveredTarget{{host: "10.96.0.11"}},
+			wantMode:   "cluster-ip",
+		},
+		{
+			name:       "dns cluster-ip of a headless service",
+			addressing: "cluster-ip",
+			lookup:     lookupClusterIP(resolver, "pods.ns.svc"),
+			want:       []discoveredTarget{{host: "10.0.0.1", addressing: "pod-ip"}, {host: "10.0.0.2", addressing: "pod-ip"}},
+			wantMode:   "pod-ip",
+		},
+		{
+			name:       "dns cluster-ip of a headless service with one pod",
+			addressing: "cluster-ip",
+			lookup:     lookupClusterIP(resolver, "one-pod.ns.svc"),
+			want:       []discoveredTarget{{host: "10.0.0.3", addressing: "pod-ip"}},
+			wantMode:   "pod-ip",
+		},
+		{
+			name:       "dns pod-ip of a service with a ClusterIP",
+			addressing: "pod-ip",
+			lookup:     lookupPodIPs(resolver, "web.ns.svc"),
+			want:       []discoveredTarget{{host: "10.96.0.10", addressing: "service"}},
+			wantMode:   "service",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := test.lookup(ctx)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("found %v, error %v, want one containing %q", got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("targets %v, want %v", got, test.want)
+			}
+
+			// The discovery reports the addressing the lookup found
+			d := &targetDiscovery{
+				config:  DiscoveryConfig{Addressing: test.addressing},
+				lookup:  test.lookup,
+				targets: prometheus.NewGauge(prometheus.GaugeOpts{Name: "discovered_targets"}),
+			}
+			d.refresh()
+			if d.mode() != test.wantMode {
+				t.Errorf("discovery reports %s addressing, want %s", d.mode(), test.wantMode)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "test-communicator/proto"
+)
+
+// DownstreamCall is one dependency called for every inbound call-target
+// request. The URL scheme selects the protocol: http/https call the URL as
+// given, grpc calls Health and tcp sends a health request.
+//
+// With Addressing set, the URL host names a Service rather than an address:
+// "name" or "name.namespace" for kubernetes discovery, a DNS name for dns
+// discovery. Every call goes to the next address found for that mode.
+type DownstreamCall struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Timeout    string     `json:"timeout"`    // Go duration per attempt, defaults to CALL_TIMEOUT
+	Retry      *retrySpec `json:"retry"`      // Overrides of the default retry policy
+	Addressing string     `json:"addressing"` // "pod-ip", "cluster-ip", "node-port", "headless", or "external-name"
+	Discovery  string     `json:"discovery"`  // "kubernetes" (default) or "dns", with Addressing
+
+	HTTPClient *httpClientSpec `json:"http_client"` // Overrides of the default HTTP client policy, for http and https URLs
+
+	target     *url.URL
+	policy     RetryPolicy
+	httpPolicy HTTPClientPolicy
+	discovery  *targetDiscovery
+}
+
+type CallResult struct {
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	Addressing string `json:"addressing"`
+	Status     string `json:"status"` // "ok", "error", "cancelled", "circuit-open", or "skipped"
+	StatusCode int    `json:"status_code,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Response   string `json:"response,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type FanOutResponse struct {
+	Message       string       `json:"message"`
+	Service       string       `json:"service"`
+	Mode          string       `json:"mode"`
+	FailurePolicy string       `json:"failure_policy"`
+	Calls         []CallResult `json:"calls"`
+	Succeeded     int          `json:"succeeded"`
+	Failed        int          `json:"failed"`
+	Timestamp     string       `json:"timestamp"`
+}
+
+// parseDownstreamCalls decodes the CALL_TARGETS JSON array. The call timeout
+// becomes the attempt timeout of the call's retry policy unless the retry
+// override sets one.
+func parseDownstreamCalls(value string, defaultTimeout time.Duration, defaultPolicy RetryPolicy, defaultClient HTTPClientPolicy) ([]DownstreamCall, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var calls []DownstreamCall
+	if err := json.Unmarshal([]byte(value), &calls); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	for i := range calls {
+		call := &calls[i]
+		target, err := url.Parse(call.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for call %d: %v", i, err)
+		}
+		switch target.Scheme {
+		case "http", "https", "grpc", "tcp":
+		default:
+			return nil, fmt.Errorf("unsupported scheme %q for call %d", target.Scheme, i)
+		}
+		call.target = target
+
+		call.policy = defaultPolicy
+		call.policy.AttemptTimeout = defaultTimeout
+		if call.Timeout != "" {
+			if call.policy.AttemptTimeout, err = time.ParseDuration(call.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout for call %d: %v", i, err)
+			}
+		}
+		if call.policy, err = call.Retry.apply(call.policy); err != nil {
+			return nil, fmt.Errorf("invalid retry policy for call %d: %v", i, err)
+		}
+		if call.policy.AttemptTimeout <= 0 && call.policy.Deadline <= 0 {
+			return nil, fmt.Errorf("call %d needs a timeout or a retry deadline, or it is never bounded", i)
+		}
+		if call.httpPolicy, err = call.HTTPClient.apply(defaultClient); err != nil {
+			return nil, fmt.Errorf("invalid HTTP client policy for call %d: %v", i, err)
+		}
+		if call.Name == "" {
+			call.Name = target.Host
+		}
+
+		if call.Addressing != "" {
+			if !slices.Contains(addressingModes, call.Addressing) {
+				return nil, fmt.Errorf("unknown addressing %q for call %d", call.Addressing, i)
+			}
+			if target.Port() == "" {
+				return nil, fmt.Errorf("call %d with addressing needs a port in its URL", i)
+			}
+			switch call.Discovery {
+			case "":
+				call.Discovery = "kubernetes"
+			case "kubernetes", "dns":
+			default:
+				return nil, fmt.Errorf("unknown discovery %q for call %d", call.Discovery, i)
+			}
+		}
+	}
+
+	return calls, nil
+}
+
+// fanOut runs the configured downstream calls and reports whether the
+// aggregated result counts as a success under the failure policy:
+// "all" needs every call to succeed and stops at the first failure, "any"
+// needs one success and "best-effort" always succeeds.
+func (a *App) fanOut(ctx context.Context) (FanOutResponse, bool) {
+	calls := a.config.CallTargets
+	results := make([]CallResult, len(calls))
+	failFast := a.config.CallFailurePolicy == "all"
+
+	if a.config.CallMode == "sequential" {
+		for i, call := range calls {
+			results[i] = a.executeCall(ctx, call)
+			if failFast && results[i].Status != "ok" {
+				for j := i + 1; j < len(calls); j++ {
+					results[j] = CallResult{Name: calls[j].Name, Target: calls[j].URL, Status: "skipped"}
+				}
+				break
+			}
+		}
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for i, call := range calls {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = a.executeCall(ctx, call)
+				if failFast && results[i].Status != "ok" {
+					cancel()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	response := FanOutResponse{
+		Service:       a.config.ServiceName,
+		Mode:          a.config.CallMode,
+		FailurePolicy: a.config.CallFailurePolicy,
+		Calls:         results,
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, result := range results {
+		if result.Status == "ok" {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+
+	var ok bool
+	switch a.config.CallFailurePolicy {
+	case "any":
+		ok = response.Succeeded > 0
+	case "best-effort":
+		ok = true
+	default:
+		ok = response.Failed == 0
+	}
+
+	if ok {
+		response.Message = fmt.Sprintf("Called %d target services", len(calls))
+	} else {
+		response.Message = fmt.Sprintf("%d of %d target calls failed", response.Failed, len(calls))
+	}
+	return response, ok
+}
+
+// callValue is what a downstream call returns, whatever its protocol.
+type callValue struct {
+	statusCode int
+	response   string
+}
+
+// discoveryConfig returns the discovery settings for a call with an
+// addressing mode.
+func (call *DownstreamCall) discoveryConfig(defaults DiscoveryConfig) DiscoveryConfig {
+	port, _ := strconv.Atoi(call.target.Port())
+	config := DiscoveryConfig{
+		Mode:       call.Discovery,
+		Service:    call.target.Hostname(),
+		Namespace:  defaults.Namespace,
+		Addressing: call.Addressing,
+		Policy:     "round-robin",
+		Port:       port,
+		Refresh:    defaults.Refresh,
+	}
+	// "name.namespace", optionally followed by ".svc" and the cluster domain
+	if parts := strings.Split(config.Service, "."); len(parts) > 1 && config.Mode == "kubernetes" {
+		config.Service, config.Namespace = parts[0], parts[1]
+	}
+	return config
+}
+
+func (a *App) executeCall(ctx context.Context, call DownstreamCall) CallResult {
+	display := redactUserinfo(call.URL)
+	result := CallResult{Name: call.Name, Target: display, Addressing: cmp.Or(call.Addressing, "static")}
+	started := time.Now()
+
+	// Resolve the Service to an address for the addressing mode
+	target := *call.target
+	if call.discovery != nil {
+		picked := call.discovery.pick()
+		if len(picked) == 0 {
+			result.Status, result.Error = "error", "no addresses discovered for "+call.discovery.String()
+			log.Printf("Downstream call %s to %s failed: %s", call.Name, display, result.Error)
+			return result
+		}
+		target.Host = net.JoinHostPort(picked[0].host, strconv.Itoa(cmp.Or(picked[0].port, call.discovery.config.Port)))
+		result.Target = redactUserinfo(target.String())
+		result.Addressing = cmp.Or(picked[0].addressing, call.Addressing)
+	}
+
+	value, err := callWithPolicy(ctx, a.resilience, call.Name, call.policy, func(ctx context.Context) (callValue, string, error) {
+		switch call.target.Scheme {
+		case "grpc":
+			response, err := callGRPC(ctx, target.Host)
+			return callValue{response: response}, grpcOutcome(ctx, err), err
+		case "tcp":
+			response, err := a.callTCP(ctx, target.Host)
+			return callValue{response: response}, "", err
+		default:
+			resp, outcome, err := a.httpClients.edge("call "+call.Name, call.httpPolicy).fetch(ctx, target.String())
+			return callValue{statusCode: resp.status, response: string(resp.body)}, outcome, err
+		}
+	})
+	result.StatusCode, result.Response = value.statusCode, value.response
+	result.DurationMs = time.Since(started).Milliseconds()
+
+	switch {
+	case err == nil:
+		result.Status = "ok"
+	case ctx.Err() == context.Canceled:
+		result.Status = "cancelled"
+		result.Error = err.Error()
+	case errors.Is(err, errCircuitOpen):
+		result.Status = "circuit-open"
+		result.Error = err.Error()
+	default:
+		result.Status = "error"
+		result.Error = err.Error()
+	}
+
+	if call.discovery != nil {
+		log.Printf("Downstream call %s to %s (%s addressing, %s) finished: %s in %dms", call.Name, display, result.Addressing, result.Target, result.Status, result.DurationMs)
+	} else {
+		log.Printf("Downstream call %s to %s (static addressing) finished: %s in %dms", call.Name, display, result.Status, result.DurationMs)
+	}
+	return result
+}
+
+func callGRPC(ctx context.Context, address string) (string, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	spanFromContext(ctx).inject(func(key, value string) { ctx = metadata.AppendToOutgoingContext(ctx, key, value) })
+	resp, err := pb.NewTestCommunicatorClient(conn).Health(ctx, &pb.HealthRequest{})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`{"status":"%s","service":"%s","timestamp":"%s"}`, resp.Status, resp.Service, resp.Timestamp), nil
+}
+
+// callTCP sends one request to a TCP target with the configured framing.
+func (a *App) callTCP(ctx context.Context, address string) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// A stream has no request; the server's summary is the response
+	if a.config.TCPFraming == "stream" {
+		return streamTCP(conn, a.config.TCPStreamBytes)
+	}
+	framer, err := newTCPFramer(a.config.TCPFraming, a.config.TCPRecordSize)
+	if err != nil {
+		return "", err
+	}
+
+	if err := framer.writeFrame(conn, []byte("health")); err != nil {
+		return "", err
+	}
+	response, err := framer.readFrame(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	// Targets answer after 50ms, /fail with a 500 after 100ms and /slow
+	// after 400ms
+	var mu sync.Mutex
+	received := map[string]int{}
+	inflight, maxInflight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.URL.Path]++
+		inflight++
+		maxInflight = max(maxInflight, inflight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}()
+
+		delay := 50 * time.Millisecond
+		switch r.URL.Path {
+		case "/fail":
+			delay = 100 * time.Millisecond
+		case "/slow":
+			delay = 400 * time.Millisecond
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		mode        string
+		policy      string
+		paths       []string
+		want        []string // Status of every call
+		wantCalled  map[string]int
+		wantOK      bool
+		parallelism int
+	}{
+		{
+			name: "parallel calls everything at once", mode: "parallel", policy: "all",
+			paths:       []string{"/a", "/b", "/c"},
+			want:        []string{"ok", "ok", "ok"},
+			wantCalled:  map[string]int{"/a": 1, "/b": 1, "/c": 1},
+			wantOK:      true,
+			parallelism: 3,
+		},
+		{
+			name: "sequential calls one at a time", mode: "sequential", policy: "all",
+			paths:       []string{"/a", "/b", "/c"},
+			want:        []string{"ok", "ok", "ok"},
+			wantCalled:  map[string]int{"/a": 1, "/b": 1, "/c": 1},
+			wantOK:      true,
+			parallelism: 1,
+		},
+		{
+			name: "parallel all cancels the others on failure", mode: "parallel", policy: "all",
+			paths:       []string{"/a", "/fail", "/slow"},
+			want:        []string{"ok", "error", "cancelled"},
+			wantCalled:  map[string]int{"/a": 1, "/fail": 1, "/slow": 1},
+			parallelism: 3,
+		},
+		{
+			name: "sequential all skips the rest on failure", mode: "sequential", policy: "all",
+			paths:       []string{"/a", "/fail", "/slow"},
+			want:        []string{"ok", "error", "skipped"},
+			wantCalled:  map[string]int{"/a": 1, "/fail": 1},
+			parallelism: 1,
+		},
+		{
+			name: "any needs one success", mode: "parallel", policy: "any",
+			paths:       []string{"/fail", "/slow"},
+			want:        []string{"error", "ok"},
+			wantCalled:  map[string]int{"/fail": 1, "/slow": 1},
+			wantOK:      true,
+			parallelism: 2,
+		},
+		{
+			name: "any fails without a success", mode: "sequential", policy: "any",
+			paths:       []string{"/fail", "/fail"},
+			want:        []string{"error", "error"},
+			wantCalled:  map[string]int{"/fail": 2},
+			parallelism: 1,
+		},
+		{
+			name: "best-effort always succeeds", mode: "sequential", policy: "best-effort",
+			paths:       []string{"/fail", "/a"},
+			want:        []string{"error", "ok"},
+			wantCalled:  map[string]int{"/fail": 1, "/a": 1},
+			wantOK:      true,
+			parallelism: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mu.Lock()
+			received, maxInflight = map[string]int{}, 0
+			mu.Unlock()
+
+			var targets []string
+			for i, path := range test.paths {
+				targets = append(targets, fmt.Sprintf(`{"name":"call%d","url":"%s%s"}`, i, server.URL, path))
+			}
+			config := defaultConfig()
+			config.CallMode, config.CallFailurePolicy = test.mode, test.policy
+			calls, err := parseDownstreamCalls("["+strings.Join(targets, ",")+"]", time.Second, RetryPolicy{MaxAttempts: 1}, config.HTTPClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.CallTargets = calls
+			response, ok := newTestApp(config).fanOut(context.Background())
+
+			var statuses []string
+			for _, result := range response.Calls {
+				statuses = append(statuses, result.Status)
+			}
+			if !reflect.DeepEqual(statuses, test.want) || ok != test.wantOK {
+				t.Errorf("statuses %v, ok %t, want %v, %t", statuses, ok, test.want, test.wantOK)
+			}
+			succeeded := strings.Count(strings.Join(test.want, " "), "ok")
+			if response.Succeeded != succeeded || response.Failed != len(test.want)-succeeded {
+				t.Errorf("%d succeeded and %d failed, want %d and %d", response.Succeeded, response.Failed, succeeded, len(test.want)-succeeded)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(received, test.wantCalled) {
+				t.Errorf("targets received %v, want %v", received, test.wantCalled)
+			}
+			if maxInflight != test.parallelism {
+				t.Errorf("%d calls in flight at once, want %d", maxInflight, test.parallelism)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flow is one edge of a traffic matrix spanning namespaces: a periodic GET
+// of URL. Every request is tagged with the flow name and the source
+// namespace in its headers, and both ends log and count it with the flow
+// name and the namespaces at either end.
+type Flow struct {
+	Name                 string          `json:"name"`
+	URL                  string          `json:"url"`
+	DestinationNamespace string          `json:"destination_namespace"` // Derived from the URL host when omitted
+	HTTPClient           *httpClientSpec `json:"http_client"`           // Overrides of the default HTTP client policy
+
+	host       string
+	httpPolicy HTTPClientPolicy
+}
+
+// Headers that tag the requests of a flow
+const (
+	flowHeader          = "X-Flow"
+	flowNamespaceHeader = "X-Flow-Source-Namespace"
+)
+
+// externalNamespace is the destination namespace of hosts outside the
+// cluster.
+const externalNamespace = "external"
+
+// parseFlows decodes the FLOWS JSON array. namespaces are the namespaces
+// known to exist besides the explicit destinations of the flows.
+func parseFlows(value string, defaultClient HTTPClientPolicy, namespaces ...string) ([]Flow, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var flows []Flow
+	if err := json.Unmarshal([]byte(value), &flows); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	for _, flow := range flows {
+		namespaces = append(namespaces, flow.DestinationNamespace)
+	}
+	known := make(map[string]bool)
+	for _, namespace := range namespaces {
+		if namespace != "" && namespace != externalNamespace {
+			known[namespace] = true
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range flows {
+		flow := &flows[i]
+		if flow.Name == "" {
+			return nil, fmt.Errorf("flow %d needs a name", i)
+		}
+		if names[flow.Name] {
+			return nil, fmt.Errorf("duplicate flow name %q", flow.Name)
+		}
+		names[flow.Name] = true
+
+		target, err := url.Parse(flow.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("flow %s needs an http or https URL, got %q", flow.Name, redactUserinfo(flow.URL))
+		}
+		if flow.DestinationNamespace == "" {
+			flow.DestinationNamespace = hostNamespace(target.Hostname(), known)
+		}
+		flow.host = target.Host
+		if flow.httpPolicy, err = flow.HTTPClient.apply(defaultClient); err != nil {
+			return nil, fmt.Errorf("invalid HTTP client policy for flow %s: %v", flow.Name, err)
+		}
+	}
+
+	return flows, nil
+}
+
+// hostNamespace derives the namespace of a Service from its host name: a
+// bare "name" is in the pod's own namespace, returned as "", and
+// "name.namespace.svc" and longer forms ending in .svc.cluster.local are in
+// namespace. "name.namespace" is only taken for a Service when namespace is
+// known, since it looks just like a public domain. Any other host, IP
+// addresses included, is external.
+func hostNamespace(host string, known map[string]bool) string {
+	if net.ParseIP(host) != nil {
+		return externalNamespace
+	}
+	parts := strings.Split(strings.TrimSuffix(host, "."), ".")
+	switch {
+	case len(parts) == 1:
+		return ""
+	case len(parts) == 3 && parts[2] == "svc", len(parts) == 5 && strings.Join(parts[2:], ".") == "svc.cluster.local":
+		return parts[1]
+	case len(parts) == 2 && known[parts[1]]:
+		return parts[1]
+	}
+	return externalNamespace
+}
+
+type flowTag struct {
+	name      string
+	namespace string
+}
+
+type flowKey struct{}
+
+// injectFlow adds the flow headers to header when ctx belongs to a flow.
+func injectFlow(ctx context.Context, header http.Header) {
+	if tag, ok := ctx.Value(flowKey{}).(flowTag); ok {
+		header.Set(flowHeader, tag.name)
+		header.Set(flowNamespaceHeader, tag.namespace)
+	}
+}
+
+// makeFlowRequest sends one request of flow. Tests can match the "Flow
+// <name> from <source> to <destination>" log line or
+// flow_requests_total.
+func (a *App) makeFlowRequest(flow Flow) {
+	source := a.config.Namespace
+	destination := cmp.Or(flow.DestinationNamespace, source)
+
+	ctx := context.WithValue(context.Background(), flowKey{}, flowTag{flow.Name, source})
+	ctx, span := a.tracer.start(ctx, "GET", "client", nil)
+	span.setAttribute("http.request.method", "GET")
+	span.setAttribute("url.full", redactUserinfo(flow.URL))
+	started := time.Now()
+	resp, err := a.fetchHTTPWith(ctx, a.httpClients.edge("flow "+flow.Name, flow.httpPolicy), flow.host, flow.URL, a.config.Retry)
+	duration := time.Since(started).Milliseconds()
+	if resp.status != 0 {
+		span.setAttribute("http.response.status_code", strconv.Itoa(resp.status))
+	}
+	if err != nil {
+		span.finish(err.Error())
+	} else {
+		span.finish("")
+	}
+
+	if resp.status == 0 {
+		a.flowRequests.WithLabelValues(flow.Name, source, destination, "error").Inc()
+		log.Printf("Flow %s from %s to %s (%s) failed after %dms: %v", flow.Name, source, destination, redactUserinfo(flow.URL), duration, err)
+		return
+	}
+	a.flowRequests.WithLabelValues(flow.Name, source, destination, strconv.Itoa(resp.status)).Inc()
+	log.Printf("Flow %s from %s to %s (%s): status %d in %dms", flow.Name, source, destination, redactUserinfo(flow.URL), resp.status, duration)
+}
+
+// receiveFlow logs and counts an inbound request tagged with a flow.
+func (a *App) receiveFlow(r *http.Request) {
+	name := r.Header.Get(flowHeader)
+	if name == "" {
+		return
+	}
+	source := cmp.Or(r.Header.Get(flowNamespaceHeader), "unknown")
+	a.flowsReceived.WithLabelValues(name, source, a.config.Namespace).Inc()
+	log.Printf("Flow %s received from %s in %s: %s %s from %s", name, source, a.config.Namespace, r.Method, r.URL.Path, r.RemoteAddr)
+}
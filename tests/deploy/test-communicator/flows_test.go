@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestApp returns an App with config and the HTTP clients, resilience and
+// flow metrics of NewApp, registered nowhere, so tests can make several.
+func newTestApp(config Config) *App {
+	counter := func(name string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, labels)
+	}
+	app := &App{
+		config:   config,
+		random:   newSeededRand("test", "test"),
+		tcpPool:  &tcpClientPool{size: config.TCPPoolSize, idleTimeout: config.TCPIdleTimeout},
+		tcpConns: newConnTracker(),
+		stopCh:   make(chan struct{}),
+	}
+	app.httpClients = newHTTPClients(counter("http_client_connections_total", "target", "state"))
+	app.flowRequests = counter("flow_requests_total", "flow", "source_namespace", "destination_namespace", "outcome")
+	app.flowsReceived = counter("flow_requests_received_total", "flow", "source_namespace", "destination_namespace")
+	breakerState := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "circuit_breaker_state"}, []string{"target"})
+	app.exemplarRandom = app.random.stream("exemplars")
+	app.resilience = newOutboundResilience(config.Breaker, app.random.stream("resilience"),
+		counter("outbound_attempts_total", "target", "kind", "outcome"), breakerState,
+		counter("circuit_breaker_transitions_total", "target", "from", "to"))
+	return app
+}
+
+// counterValue returns the value of a counter.
+func counterValue(c prometheus.Counter) float64 {
+	var metric dto.Metric
+	c.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestHostNamespace(t *testing.T) {
+	known := map[string]bool{"ns": true, "shop": true}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"svc", ""},
+		{"svc.ns", "ns"},
+		{"svc.ns.svc", "ns"},
+		{"svc.ns.svc.cluster.local", "ns"},
+		{"svc.ns.svc.cluster.local.", "ns"},
+		{"svc.other", externalNamespace},
+		{"svc.other.svc", "other"},
+		{"example.com", externalNamespace},
+		{"www.example.com", externalNamespace},
+		{"www.example.svc.com", externalNamespace},
+		{"10.0.0.1", externalNamespace},
+		{"::1", externalNamespace},
+	}
+	for _, test := range tests {
+		if got := hostNamespace(test.host, known); got != test.want {
+			t.Errorf("hostNamespace(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestParseFlows(t *testing.T) {
+	flows, err := parseFlows(`[
+		{"name":"local","url":"http://web:8080/"},
+		{"name":"fqdn","url":"http://web.shop.svc.cluster.local:8080/health"},
+		{"name":"short","url":"http://web.shop/"},
+		{"name":"pod","url":"http://web.pods/"},
+		{"name":"explicit","url":"http://web.billing/","destination_namespace":"billing"},
+		{"name":"sibling","url":"https://api.billing/"},
+		{"name":"external","url":"http://example.com/"},
+		{"name":"tagged","url":"http://example.com/","destination_namespace":"external"}
+	]`, HTTPClientPolicy{Connection: "pool"}, "pods", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]string{
+		"local":    {"", "web:8080"},
+		"fqdn":     {"shop", "web.shop.svc.cluster.local:8080"},
+		"short":    {externalNamespace, "web.shop"},
+		"pod":      {"pods", "web.pods"},
+		"explicit": {"billing", "web.billing"},
+		"sibling":  {"billing", "api.billing"},
+		"external": {externalNamespace, "example.com"},
+		"tagged":   {externalNamespace, "example.com"},
+	}
+	for _, flow := range flows {
+		if got := [2]string{flow.DestinationNamespace, flow.host}; got != want[flow.Name] {
+			t.Errorf("flow %s: destination and host %q, want %q", flow.Name, got, want[flow.Name])
+		}
+		if flow.httpPolicy.Connection != "pool" {
+			t.Errorf("flow %s: connection policy %q, want the default", flow.Name, flow.httpPolicy.Connection)
+		}
+	}
+
+	for _, value := range []string{
+		`{`,
+		`[{"url":"http://a/"}]`,
+		`[{"name":"a","url":"http://a/"},{"name":"a","url":"http://b/"}]`,
+		`[{"name":"a","url":"ftp://a/"}]`,
+		`[{"name":"a","url":"http:///path"}]`,
+		`[{"name":"a","url":"http://a/","http_client":{"idle_conn_timeout":"soon"}}]`,
+	} {
+		if _, err := parseFlows(value, HTTPClientPolicy{}); err == nil {
+			t.Errorf("parseFlows(%s) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestFlowRequest(t *testing.T) {
+	receiver := newTestApp(Config{Namespace: "included"})
+	var mu sync.Mutex
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.receiveFlow(r)
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	config := defaultConfig()
+	config.Namespace = "ignored"
+	flows, err := parseFlows(`[
+		{"name":"to-included","url":"`+server.URL+`/health","destination_namespace":"included"},
+		{"name":"to-missing","url":"`+server.URL+`/missing"},
+		{"name":"to-nowhere","url":"`+closed.URL+`/"}
+	]`, config.HTTPClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestApp(config)
+	for _, flow := range flows {
+		sender.makeFlowRequest(flow)
+	}
+
+	if len(headers) != 2 {
+		t.Fatalf("server received %d requests, want 2", len(headers))
+	}
+	for i, name := range []string{"to-included", "to-missing"} {
+		if headers[i].Get(flowHeader) != name || headers[i].Get(flowNamespaceHeader) != "ignored" {
+			t.Errorf("request %d has flow headers %q and %q, want %s from ignored", i, headers[i].Get(flowHeader), headers[i].Get(flowNamespaceHeader), name)
+		}
+	}
+
+	sent := []struct {
+		flow, destination, outcome string
+	}{
+		{"to-included", "included", "200"},
+		{"to-missing", externalNamespace, "404"},
+		{"to-nowhere", externalNamespace, "error"},
+	}
+	for _, want := range sent {
+		if got := counterValue(sender.flowRequests.WithLabelValues(want.flow, "ignored", want.destination, want.outcome)); got != 1 {
+			t.Errorf("flow_requests_total{flow=%q,destination_namespace=%q,outcome=%q} = %g, want 1", want.flow, want.destination, want.outcome, got)
+		}
+	}
+	for _, flow := range []string{"to-included", "to-missing"} {
+		if got := counterValue(receiver.flowsReceived.WithLabelValues(flow, "ignored", "included")); got != 1 {
+			t.Errorf("flow_requests_received_total{flow=%q} = %g, want 1", flow, got)
+		}
+	}
+
+	// Untagged requests are not counted, and a missing source is "unknown"
+	receiver.receiveFlow(httptest.NewRequest(http.MethodGet, "/", nil))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(flowHeader, "anonymous")
+	receiver.receiveFlow(r)
+	if got := counterValue(receiver.flowsReceived.WithLabelValues("anonymous", "unknown", "included")); got != 1 {
+		t.Errorf("flow without a source counted %g times, want 1", got)
+	}
+}
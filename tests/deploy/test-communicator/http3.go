@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func (a *App) startHTTP3Server() error {
+	certificate, err := a.selfSignedCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate: %v", err)
+	}
+
+	a.http3Server = &http3.Server{
+		Addr:    fmt.Sprintf(":%d", a.config.Port),
+		Handler: a.router,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{certificate},
+		}),
+	}
+
+	// Start periodic client requests if target is configured
+	if a.hasURLTarget() {
+		go a.startPeriodicRequests()
+	}
+
+	go func() {
+		log.Printf("HTTP/3 server listening on :%d (UDP)", a.config.Port)
+		if err := a.http3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP/3 server failed to start: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// selfSignedCertificate creates a throwaway ECDSA certificate so the HTTP/3
+// server works offline. It is valid for the service name, the pod hostname,
+// localhost and the loopback addresses.
+func (a *App) selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	dnsNames := []string{a.config.ServiceName, "localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: a.config.ServiceName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newHTTP3Transport returns the client transport shared by all HTTP/3
+// edges, so QUIC connections are reused like those of the HTTP clients.
+// Targets use self-generated certificates, so there is nothing to verify
+// against.
+func newHTTP3Transport(policy HTTPClientPolicy) *http3.Transport {
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if policy.IdleConnTimeout > 0 {
+		transport.QUICConfig = &quic.Config{MaxIdleTimeout: policy.IdleConnTimeout}
+	}
+	return transport
+}
+
+// http3Edge returns the client of the named HTTP/3 edge, creating it with
+// policy on transport.
+func (c *httpClients) http3Edge(name string, policy HTTPClientPolicy, transport *http3.Transport) *httpEdgeClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := "http3 " + name
+	client, ok := c.edges[key]
+	if !ok {
+		client = &httpEdgeClient{policy: policy, client: &http.Client{Transport: transport}, connections: c.connections}
+		c.edges[key] = client
+	}
+	return client
+}
+
+func (a *App) makeHTTP3TargetRequest(target string) {
+	log.Printf("Making periodic HTTP/3 request to target: %s", target)
+
+	edge := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		edge = u.Host
+	}
+	ctx, span := a.tracer.start(context.Background(), "GET", "client", nil)
+	span.setAttribute("http.request.method", "GET")
+	span.setAttribute("url.full", target+"/health")
+	span.setAttribute("network.protocol.version", "3")
+	client := a.httpClients.http3Edge(edge, a.config.HTTPClient, a.http3Transport)
+	resp, err := a.fetchHTTPWith(ctx, client, edge, target+"/health", a.config.Retry)
+	if resp.status != 0 {
+		span.setAttribute("http.response.status_code", strconv.Itoa(resp.status))
+	}
+	if err != nil {
+		span.finish(err.Error())
+	} else {
+		span.finish("")
+	}
+	if err != nil && resp.status == 0 {
+		log.Printf("Error in periodic HTTP/3 request to target: %v", err)
+		return
+	}
+
+	log.Printf("Periodic HTTP/3 request successful - Status: %d, Response: %s", resp.status, resp.body)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3TargetRequest(t *testing.T) {
+	config := defaultConfig()
+	config.ServiceName, config.Protocol = "svc", "http3"
+	app := newTestApp(config)
+	app.tracer = newTestTracer(t, "otlp", "json", "http://localhost", "w3c")
+	app.http3Transport = newHTTP3Transport(config.HTTPClient)
+
+	certificate, err := app.selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var requests []*http.Request
+	server := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r)
+			mu.Unlock()
+			if r.URL.Path != "/health" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("ok"))
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{certificate}}),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	edge := conn.LocalAddr().String()
+	target := "https://" + edge
+	app.makeHTTP3TargetRequest(target)
+	app.makeHTTP3TargetRequest(target)
+
+	if len(requests) != 2 {
+		t.Fatalf("server received %d requests, want 2", len(requests))
+	}
+	for _, r := range requests {
+		if r.Proto != "HTTP/3.0" || r.URL.Path != "/health" {
+			t.Errorf("request %s %s, want HTTP/3.0 /health", r.Proto, r.URL.Path)
+		}
+		if !strings.HasPrefix(r.Header.Get("traceparent"), "00-") {
+			t.Errorf("request without trace context: %q", r.Header.Get("traceparent"))
+		}
+	}
+	if requests[0].RemoteAddr != requests[1].RemoteAddr {
+		t.Errorf("requests came from %s and %s, want one reused connection", requests[0].RemoteAddr, requests[1].RemoteAddr)
+	}
+	if got := counterValue(app.resilience.attempts.WithLabelValues(edge, "first", "200")); got != 2 {
+		t.Errorf("outbound_attempts_total{outcome=\"200\"} = %g, want 2", got)
+	}
+
+	// After Stop closes the transport, requests fail instead of dialing again
+	app.http3Transport.Close()
+	app.makeHTTP3TargetRequest(target)
+	if got := counterValue(app.resilience.attempts.WithLabelValues(edge, "first", "error")); got != 1 {
+		t.Errorf("outbound_attempts_total{outcome=\"error\"} = %g after closing the transport, want 1", got)
+	}
+	if len(requests) != 2 {
+		t.Errorf("server received %d requests after the transport was closed", len(requests))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HTTPClientPolicy controls how outbound HTTP requests on an edge open and
+// reuse connections, so flow counts can be predicted exactly.
+type HTTPClientPolicy struct {
+	// Connection is "pool" (keep-alive pool), "new" (a new connection for
+	// every request), "close" (keep-alive transport, but every request
+	// asks the server to close with Connection: close) or "pipeline"
+	// (HTTP/1.1 pipelining of up to PipelineDepth requests per connection).
+	Connection          string        `json:"connection"`
+	MaxIdleConns        int           `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `json:"max_conns_per_host"` // 0 means unlimited
+	IdleConnTimeout     time.Duration `json:"idle_conn_timeout"`
+	PipelineDepth       int           `json:"pipeline_depth"`
+	RequestsPerInterval int           `json:"requests_per_interval"` // Requests sent per periodic request
+	Concurrency         int           `json:"concurrency"`           // Requests in flight at once, queued beyond MaxConnsPerHost
+}
+
+// httpClientSpec overrides parts of the default HTTP client policy for one
+// edge. Unset fields keep the default.
+type httpClientSpec struct {
+	Connection          string `json:"connection"`
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     *int   `json:"max_conns_per_host"`
+	IdleConnTimeout     string `json:"idle_conn_timeout"`
+	PipelineDepth       int    `json:"pipeline_depth"`
+}
+
+func (s *httpClientSpec) apply(policy HTTPClientPolicy) (HTTPClientPolicy, error) {
+	if s == nil {
+		return policy, nil
+	}
+	if s.Connection != "" {
+		if !slices.Contains(httpConnectionPolicies, s.Connection) {
+			return policy, fmt.Errorf("unsupported HTTP connection policy %q", s.Connection)
+		}
+		policy.Connection = s.Connection
+	}
+	if s.MaxIdleConnsPerHost > 0 {
+		policy.MaxIdleConnsPerHost = s.MaxIdleConnsPerHost
+	}
+	if s.MaxConnsPerHost != nil {
+		if *s.MaxConnsPerHost < 0 {
+			return policy, fmt.Errorf("max_conns_per_host must not be negative")
+		}
+		policy.MaxConnsPerHost = *s.MaxConnsPerHost
+	}
+	if s.PipelineDepth < 0 {
+		return policy, fmt.Errorf("pipeline_depth must be positive")
+	}
+	if s.PipelineDepth > 0 {
+		policy.PipelineDepth = s.PipelineDepth
+	}
+	if s.IdleConnTimeout != "" {
+		timeout, err := time.ParseDuration(s.IdleConnTimeout)
+		if err != nil {
+			return policy, fmt.Errorf("invalid idle_conn_timeout: %v", err)
+		}
+		policy.IdleConnTimeout = timeout
+	}
+	return policy, nil
+}
+
+var httpConnectionPolicies = []string{"pool", "new", "close", "pipeline"}
+
+// httpClients keeps one client per edge, created on first use. Edges are
+// independent pools, so the connections of one edge never serve another
+// and each follows its own policy.
+type httpClients struct {
+	mu          sync.Mutex
+	edges       map[string]*httpEdgeClient
+	connections *prometheus.CounterVec
+}
+
+func newHTTPClients(connections *prometheus.CounterVec) *httpClients {
+	return &httpClients{edges: make(map[string]*httpEdgeClient), connections: connections}
+}
+
+// edge returns the client of the named edge, creating it with policy.
+func (c *httpClients) edge(name string, policy HTTPClientPolicy) *httpEdgeClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.edges[name]
+	if !ok {
+		client = newHTTPEdgeClient(policy, c.connections)
+		c.edges[name] = client
+	}
+	return client
+}
+
+func (c *httpClients) closeIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, client := range c.edges {
+		client.client.CloseIdleConnections()
+	}
+}
+
+// httpEdgeClient is the outbound HTTP client for one edge. It is shared
+// across requests so that connection reuse follows the policy rather than
+// depending on how many clients happen to be created.
+type httpEdgeClient struct {
+	policy      HTTPClientPolicy
+	client      *http.Client
+	connections *prometheus.CounterVec
+}
+
+func newHTTPEdgeClient(policy HTTPClientPolicy, connections *prometheus.CounterVec) *httpEdgeClient {
+	if policy.Connection == "pipeline" {
+		return &httpEdgeClient{
+			policy:      policy,
+			client:      &http.Client{Transport: newPipelineTransport(policy)},
+			connections: connections,
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        policy.MaxIdleConns,
+		MaxIdleConnsPerHost: policy.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     policy.MaxConnsPerHost,
+		IdleConnTimeout:     policy.IdleConnTimeout,
+	}
+
+	if policy.Connection == "new" {
+		transport.DisableKeepAlives = true
+	}
+
+	return &httpEdgeClient{
+		policy:      policy,
+		client:      &http.Client{Transport: transport}, // Deadlines come from the retry policy
+		connections: connections,
+	}
+}
+
+// get issues a GET request and records whether it used a new or a reused
+// connection.
+func (c *httpEdgeClient) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.policy.Connection == "close" {
+		req.Close = true
+	}
+	spanFromContext(ctx).inject(req.Header.Set)
+	injectFlow(ctx, req.Header)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state := "new"
+			if info.Reused {
+				state = "reused"
+			}
+			c.connections.WithLabelValues(req.URL.Host, state).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	return c.client.Do(req)
+}
+
+// httpResult is the response of an outbound HTTP request.
+type httpResult struct {
+	status int
+	body   []byte
+}
+
+// fetch makes one GET attempt and reads the whole body, so the attempt's
+// deadline covers the response as well. Statuses of 400 and above are
+// returned as errors alongside the response.
+func (c *httpEdgeClient) fetch(ctx context.Context, url string) (httpResult, string, error) {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return httpResult{}, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	result := httpResult{status: resp.StatusCode, body: body}
+	if err != nil {
+		return result, "", err
+	}
+
+	outcome := strconv.Itoa(resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		return result, outcome, fmt.Errorf("target returned status %d", resp.StatusCode)
+	}
+	return result, outcome, nil
+}
+
+// fetchHTTP calls target under policy, using the target's host as the edge
+// for its circuit breaker and its connections under the default HTTP
+// client policy.
+func (a *App) fetchHTTP(ctx context.Context, target string, policy RetryPolicy) (httpResult, error) {
+	edge := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		edge = u.Host
+	}
+	return a.fetchHTTPWith(ctx, a.httpClients.edge(edge, a.config.HTTPClient), edge, target, policy)
+}
+
+// fetchHTTPWith calls target under policy with client, counting the
+// attempts and tripping the breaker of edge.
+func (a *App) fetchHTTPWith(ctx context.Context, client *httpEdgeClient, edge, target string, policy RetryPolicy) (httpResult, error) {
+	return callWithPolicy(ctx, a.resilience, edge, policy, func(ctx context.Context) (httpResult, string, error) {
+		return client.fetch(ctx, target)
+	})
+}
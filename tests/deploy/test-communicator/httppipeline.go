@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// pipelineTransport sends HTTP/1.1 requests pipelined: a request is written
+// to a connection that still has responses outstanding, as long as fewer
+// than depth are. A new connection is opened only when every open one is
+// full, up to maxConns per host (0 for no limit); beyond that requests wait.
+// Responses come back in request order and are read whole, so the next
+// response on the connection is never held up by an unread body.
+type pipelineTransport struct {
+	depth       int
+	maxConns    int
+	maxIdle     int
+	idleTimeout time.Duration
+	dialer      *net.Dialer
+
+	mu      sync.Mutex
+	conns   map[string][]*pipelineConn // By scheme and host
+	dialing map[string]int
+	changed map[string]chan struct{} // Closed when a connection of the host frees up or goes away
+}
+
+type pipelineConn struct {
+	conn    net.Conn
+	key     string
+	writeMu sync.Mutex
+	pending chan *pipelineCall // Requests written and not yet answered, in order
+
+	// Guarded by pipelineTransport.mu
+	inflight int
+	used     time.Time
+	broken   bool
+}
+
+type pipelineCall struct {
+	req  *http.Request
+	done chan pipelineResult
+}
+
+type pipelineResult struct {
+	resp *http.Response
+	err  error
+}
+
+func newPipelineTransport(policy HTTPClientPolicy) *pipelineTransport {
+	return &pipelineTransport{
+		depth:       policy.PipelineDepth,
+		maxConns:    policy.MaxConnsPerHost,
+		maxIdle:     cmp.Or(policy.MaxIdleConnsPerHost, http.DefaultMaxIdleConnsPerHost),
+		idleTimeout: policy.IdleConnTimeout,
+		dialer:      &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+		conns:       make(map[string][]*pipelineConn),
+		dialing:     make(map[string]int),
+		changed:     make(map[string]chan struct{}),
+	}
+}
+
+func (t *pipelineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	key := req.URL.Scheme + "://" + host
+
+	pc, reused, err := t.acquire(ctx, key, req.URL.Scheme, host, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: pc.conn, Reused: reused})
+	}
+
+	call := &pipelineCall{req: req, done: make(chan pipelineResult, 1)}
+	pc.writeMu.Lock()
+	pc.pending <- call
+	writer := bufio.NewWriter(pc.conn)
+	if err := req.Write(writer); err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		// The reader fails this and every later request on the connection
+		pc.conn.Close()
+	}
+	pc.writeMu.Unlock()
+
+	select {
+	case result := <-call.done:
+		return result.resp, result.err
+	case <-ctx.Done():
+		// The reader still consumes the response to keep the order
+		return nil, ctx.Err()
+	}
+}
+
+// acquire reserves a request slot on a connection to key, opening one when
+// all are full and the limit allows, or waiting until one frees up.
+func (t *pipelineTransport) acquire(ctx context.Context, key, scheme, host, serverName string) (*pipelineConn, bool, error) {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		for _, pc := range t.conns[key] {
+			if pc.inflight == 0 && t.idleTimeout > 0 && now.Sub(pc.used) > t.idleTimeout {
+				t.retire(pc)
+			}
+		}
+		for _, pc := range t.conns[key] {
+			if pc.inflight < t.depth {
+				pc.inflight++
+				t.mu.Unlock()
+				return pc, true, nil
+			}
+		}
+
+		if t.maxConns == 0 || len(t.conns[key])+t.dialing[key] < t.maxConns {
+			t.dialing[key]++
+			t.mu.Unlock()
+			conn, err := t.dial(ctx, scheme, host, serverName)
+			t.mu.Lock()
+			t.dialing[key]--
+			if err != nil {
+				t.notify(key)
+				t.mu.Unlock()
+				return nil, false, err
+			}
+			pc := &pipelineConn{conn: conn, key: key, pending: make(chan *pipelineCall, t.depth), inflight: 1}
+			t.conns[key] = append(t.conns[key], pc)
+			t.mu.Unlock()
+			go t.readResponses(pc)
+			return pc, false, nil
+		}
+
+		changed, ok := t.changed[key]
+		if !ok {
+			changed = make(chan struct{})
+			t.changed[key] = changed
+		}
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+func (t *pipelineTransport) dial(ctx context.Context, scheme, host, serverName string) (net.Conn, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", host)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, NextProtos: []string{"http/1.1"}})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// readResponses answers the requests of pc in order. After an error or a
+// response that closes the connection, the requests still outstanding fail.
+func (t *pipelineTransport) readResponses(pc *pipelineConn) {
+	reader := bufio.NewReader(pc.conn)
+	for call := range pc.pending {
+		resp, err := http.ReadResponse(reader, call.req)
+		if err == nil {
+			var body []byte
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if err != nil {
+			resp = nil
+		}
+		call.done <- pipelineResult{resp, err}
+		t.release(pc, err != nil || resp.Close)
+	}
+}
+
+// release frees the request slot of a finished request, retiring the
+// connection when it broke or more connections are idle than are kept.
+func (t *pipelineTransport) release(pc *pipelineConn, broken bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pc.inflight--
+	pc.used = time.Now()
+	switch {
+	case broken && !pc.broken:
+		t.retire(pc)
+	case pc.broken && pc.inflight == 0:
+		close(pc.pending)
+	case pc.inflight == 0:
+		idle := 0
+		for _, other := range t.conns[pc.key] {
+			if other.inflight == 0 {
+				idle++
+			}
+		}
+		if idle > t.maxIdle {
+			t.retire(pc)
+		}
+	}
+	t.notify(pc.key)
+}
+
+// retire closes pc and takes it out of the pool. Its reader stops once the
+// requests still outstanding have failed.
+func (t *pipelineTransport) retire(pc *pipelineConn) {
+	pc.broken = true
+	pc.conn.Close()
+	conns := t.conns[pc.key]
+	for i, other := range conns {
+		if other == pc {
+			t.conns[pc.key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if pc.inflight == 0 {
+		close(pc.pending)
+	}
+	t.notify(pc.key)
+}
+
+// notify wakes the requests waiting for a connection to key.
+func (t *pipelineTransport) notify(key string) {
+	if changed, ok := t.changed[key]; ok {
+		close(changed)
+		delete(t.changed, key)
+	}
+}
+
+func (t *pipelineTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conns := range t.conns {
+		for _, pc := range conns {
+			if pc.inflight == 0 {
+				t.retire(pc)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPipelineServer starts a server that answers with the request path and
+// counts the connections opened to it. Requests to /block/... wait until
+// unblock is closed.
+func newPipelineServer(t *testing.T, unblock <-chan struct{}, started chan<- string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if started != nil {
+			started <- r.URL.Path
+		}
+		if strings.HasPrefix(r.URL.Path, "/block/") {
+			<-unblock
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+// pipelineGet returns the body of a GET of path through client.
+func pipelineGet(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestPipelineTransportOrder(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan string, 4)
+	server, conns := newPipelineServer(t, unblock, started)
+	client := &http.Client{Transport: newPipelineTransport(HTTPClientPolicy{PipelineDepth: 4, MaxConnsPerHost: 1})}
+
+	// The first request holds the connection, so the others are pipelined
+	// behind it and must each get their own response
+	paths := []string{"/block/first", "/a", "/b", "/c"}
+	bodies := make([]string, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := pipelineGet(context.Background(), client, server.URL+path)
+			if err != nil {
+				t.Errorf("GET %s: %v", path, err)
+			}
+			bodies[i] = body
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	for i, path := range paths {
+		if bodies[i] != path {
+			t.Errorf("GET %s answered with %q", path, bodies[i])
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestPipelineTransportWaitsForConnection(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan string, 3)
+	server, conns := newPipelineServer(t, unblock, started)
+	client := &http.Client{Transport: newPipelineTransport(HTTPClientPolicy{PipelineDepth: 1, MaxConnsPerHost: 1})}
+
+	// With depth 1 and one connection, the second request waits for the
+	// first to finish instead of opening another connection
+	results := make(chan string, 2)
+	for _, path := range []string{"/block/first", "/second"} {
+		go func() {
+			body, err := pipelineGet(context.Background(), client, server.URL+path)
+			if err != nil {
+				body = err.Error()
+			}
+			results <- body
+		}()
+		if path == "/block/first" {
+			<-started
+		}
+	}
+	select {
+	case body := <-results:
+		t.Fatalf("request finished with %q while the connection was busy", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["/block/first"] || !got["/second"] {
+		t.Errorf("responses %v, want both paths", got)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+
+	// A waiting request gives up when its context ends
+	transport := newPipelineTransport(HTTPClientPolicy{PipelineDepth: 1, MaxConnsPerHost: 1})
+	client = &http.Client{Transport: transport}
+	blocked := make(chan struct{})
+	defer close(blocked)
+	held, _ := newPipelineServer(t, blocked, nil)
+	go pipelineGet(context.Background(), client, held.URL+"/block/held")
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pipelineGet(ctx, client, held.URL+"/waiting"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting request ended with %v, want the context deadline", err)
+	}
+}
+
+func TestPipelineTransportCancel(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan string, 4)
+	server, conns := newPipelineServer(t, unblock, started)
+	client := &http.Client{Transport: newPipelineTransport(HTTPClientPolicy{PipelineDepth: 2, MaxConnsPerHost: 1})}
+
+	first := make(chan string, 1)
+	go func() {
+		body, _ := pipelineGet(context.Background(), client, server.URL+"/block/first")
+		first <- body
+	}()
+	<-started
+
+	// The second request is written behind the first and canceled before
+	// its response arrives
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { cancel() }})
+	if _, err := pipelineGet(ctx, client, server.URL+"/canceled"); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled request ended with %v", err)
+	}
+
+	close(unblock)
+	if body := <-first; body != "/block/first" {
+		t.Errorf("first request answered with %q", body)
+	}
+	if path := <-started; path != "/canceled" {
+		t.Errorf("server received %s after the first request, want the canceled one", path)
+	}
+
+	// The reader consumed the canceled request's response, so the next
+	// request on the connection gets its own
+	if body, err := pipelineGet(context.Background(), client, server.URL+"/next"); err != nil || body != "/next" {
+		t.Errorf("next request answered with %q, %v", body, err)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
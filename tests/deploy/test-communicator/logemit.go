@@ -0,0 +1,356 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LogEmitConfig controls sending log records to a syslog or Fluent Forward
+// receiver: the communicator's own log lines and generated messages with a
+// known rate, severity mix and size.
+type LogEmitConfig struct {
+	Protocol       string   `json:"protocol"`        // "", "syslog", or "fluent"
+	Address        string   `json:"address"`         // host:port of the receiver
+	Transport      string   `json:"transport"`       // "udp" (syslog only), "tcp", or "tls"
+	TLSInsecure    bool     `json:"tls_insecure"`    // Skip verification of the receiver's certificate
+	SyslogFormat   string   `json:"syslog_format"`   // "rfc5424" or "rfc3164"
+	SyslogFacility int      `json:"syslog_facility"` // 0 to 23
+	Tag            string   `json:"tag"`             // Fluent tag or syslog app name; defaults to SERVICE_NAME
+	AppLogs        bool     `json:"app_logs"`        // Also send the communicator's own log lines
+	Rate           float64  `json:"rate"`            // Generated messages per second, 0 for none
+	Severities     []string `json:"severities"`      // Severities of generated messages, each optionally weighted as "name:weight"
+	MinSize        int      `json:"min_size"`        // Generated messages are padded to between MinSize and MaxSize bytes
+	MaxSize        int      `json:"max_size"`
+}
+
+// logSeverities are the syslog severity names, indexed by severity.
+var logSeverities = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+// logSeverityInfo is the severity of the communicator's own log lines.
+const logSeverityInfo = 6
+
+// logQueueSize bounds the records waiting to be sent; later ones are
+// dropped rather than blocking the logger.
+const logQueueSize = 1024
+
+// maxLogEmitRate bounds the generated messages per second, so the interval
+// between them stays at a microsecond or more.
+const maxLogEmitRate = 1e6
+
+// logPadding fills generated messages up to their size.
+const logPadding = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+type weightedSeverity struct {
+	severity int
+	weight   float64
+}
+
+// parseLogSeverities parses entries such as "info:80", "warning:15" and
+// "error". Entries without a weight weigh 1.
+func parseLogSeverities(entries []string) ([]weightedSeverity, error) {
+	var severities []weightedSeverity
+	for _, entry := range entries {
+		name, weight, weighted := strings.Cut(entry, ":")
+		severity := -1
+		for i, s := range logSeverities {
+			if s == name {
+				severity = i
+			}
+		}
+		if severity < 0 {
+			return nil, fmt.Errorf("unknown severity %q (expected one of %s)", name, strings.Join(logSeverities, ", "))
+		}
+		w := 1.0
+		if weighted {
+			var err error
+			if w, err = strconv.ParseFloat(weight, 64); err != nil || !(w > 0) || math.IsInf(w, 1) {
+				return nil, fmt.Errorf("weight of %s must be a positive number", name)
+			}
+		}
+		severities = append(severities, weightedSeverity{severity, w})
+	}
+	if len(severities) == 0 {
+		return nil, fmt.Errorf("at least one severity is required")
+	}
+	return severities, nil
+}
+
+type logRecord struct {
+	time     time.Time
+	severity int
+	source   string // "app" or "generated"
+	message  string
+	flushed  chan struct{} // Set on the marker record of flush, which is not sent
+}
+
+// logEmitter sends records over one connection from a single goroutine.
+// Every sent record carries a sequence number counted from 1, so a receiver
+// can check that none were lost.
+type logEmitter struct {
+	config     LogEmitConfig
+	severities []weightedSeverity
+	service    string
+	hostname   string
+	random     *seededRand
+	records    *prometheus.CounterVec
+	queue      chan logRecord
+
+	conn     net.Conn
+	sequence uint64
+	retryAt  time.Time // No connection attempts until then after a failed one
+}
+
+func newLogEmitter(config LogEmitConfig, service string, random *seededRand, records *prometheus.CounterVec) (*logEmitter, error) {
+	severities, err := parseLogSeverities(config.Severities)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	e := &logEmitter{
+		config:     config,
+		severities: severities,
+		service:    service,
+		hostname:   hostname,
+		random:     random,
+		records:    records,
+		queue:      make(chan logRecord, logQueueSize),
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *logEmitter) String() string {
+	format := "forward"
+	if e.config.Protocol == "syslog" {
+		format = e.config.SyslogFormat
+	}
+	return fmt.Sprintf("%s %s over %s to %s", e.config.Protocol, format, e.config.Transport, e.config.Address)
+}
+
+// Write sends one line of the standard logger, which writes every entry in
+// a single call. The logger's date and time prefix is removed, since the
+// record has a more precise timestamp.
+func (e *logEmitter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	if len(line) > 20 {
+		if _, err := time.Parse("2006/01/02 15:04:05", line[:19]); err == nil {
+			line = line[20:]
+		}
+	}
+	e.enqueue(logRecord{time: time.Now(), severity: logSeverityInfo, source: "app", message: line})
+	return len(p), nil
+}
+
+func (e *logEmitter) enqueue(record logRecord) {
+	select {
+	case e.queue <- record:
+	default:
+		e.records.WithLabelValues(record.source, "dropped").Inc()
+	}
+}
+
+// generate queues messages at the configured rate until stop is closed.
+func (e *logEmitter) generate(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / e.config.Rate))
+	defer ticker.Stop()
+	for n := uint64(1); ; n++ {
+		select {
+		case <-ticker.C:
+			e.enqueue(e.generateMessage(n))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// generateMessage returns the n-th generated message, with a severity drawn
+// from the configured mix and padded to a size between MinSize and MaxSize.
+func (e *logEmitter) generateMessage(n uint64) logRecord {
+	var total float64
+	for _, s := range e.severities {
+		total += s.weight
+	}
+	pick := e.random.Float64() * total
+	severity := e.severities[len(e.severities)-1].severity
+	for _, s := range e.severities {
+		if pick < s.weight {
+			severity = s.severity
+			break
+		}
+		pick -= s.weight
+	}
+
+	message := fmt.Sprintf("Generated %s message %d", logSeverities[severity], n)
+	size := e.config.MinSize
+	if e.config.MaxSize > size {
+		size += e.random.IntN(e.config.MaxSize - size + 1)
+	}
+	if pad := size - len(message) - 1; pad > 0 {
+		message += " " + strings.Repeat(logPadding, pad/len(logPadding)+1)[:pad]
+	}
+	return logRecord{time: time.Now(), severity: severity, source: "generated", message: message}
+}
+
+// flush waits until the records queued so far are sent or ctx is done.
+func (e *logEmitter) flush(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case e.queue <- logRecord{flushed: flushed}:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+	}
+}
+
+func (e *logEmitter) run() {
+	for record := range e.queue {
+		if record.flushed != nil {
+			close(record.flushed)
+			continue
+		}
+		if err := e.send(record); err != nil {
+			e.records.WithLabelValues(record.source, "failed").Inc()
+			continue
+		}
+		e.records.WithLabelValues(record.source, "sent").Inc()
+	}
+}
+
+// send writes one record, connecting first if needed. A failed write closes
+// the connection, and a failed connection attempt is retried after a second
+// at the earliest; records until then fail.
+func (e *logEmitter) send(record logRecord) error {
+	if e.conn == nil {
+		if time.Now().Before(e.retryAt) {
+			return fmt.Errorf("not connected")
+		}
+		conn, err := e.dial()
+		if err != nil {
+			e.retryAt = time.Now().Add(time.Second)
+			log.Printf("Log emitter cannot connect to %s: %v", e.config.Address, err)
+			return err
+		}
+		e.conn = conn
+	}
+
+	e.sequence++
+	var payload []byte
+	if e.config.Protocol == "fluent" {
+		payload = e.forwardMessage(record)
+	} else {
+		payload = e.syslogMessage(record)
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := e.conn.Write(payload); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		log.Printf("Log emitter lost connection to %s: %v", e.config.Address, err)
+		return err
+	}
+	return nil
+}
+
+func (e *logEmitter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	switch e.config.Transport {
+	case "tls":
+		host, _, _ := net.SplitHostPort(e.config.Address)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, InsecureSkipVerify: e.config.TLSInsecure}}
+		return tlsDialer.Dial("tcp", e.config.Address)
+	default:
+		return dialer.Dial(e.config.Transport, e.config.Address)
+	}
+}
+
+// syslogMessage formats a record as RFC 5424 or RFC 3164. RFC 5424 records
+// carry the service, source and sequence as structured data; RFC 3164 has
+// none, so they are left out. Over TCP and TLS, RFC 5424 messages are
+// framed by octet counting and RFC 3164 messages end with a newline, as
+// RFC 6587 describes.
+func (e *logEmitter) syslogMessage(record logRecord) []byte {
+	priority := e.config.SyslogFacility*8 + record.severity
+	var message string
+	if e.config.SyslogFormat == "rfc3164" {
+		tag := e.config.Tag
+		if len(tag) > 32 {
+			tag = tag[:32]
+		}
+		message = fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, record.time.Format(time.Stamp), e.hostname, tag,
+			os.Getpid(), strings.ReplaceAll(record.message, "\n", " "))
+		if e.config.Transport != "udp" {
+			message += "\n"
+		}
+		return []byte(message)
+	}
+
+	// Empty header fields are the NILVALUE "-"
+	appName := cmp.Or(e.config.Tag, "-")
+	if len(appName) > 48 {
+		appName = appName[:48]
+	}
+	message = fmt.Sprintf(`<%d>1 %s %s %s %d %s [meta@32473 service="%s" source="%s" sequence="%d"] %s`,
+		priority, record.time.Format("2006-01-02T15:04:05.000000Z07:00"), cmp.Or(e.hostname, "-"), appName, os.Getpid(),
+		record.source, syslogParam(e.service), record.source, e.sequence, record.message)
+	if e.config.Transport != "udp" {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	return []byte(message)
+}
+
+// syslogParam escapes a structured data parameter value.
+func syslogParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// forwardMessage encodes a record in the Message mode of the Fluent Forward
+// protocol: a MessagePack array of the tag, the EventTime and the record.
+func (e *logEmitter) forwardMessage(record logRecord) []byte {
+	b := []byte{0x93}
+	b = msgpackString(b, e.config.Tag)
+	// EventTime is extension type 0: seconds and nanoseconds, big-endian
+	b = append(b, 0xd7, 0x00)
+	b = binary.BigEndian.AppendUint32(b, uint32(record.time.Unix()))
+	b = binary.BigEndian.AppendUint32(b, uint32(record.time.Nanosecond()))
+
+	b = append(b, 0x86)
+	b = msgpackString(msgpackString(b, "message"), record.message)
+	b = msgpackString(msgpackString(b, "severity"), logSeverities[record.severity])
+	b = msgpackString(msgpackString(b, "host"), e.hostname)
+	b = msgpackString(msgpackString(b, "service"), e.service)
+	b = msgpackString(msgpackString(b, "source"), record.source)
+	b = msgpackString(b, "sequence")
+	b = append(b, 0xcf)
+	return binary.BigEndian.AppendUint64(b, e.sequence)
+}
+
+func msgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseLogSeverities(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []weightedSeverity
+	}{
+		{[]string{"info"}, []weightedSeverity{{6, 1}}},
+		{[]string{"info:80", "warning:15", "error"}, []weightedSeverity{{6, 80}, {4, 15}, {3, 1}}},
+		{[]string{"emergency:0.5", "debug:1e3"}, []weightedSeverity{{0, 0.5}, {7, 1000}}},
+	}
+	for _, test := range tests {
+		got, err := parseLogSeverities(test.entries)
+		if err != nil {
+			t.Errorf("parseLogSeverities(%q): %v", test.entries, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseLogSeverities(%q) = %v, want %v", test.entries, got, test.want)
+		}
+	}
+
+	for _, entries := range [][]string{
+		nil,
+		{"verbose"},
+		{"INFO"},
+		{"info:"},
+		{"info:0"},
+		{"info:-1"},
+		{"info:many"},
+		{"info:NaN"},
+		{"info:Inf"},
+		{"info:+Inf"},
+		{"info", "warning:0"},
+	} {
+		if got, err := parseLogSeverities(entries); err == nil {
+			t.Errorf("parseLogSeverities(%q) = %v, want an error", entries, got)
+		}
+	}
+}
+
+func TestMsgpackString(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0xa0}},
+		{1, []byte{0xa1}},
+		{31, []byte{0xbf}},
+		{32, []byte{0xd9, 32}},
+		{255, []byte{0xd9, 255}},
+		{256, []byte{0xda, 0x01, 0x00}},
+		{65535, []byte{0xda, 0xff, 0xff}},
+		{65536, []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		s := strings.Repeat("x", test.length)
+		encoded := msgpackString([]byte{0x93}, s)
+		if !bytes.Equal(encoded[1:1+len(test.header)], test.header) || string(encoded[1+len(test.header):]) != s || encoded[0] != 0x93 {
+			t.Errorf("length %d: header %x, want %x", test.length, encoded[1:min(len(encoded), 6)], test.header)
+		}
+		if decoded := readMsgpack(t, bufio.NewReader(bytes.NewReader(encoded[1:]))); decoded != s {
+			t.Errorf("length %d: decoded %d bytes", test.length, len(decoded.(string)))
+		}
+	}
+}
+
+// readMsgpack reads one MessagePack value of the types the Forward encoder
+// writes: arrays, maps, strings, uint64 and the EventTime extension, which
+// is returned as a time.Time.
+func readMsgpack(t *testing.T, r *bufio.Reader) any {
+	t.Helper()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("reading MessagePack: %v", err)
+		}
+		return b
+	}
+	str := func(n int) string { return string(read(n)) }
+
+	kind := read(1)[0]
+	switch {
+	case kind&0xe0 == 0xa0:
+		return str(int(kind & 0x1f))
+	case kind == 0xd9:
+		return str(int(read(1)[0]))
+	case kind == 0xda:
+		return str(int(binary.BigEndian.Uint16(read(2))))
+	case kind == 0xdb:
+		return str(int(binary.BigEndian.Uint32(read(4))))
+	case kind == 0xcf:
+		return binary.BigEndian.Uint64(read(8))
+	case kind == 0xd7:
+		if ext := read(1)[0]; ext != 0 {
+			t.Fatalf("extension type %d, want EventTime", ext)
+		}
+		b := read(8)
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	case kind&0xf0 == 0x90:
+		list := make([]any, kind&0x0f)
+		for i := range list {
+			list[i] = readMsgpack(t, r)
+		}
+		return list
+	case kind&0xf0 == 0x80:
+		m := map[string]any{}
+		for range kind & 0x0f {
+			key := readMsgpack(t, r).(string)
+			m[key] = readMsgpack(t, r)
+		}
+		return m
+	}
+	t.Fatalf("unexpected MessagePack type %#x", kind)
+	return nil
+}
+
+func newTestLogEmitter(config LogEmitConfig) *logEmitter {
+	return &logEmitter{config: config, service: "svc", hostname: "host", sequence: 7}
+}
+
+func TestForwardMessage(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"short", "hello"},
+		{"str8", strings.Repeat("m", 200)},
+		{"str16", strings.Repeat("m", 1000)},
+		{"str32", strings.Repeat("m", 70000)},
+		{"multi-line", "first\nsecond"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestLogEmitter(LogEmitConfig{Protocol: "fluent", Tag: "app.logs"})
+			encoded := e.forwardMessage(logRecord{time: at, severity: 3, source: "generated", message: test.message})
+			r := bufio.NewReader(bytes.NewReader(encoded))
+			got := readMsgpack(t, r)
+			if r.Buffered() != 0 {
+				t.Errorf("%d bytes after the message", r.Buffered())
+			}
+			want := []any{"app.logs", at, map[string]any{
+				"message":  test.message,
+				"severity": "error",
+				"host":     "host",
+				"service":  "svc",
+				"source":   "generated",
+				"sequence": uint64(7),
+			}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	at := time.Date(2026, 1, 5, 9, 3, 4, 120000000, time.UTC)
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name     string
+		config   LogEmitConfig
+		hostname string
+		record   logRecord
+		want     string
+	}{
+		{
+			name:     "rfc5424 udp",
+			config:   LogEmitConfig{SyslogFormat: "rfc5424", Transport: "udp", SyslogFacility: 16, Tag: "app"},
+			hostname: "host",
+			record:   logRecord{time: at, severity: 3, source: "generated", message: "boom"},
+			want:     `<131>1 2026-01-05T09:03:04.120000Z host app ` + pid + ` generated [meta@32473 service="svc" source="generated" sequence="7"] boom`,
+		},
+		{
+			name:     "rfc5424 nil values",
+			config:   LogEmitConfig{SyslogFormat: "rfc5424", Transport: "udp"},
+			hostname: "",
+			record:   logRecord{time: at, severity: 6, source: "app", message: "started"},
+			want:     `<6>1 2026-01-05T09:03:04.120000Z - - ` + pid + ` app [meta@32473 service="svc" source="app" sequence="7"] started`,
+		},
+		{
+			name:     "rfc3164 udp",
+			config:   LogEmitConfig{SyslogFormat: "rfc3164", Transport: "udp", SyslogFacility: 1, Tag: "app"},
+			hostname: "host",
+			record:   logRecord{time: at, severity: 4, source: "app", message: "line one\nline two"},
+			want:     `<12>Jan  5 09:03:04 host app[` + pid + `]: line one line two`,
+		},
+		{
+			name:     "rfc3164 tcp",
+			config:   LogEmitConfig{SyslogFormat: "rfc3164", Transport: "tcp", Tag: strings.Repeat("t", 40)},
+			hostname: "host",
+			record:   logRecord{time: at, severity: 7, source: "app", message: "debug"},
+			want:     `<7>Jan  5 09:03:04 host ` + strings.Repeat("t", 32) + `[` + pid + `]: debug` + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestLogEmitter(test.config)
+			e.hostname = test.hostname
+			if got := string(e.syslogMessage(test.record)); got != test.want {
+				t.Errorf("message\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyslogOctetCounting(t *testing.T) {
+	for _, transport := range []string{"tcp", "tls"} {
+		e := newTestLogEmitter(LogEmitConfig{SyslogFormat: "rfc5424", Transport: transport, Tag: strings.Repeat("a", 60)})
+		e.service = `we"ird]\name`
+		framed := string(e.syslogMessage(logRecord{time: time.Now(), severity: 6, source: "app", message: "héllo\nworld"}))
+		length, message, ok := strings.Cut(framed, " ")
+		if !ok {
+			t.Fatalf("%s: no length in %q", transport, framed)
+		}
+		if n, err := strconv.Atoi(length); err != nil || n != len(message) {
+			t.Errorf("%s: length %s for a %d byte message", transport, length, len(message))
+		}
+		if !strings.Contains(message, " "+strings.Repeat("a", 48)+" ") || strings.Contains(message, strings.Repeat("a", 49)) {
+			t.Errorf("%s: app name not truncated to 48 bytes: %q", transport, message)
+		}
+		if !strings.Contains(message, `service="we\"ird\]\\name"`) {
+			t.Errorf("%s: service not escaped: %q", transport, message)
+		}
+	}
+}
+
+func TestGenerateMessage(t *testing.T) {
+	e := newTestLogEmitter(LogEmitConfig{MinSize: 100, MaxSize: 120})
+	e.random = newSeededRand("test", "test")
+	e.severities = []weightedSeverity{{6, 3}, {3, 1}}
+	counts := map[int]int{}
+	for n := uint64(1); n <= 2000; n++ {
+		record := e.generateMessage(n)
+		counts[record.severity]++
+		if len(record.message) < 100 || len(record.message) > 120 {
+			t.Fatalf("message of %d bytes, want 100 to 120", len(record.message))
+		}
+		if want := fmt.Sprintf("Generated %s message %d ", logSeverities[record.severity], n); !strings.HasPrefix(record.message, want) {
+			t.Fatalf("message %q, want prefix %q", record.message, want)
+		}
+	}
+	if len(counts) != 2 || counts[6] < 1300 || counts[6] > 1700 {
+		t.Errorf("severity counts %v, want about 3 info to 1 error", counts)
+	}
+
+	// Messages longer than MaxSize are not truncated
+	e.config = LogEmitConfig{}
+	if record := e.generateMessage(1); record.message != "Generated "+logSeverities[record.severity]+" message 1" {
+		t.Errorf("unpadded message %q", record.message)
+	}
+}
+
+func TestLogEmitterSends(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	records := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "log_records_total"}, []string{"source", "status"})
+	config := LogEmitConfig{Protocol: "syslog", Address: listener.Addr().String(), Transport: "tcp", SyslogFormat: "rfc3164", Tag: "app", Severities: []string{"info"}}
+	e, err := newLogEmitter(config, "svc", newSeededRand("test", "test"), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(e, "2026/01/05 09:03:04 Starting server\n")
+	fmt.Fprintf(e, "no prefix\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.flush(ctx)
+	e.conn.Close()
+
+	lines := strings.Split(strings.TrimSuffix(<-received, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "]: Starting server") || !strings.HasSuffix(lines[1], "]: no prefix") {
+		t.Errorf("received %q", lines)
+	}
+	if e.sequence != 2 {
+		t.Errorf("sequence %d, want 2", e.sequence)
+	}
+}
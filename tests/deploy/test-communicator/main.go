@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -11,16 +13,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 
 	pb "test-communicator/proto"
 )
@@ -29,30 +39,173 @@ type Config struct {
 	Port        int    `json:"port"`
 	ServiceName string `json:"service_name"`
 	TargetURL   string `json:"target_url"`
-	Protocol    string `json:"protocol"`    // "http", "grpc", or "tcp"
+	Protocol    string `json:"protocol"`    // "http", "grpc", "tcp", "mqtt", "memcached", "mongo", "amqp", or "http3"
 	TargetHost  string `json:"target_host"` // For non-HTTP protocols
 	TargetPort  int    `json:"target_port"` // For non-HTTP protocols
+	Namespace   string `json:"namespace"`   // The pod's own namespace; read from the service account when unset
+
+	// Traffic matrix of tagged flows, which may span namespaces
+	Flows []Flow `json:"flows"`
+
+	// Discovery of periodic request targets through the Kubernetes API or DNS
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// Seed for all random choices. Runs with the same seed and service name
+	// make the same choices; a random seed is picked and logged when unset.
+	Seed string `json:"seed"`
+
+	// Timeline of periodic traffic. Without phases, periodic requests run
+	// once a minute on all edges.
+	Phases       []Phase `json:"phases"`
+	PhasesRepeat bool    `json:"phases_repeat"` // Restart the relative timeline after its last phase
+
+	// Resource-pressure simulation: /admin endpoints and actions run at fixed
+	// times after startup
+	AdminEndpoints bool              `json:"admin_endpoints"`
+	Actions        []ScheduledAction `json:"actions"`
+
+	// Shutdown. On SIGTERM, health checks fail for PreStopDelay so endpoints
+	// are removed before the servers drain; everything must finish within
+	// ShutdownTimeout.
+	ShutdownTimeout     time.Duration `json:"shutdown_timeout"`
+	PreStopDelay        time.Duration `json:"prestop_delay"`
+	TerminationBehavior string        `json:"termination_behavior"`  // "graceful", "ignore-sigterm", "exit-nonzero", or "crash-mid-request"
+	TerminationExitCode int           `json:"termination_exit_code"` // Exit code for "exit-nonzero"
+
+	// Metrics exposition. With OpenMetrics, scrapers that ask for it get
+	// exemplars carrying the trace ID of sampled inbound requests.
+	OpenMetrics         bool    `json:"openmetrics"`
+	ExemplarSampleRatio float64 `json:"exemplar_sample_ratio"` // Share of requests without trace headers that get a trace ID, without tracing
+
+	// Synthetic custom metrics served on their own port
+	SyntheticMetrics SyntheticMetricsConfig `json:"synthetic_metrics"`
+
+	// Additional metrics endpoints, which can misbehave on purpose
+	MetricsEndpoints []MetricsEndpoint `json:"metrics_endpoints"`
+
+	// Pushing metrics by remote write and to a Pushgateway
+	Push PushConfig `json:"push"`
+
+	// Per-request metrics sent to a StatsD or DogStatsD agent
+	StatsD StatsDConfig `json:"statsd"`
+
+	// Spans of inbound and periodic requests, and their propagation
+	Tracing TracingConfig `json:"tracing"`
+
+	// Log records sent to a syslog or Fluent Forward receiver
+	LogEmit LogEmitConfig `json:"log_emit"`
+
+	// Print the planned request schedule for DryRunDuration and exit
+	DryRun         bool          `json:"dry_run"`
+	DryRunDuration time.Duration `json:"dry_run_duration"`
+
+	// Outbound HTTP connection handling for TARGET_URL and CALL_TARGETS
+	HTTPClient HTTPClientPolicy `json:"http_client"`
+
+	// Retries, deadlines, hedging and circuit breaking for outbound HTTP and
+	// gRPC calls. Entries in CALL_TARGETS may override the retry policy.
+	Retry   RetryPolicy   `json:"retry"`
+	Breaker BreakerPolicy `json:"breaker"`
+
+	// Downstream calls made by /api/call-target and gRPC CallTarget. When
+	// empty, /api/call-target calls TARGET_URL once.
+	CallTargets       []DownstreamCall `json:"call_targets"`
+	CallMode          string           `json:"call_mode"`           // "parallel" or "sequential"
+	CallFailurePolicy string           `json:"call_failure_policy"` // "all", "any", or "best-effort"
+	CallTimeout       time.Duration    `json:"call_timeout"`        // Default per-call timeout
+
+	// Chain calls made by /api/chain
+	ChainMaxDepth    int `json:"chain_max_depth"`    // Maximum number of communicators in a chain
+	ChainDefaultPort int `json:"chain_default_port"` // Port used for hops given without one
+
+	// Raw TCP settings, used when Protocol is "tcp"
+	TCPFraming               string        `json:"tcp_framing"`                 // "newline", "length-prefixed", "fixed", or "stream"
+	TCPRecordSize            int           `json:"tcp_record_size"`             // Record size for "fixed" framing
+	TCPStreamBytes           int           `json:"tcp_stream_bytes"`            // Bytes sent per periodic request for "stream" framing
+	TCPRequestsPerConnection int           `json:"tcp_requests_per_connection"` // Requests sent per periodic request
+	TCPPoolSize              int           `json:"tcp_pool_size"`               // Idle client connections kept for reuse, 0 disables pooling
+	TCPIdleTimeout           time.Duration `json:"tcp_idle_timeout"`            // Idle time before server and pool close connections, 0 disables
+	TCPHalfClose             bool          `json:"tcp_half_close"`              // Client half-closes after its last request
+	TCPKeepAlive             time.Duration `json:"tcp_keep_alive"`              // Client TCP keep-alive probe period, negative disables
+
+	// MQTT client settings, used when Protocol is "mqtt" and TargetHost is set
+	MQTTRole            string        `json:"mqtt_role"`    // "publisher", "subscriber", or "both"
+	MQTTTopics          []string      `json:"mqtt_topics"`  // Topics to publish to / filters to subscribe to
+	MQTTQoS             int           `json:"mqtt_qos"`     // 0 or 1
+	MQTTVersion         int           `json:"mqtt_version"` // 4 (3.1.1) or 5
+	MQTTPublishInterval time.Duration `json:"mqtt_publish_interval"`
+
+	// Memcached settings, used when Protocol is "memcached"
+	MemcachedMaxItems   int    `json:"memcached_max_items"`  // LRU capacity of the server
+	MemcachedProtocol   string `json:"memcached_protocol"`   // Client protocol: "text" or "binary"
+	MemcachedOperations int    `json:"memcached_operations"` // Client gets per periodic request
+	MemcachedHitRatio   int    `json:"memcached_hit_ratio"`  // Percentage of client gets that hit
+	MemcachedKeyCount   int    `json:"memcached_key_count"`  // Distinct keys used for hits
+
+	// MongoDB client settings, used when Protocol is "mongo"
+	MongoDatabase   string   `json:"mongo_database"`
+	MongoCollection string   `json:"mongo_collection"`
+	MongoOperations []string `json:"mongo_operations"` // Operations run in order on every periodic request
+
+	// AMQP client settings, used when Protocol is "amqp" and TargetHost is set
+	AMQPRole            string        `json:"amqp_role"`          // "publisher", "consumer", or "both"
+	AMQPExchange        string        `json:"amqp_exchange"`      // Empty for the default exchange
+	AMQPExchangeType    string        `json:"amqp_exchange_type"` // "direct", "fanout", or "topic"
+	AMQPQueue           string        `json:"amqp_queue"`
+	AMQPRoutingKey      string        `json:"amqp_routing_key"`
+	AMQPPublishInterval time.Duration `json:"amqp_publish_interval"`
 }
 
 type App struct {
-	config     Config
-	router     *mux.Router
-	httpServer *http.Server
-	grpcServer *grpc.Server
-	tcpServer  net.Listener
-	requests   prometheus.Counter
-	stopCh     chan struct{}
+	config          Config
+	settings        []ConfigSetting // Effective configuration and where each value came from
+	router          *mux.Router
+	httpServer      *http.Server
+	http3Server     *http3.Server
+	http3Transport  *http3.Transport // Client transport of HTTP/3 edges, nil unless PROTOCOL is http3
+	grpcServer      *grpc.Server
+	tcpServer       net.Listener
+	tcpConns        *connTracker
+	tcpPool         *tcpClientPool
+	httpClients     *httpClients
+	discovery       *targetDiscovery   // Periodic request targets, nil when static
+	discoveries     []*targetDiscovery // All discoveries, including those of CALL_TARGETS
+	resilience      *outboundResilience
+	random          *seededRand // Root of the random streams of all consumers
+	exemplarRandom  *seededRand // Exemplar sampling and generated trace IDs
+	pressure        *pressure
+	synthetic       *syntheticMetrics // Synthetic custom metrics, nil when disabled
+	metricsServers  []*http.Server    // Servers of METRICS_ENDPOINTS
+	metricsScrapes  *prometheus.CounterVec
+	pusher          *metricsPusher // Nil unless a push URL is set
+	statsd          *statsdEmitter // Nil unless STATSD_ADDRESS is set
+	tracer          *tracer        // Nil unless TRACE_EXPORTER is set
+	logEmitter      *logEmitter    // Nil unless LOG_EMIT_PROTOCOL is set
+	flowRequests    *prometheus.CounterVec
+	flowsReceived   *prometheus.CounterVec
+	phase           *prometheus.GaugeVec
+	phaseChanges    *prometheus.CounterVec
+	requests        prometheus.Counter
+	requestDuration *prometheus.HistogramVec
+	stopCh          chan struct{}
+	draining        atomic.Bool // Set once shutdown starts; health checks fail
+	crashArmed      atomic.Bool // Set by the crash-mid-request termination behaviour
 }
 
 // gRPC server implementation
 type testCommunicatorServer struct {
 	pb.UnimplementedTestCommunicatorServer
 	serviceName string
+	app         *App
 }
 
 func (s *testCommunicatorServer) Health(ctx context.Context, req *pb.HealthRequest) (*pb.HealthResponse, error) {
+	status := "healthy"
+	if s.app.draining.Load() {
+		status = "draining"
+	}
 	return &pb.HealthResponse{
-		Status:    "healthy",
+		Status:    status,
 		Service:   s.serviceName,
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
 	}, nil
@@ -67,6 +220,24 @@ func (s *testCommunicatorServer) GetData(ctx context.Context, req *pb.DataReques
 }
 
 func (s *testCommunicatorServer) CallTarget(ctx context.Context, req *pb.TargetRequest) (*pb.TargetResponse, error) {
+	if len(s.app.config.CallTargets) > 0 {
+		result, ok := s.app.fanOut(ctx)
+		if !ok {
+			return nil, status.Error(codes.Unavailable, result.Message)
+		}
+
+		aggregated, err := json.Marshal(result)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "encoding target responses: %v", err)
+		}
+		return &pb.TargetResponse{
+			Message:        result.Message,
+			Service:        s.serviceName,
+			TargetResponse: string(aggregated),
+			Timestamp:      result.Timestamp,
+		}, nil
+	}
+
 	return &pb.TargetResponse{
 		Message:   "Target called successfully via gRPC",
 		Service:   s.serviceName,
@@ -92,20 +263,21 @@ type UserResponse struct {
 	Created string `json:"created"`
 }
 
-func NewApp() *App {
-	config := Config{
-		Port:        getEnvAsInt("PORT", 8080),
-		ServiceName: getEnv("SERVICE_NAME", "test-communicator"),
-		TargetURL:   getEnv("TARGET_URL", ""),
-		Protocol:    getEnv("PROTOCOL", "http"),
-		TargetHost:  getEnv("TARGET_HOST", ""),
-		TargetPort:  getEnvAsInt("TARGET_PORT", 8080),
+func NewApp(config Config, settings []ConfigSetting) *App {
+	if config.Namespace == "" {
+		config.Namespace = "unknown"
+		if namespace, err := serviceAccountNamespace(); err == nil {
+			config.Namespace = namespace
+		}
 	}
-
 	app := &App{
-		config: config,
-		router: mux.NewRouter(),
-		stopCh: make(chan struct{}),
+		config:   config,
+		settings: settings,
+		random:   newSeededRand(config.Seed, config.ServiceName),
+		router:   mux.NewRouter(),
+		tcpPool:  &tcpClientPool{size: config.TCPPoolSize, idleTimeout: config.TCPIdleTimeout},
+		tcpConns: newConnTracker(),
+		stopCh:   make(chan struct{}),
 	}
 
 	// Initialize Prometheus metrics
@@ -113,10 +285,163 @@ func NewApp() *App {
 		Name: "requests_total",
 		Help: "Total number of requests",
 	})
-	prometheus.MustRegister(app.requests)
+	app.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_server_request_duration_seconds",
+		Help:    "Duration of inbound HTTP requests by method and status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: infoFamily,
+		Help: "Communicator instance information",
+	}, []string{"service", "protocol", "seed", "go_version"})
+	info.WithLabelValues(config.ServiceName, config.Protocol, config.Seed, runtime.Version()).Set(1)
+	prometheus.MustRegister(app.requests, app.requestDuration, info)
+
+	httpConnections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_client_connections_total",
+		Help: "Outbound HTTP requests by target and whether they used a new or a reused connection",
+	}, []string{"target", "state"})
+	prometheus.MustRegister(httpConnections)
+
+	app.flowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flow_requests_total",
+		Help: "Requests of FLOWS by flow, source and destination namespace, and outcome (status code or error)",
+	}, []string{"flow", "source_namespace", "destination_namespace", "outcome"})
+	app.flowsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flow_requests_received_total",
+		Help: "Inbound requests tagged with a flow by flow, source and destination namespace",
+	}, []string{"flow", "source_namespace", "destination_namespace"})
+	prometheus.MustRegister(app.flowRequests, app.flowsReceived)
+
+	app.httpClients = newHTTPClients(httpConnections)
+	if config.Protocol == "http3" {
+		app.http3Transport = newHTTP3Transport(config.HTTPClient)
+	}
+
+	outboundAttempts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_attempts_total",
+		Help: "Outbound call attempts by target, kind (first, retry, or hedge) and outcome",
+	}, []string{"target", "kind", "outcome"})
+	breakerState := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "Circuit breaker state by target: 0 closed, 1 half-open, 2 open",
+	}, []string{"target"})
+	breakerTransitions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_transitions_total",
+		Help: "Circuit breaker state changes by target",
+	}, []string{"target", "from", "to"})
+	prometheus.MustRegister(outboundAttempts, breakerState, breakerTransitions)
+	app.exemplarRandom = app.random.stream("exemplars")
+	app.resilience = newOutboundResilience(config.Breaker, app.random.stream("resilience"), outboundAttempts, breakerState, breakerTransitions)
+
+	app.phase = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "traffic_phase",
+		Help: "Active traffic phase, always 1 and only present for the active phase",
+	}, []string{"phase"})
+	app.phaseChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "traffic_phase_changes_total",
+		Help: "Number of times each traffic phase started",
+	}, []string{"phase"})
+	prometheus.MustRegister(app.phase, app.phaseChanges)
+
+	pressureUsage := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "simulated_pressure",
+		Help: "Resources held by the pressure actions, by resource",
+	}, []string{"resource"})
+	prometheus.MustRegister(pressureUsage)
+	app.pressure = newPressure(pressureUsage)
+
+	var err error
+	discoveredTargets := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discovered_targets",
+		Help: "Number of targets found by discovery, by edge (\"periodic\" or the call name)",
+	}, []string{"edge"})
+	prometheus.MustRegister(discoveredTargets)
+	if config.Discovery.Mode != "" {
+		if app.discovery, err = newTargetDiscovery(config.Discovery, app.random.stream("discovery/periodic"), discoveredTargets.WithLabelValues("periodic")); err != nil {
+			log.Fatalf("Invalid discovery configuration: %v", err)
+		}
+		app.discoveries = append(app.discoveries, app.discovery)
+	}
+	for i := range app.config.CallTargets {
+		call := &app.config.CallTargets[i]
+		if call.Addressing == "" {
+			continue
+		}
+		if call.discovery, err = newTargetDiscovery(call.discoveryConfig(config.Discovery), app.random.stream("discovery/"+call.Name), discoveredTargets.WithLabelValues(call.Name)); err != nil {
+			log.Fatalf("Invalid discovery configuration for call %s: %v", call.Name, err)
+		}
+		app.discoveries = append(app.discoveries, call.discovery)
+	}
+
+	if config.SyntheticMetrics.Enabled {
+		syntheticSeries := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "synthetic_metrics_series",
+			Help: "Number of series currently exposed by the synthetic metrics generator",
+		})
+		prometheus.MustRegister(syntheticSeries)
+		app.synthetic = newSyntheticMetrics(config.SyntheticMetrics, app.random.stream("synthetic"), syntheticSeries)
+	}
+
+	app.metricsScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_endpoint_scrapes_total",
+		Help: "Scrapes of the additional metrics endpoints by endpoint, behavior and status code",
+	}, []string{"endpoint", "behavior", "code"})
+	prometheus.MustRegister(app.metricsScrapes)
+
+	if config.Push.RemoteWriteURL != "" || config.Push.PushgatewayURL != "" {
+		pushes := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metrics_pushes_total",
+			Help: "Metrics pushes by mode (remote-write or pushgateway) and outcome",
+		}, []string{"mode", "outcome"})
+		prometheus.MustRegister(pushes)
+		var source prometheus.Gatherer = prometheus.DefaultGatherer
+		if config.Push.Source == "synthetic" {
+			source = app.synthetic.registry
+		}
+		app.pusher = newMetricsPusher(config.Push, config.ServiceName, source, pushes)
+	}
+
+	if config.StatsD.Address != "" {
+		statsdPackets := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statsd_packets_total",
+			Help: "StatsD datagrams by outcome (sent or error)",
+		}, []string{"outcome"})
+		prometheus.MustRegister(statsdPackets)
+		if app.statsd, err = newStatsdEmitter(config.StatsD, config.ServiceName, app.random.stream("statsd"), statsdPackets); err != nil {
+			log.Fatalf("Invalid StatsD configuration: %v", err)
+		}
+		log.Printf("Emitting request metrics as %s", app.statsd)
+	}
+
+	if config.Tracing.Exporter != "" {
+		spans := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "trace_spans_total",
+			Help: "Sampled spans by outcome (exported, failed, or dropped)",
+		}, []string{"outcome"})
+		prometheus.MustRegister(spans)
+		if app.tracer, err = newTracer(config.Tracing, config.ServiceName, app.random.stream("tracing"), spans); err != nil {
+			log.Fatalf("Invalid tracing configuration: %v", err)
+		}
+	}
+
+	if config.LogEmit.Protocol != "" {
+		logRecords := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "log_emitter_records_total",
+			Help: "Log records sent to the syslog or Fluent Forward receiver by source (app or generated) and outcome (sent, failed, or dropped)",
+		}, []string{"source", "outcome"})
+		prometheus.MustRegister(logRecords)
+		if app.logEmitter, err = newLogEmitter(config.LogEmit, config.ServiceName, app.random.stream("logemit"), logRecords); err != nil {
+			log.Fatalf("Invalid log emitter configuration: %v", err)
+		}
+		if config.LogEmit.AppLogs {
+			log.SetOutput(io.MultiWriter(os.Stderr, app.logEmitter))
+		}
+		log.Printf("Sending logs by %s", app.logEmitter)
+	}
 
 	// Setup HTTP routes if HTTP protocol is enabled
-	if config.Protocol == "http" || config.Protocol == "all" {
+	if config.Protocol == "http" || config.Protocol == "http3" || config.Protocol == "all" {
 		app.setupHTTPRoutes()
 	}
 
@@ -131,9 +456,19 @@ func (a *App) setupHTTPRoutes() {
 	a.router.HandleFunc("/api/data", a.dataHandler).Methods("GET")
 	a.router.HandleFunc("/api/users/{id}", a.userHandler).Methods("GET")
 	a.router.HandleFunc("/api/call-target", a.callTargetHandler).Methods("GET")
+	a.router.HandleFunc("/api/chain", a.chainHandler).Methods("GET")
+
+	// Resource-pressure endpoints, only when enabled
+	if a.config.AdminEndpoints {
+		a.router.HandleFunc("/admin/pressure", a.pressureStateHandler).Methods("GET")
+		a.router.HandleFunc("/admin/{action}", a.pressureHandler).Methods("POST", "DELETE")
+	}
+
+	// Effective configuration
+	a.router.HandleFunc("/config", a.configHandler).Methods("GET")
 
 	// Metrics endpoint
-	a.router.Handle("/metrics", promhttp.Handler())
+	a.router.Handle("/metrics", a.metricsHandler())
 
 	// Root endpoint
 	a.router.HandleFunc("/", a.rootHandler).Methods("GET")
@@ -144,8 +479,36 @@ func (a *App) setupHTTPRoutes() {
 
 func (a *App) requestCounterMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		a.requests.Inc()
-		next.ServeHTTP(w, r)
+		route := r.URL.Path
+		if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			route = template
+		}
+		ctx, span := a.tracer.start(r.Context(), r.Method+" "+route, "server", extractSpanContext(r.Header.Get))
+		traceID := a.requestTrace(w, r, span)
+		a.countRequest(traceID)
+		a.crashIfArmed(fmt.Sprintf("HTTP %s %s", r.Method, r.URL.Path))
+
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		span.setAttribute("http.request.method", r.Method)
+		span.setAttribute("http.route", route)
+		span.setAttribute("url.path", r.URL.Path)
+		defer func() {
+			span.setAttribute("http.response.status_code", strconv.Itoa(recorder.status))
+			if recorder.status >= 500 {
+				span.finish(http.StatusText(recorder.status))
+			} else {
+				span.finish("")
+			}
+		}()
+		r = r.WithContext(ctx)
+		a.receiveFlow(r)
+		if a.statsd != nil {
+			finish := a.statsd.start("http", r.RemoteAddr)
+			defer func() { finish(r.Method, strconv.Itoa(recorder.status)) }()
+		}
+		next.ServeHTTP(recorder, r)
+		a.observeRequest(r.Method, recorder.status, time.Since(started), traceID)
 	})
 }
 
@@ -157,6 +520,11 @@ func (a *App) healthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	// Fail health checks while shutting down so the endpoint is removed
+	if a.draining.Load() {
+		response.Status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -186,6 +554,11 @@ func (a *App) userHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) callTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if len(a.config.CallTargets) > 0 {
+		a.fanOutHandler(w, r)
+		return
+	}
+
 	if a.config.TargetURL == "" {
 		http.Error(w, "No target URL configured", http.StatusBadRequest)
 		return
@@ -193,31 +566,19 @@ func (a *App) callTargetHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Making HTTP request to target: %s", a.config.TargetURL)
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	resp, err := client.Get(a.config.TargetURL + "/health")
-	if err != nil {
+	resp, err := a.fetchHTTP(r.Context(), a.config.TargetURL+"/health", a.config.Retry)
+	if err != nil && resp.status == 0 {
 		log.Printf("Error calling target: %v", err)
 		http.Error(w, fmt.Sprintf("Error calling target: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, fmt.Sprintf("Error reading response: %v", err), http.StatusInternalServerError)
-		return
-	}
 
 	response := map[string]interface{}{
 		"message":         "Successfully called target service",
 		"service":         a.config.ServiceName,
 		"target_url":      a.config.TargetURL,
-		"target_status":   resp.StatusCode,
-		"target_response": string(body),
+		"target_status":   resp.status,
+		"target_response": string(resp.body),
 		"timestamp":       time.Now().UTC().Format(time.RFC3339),
 	}
 
@@ -225,10 +586,22 @@ func (a *App) callTargetHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+func (a *App) fanOutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Calling %d target services (%s)", len(a.config.CallTargets), a.config.CallMode)
+
+	response, ok := a.fanOut(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 func (a *App) rootHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"service":   a.config.ServiceName,
-		"endpoints": []string{"/health", "/api/data", "/api/users/{id}", "/api/call-target", "/metrics"},
+		"endpoints": []string{"/health", "/api/data", "/api/users/{id}", "/api/call-target", "/api/chain", "/config", "/metrics"},
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 	}
 
@@ -236,10 +609,44 @@ func (a *App) rootHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+func (a *App) configHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"service":  a.config.ServiceName,
+		"settings": a.settings,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (a *App) Start() error {
 	log.Printf("Starting %s server with protocol: %s on port %d", a.config.ServiceName, a.config.Protocol, a.config.Port)
 	log.Printf("Target URL: %s, Target Host: %s, Target Port: %d", a.config.TargetURL, a.config.TargetHost, a.config.TargetPort)
 
+	for _, discovery := range a.discoveries {
+		log.Printf("Discovering targets: %s, refreshed every %s", discovery, discovery.config.Refresh)
+		go discovery.run(a.stopCh)
+	}
+
+	if a.synthetic != nil {
+		a.startSyntheticMetrics()
+	}
+	if err := a.startMetricsEndpoints(a.metricsScrapes); err != nil {
+		return err
+	}
+	if a.tracer != nil {
+		log.Printf("Exporting spans by %s", a.tracer)
+		go a.tracer.run(a.stopCh)
+	}
+	if a.logEmitter != nil && a.config.LogEmit.Rate > 0 {
+		log.Printf("Generating %g log messages per second with severities %s", a.config.LogEmit.Rate, strings.Join(a.config.LogEmit.Severities, ","))
+		go a.logEmitter.generate(a.stopCh)
+	}
+	if a.pusher != nil {
+		log.Printf("Pushing %s every %s", a.pusher, a.config.Push.Interval)
+		go a.pusher.run(a.stopCh)
+	}
+
 	switch a.config.Protocol {
 	case "http":
 		return a.startHTTPServer()
@@ -247,8 +654,20 @@ func (a *App) Start() error {
 		return a.startGRPCServer()
 	case "tcp":
 		return a.startTCPServer()
+	case "mqtt":
+		return a.startMQTTServer()
+	case "memcached":
+		return a.startMemcachedServer()
+	case "mongo":
+		return a.startMongoServer()
+	case "amqp":
+		return a.startAMQPServer()
+	case "http3":
+		return a.startHTTP3Server()
 	case "all":
-		// Start all servers
+		// Start the HTTP, gRPC and TCP servers. MQTT and AMQP are left out:
+		// their clients hold one broker session instead of following the
+		// phases, so a broker runs in pods of its own mode
 		go a.startGRPCServer()
 		go a.startTCPServer()
 		return a.startHTTPServer()
@@ -264,7 +683,7 @@ func (a *App) startHTTPServer() error {
 	}
 
 	// Start periodic client requests if target is configured
-	if a.config.TargetURL != "" || a.config.TargetHost != "" {
+	if a.hasURLTarget() || a.hasHostTarget() || len(a.config.Flows) > 0 {
 		go a.startPeriodicRequests()
 	}
 
@@ -285,13 +704,50 @@ func (a *App) startGRPCServer() error {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	a.grpcServer = grpc.NewServer()
+	a.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		a.crashIfArmed("gRPC " + info.FullMethod)
+
+		var remote *spanContext
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			remote = extractSpanContext(func(key string) string {
+				if values := md.Get(key); len(values) > 0 {
+					return values[0]
+				}
+				return ""
+			})
+		}
+		ctx, span := a.tracer.start(ctx, strings.TrimPrefix(info.FullMethod, "/"), "server", remote)
+		span.setAttribute("rpc.system", "grpc")
+		span.setAttribute("rpc.method", info.FullMethod)
+
+		var finish func(method, status string)
+		if a.statsd != nil {
+			var client string
+			if p, ok := peer.FromContext(ctx); ok {
+				client = p.Addr.String()
+			}
+			finish = a.statsd.start("grpc", client)
+		}
+		resp, err := handler(ctx, req)
+		code := status.Code(err)
+		if finish != nil {
+			finish(path.Base(info.FullMethod), code.String())
+		}
+		span.setAttribute("rpc.grpc.status_code", strconv.Itoa(int(code)))
+		if err != nil {
+			span.finish(err.Error())
+		} else {
+			span.finish("")
+		}
+		return resp, err
+	}))
 	pb.RegisterTestCommunicatorServer(a.grpcServer, &testCommunicatorServer{
 		serviceName: a.config.ServiceName,
+		app:         a,
 	})
 
 	// Start periodic client requests if target is configured
-	if a.config.TargetHost != "" {
+	if a.hasHostTarget() {
 		go a.startPeriodicRequests()
 	}
 
@@ -306,27 +762,49 @@ func (a *App) startGRPCServer() error {
 }
 
 func (a *App) startTCPServer() error {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", a.config.Port))
-	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+	if a.config.TCPFraming != "stream" {
+		if _, err := newTCPFramer(a.config.TCPFraming, a.config.TCPRecordSize); err != nil {
+			return err
+		}
 	}
 
-	a.tcpServer = lis
+	if err := a.serveTCP("TCP", a.handleTCPConnection); err != nil {
+		return err
+	}
 
 	// Start periodic client requests if target is configured
-	if a.config.TargetHost != "" {
+	if a.hasHostTarget() {
 		go a.startPeriodicRequests()
 	}
 
+	return nil
+}
+
+// serveTCP listens on the configured port and hands every accepted connection
+// to handle in its own goroutine. It is shared by all raw TCP based protocols.
+func (a *App) serveTCP(name string, handle func(net.Conn)) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", a.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+
+	a.tcpServer = lis
+
 	go func() {
-		log.Printf("TCP server listening on :%d", a.config.Port)
+		log.Printf("%s server listening on :%d", name, a.config.Port)
 		for {
 			conn, err := lis.Accept()
 			if err != nil {
-				log.Printf("TCP server accept error: %v", err)
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("%s server accept error: %v", name, err)
+				}
 				return
 			}
-			go a.handleTCPConnection(conn)
+			a.tcpConns.add(conn)
+			go func() {
+				defer a.tcpConns.remove(conn)
+				handle(conn)
+			}()
 		}
 	}()
 
@@ -337,105 +815,246 @@ func (a *App) handleTCPConnection(conn net.Conn) {
 	defer conn.Close()
 	a.requests.Inc()
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("TCP received: %s", line)
+	if a.config.TCPFraming == "stream" {
+		a.handleTCPStream(conn)
+		return
+	}
 
-		var response string
-		switch {
-		case strings.Contains(line, "health"):
-			response = fmt.Sprintf(`{"status":"healthy","service":"%s","timestamp":"%s"}`,
-				a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
-		case strings.Contains(line, "data"):
-			response = fmt.Sprintf(`{"message":"Data retrieved successfully via TCP","service":"%s","timestamp":"%s","items":["item1","item2","item3"],"count":3,"active":true}`,
-				a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
-		default:
-			response = fmt.Sprintf(`{"message":"TCP server response","service":"%s","timestamp":"%s"}`,
-				a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
+	framer, err := newTCPFramer(a.config.TCPFraming, a.config.TCPRecordSize)
+	if err != nil {
+		log.Printf("TCP connection error: %v", err)
+		return
+	}
+
+	opened := time.Now()
+	requests := 0
+	reader := bufio.NewReader(conn)
+	for {
+		if a.config.TCPIdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(a.config.TCPIdleTimeout))
+		}
+
+		a.tcpConns.setIdle(conn, true)
+		request, err := framer.readFrame(reader)
+		a.tcpConns.setIdle(conn, false)
+		if err != nil {
+			if a.draining.Load() {
+				log.Printf("TCP connection from %s closed for shutdown", conn.RemoteAddr())
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("TCP connection from %s idle for %s, closing", conn.RemoteAddr(), a.config.TCPIdleTimeout)
+			} else if err != io.EOF {
+				log.Printf("TCP read error from %s: %v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+		requests++
+		log.Printf("TCP received: %s", request)
+		a.crashIfArmed("TCP request from " + conn.RemoteAddr().String())
+
+		// TCP frames carry no trace context, so every request starts a trace
+		_, span := a.tracer.start(context.Background(), "TCP request", "server", nil)
+		span.setAttribute("network.peer.address", conn.RemoteAddr().String())
+		span.setAttribute("tcp.framing", a.config.TCPFraming)
+		var finish func(method, status string)
+		if a.statsd != nil {
+			finish = a.statsd.start("tcp", conn.RemoteAddr().String())
+		}
+		if err := framer.writeFrame(conn, []byte(a.tcpResponse(string(request)))); err != nil {
+			if finish != nil {
+				finish(a.config.TCPFraming, "error")
+			}
+			span.finish(err.Error())
+			log.Printf("TCP write error to %s: %v", conn.RemoteAddr(), err)
+			break
 		}
+		if finish != nil {
+			finish(a.config.TCPFraming, "ok")
+		}
+		span.finish("")
 
-		conn.Write([]byte(response + "\n"))
+		// Finish the in-flight request, then close for shutdown
+		if a.draining.Load() {
+			log.Printf("TCP connection from %s closed for shutdown after in-flight request", conn.RemoteAddr())
+			break
+		}
 	}
+
+	log.Printf("TCP connection from %s closed after %d requests, lifetime %s", conn.RemoteAddr(), requests, time.Since(opened).Round(time.Millisecond))
 }
 
-func (a *App) startPeriodicRequests() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+func (a *App) tcpResponse(request string) string {
+	switch {
+	case strings.Contains(request, "health"):
+		return fmt.Sprintf(`{"status":"healthy","service":"%s","timestamp":"%s"}`,
+			a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
+	case strings.Contains(request, "data"):
+		return fmt.Sprintf(`{"message":"Data retrieved successfully via TCP","service":"%s","timestamp":"%s","items":["item1","item2","item3"],"count":3,"active":true}`,
+			a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
+	default:
+		return fmt.Sprintf(`{"message":"TCP server response","service":"%s","timestamp":"%s"}`,
+			a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
+	}
+}
 
-	log.Printf("Starting periodic requests to target every minute")
+// handleTCPStream consumes a raw byte stream until the client half-closes
+// the connection and answers with a single summary line.
+func (a *App) handleTCPStream(conn net.Conn) {
+	opened := time.Now()
+	_, span := a.tracer.start(context.Background(), "TCP stream", "server", nil)
+	span.setAttribute("network.peer.address", conn.RemoteAddr().String())
+	status := "ok"
+	if a.statsd != nil {
+		finish := a.statsd.start("tcp", conn.RemoteAddr().String())
+		defer func() { finish("stream", status) }()
+	}
+	// A stream has no request boundaries to wait for, so draining ends it
+	// at once and the bytes received so far are acknowledged
+	a.tcpConns.setIdle(conn, true)
+	received, err := io.Copy(io.Discard, conn)
+	a.tcpConns.setIdle(conn, false)
+	span.setAttribute("tcp.bytes_received", strconv.FormatInt(received, 10))
+	if a.tcpConns.woken(err) {
+		log.Printf("TCP stream from %s ended for shutdown", conn.RemoteAddr())
+		conn.SetReadDeadline(time.Time{})
+		err = nil
+	}
+	if err != nil {
+		status = "error"
+		span.finish(err.Error())
+		log.Printf("TCP stream read error from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	span.finish("")
+
+	log.Printf("TCP stream from %s received %d bytes in %s", conn.RemoteAddr(), received, time.Since(opened).Round(time.Millisecond))
+	response := fmt.Sprintf(`{"message":"TCP stream received","service":"%s","bytes":%d,"timestamp":"%s"}`,
+		a.config.ServiceName, received, time.Now().UTC().Format(time.RFC3339))
+	conn.Write([]byte(response + "\n"))
+}
+
+func (a *App) startPeriodicRequests() {
+	now := time.Now()
+	scheduler := newPhaseScheduler(a.config.Phases, a.config.PhasesRepeat, now)
 
-	// Make an initial request after 30 seconds to avoid startup race conditions
-	time.Sleep(30 * time.Second)
-	a.makeTargetRequest()
+	log.Printf("Starting periodic requests to target (%d phases)", len(a.config.Phases))
 
 	for {
+		changed, due := scheduler.advance(now)
+		if changed {
+			a.enterPhase(scheduler.current, scheduler.end)
+		}
+		if due {
+			a.makeTargetRequest(scheduler.current)
+		}
+
+		// Without a wake-up time nothing happens until the app stops
+		var wake <-chan time.Time
+		var timer *time.Timer
+		if next := scheduler.wake(); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			wake = timer.C
+		}
+
 		select {
-		case <-ticker.C:
-			a.makeTargetRequest()
+		case now = <-wake:
 		case <-a.stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
 			log.Println("Stopping periodic requests")
 			return
 		}
 	}
 }
 
-func (a *App) makeTargetRequest() {
-	switch a.config.Protocol {
-	case "http":
-		a.makeHTTPTargetRequest()
-	case "grpc":
-		a.makeGRPCTargetRequest()
-	case "tcp":
-		a.makeTCPTargetRequest()
-	case "all":
-		// Make requests with all protocols
-		a.makeHTTPTargetRequest()
-		a.makeGRPCTargetRequest()
-		a.makeTCPTargetRequest()
+// enterPhase logs and records a phase change. Tests can wait for the
+// "Phase started" log line or the traffic_phase metric.
+func (a *App) enterPhase(phase *Phase, end time.Time) {
+	until := "open-ended"
+	if !end.IsZero() {
+		until = "until " + end.UTC().Format(time.RFC3339)
 	}
+	log.Printf("Phase started: %s, %s", phase, until)
+
+	a.phase.Reset()
+	a.phase.WithLabelValues(phase.Name).Set(1)
+	a.phaseChanges.WithLabelValues(phase.Name).Inc()
 }
 
-func (a *App) makeHTTPTargetRequest() {
-	if a.config.TargetURL == "" {
-		return
+func (a *App) makeTargetRequest(phase *Phase) {
+	for _, edge := range a.periodicEdges() {
+		if !phase.runs(edge.protocol) {
+			continue
+		}
+		if edge.fixed {
+			edge.run(edge.target)
+			continue
+		}
+		addressing := "static"
+		if a.discovery != nil {
+			addressing = a.discovery.mode()
+		}
+		targets := a.hostTargets()
+		if edge.url {
+			targets = a.urlTargets()
+		}
+		if len(targets) == 0 {
+			log.Printf("No %s targets discovered yet, skipping periodic request", edge.protocol)
+		}
+		for _, target := range targets {
+			log.Printf("Periodic %s edge to %s (%s addressing)", edge.protocol, target, addressing)
+			edge.run(target)
+		}
 	}
+}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+func (a *App) makeHTTPTargetRequest(target string) {
+	log.Printf("Making periodic HTTP request to target: %s (connection policy: %s)", target, a.config.HTTPClient.Connection)
+
+	// Issue the configured number of requests with bounded concurrency
+	slots := make(chan struct{}, max(a.config.HTTPClient.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < a.config.HTTPClient.RequestsPerInterval; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			a.makeHTTPHealthRequest(target)
+		}()
 	}
+	wg.Wait()
+}
 
-	log.Printf("Making periodic HTTP request to target: %s", a.config.TargetURL)
-
-	resp, err := client.Get(a.config.TargetURL + "/health")
-	if err != nil {
-		log.Printf("Error in periodic HTTP request to target: %v", err)
-		return
+func (a *App) makeHTTPHealthRequest(target string) {
+	ctx, span := a.tracer.start(context.Background(), "GET", "client", nil)
+	span.setAttribute("http.request.method", "GET")
+	span.setAttribute("url.full", target+"/health")
+	resp, err := a.fetchHTTP(ctx, target+"/health", a.config.Retry)
+	if resp.status != 0 {
+		span.setAttribute("http.response.status_code", strconv.Itoa(resp.status))
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Error reading periodic HTTP response: %v", err)
+		span.finish(err.Error())
+	} else {
+		span.finish("")
+	}
+	if err != nil && resp.status == 0 {
+		log.Printf("Error in periodic HTTP request to target: %v", err)
 		return
 	}
 
-	bodyPreview := string(body)
+	bodyPreview := string(resp.body)
 	truncatedInfo := ""
 	if len(bodyPreview) > 100 {
 		bodyPreview = bodyPreview[:100] + "..."
 		truncatedInfo = " (truncated)"
 	}
-	log.Printf("Periodic HTTP request successful - Status: %d, Response%s: %s", resp.StatusCode, truncatedInfo, bodyPreview)
+	log.Printf("Periodic HTTP request successful - Status: %d, Response%s: %s", resp.status, truncatedInfo, bodyPreview)
 }
 
-func (a *App) makeGRPCTargetRequest() {
-	if a.config.TargetHost == "" {
-		return
-	}
-
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", a.config.TargetHost, a.config.TargetPort),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+func (a *App) makeGRPCTargetRequest(target string) {
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Printf("Error connecting to gRPC target: %v", err)
 		return
@@ -443,80 +1062,257 @@ func (a *App) makeGRPCTargetRequest() {
 	defer conn.Close()
 
 	client := pb.NewTestCommunicatorClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
-	log.Printf("Making periodic gRPC request to target: %s:%d", a.config.TargetHost, a.config.TargetPort)
+	log.Printf("Making periodic gRPC request to target: %s", target)
 
-	resp, err := client.Health(ctx, &pb.HealthRequest{})
+	ctx, span := a.tracer.start(context.Background(), "testcommunicator.TestCommunicator/Health", "client", nil)
+	span.setAttribute("rpc.system", "grpc")
+	span.setAttribute("server.address", target)
+	span.inject(func(key, value string) { ctx = metadata.AppendToOutgoingContext(ctx, key, value) })
+	resp, err := callWithPolicy(ctx, a.resilience, target, a.config.Retry, func(ctx context.Context) (*pb.HealthResponse, string, error) {
+		resp, err := client.Health(ctx, &pb.HealthRequest{})
+		return resp, grpcOutcome(ctx, err), err
+	})
 	if err != nil {
+		span.finish(err.Error())
 		log.Printf("Error in periodic gRPC request: %v", err)
 		return
 	}
+	span.finish("")
 
 	log.Printf("Periodic gRPC request successful - Response: %v", resp)
 }
 
-func (a *App) makeTCPTargetRequest() {
-	if a.config.TargetHost == "" {
+func (a *App) makeTCPTargetRequest(target string) {
+	if a.config.TCPFraming == "stream" {
+		a.makeTCPStreamRequest(target)
 		return
 	}
 
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", a.config.TargetHost, a.config.TargetPort), 10*time.Second)
+	framer, err := newTCPFramer(a.config.TCPFraming, a.config.TCPRecordSize)
+	if err != nil {
+		log.Printf("Error in periodic TCP request: %v", err)
+		return
+	}
+
+	c := a.tcpPool.get(target)
+	reused := c != nil
+	if c == nil {
+		conn, err := a.dialTCPTarget(target)
+		if err != nil {
+			log.Printf("Error connecting to TCP target: %v", err)
+			return
+		}
+		c = &tcpClientConn{conn: conn, address: target, opened: time.Now()}
+		c.reader = bufio.NewReader(c)
+	}
+
+	log.Printf("Making periodic TCP request to target: %s (framing: %s, reused connection: %t)",
+		target, a.config.TCPFraming, reused)
+
+	for i := 0; i < a.config.TCPRequestsPerConnection; i++ {
+		// Send health check request
+		if err := framer.writeFrame(c, []byte("health")); err != nil {
+			log.Printf("Error writing to TCP connection: %v", err)
+			c.conn.Close()
+			return
+		}
+		c.requests++
+
+		// Half-close after the last request; the response still arrives
+		if a.config.TCPHalfClose && i == a.config.TCPRequestsPerConnection-1 {
+			if err := closeWrite(c.conn); err != nil {
+				log.Printf("Error half-closing TCP connection: %v", err)
+			}
+		}
+
+		// Read response
+		response, err := framer.readFrame(c.reader)
+		if err != nil {
+			log.Printf("Error reading TCP response: %v", err)
+			c.conn.Close()
+			return
+		}
+		log.Printf("Periodic TCP request successful - Response: %s", response)
+	}
+
+	if !a.config.TCPHalfClose && a.tcpPool.put(c) {
+		return
+	}
+
+	if a.config.TCPHalfClose {
+		// Wait for the server to close its side as well
+		c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		io.Copy(io.Discard, c.reader)
+	}
+	c.conn.Close()
+	log.Printf("TCP connection to target closed after %d requests, lifetime %s, %d bytes sent, %d bytes received",
+		c.requests, time.Since(c.opened).Round(time.Millisecond), c.written, c.read)
+}
+
+// makeTCPStreamRequest streams TCPStreamBytes of raw data to the target,
+// half-closes the connection and reads the server's summary.
+func (a *App) makeTCPStreamRequest(target string) {
+	conn, err := a.dialTCPTarget(target)
 	if err != nil {
 		log.Printf("Error connecting to TCP target: %v", err)
 		return
 	}
 	defer conn.Close()
 
-	log.Printf("Making periodic TCP request to target: %s:%d", a.config.TargetHost, a.config.TargetPort)
+	log.Printf("Making periodic TCP stream of %d bytes to target: %s", a.config.TCPStreamBytes, target)
 
-	// Send health check request
-	_, err = conn.Write([]byte("health\n"))
+	started := time.Now()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	response, err := streamTCP(conn, a.config.TCPStreamBytes)
 	if err != nil {
-		log.Printf("Error writing to TCP connection: %v", err)
+		log.Printf("Error in TCP stream: %v", err)
 		return
 	}
+	log.Printf("Periodic TCP stream successful in %s - Response: %s", time.Since(started).Round(time.Millisecond), response)
+}
 
-	// Read response
-	scanner := bufio.NewScanner(conn)
-	if scanner.Scan() {
-		response := scanner.Text()
-		log.Printf("Periodic TCP request successful - Response: %s", response)
-	} else {
-		log.Printf("Error reading TCP response: %v", scanner.Err())
+// streamTCP writes size bytes of raw data to conn, half-closes it and
+// returns the summary line the server answers with.
+func streamTCP(conn net.Conn, size int) (string, error) {
+	chunk := []byte(strings.Repeat("x", 32*1024))
+	for remaining := size; remaining > 0; remaining -= len(chunk) {
+		if _, err := conn.Write(chunk[:min(remaining, len(chunk))]); err != nil {
+			return "", fmt.Errorf("writing stream: %w", err)
+		}
+	}
+	if err := closeWrite(conn); err != nil {
+		return "", fmt.Errorf("half-closing connection: %w", err)
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading response: %w", err)
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// closeWrite half-closes conn, for connections that support it.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return fmt.Errorf("%T does not support half-closing", conn)
+}
+
+func (a *App) dialTCPTarget(address string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: a.config.TCPKeepAlive,
 	}
+	return dialer.Dial("tcp", address)
 }
 
+// Stop shuts the servers down within ShutdownTimeout. Health checks fail for
+// PreStopDelay first, then periodic traffic stops and all servers drain in
+// parallel; whatever is still running shortly before the deadline is closed,
+// and the last spans and log records are flushed in the time left.
 func (a *App) Stop() error {
-	log.Println("Shutting down servers...")
+	log.Printf("Shutting down servers (deadline %s)...", a.config.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
+	defer cancel()
+
+	// Servers drain until shortly before the deadline, leaving the rest for
+	// exporting the last spans and sending the last log records
+	drainCtx, cancelDrain := context.WithTimeout(ctx, a.config.ShutdownTimeout-shutdownFlushBudget(a.config.ShutdownTimeout))
+	defer cancelDrain()
+
+	a.draining.Store(true)
+	if a.config.PreStopDelay > 0 {
+		log.Printf("Failing health checks for %s before draining", a.config.PreStopDelay)
+		select {
+		case <-time.After(a.config.PreStopDelay):
+		case <-drainCtx.Done():
+		}
+	}
 
 	// Signal periodic requests to stop
 	close(a.stopCh)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
+	var mu sync.Mutex
 	var errors []error
+	var wg sync.WaitGroup
+	shutdown := func(name string, stop func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stop(); err != nil {
+				mu.Lock()
+				errors = append(errors, fmt.Errorf("%s shutdown error: %v", name, err))
+				mu.Unlock()
+			}
+		}()
+	}
 
 	// Stop HTTP server
 	if a.httpServer != nil {
-		if err := a.httpServer.Shutdown(ctx); err != nil {
-			errors = append(errors, fmt.Errorf("HTTP server shutdown error: %v", err))
-		}
+		shutdown("HTTP server", func() error { return drainServer(drainCtx, "HTTP server", a.httpServer) })
+	}
+
+	// Stop HTTP/3 server
+	if a.http3Server != nil {
+		shutdown("HTTP/3 server", func() error { return drainServer(drainCtx, "HTTP/3 server", a.http3Server) })
+	}
+
+	// Stop synthetic metrics server
+	if a.synthetic != nil {
+		shutdown("Synthetic metrics server", func() error {
+			return drainServer(drainCtx, "Synthetic metrics server", a.synthetic.server)
+		})
+	}
+
+	// Stop additional metrics endpoints
+	for _, server := range a.metricsServers {
+		name := "Metrics endpoint server " + server.Addr
+		shutdown(name, func() error { return drainServer(drainCtx, name, server) })
 	}
 
-	// Stop gRPC server
+	// Stop gRPC server, forcing it once the deadline passes
 	if a.grpcServer != nil {
-		a.grpcServer.GracefulStop()
+		shutdown("gRPC server", func() error {
+			stopped := make(chan struct{})
+			go func() {
+				a.grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-drainCtx.Done():
+				a.grpcServer.Stop()
+				log.Printf("Forced gRPC server to stop at the shutdown deadline")
+				return nil
+			}
+		})
 	}
 
-	// Stop TCP server
+	// Stop accepting TCP connections and drain the open ones
 	if a.tcpServer != nil {
-		if err := a.tcpServer.Close(); err != nil {
-			errors = append(errors, fmt.Errorf("TCP server shutdown error: %v", err))
-		}
+		shutdown("TCP server", func() error {
+			if err := a.tcpServer.Close(); err != nil {
+				return err
+			}
+			a.tcpConns.drain(drainCtx)
+			return nil
+		})
+	}
+
+	wg.Wait()
+
+	// Close pooled client connections
+	a.tcpPool.close()
+	a.tracer.flush(ctx)
+	a.httpClients.closeIdleConnections()
+	if a.http3Transport != nil {
+		a.http3Transport.Close()
 	}
+	a.logEmitter.flush(ctx)
 
 	if len(errors) > 0 {
 		return fmt.Errorf("server shutdown errors: %v", errors)
@@ -525,37 +1321,88 @@ func (a *App) Stop() error {
 	return nil
 }
 
-func main() {
-	app := NewApp()
+// drainableServer is an HTTP or HTTP/3 server that can drain and be closed.
+type drainableServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
 
-	if err := app.Start(); err != nil {
-		log.Fatalf("Failed to start application: %v", err)
+// drainServer shuts server down gracefully and closes it if requests are
+// still running when ctx expires. Like the gRPC server and TCP connections,
+// a forced close at the deadline is logged rather than reported as an error.
+func drainServer(ctx context.Context, name string, server drainableServer) error {
+	err := server.Shutdown(ctx)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	log.Printf("Forced %s to stop at the shutdown deadline", name)
+	if err := server.Close(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
+}
 
-	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+// terminate stops the app after the termination signal and returns the exit
+// code of the process for its termination behaviour.
+func (a *App) terminate() int {
+	if err := a.Stop(); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+		return 1
+	}
 
-	if err := app.Stop(); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	if a.config.TerminationBehavior == "exit-nonzero" {
+		log.Printf("Exiting with code %d (TERMINATION_BEHAVIOR=exit-nonzero)", a.config.TerminationExitCode)
+		return a.config.TerminationExitCode
 	}
 
 	log.Println("Server exited")
+	return 0
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
+// shutdownFlushBudget is the part of the shutdown deadline kept for the
+// final flushes: a fifth of it, at most 5s.
+func shutdownFlushBudget(timeout time.Duration) time.Duration {
+	return min(timeout/5, 5*time.Second)
 }
 
-func getEnvAsInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+func main() {
+	config, settings, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	app := NewApp(config, settings)
+
+	if app.config.DryRun {
+		app.printSchedule(os.Stdout)
+		return
+	}
+
+	if err := app.Start(); err != nil {
+		log.Fatalf("Failed to start application: %v", err)
+	}
+
+	if len(app.config.Actions) > 0 {
+		go app.runScheduledActions()
+	}
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range quit {
+		if sig == syscall.SIGTERM && app.config.TerminationBehavior == "ignore-sigterm" {
+			log.Printf("Ignoring SIGTERM (TERMINATION_BEHAVIOR=ignore-sigterm)")
+			continue
 		}
+		break
 	}
-	return defaultValue
+
+	if app.config.TerminationBehavior == "crash-mid-request" {
+		app.crashMidRequest()
+	}
+
+	os.Exit(app.terminate())
 }
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memcachedVersion = "1.6.0-test-communicator"
+
+// memcachedMaxItemSize is the largest value stored, memcached's default
+// item size limit. It also bounds the binary bodies read, so a bad length
+// cannot make either end allocate without limit.
+const memcachedMaxItemSize = 1 << 20
+
+// Binary protocol constants (https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped)
+const (
+	memcachedMagicRequest  byte = 0x80
+	memcachedMagicResponse byte = 0x81
+
+	memcachedOpGet       byte = 0x00
+	memcachedOpSet       byte = 0x01
+	memcachedOpDelete    byte = 0x04
+	memcachedOpIncrement byte = 0x05
+	memcachedOpDecrement byte = 0x06
+	memcachedOpQuit      byte = 0x07
+	memcachedOpNoop      byte = 0x0a
+	memcachedOpVersion   byte = 0x0b
+
+	memcachedStatusOK          uint16 = 0x0000
+	memcachedStatusNotFound    uint16 = 0x0001
+	memcachedStatusInvalidArgs uint16 = 0x0004
+	memcachedStatusNonNumeric  uint16 = 0x0006
+	memcachedStatusUnknown     uint16 = 0x0081
+)
+
+var errMemcachedNonNumeric = errors.New("cannot increment or decrement non-numeric value")
+
+type memcachedItem struct {
+	key     string
+	flags   uint32
+	value   []byte
+	expires time.Time
+}
+
+// memcachedCache is an in-memory LRU cache holding at most capacity items.
+type memcachedCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List // most recently used at the front
+}
+
+func newMemcachedCache(capacity int) *memcachedCache {
+	return &memcachedCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *memcachedCache) get(key string) (memcachedItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.lookup(key)
+	if !ok {
+		return memcachedItem{}, false
+	}
+	c.order.MoveToFront(element)
+	return *element.Value.(*memcachedItem), true
+}
+
+func (c *memcachedCache) set(key string, flags uint32, exptime int64, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item := &memcachedItem{key: key, flags: flags, value: value, expires: memcachedExpiry(exptime)}
+	if element, ok := c.items[key]; ok {
+		element.Value = item
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(item)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*memcachedItem).key)
+	}
+}
+
+func (c *memcachedCache) delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.lookup(key)
+	if !ok {
+		return false
+	}
+	c.order.Remove(element)
+	delete(c.items, key)
+	return true
+}
+
+// incr adds delta to (or subtracts it from, when decr is set) the numeric
+// value stored at key. Decrementing below zero yields zero, as in memcached.
+func (c *memcachedCache) incr(key string, delta uint64, decr bool) (uint64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.lookup(key)
+	if !ok {
+		return 0, false, nil
+	}
+	item := element.Value.(*memcachedItem)
+
+	current, err := strconv.ParseUint(string(item.value), 10, 64)
+	if err != nil {
+		return 0, true, errMemcachedNonNumeric
+	}
+	switch {
+	case !decr:
+		current += delta
+	case delta > current:
+		current = 0
+	default:
+		current -= delta
+	}
+
+	item.value = []byte(strconv.FormatUint(current, 10))
+	c.order.MoveToFront(element)
+	return current, true, nil
+}
+
+func (c *memcachedCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// lookup returns the element for key, evicting it if it has expired.
+// The caller must hold c.mu.
+func (c *memcachedCache) lookup(key string) (*list.Element, bool) {
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*memcachedItem)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		return nil, false
+	}
+	return element, true
+}
+
+// memcachedExpiry converts a memcached exptime into an absolute time. Values
+// up to 30 days are relative seconds, larger values are Unix timestamps.
+func memcachedExpiry(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime <= 30*24*60*60:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func (a *App) startMemcachedServer() error {
+	cache := newMemcachedCache(a.config.MemcachedMaxItems)
+	if err := a.serveTCP("Memcached", func(conn net.Conn) {
+		a.handleMemcachedConnection(conn, cache)
+	}); err != nil {
+		return err
+	}
+
+	// Start periodic client requests if target is configured
+	if a.hasHostTarget() {
+		go a.startPeriodicRequests()
+	}
+
+	return nil
+}
+
+func (a *App) handleMemcachedConnection(conn net.Conn, cache *memcachedCache) {
+	defer conn.Close()
+	a.requests.Inc()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// The first byte tells the two protocols apart: binary requests always
+	// start with the request magic, text commands never do.
+	a.tcpConns.setIdle(conn, true)
+	first, err := reader.Peek(1)
+	a.tcpConns.setIdle(conn, false)
+	if err != nil {
+		return
+	}
+
+	// Between requests the connection is idle, so draining can close it
+	idle := func(idle bool) { a.tcpConns.setIdle(conn, idle && reader.Buffered() == 0) }
+	if first[0] == memcachedMagicRequest {
+		err = serveMemcachedBinary(reader, writer, cache, idle)
+	} else {
+		err = serveMemcachedText(reader, writer, cache, idle)
+	}
+	if a.tcpConns.woken(err) {
+		log.Printf("Memcached connection from %s closed for shutdown", conn.RemoteAddr())
+	} else if err != nil && err != io.EOF {
+		log.Printf("Memcached connection error from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func serveMemcachedText(reader *bufio.Reader, writer *bufio.Writer, cache *memcachedCache, idle func(bool)) error {
+	for {
+		idle(true)
+		line, err := reader.ReadString('\n')
+		idle(false)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		noreply := fields[len(fields)-1] == "noreply"
+		if noreply {
+			fields = fields[:len(fields)-1]
+		}
+
+		var response string
+		switch command := fields[0]; command {
+		case "get", "gets":
+			var sb strings.Builder
+			for _, key := range fields[1:] {
+				if item, ok := cache.get(key); ok {
+					fmt.Fprintf(&sb, "VALUE %s %d %d\r\n%s\r\n", key, item.flags, len(item.value), item.value)
+				}
+			}
+			sb.WriteString("END\r\n")
+			response = sb.String()
+		case "set", "add", "replace":
+			if len(fields) != 5 {
+				response = "CLIENT_ERROR bad command line format\r\n"
+				break
+			}
+			flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+			exptime, err2 := strconv.ParseInt(fields[3], 10, 64)
+			size, err3 := strconv.Atoi(fields[4])
+			if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+				response = "CLIENT_ERROR bad command line format\r\n"
+				break
+			}
+			if size > memcachedMaxItemSize {
+				// Swallow the data block so the next command line is read
+				if _, err := io.CopyN(io.Discard, reader, int64(size)+2); err != nil {
+					return err
+				}
+				response = "SERVER_ERROR object too large for cache\r\n"
+				break
+			}
+
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return err
+			}
+			if string(data[size:]) != "\r\n" {
+				response = "CLIENT_ERROR bad data chunk\r\n"
+				break
+			}
+
+			_, exists := cache.get(fields[1])
+			if (command == "add" && exists) || (command == "replace" && !exists) {
+				response = "NOT_STORED\r\n"
+				break
+			}
+			cache.set(fields[1], uint32(flags), exptime, data[:size])
+			response = "STORED\r\n"
+		case "delete":
+			if len(fields) < 2 {
+				response = "ERROR\r\n"
+			} else if cache.delete(fields[1]) {
+				response = "DELETED\r\n"
+			} else {
+				response = "NOT_FOUND\r\n"
+			}
+		case "incr", "decr":
+			if len(fields) != 3 {
+				response = "ERROR\r\n"
+				break
+			}
+			delta, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				response = "CLIENT_ERROR invalid numeric delta argument\r\n"
+				break
+			}
+			value, found, err := cache.incr(fields[1], delta, command == "decr")
+			switch {
+			case err != nil:
+				response = "CLIENT_ERROR " + err.Error() + "\r\n"
+			case !found:
+				response = "NOT_FOUND\r\n"
+			default:
+				response = strconv.FormatUint(value, 10) + "\r\n"
+			}
+		case "flush_all":
+			cache.flush()
+			response = "OK\r\n"
+		case "version":
+			response = "VERSION " + memcachedVersion + "\r\n"
+		case "quit":
+			return writer.Flush()
+		default:
+			response = "ERROR\r\n"
+		}
+
+		if noreply {
+			continue
+		}
+		if _, err := writer.WriteString(response); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+type memcachedBinaryRequest struct {
+	opcode byte
+	opaque uint32
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func serveMemcachedBinary(reader *bufio.Reader, writer *bufio.Writer, cache *memcachedCache, idle func(bool)) error {
+	for {
+		idle(true)
+		req, err := readMemcachedBinaryRequest(reader)
+		idle(false)
+		if err != nil {
+			return err
+		}
+
+		var (
+			status uint16
+			extras []byte
+			value  []byte
+		)
+		switch req.opcode {
+		case memcachedOpGet:
+			if item, ok := cache.get(req.key); ok {
+				extras = binary.BigEndian.AppendUint32(nil, item.flags)
+				value = item.value
+			} else {
+				status = memcachedStatusNotFound
+			}
+		case memcachedOpSet:
+			if len(req.extras) != 8 {
+				status = memcachedStatusInvalidArgs
+				break
+			}
+			flags := binary.BigEndian.Uint32(req.extras[0:4])
+			exptime := binary.BigEndian.Uint32(req.extras[4:8])
+			cache.set(req.key, flags, int64(exptime), req.value)
+		case memcachedOpDelete:
+			if !cache.delete(req.key) {
+				status = memcachedStatusNotFound
+			}
+		case memcachedOpIncrement, memcachedOpDecrement:
+			if len(req.extras) != 20 {
+				status = memcachedStatusInvalidArgs
+				break
+			}
+			delta := binary.BigEndian.Uint64(req.extras[0:8])
+			initial := binary.BigEndian.Uint64(req.extras[8:16])
+			exptime := binary.BigEndian.Uint32(req.extras[16:20])
+
+			result, found, err := cache.incr(req.key, delta, req.opcode == memcachedOpDecrement)
+			switch {
+			case err != nil:
+				status = memcachedStatusNonNumeric
+			case !found && exptime == 0xffffffff:
+				status = memcachedStatusNotFound
+			case !found:
+				cache.set(req.key, 0, int64(exptime), []byte(strconv.FormatUint(initial, 10)))
+				result = initial
+			}
+			if status == memcachedStatusOK {
+				value = binary.BigEndian.AppendUint64(nil, result)
+			}
+		case memcachedOpNoop:
+		case memcachedOpVersion:
+			value = []byte(memcachedVersion)
+		case memcachedOpQuit:
+			writeMemcachedBinaryResponse(writer, req, memcachedStatusOK, nil, nil)
+			return writer.Flush()
+		default:
+			status = memcachedStatusUnknown
+		}
+
+		if status != memcachedStatusOK && value == nil {
+			value = []byte(memcachedBinaryStatusText(status))
+		}
+		writeMemcachedBinaryResponse(writer, req, status, extras, value)
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func readMemcachedBinaryRequest(reader *bufio.Reader) (memcachedBinaryRequest, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return memcachedBinaryRequest{}, err
+	}
+	if header[0] != memcachedMagicRequest {
+		return memcachedBinaryRequest{}, fmt.Errorf("invalid request magic 0x%02x", header[0])
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLength := int(header[4])
+	bodyLength := int(binary.BigEndian.Uint32(header[8:12]))
+	if keyLength+extrasLength > bodyLength || bodyLength > memcachedMaxItemSize+keyLength+extrasLength {
+		return memcachedBinaryRequest{}, errors.New("invalid body length")
+	}
+
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return memcachedBinaryRequest{}, err
+	}
+
+	return memcachedBinaryRequest{
+		opcode: header[1],
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		extras: body[:extrasLength],
+		key:    string(body[extrasLength : extrasLength+keyLength]),
+		value:  body[extrasLength+keyLength:],
+	}, nil
+}
+
+func writeMemcachedBinaryResponse(writer io.Writer, req memcachedBinaryRequest, status uint16, extras, value []byte) error {
+	header := make([]byte, 24)
+	header[0] = memcachedMagicResponse
+	header[1] = req.opcode
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:8], status)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(value)))
+	binary.BigEndian.PutUint32(header[12:16], req.opaque)
+
+	packet := append(header, extras...)
+	packet = append(packet, value...)
+	_, err := writer.Write(packet)
+	return err
+}
+
+func memcachedBinaryStatusText(status uint16) string {
+	switch status {
+	case memcachedStatusNotFound:
+		return "Not found"
+	case memcachedStatusInvalidArgs:
+		return "Invalid arguments"
+	case memcachedStatusNonNumeric:
+		return "Non-numeric server-side value for incr or decr"
+	default:
+		return "Unknown command"
+	}
+}
+
+// memcachedClient issues single commands over either protocol and reports
+// whether a get was a hit.
+type memcachedClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	binary bool
+	opaque uint32
+}
+
+func (c *memcachedClient) set(key string, value []byte) error {
+	if c.binary {
+		extras := make([]byte, 8) // flags and exptime of zero
+		status, _, err := c.binaryRoundTrip(memcachedOpSet, extras, key, value)
+		if err == nil && status != memcachedStatusOK {
+			err = fmt.Errorf("set failed with status 0x%04x", status)
+		}
+		return err
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "set %s 0 0 %d\r\n%s\r\n", key, len(value), value); err != nil {
+		return err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != "STORED\r\n" {
+		return fmt.Errorf("set failed: %s", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func (c *memcachedClient) get(key string) (bool, error) {
+	if c.binary {
+		status, _, err := c.binaryRoundTrip(memcachedOpGet, nil, key, nil)
+		return status == memcachedStatusOK, err
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "get %s\r\n", key); err != nil {
+		return false, err
+	}
+	hit := false
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		if line == "END\r\n" {
+			return hit, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return false, fmt.Errorf("unexpected get response: %s", strings.TrimSpace(line))
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(io.Discard, c.reader, int64(size+2)); err != nil {
+			return false, err
+		}
+		hit = true
+	}
+}
+
+func (c *memcachedClient) incr(key string) (uint64, error) {
+	if c.binary {
+		// Delta 1, initial value 0 and no expiry: creates the counter on first use
+		extras := binary.BigEndian.AppendUint64(nil, 1)
+		extras = binary.BigEndian.AppendUint64(extras, 0)
+		extras = binary.BigEndian.AppendUint32(extras, 0)
+		status, value, err := c.binaryRoundTrip(memcachedOpIncrement, extras, key, nil)
+		if err != nil {
+			return 0, err
+		}
+		if status != memcachedStatusOK || len(value) != 8 {
+			return 0, fmt.Errorf("incr failed with status 0x%04x", status)
+		}
+		return binary.BigEndian.Uint64(value), nil
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "incr %s 1\r\n", key); err != nil {
+		return 0, err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSpace(line)
+	if line == "NOT_FOUND" {
+		return 0, c.set(key, []byte("0"))
+	}
+	return strconv.ParseUint(line, 10, 64)
+}
+
+func (c *memcachedClient) binaryRoundTrip(opcode byte, extras []byte, key string, value []byte) (uint16, []byte, error) {
+	c.opaque++
+
+	header := make([]byte, 24)
+	header[0] = memcachedMagicRequest
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:16], c.opaque)
+
+	packet := append(header, extras...)
+	packet = append(packet, key...)
+	packet = append(packet, value...)
+	if _, err := c.conn.Write(packet); err != nil {
+		return 0, nil, err
+	}
+
+	response := make([]byte, 24)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return 0, nil, err
+	}
+	if response[0] != memcachedMagicResponse {
+		return 0, nil, fmt.Errorf("invalid response magic 0x%02x", response[0])
+	}
+
+	extrasLength := int(response[4])
+	keyLength := int(binary.BigEndian.Uint16(response[2:4]))
+	bodyLength := int(binary.BigEndian.Uint32(response[8:12]))
+	if keyLength+extrasLength > bodyLength || bodyLength > memcachedMaxItemSize+keyLength+extrasLength {
+		return 0, nil, errors.New("invalid response body length")
+	}
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return binary.BigEndian.Uint16(response[6:8]), body[extrasLength+keyLength:], nil
+}
+
+// memcachedOp is one request of a periodic Memcached run.
+type memcachedOp struct {
+	kind string // "set", "get" or "incr"
+	key  string
+}
+
+// memcachedOperations lists the requests of a periodic run in order, for
+// sending them and for the dry run. Hits read a small set of keys written
+// first by this client, misses read keys that are never written. Spreading
+// hits evenly over the batch keeps the mix exact for any batch size. A
+// counter is incremented last.
+func (a *App) memcachedOperations() []memcachedOp {
+	prefix := a.config.ServiceName
+	hitKey := func(i int) string { return fmt.Sprintf("%s:hit:%d", prefix, i%a.config.MemcachedKeyCount) }
+
+	var ops []memcachedOp
+	for i := 0; i < min(a.config.MemcachedKeyCount, a.config.MemcachedOperations); i++ {
+		ops = append(ops, memcachedOp{kind: "set", key: hitKey(i)})
+	}
+	for i := 0; i < a.config.MemcachedOperations; i++ {
+		key := fmt.Sprintf("%s:miss:%d", prefix, i)
+		if (i+1)*a.config.MemcachedHitRatio/100 > i*a.config.MemcachedHitRatio/100 {
+			key = hitKey(i)
+		}
+		ops = append(ops, memcachedOp{kind: "get", key: key})
+	}
+	return append(ops, memcachedOp{kind: "incr", key: prefix + ":requests"})
+}
+
+func (a *App) makeMemcachedTargetRequest(address string) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		log.Printf("Error connecting to Memcached target: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client := &memcachedClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		binary: a.config.MemcachedProtocol == "binary",
+	}
+
+	log.Printf("Making periodic Memcached (%s) requests to target: %s", a.config.MemcachedProtocol, address)
+
+	hits, misses := 0, 0
+	var counter uint64
+	for _, op := range a.memcachedOperations() {
+		var err error
+		switch op.kind {
+		case "set":
+			value := fmt.Sprintf(`{"service":"%s","timestamp":"%s"}`, a.config.ServiceName, time.Now().UTC().Format(time.RFC3339))
+			err = client.set(op.key, []byte(value))
+		case "get":
+			var hit bool
+			hit, err = client.get(op.key)
+			if hit {
+				hits++
+			} else if err == nil {
+				misses++
+			}
+		case "incr":
+			counter, err = client.incr(op.key)
+		}
+		if err != nil {
+			log.Printf("Error in periodic Memcached %s: %v", op.kind, err)
+			return
+		}
+	}
+
+	log.Printf("Periodic Memcached requests successful - Hits: %d, Misses: %d, Counter: %d", hits, misses, counter)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// memcachedPipe serves one end of an in-memory connection with cache and
+// returns a client on the other end.
+func memcachedPipe(t *testing.T, cache *memcachedCache, binaryProtocol bool) *memcachedClient {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		reader, writer := bufio.NewReader(server), bufio.NewWriter(server)
+		if binaryProtocol {
+			serveMemcachedBinary(reader, writer, cache, func(bool) {})
+		} else {
+			serveMemcachedText(reader, writer, cache, func(bool) {})
+		}
+	}()
+	return &memcachedClient{conn: client, reader: bufio.NewReader(client), binary: binaryProtocol}
+}
+
+func TestMemcachedClientRoundTrip(t *testing.T) {
+	for _, protocol := range []string{"text", "binary"} {
+		t.Run(protocol, func(t *testing.T) {
+			cache := newMemcachedCache(16)
+			c := memcachedPipe(t, cache, protocol == "binary")
+
+			if hit, err := c.get("missing"); err != nil || hit {
+				t.Fatalf("get missing = %t, %v; want miss", hit, err)
+			}
+			if err := c.set("key", []byte("value with\r\nline breaks")); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if hit, err := c.get("key"); err != nil || !hit {
+				t.Fatalf("get key = %t, %v; want hit", hit, err)
+			}
+			if item, _ := cache.get("key"); string(item.value) != "value with\r\nline breaks" {
+				t.Errorf("stored value = %q", item.value)
+			}
+
+			// Counters start at 0 on first use in both protocols
+			first, err := c.incr("counter")
+			if err != nil {
+				t.Fatalf("first incr: %v", err)
+			}
+			second, err := c.incr("counter")
+			if err != nil {
+				t.Fatalf("second incr: %v", err)
+			}
+			if second != first+1 {
+				t.Errorf("incr went from %d to %d, want +1", first, second)
+			}
+		})
+	}
+}
+
+func TestMemcachedText(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"set and get", "set k 5 0 2\r\nab\r\nget k\r\n", "STORED\r\nVALUE k 5 2\r\nab\r\nEND\r\n"},
+		{"add existing", "set k 0 0 1\r\na\r\nadd k 0 0 1\r\nb\r\n", "STORED\r\nNOT_STORED\r\n"},
+		{"replace missing", "replace k 0 0 1\r\na\r\n", "NOT_STORED\r\n"},
+		{"noreply", "set k 0 0 1 noreply\r\na\r\nget k\r\n", "VALUE k 0 1\r\na\r\nEND\r\n"},
+		{"delete", "set k 0 0 1\r\na\r\ndelete k\r\ndelete k\r\n", "STORED\r\nDELETED\r\nNOT_FOUND\r\n"},
+		{"incr and decr", "set n 0 0 2\r\n10\r\nincr n 5\r\ndecr n 20\r\n", "STORED\r\n15\r\n0\r\n"},
+		{"incr non-numeric", "set n 0 0 1\r\nx\r\nincr n 1\r\n", "STORED\r\nCLIENT_ERROR " + errMemcachedNonNumeric.Error() + "\r\n"},
+		{"incr missing", "incr n 1\r\n", "NOT_FOUND\r\n"},
+		{"incr bad delta", "incr n -1\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"flush", "set k 0 0 1\r\na\r\nflush_all\r\nget k\r\n", "STORED\r\nOK\r\nEND\r\n"},
+		{"version", "version\r\n", "VERSION " + memcachedVersion + "\r\n"},
+		{"unknown command", "stats\r\n", "ERROR\r\n"},
+		{"empty line", "\r\nversion\r\n", "VERSION " + memcachedVersion + "\r\n"},
+		{"missing fields", "set k 0 0\r\ndelete\r\nincr n\r\n", "CLIENT_ERROR bad command line format\r\nERROR\r\nERROR\r\n"},
+		{"negative size", "set k 0 0 -1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"non-numeric size", "set k 0 0 abc\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"bad data chunk", "set k 0 0 1\r\nabc\r\n", "CLIENT_ERROR bad data chunk\r\n"},
+		{"too large", "set k 0 0 2000000\r\n" + strings.Repeat("x", 2000000) + "\r\nversion\r\n", "SERVER_ERROR object too large for cache\r\nVERSION " + memcachedVersion + "\r\n"},
+		{"huge size", "set k 0 0 9223372036854775807\r\n", "SERVER_ERROR object too large for cache\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writer := bufio.NewWriter(&out)
+			err := serveMemcachedText(bufio.NewReader(strings.NewReader(test.request)), writer, newMemcachedCache(16), func(bool) {})
+			writer.Flush()
+			if err != io.EOF {
+				t.Errorf("error = %v, want EOF", err)
+			}
+			if out.String() != test.want {
+				t.Errorf("response = %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+// memcachedBinaryPacket encodes a binary request with explicit lengths, so
+// tests can send lengths that disagree with the body.
+func memcachedBinaryPacket(opcode byte, keyLength, extrasLength int, bodyLength uint32, body []byte) []byte {
+	header := make([]byte, 24)
+	header[0] = memcachedMagicRequest
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(keyLength))
+	header[4] = byte(extrasLength)
+	binary.BigEndian.PutUint32(header[8:12], bodyLength)
+	binary.BigEndian.PutUint32(header[12:16], 0xdeadbeef)
+	return append(header, body...)
+}
+
+func TestReadMemcachedBinaryRequest(t *testing.T) {
+	setBody := append(make([]byte, 8), "keyvalue"...)
+	tests := []struct {
+		name    string
+		packet  []byte
+		want    memcachedBinaryRequest
+		wantErr bool
+	}{
+		{
+			name:   "set",
+			packet: memcachedBinaryPacket(memcachedOpSet, 3, 8, uint32(len(setBody)), setBody),
+			want:   memcachedBinaryRequest{opcode: memcachedOpSet, opaque: 0xdeadbeef, extras: make([]byte, 8), key: "key", value: []byte("value")},
+		},
+		{
+			name:   "noop",
+			packet: memcachedBinaryPacket(memcachedOpNoop, 0, 0, 0, nil),
+			want:   memcachedBinaryRequest{opcode: memcachedOpNoop, opaque: 0xdeadbeef, extras: []byte{}, value: []byte{}},
+		},
+		{name: "bad magic", packet: append([]byte{0x81}, make([]byte, 23)...), wantErr: true},
+		{name: "short header", packet: []byte{memcachedMagicRequest, 0}, wantErr: true},
+		{name: "key beyond body", packet: memcachedBinaryPacket(memcachedOpGet, 10, 0, 3, []byte("key")), wantErr: true},
+		{name: "extras beyond body", packet: memcachedBinaryPacket(memcachedOpSet, 0, 8, 4, make([]byte, 4)), wantErr: true},
+		{name: "huge body", packet: memcachedBinaryPacket(memcachedOpSet, 0, 0, 0xffffffff, nil), wantErr: true},
+		{name: "truncated body", packet: memcachedBinaryPacket(memcachedOpGet, 3, 0, 3, []byte("k")), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readMemcachedBinaryRequest(bufio.NewReader(bytes.NewReader(test.packet)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.opcode != test.want.opcode || got.opaque != test.want.opaque || got.key != test.want.key ||
+				!bytes.Equal(got.extras, test.want.extras) || !bytes.Equal(got.value, test.want.value) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemcachedBinaryClientRejectsBadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+	}{
+		{"bad magic", append([]byte{memcachedMagicRequest}, make([]byte, 23)...)},
+		{"key beyond body", func() []byte {
+			header := make([]byte, 24)
+			header[0] = memcachedMagicResponse
+			binary.BigEndian.PutUint16(header[2:4], 100)
+			binary.BigEndian.PutUint32(header[8:12], 2)
+			return append(header, 'o', 'k')
+		}()},
+		{"huge body", func() []byte {
+			header := make([]byte, 24)
+			header[0] = memcachedMagicResponse
+			binary.BigEndian.PutUint32(header[8:12], 0xffffffff)
+			return header
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				io.ReadFull(server, make([]byte, 24+3))
+				server.Write(test.response)
+			}()
+			c := &memcachedClient{conn: client, reader: bufio.NewReader(client), binary: true}
+			if _, _, err := c.binaryRoundTrip(memcachedOpGet, nil, "key", nil); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// metricsBehaviors are the ways a metrics endpoint can answer a scrape.
+var metricsBehaviors = []string{"ok", "slow", "partial", "invalid", "duplicate", "huge"}
+
+// MetricsEndpoint is an additional metrics endpoint, for testing scrape
+// configuration and how scrapers report failing targets. Endpoints sharing a
+// port are served by one server, so they must agree on TLS.
+type MetricsEndpoint struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Path     string `json:"path"`     // Defaults to /metrics
+	Source   string `json:"source"`   // "default" (the communicator's metrics) or "synthetic"
+	Behavior string `json:"behavior"` // "ok", "slow", "partial", "invalid", "duplicate", or "huge"
+	Delay    string `json:"delay"`    // Go duration before a "slow" endpoint answers, defaults to 30s
+	Size     string `json:"size"`     // Body size of a "huge" endpoint, such as "64Mi" (the default)
+	Auth     string `json:"auth"`     // "", "bearer", or "basic"
+	Token    string `json:"token"`    // Bearer token
+	Username string `json:"username"` // Basic auth user
+	Password string `json:"password"` // Basic auth password
+	TLS      bool   `json:"tls"`      // Serve HTTPS only, with a self-signed certificate
+
+	delay time.Duration
+	size  int64
+}
+
+// parseMetricsEndpoints decodes the METRICS_ENDPOINTS JSON array.
+func parseMetricsEndpoints(value string) ([]MetricsEndpoint, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var endpoints []MetricsEndpoint
+	if err := json.Unmarshal([]byte(value), &endpoints); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	tlsByPort := map[int]bool{}
+	paths := map[string]bool{}
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		if endpoint.Port <= 0 || endpoint.Port >= 65536 {
+			return nil, fmt.Errorf("invalid port %d for endpoint %d", endpoint.Port, i)
+		}
+		if endpoint.Path == "" {
+			endpoint.Path = "/metrics"
+		}
+		if !strings.HasPrefix(endpoint.Path, "/") {
+			return nil, fmt.Errorf("path %q for endpoint %d must start with /", endpoint.Path, i)
+		}
+		if endpoint.Name == "" {
+			endpoint.Name = fmt.Sprintf(":%d%s", endpoint.Port, endpoint.Path)
+		}
+
+		key := fmt.Sprintf("%d%s", endpoint.Port, endpoint.Path)
+		if paths[key] {
+			return nil, fmt.Errorf("endpoint %d repeats :%d%s", i, endpoint.Port, endpoint.Path)
+		}
+		paths[key] = true
+		if secure, ok := tlsByPort[endpoint.Port]; ok && secure != endpoint.TLS {
+			return nil, fmt.Errorf("endpoints on port %d must all use TLS or all not", endpoint.Port)
+		}
+		tlsByPort[endpoint.Port] = endpoint.TLS
+
+		switch endpoint.Source {
+		case "":
+			endpoint.Source = "default"
+		case "default", "synthetic":
+		default:
+			return nil, fmt.Errorf("unknown source %q for endpoint %d", endpoint.Source, i)
+		}
+		if endpoint.Behavior == "" {
+			endpoint.Behavior = "ok"
+		}
+		if !slices.Contains(metricsBehaviors, endpoint.Behavior) {
+			return nil, fmt.Errorf("unknown behavior %q for endpoint %d", endpoint.Behavior, i)
+		}
+
+		var err error
+		if endpoint.delay, err = parseDurationParam(endpoint.Delay, 30*time.Second); err != nil {
+			return nil, fmt.Errorf("invalid delay for endpoint %d: %v", i, err)
+		}
+		if endpoint.size, err = parseByteSize(endpoint.Size, 64<<20); err != nil {
+			return nil, fmt.Errorf("invalid size for endpoint %d: %v", i, err)
+		}
+
+		switch endpoint.Auth {
+		case "":
+		case "bearer":
+			if endpoint.Token == "" {
+				return nil, fmt.Errorf("endpoint %d with bearer auth needs a token", i)
+			}
+		case "basic":
+			if endpoint.Username == "" {
+				return nil, fmt.Errorf("endpoint %d with basic auth needs a username", i)
+			}
+		default:
+			return nil, fmt.Errorf("unknown auth %q for endpoint %d", endpoint.Auth, i)
+		}
+	}
+	return endpoints, nil
+}
+
+// startMetricsEndpoints serves METRICS_ENDPOINTS, one server per port.
+func (a *App) startMetricsEndpoints(scrapes *prometheus.CounterVec) error {
+	muxes := map[int]*http.ServeMux{}
+	var ports []int
+	secure := map[int]bool{}
+	anySecure := false
+	for _, endpoint := range a.config.MetricsEndpoints {
+		if muxes[endpoint.Port] == nil {
+			muxes[endpoint.Port] = http.NewServeMux()
+			ports = append(ports, endpoint.Port)
+		}
+		secure[endpoint.Port] = endpoint.TLS
+		anySecure = anySecure || endpoint.TLS
+		muxes[endpoint.Port].Handle(endpoint.Path, a.metricsEndpointHandler(endpoint, scrapes))
+	}
+
+	var certificate tls.Certificate
+	if anySecure {
+		var err error
+		if certificate, err = a.selfSignedCertificate(); err != nil {
+			return fmt.Errorf("failed to generate certificate: %v", err)
+		}
+	}
+
+	for _, port := range ports {
+		server := &http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: muxes[port],
+		}
+		if secure[port] {
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+		a.metricsServers = append(a.metricsServers, server)
+
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				log.Printf("Metrics endpoints listening on :%d (HTTPS)", port)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("Metrics endpoints listening on :%d", port)
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Metrics endpoint server on :%d failed to start: %v", port, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// metricsEndpointHandler checks the endpoint's credentials, then answers
+// with its behavior. Misbehaving endpoints always use the classic text
+// format, which is what their broken bodies are written in.
+func (a *App) metricsEndpointHandler(endpoint MetricsEndpoint, scrapes *prometheus.CounterVec) http.Handler {
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if endpoint.Source == "synthetic" {
+		gatherer = a.synthetic.registry
+	}
+	healthy := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			scrapes.WithLabelValues(endpoint.Name, endpoint.Behavior, strconv.Itoa(recorder.status)).Inc()
+		}()
+
+		if status := endpoint.authorize(r); status != http.StatusOK {
+			if endpoint.Auth == "basic" {
+				recorder.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			}
+			http.Error(recorder, http.StatusText(status), status)
+			return
+		}
+
+		if endpoint.Behavior == "ok" {
+			healthy.ServeHTTP(recorder, r)
+			return
+		}
+		if endpoint.Behavior == "slow" {
+			select {
+			case <-time.After(endpoint.delay):
+			case <-r.Context().Done():
+				return
+			case <-a.stopCh:
+				return
+			}
+			healthy.ServeHTTP(recorder, r)
+			return
+		}
+
+		body, err := gatherText(gatherer)
+		if err != nil {
+			http.Error(recorder, fmt.Sprintf("Error gathering metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recorder.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+
+		switch endpoint.Behavior {
+		case "partial":
+			// Promise the whole body but send half of it; the server then
+			// closes the connection and the scraper sees an unexpected EOF
+			recorder.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			recorder.Write(body[:len(body)/2])
+		case "invalid":
+			recorder.Write(body)
+			fmt.Fprintf(recorder, "# TYPE scrape_invalid counter\nscrape_invalid{label=\"unterminated} 1\n")
+		case "duplicate":
+			// Every sample a second time, without repeating HELP and TYPE
+			recorder.Write(body)
+			for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+				if len(line) > 0 && line[0] != '#' {
+					recorder.Write(line)
+				}
+			}
+		case "huge":
+			out := bufio.NewWriter(recorder)
+			out.Write(body)
+			written := int64(len(body))
+			fmt.Fprintf(out, "# HELP scrape_padding Padding series of a huge metrics endpoint\n# TYPE scrape_padding gauge\n")
+			for i := 0; written < endpoint.size; i++ {
+				n, err := fmt.Fprintf(out, "scrape_padding{series=\"%d\"} 1\n", i)
+				if err != nil {
+					return
+				}
+				written += int64(n)
+			}
+			out.Flush()
+		}
+	})
+}
+
+// authorize returns 200 when the request has the endpoint's credentials, 401
+// when it has none and 403 when they are wrong.
+func (endpoint MetricsEndpoint) authorize(r *http.Request) int {
+	switch endpoint.Auth {
+	case "bearer":
+		header := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return http.StatusUnauthorized
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(endpoint.Token)) != 1 {
+			return http.StatusForbidden
+		}
+	case "basic":
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return http.StatusUnauthorized
+		}
+		if username != endpoint.Username || subtle.ConstantTimeCompare([]byte(password), []byte(endpoint.Password)) != 1 {
+			return http.StatusForbidden
+		}
+	}
+	return http.StatusOK
+}
+
+// gatherText renders a gatherer's metrics in the classic text format.
+func gatherText(gatherer prometheus.Gatherer) ([]byte, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	encoder := expfmt.NewEncoder(&body, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
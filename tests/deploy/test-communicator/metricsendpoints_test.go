@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+func TestParseMetricsEndpoints(t *testing.T) {
+	endpoints, err := parseMetricsEndpoints(`[{"port":9100},{"name":"slow","port":9100,"path":"/slow","behavior":"slow","delay":"5s","source":"synthetic"},{"port":9101,"behavior":"huge","size":"1Ki","tls":true}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, slow, huge := endpoints[0], endpoints[1], endpoints[2]
+	if first.Name != ":9100/metrics" || first.Path != "/metrics" || first.Source != "default" || first.Behavior != "ok" || first.delay != 30*time.Second || first.size != 64<<20 {
+		t.Errorf("defaults not applied: %+v", first)
+	}
+	if slow.Name != "slow" || slow.delay != 5*time.Second || slow.Source != "synthetic" {
+		t.Errorf("slow endpoint %+v", slow)
+	}
+	if huge.size != 1024 || !huge.TLS {
+		t.Errorf("huge endpoint %+v", huge)
+	}
+
+	for _, value := range []string{
+		`{`,
+		`[{"port":0}]`,
+		`[{"port":65536}]`,
+		`[{"port":9100,"path":"metrics"}]`,
+		`[{"port":9100},{"port":9100}]`,
+		`[{"port":9100},{"port":9100,"path":"/other","tls":true}]`,
+		`[{"port":9100,"source":"other"}]`,
+		`[{"port":9100,"behavior":"broken"}]`,
+		`[{"port":9100,"delay":"soon"}]`,
+		`[{"port":9100,"size":"big"}]`,
+		`[{"port":9100,"auth":"bearer"}]`,
+		`[{"port":9100,"auth":"basic"}]`,
+		`[{"port":9100,"auth":"digest"}]`,
+	} {
+		if _, err := parseMetricsEndpoints(value); err == nil {
+			t.Errorf("parseMetricsEndpoints(%s): want an error", value)
+		}
+	}
+}
+
+func TestMetricsEndpointAuthorize(t *testing.T) {
+	bearer := MetricsEndpoint{Auth: "bearer", Token: "token"}
+	basic := MetricsEndpoint{Auth: "basic", Username: "user", Password: "pass"}
+	tests := []struct {
+		name     string
+		endpoint MetricsEndpoint
+		setup    func(r *http.Request)
+		want     int
+	}{
+		{"no auth", MetricsEndpoint{}, func(r *http.Request) {}, http.StatusOK},
+		{"bearer", bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"bearer missing", bearer, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer wrong", bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusForbidden},
+		{"bearer as basic", bearer, func(r *http.Request) { r.SetBasicAuth("user", "token") }, http.StatusUnauthorized},
+		{"basic", basic, func(r *http.Request) { r.SetBasicAuth("user", "pass") }, http.StatusOK},
+		{"basic missing", basic, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic wrong password", basic, func(r *http.Request) { r.SetBasicAuth("user", "other") }, http.StatusForbidden},
+		{"basic wrong user", basic, func(r *http.Request) { r.SetBasicAuth("other", "pass") }, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		test.setup(r)
+		if got := test.endpoint.authorize(r); got != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRedactEndpoints(t *testing.T) {
+	t.Setenv("METRICS_ENDPOINTS", `[{"port":9100,"auth":"bearer","token":"endpoint-secret"},{"port":9101,"auth":"basic","username":"u","password":"basic-secret"}]`)
+	_, settings, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := settingSource(settings, "METRICS_ENDPOINTS")
+	if strings.Contains(value, "secret") || !strings.Contains(value, redactedValue) || !strings.Contains(value, `"username":"u"`) {
+		t.Errorf("METRICS_ENDPOINTS = %s, want the secrets redacted and the username kept", value)
+	}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{`[{"port":1,"token":""}]`, `[{"port":1,"token":""}]`},
+		{`[{"port":1,"password":"p"}]`, `[{"password":"[redacted]","port":1}]`},
+		{`not json with a secret`, redactedValue},
+	}
+	for _, test := range tests {
+		if got := redactEndpoints(test.value); got != test.want {
+			t.Errorf("redactEndpoints(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+// parseText parses a body in the classic text format.
+func parseText(body string) (map[string]*dto.MetricFamily, error) {
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	return parser.TextToMetricFamilies(strings.NewReader(body))
+}
+
+func TestMetricsEndpointBehaviors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hits := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "hits_total", Help: "Hits."}, []string{"path"})
+	hits.WithLabelValues("/a").Add(3)
+	hits.WithLabelValues("/b").Inc()
+	registry.MustRegister(hits)
+	app := &App{synthetic: &syntheticMetrics{registry: registry}, stopCh: make(chan struct{})}
+	scrapes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "metrics_endpoint_scrapes_total"}, []string{"endpoint", "behavior", "code"})
+
+	tests := []struct {
+		behavior string
+		auth     string
+		check    func(t *testing.T, status int, body string, readErr error)
+	}{
+		{behavior: "ok", check: func(t *testing.T, status int, body string, readErr error) {
+			families, err := parseText(body)
+			if status != http.StatusOK || err != nil || len(families["hits_total"].GetMetric()) != 2 {
+				t.Errorf("status %d, parse error %v, body %q", status, err, body)
+			}
+		}},
+		{behavior: "slow", check: func(t *testing.T, status int, body string, readErr error) {
+			if status != http.StatusOK || !strings.Contains(body, `hits_total{path="/a"} 3`) {
+				t.Errorf("status %d, body %q", status, body)
+			}
+		}},
+		{behavior: "partial", check: func(t *testing.T, status int, body string, readErr error) {
+			if readErr == nil || body == "" || !strings.HasPrefix(body, "# HELP") {
+				t.Errorf("read %q with error %v, want a truncated body", body, readErr)
+			}
+		}},
+		{behavior: "invalid", check: func(t *testing.T, status int, body string, readErr error) {
+			if _, err := parseText(body); err == nil {
+				t.Errorf("invalid body %q parsed", body)
+			}
+		}},
+		{behavior: "duplicate", check: func(t *testing.T, status int, body string, readErr error) {
+			if strings.Count(body, `hits_total{path="/a"} 3`) != 2 || strings.Count(body, "# TYPE hits_total") != 1 {
+				t.Errorf("body %q, want every sample twice", body)
+			}
+		}},
+		{behavior: "huge", check: func(t *testing.T, status int, body string, readErr error) {
+			families, err := parseText(body)
+			if len(body) < 4096 || err != nil || len(families["scrape_padding"].GetMetric()) == 0 || len(families["hits_total"].GetMetric()) != 2 {
+				t.Errorf("%d bytes, parse error %v", len(body), err)
+			}
+		}},
+		{behavior: "ok", auth: "basic", check: func(t *testing.T, status int, body string, readErr error) {
+			if status != http.StatusUnauthorized {
+				t.Errorf("status %d, want 401", status)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(strings.TrimSpace(test.behavior+" "+test.auth), func(t *testing.T) {
+			endpoint := MetricsEndpoint{Name: test.behavior, Path: "/metrics", Source: "synthetic", Behavior: test.behavior, Auth: test.auth,
+				Username: "u", Password: "p", delay: 10 * time.Millisecond, size: 4096}
+			server := httptest.NewServer(app.metricsEndpointHandler(endpoint, scrapes))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/metrics")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, readErr := io.ReadAll(resp.Body)
+			test.check(t, resp.StatusCode, string(body), readErr)
+			if test.auth == "basic" && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+			if got := counterValue(scrapes.WithLabelValues(test.behavior, test.behavior, strconv.Itoa(resp.StatusCode))); got < 1 {
+				t.Errorf("scrape with status %d not counted", resp.StatusCode)
+			}
+		})
+	}
+
+	// A slow endpoint gives up when the communicator stops
+	close(app.stopCh)
+	endpoint := MetricsEndpoint{Name: "stopped", Behavior: "slow", delay: time.Hour}
+	w := httptest.NewRecorder()
+	app.metricsEndpointHandler(endpoint, scrapes).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Body.Len() != 0 {
+		t.Errorf("stopped slow endpoint answered %q", w.Body.String())
+	}
+}
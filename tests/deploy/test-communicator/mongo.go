@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MongoDB wire protocol opcodes
+const (
+	mongoOpReply int32 = 1
+	mongoOpQuery int32 = 2004
+	mongoOpMsg   int32 = 2013
+)
+
+const mongoMaxMessageSize = 48000000
+
+type mongoHeader struct {
+	length     int32
+	requestID  int32
+	responseTo int32
+	opCode     int32
+}
+
+// mongoStore holds the in-memory collections, keyed by "<db>.<collection>".
+type mongoStore struct {
+	mu          sync.Mutex
+	collections map[string][]bsonDoc
+	random      *seededRand // Generates ObjectIDs
+}
+
+type mongoServer struct {
+	store         *mongoStore
+	connectionIDs atomic.Int32
+	conns         *connTracker // Marks connections idle between messages for draining
+}
+
+// mongoCommandError is reported to clients as an {ok: 0} reply.
+type mongoCommandError struct {
+	code     int32
+	codeName string
+	message  string
+}
+
+func (e *mongoCommandError) Error() string {
+	return e.message
+}
+
+func (a *App) startMongoServer() error {
+	server := &mongoServer{store: &mongoStore{collections: make(map[string][]bsonDoc), random: a.random.stream("mongo")}, conns: a.tcpConns}
+	if err := a.serveTCP("MongoDB", func(conn net.Conn) {
+		a.requests.Inc()
+		server.handleConnection(conn)
+	}); err != nil {
+		return err
+	}
+
+	// Start periodic client requests if target is configured
+	if a.hasHostTarget() {
+		go a.startPeriodicRequests()
+	}
+
+	return nil
+}
+
+func (s *mongoServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	connectionID := s.connectionIDs.Add(1)
+	reader := bufio.NewReader(conn)
+	var responseID int32
+
+	for {
+		s.conns.setIdle(conn, reader.Buffered() == 0)
+		header, body, err := readMongoMessage(reader)
+		s.conns.setIdle(conn, false)
+		if err != nil {
+			if s.conns.woken(err) {
+				log.Printf("MongoDB connection from %s closed for shutdown", conn.RemoteAddr())
+			} else if err != io.EOF {
+				log.Printf("MongoDB error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var command bsonDoc
+		switch header.opCode {
+		case mongoOpMsg:
+			command, err = parseMongoOpMsg(body)
+		case mongoOpQuery:
+			command, err = parseMongoOpQuery(body)
+		default:
+			err = fmt.Errorf("unsupported opcode %d", header.opCode)
+		}
+		if err != nil {
+			log.Printf("MongoDB invalid message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		reply := s.execute(command, connectionID)
+
+		responseID++
+		if header.opCode == mongoOpQuery {
+			err = writeMongoOpReply(conn, responseID, header.requestID, reply)
+		} else {
+			err = writeMongoOpMsg(conn, responseID, header.requestID, reply)
+		}
+		if err != nil {
+			log.Printf("MongoDB error writing to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *mongoServer) execute(command bsonDoc, connectionID int32) bsonDoc {
+	if len(command) == 0 {
+		return mongoErrorReply(&mongoCommandError{code: 59, codeName: "CommandNotFound", message: "empty command"})
+	}
+
+	name := command[0].Key
+	database := command.String("$db")
+	if database == "" {
+		database = "admin"
+	}
+
+	var (
+		reply bsonDoc
+		err   error
+	)
+	switch strings.ToLower(name) {
+	case "hello", "ismaster":
+		reply = bsonDoc{
+			{Key: "helloOk", Value: true},
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "ismaster", Value: true},
+			{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+			{Key: "maxMessageSizeBytes", Value: int32(mongoMaxMessageSize)},
+			{Key: "maxWriteBatchSize", Value: int32(100000)},
+			{Key: "localTime", Value: time.Now().UTC()},
+			{Key: "logicalSessionTimeoutMinutes", Value: int32(30)},
+			{Key: "connectionId", Value: connectionID},
+			{Key: "minWireVersion", Value: int32(0)},
+			{Key: "maxWireVersion", Value: int32(17)},
+			{Key: "readOnly", Value: false},
+		}
+	case "ping", "endsessions", "buildinfo":
+		reply = bsonDoc{{Key: "version", Value: "6.0.0-test-communicator"}}
+	case "find":
+		reply, err = s.store.find(database, command)
+	case "insert":
+		reply, err = s.store.insert(database, command)
+	case "update":
+		reply, err = s.store.update(database, command)
+	case "delete":
+		reply, err = s.store.delete(database, command)
+	case "aggregate":
+		reply, err = s.store.aggregate(database, command)
+	default:
+		err = &mongoCommandError{code: 59, codeName: "CommandNotFound", message: fmt.Sprintf("no such command: '%s'", name)}
+	}
+
+	if err != nil {
+		log.Printf("MongoDB command %s on %s failed: %v", name, database, err)
+		return mongoErrorReply(err)
+	}
+	return append(reply, bsonElement{Key: "ok", Value: 1.0})
+}
+
+func mongoErrorReply(err error) bsonDoc {
+	commandErr, ok := err.(*mongoCommandError)
+	if !ok {
+		commandErr = &mongoCommandError{code: 2, codeName: "BadValue", message: err.Error()}
+	}
+	return bsonDoc{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: commandErr.message},
+		{Key: "code", Value: commandErr.code},
+		{Key: "codeName", Value: commandErr.codeName},
+	}
+}
+
+func mongoCursorReply(namespace string, batch []bsonDoc) bsonDoc {
+	documents := make(bsonArray, len(batch))
+	for i, doc := range batch {
+		documents[i] = doc
+	}
+	return bsonDoc{{Key: "cursor", Value: bsonDoc{
+		{Key: "firstBatch", Value: documents},
+		{Key: "id", Value: int64(0)},
+		{Key: "ns", Value: namespace},
+	}}}
+}
+
+func (m *mongoStore) find(database string, command bsonDoc) (bsonDoc, error) {
+	namespace := database + "." + command.String("find")
+	filter := command.Doc("filter")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var batch []bsonDoc
+	for _, doc := range m.collections[namespace] {
+		if mongoMatches(doc, filter) {
+			batch = append(batch, doc)
+		}
+	}
+	if limit, ok := command.Lookup("limit"); ok {
+		if n, ok := bsonNumber(limit); ok && n > 0 && int(n) < len(batch) {
+			batch = batch[:int(n)]
+		}
+	}
+
+	return mongoCursorReply(namespace, batch), nil
+}
+
+func (m *mongoStore) insert(database string, command bsonDoc) (bsonDoc, error) {
+	namespace := database + "." + command.String("insert")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var inserted int32
+	for _, item := range command.Array("documents") {
+		doc, ok := item.(bsonDoc)
+		if !ok {
+			return nil, errors.New("documents must be an array of objects")
+		}
+		if _, ok := doc.Lookup("_id"); !ok {
+			doc = append(bsonDoc{{Key: "_id", Value: newBSONObjectID(m.random)}}, doc...)
+		}
+		m.collections[namespace] = append(m.collections[namespace], doc)
+		inserted++
+	}
+
+	return bsonDoc{{Key: "n", Value: inserted}}, nil
+}
+
+func (m *mongoStore) update(database string, command bsonDoc) (bsonDoc, error) {
+	namespace := database + "." + command.String("update")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matched, modified int32
+	for _, item := range command.Array("updates") {
+		statement, ok := item.(bsonDoc)
+		if !ok {
+			return nil, errors.New("updates must be an array of objects")
+		}
+		query, change := statement.Doc("q"), statement.Doc("u")
+		multi, _ := statement.Lookup("multi")
+
+		found := false
+		documents := m.collections[namespace]
+		for i, doc := range documents {
+			if !mongoMatches(doc, query) {
+				continue
+			}
+			found = true
+			matched++
+
+			updated, err := mongoApplyUpdate(doc, change)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(updated, doc) {
+				documents[i] = updated
+				modified++
+			}
+			if multi != true {
+				break
+			}
+		}
+
+		if upsert, _ := statement.Lookup("upsert"); !found && upsert == true {
+			doc, err := mongoApplyUpdate(bsonDoc{{Key: "_id", Value: newBSONObjectID(m.random)}}, change)
+			if err != nil {
+				return nil, err
+			}
+			m.collections[namespace] = append(documents, doc)
+			matched++
+		}
+	}
+
+	return bsonDoc{{Key: "n", Value: matched}, {Key: "nModified", Value: modified}}, nil
+}
+
+func (m *mongoStore) delete(database string, command bsonDoc) (bsonDoc, error) {
+	namespace := database + "." + command.String("delete")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int32
+	for _, item := range command.Array("deletes") {
+		statement, ok := item.(bsonDoc)
+		if !ok {
+			return nil, errors.New("deletes must be an array of objects")
+		}
+		query := statement.Doc("q")
+		value, _ := statement.Lookup("limit")
+		limit, _ := bsonNumber(value) // 0 deletes all matches, 1 only the first
+
+		var kept []bsonDoc
+		var removed int32
+		for _, doc := range m.collections[namespace] {
+			if mongoMatches(doc, query) && (limit != 1 || removed == 0) {
+				removed++
+				continue
+			}
+			kept = append(kept, doc)
+		}
+		m.collections[namespace] = kept
+		deleted += removed
+	}
+
+	return bsonDoc{{Key: "n", Value: deleted}}, nil
+}
+
+// aggregate supports the $match, $skip, $limit and $count stages.
+func (m *mongoStore) aggregate(database string, command bsonDoc) (bsonDoc, error) {
+	namespace := database + "." + command.String("aggregate")
+
+	m.mu.Lock()
+	documents := append([]bsonDoc(nil), m.collections[namespace]...)
+	m.mu.Unlock()
+
+	for _, item := range command.Array("pipeline") {
+		stage, ok := item.(bsonDoc)
+		if !ok || len(stage) != 1 {
+			return nil, &mongoCommandError{code: 40323, codeName: "Location40323", message: "A pipeline stage specification object must contain exactly one field."}
+		}
+
+		switch name, value := stage[0].Key, stage[0].Value; name {
+		case "$match":
+			filter, _ := value.(bsonDoc)
+			var matched []bsonDoc
+			for _, doc := range documents {
+				if mongoMatches(doc, filter) {
+					matched = append(matched, doc)
+				}
+			}
+			documents = matched
+		case "$skip":
+			n, ok := bsonNumber(value)
+			if !ok {
+				return nil, &mongoCommandError{code: 15972, codeName: "Location15972", message: "Argument to $skip must be a number"}
+			}
+			if !(n >= 0) { // NaN included
+				return nil, &mongoCommandError{code: 15956, codeName: "Location15956", message: "Argument to $skip cannot be negative"}
+			}
+			documents = documents[int(min(n, float64(len(documents)))):]
+		case "$limit":
+			n, ok := bsonNumber(value)
+			if !ok {
+				return nil, &mongoCommandError{code: 15957, codeName: "Location15957", message: "the limit must be specified as a number"}
+			}
+			if !(n > 0) {
+				return nil, &mongoCommandError{code: 15958, codeName: "Location15958", message: "the limit must be positive"}
+			}
+			documents = documents[:int(min(n, float64(len(documents))))]
+		case "$count":
+			field, _ := value.(string)
+			documents = []bsonDoc{{{Key: field, Value: int32(len(documents))}}}
+		default:
+			return nil, &mongoCommandError{code: 40324, codeName: "Location40324", message: fmt.Sprintf("Unrecognized pipeline stage name: '%s'", name)}
+		}
+	}
+
+	return mongoCursorReply(namespace, documents), nil
+}
+
+// mongoMatches evaluates a filter of top-level field conditions. A condition
+// is either a value to compare for equality or a document of $eq, $ne, $gt,
+// $gte, $lt, $lte and $in operators.
+func mongoMatches(doc, filter bsonDoc) bool {
+	for _, condition := range filter {
+		value, _ := doc.Lookup(condition.Key)
+
+		operators, isOperatorDoc := condition.Value.(bsonDoc)
+		if !isOperatorDoc || len(operators) == 0 || !strings.HasPrefix(operators[0].Key, "$") {
+			if !mongoEqual(value, condition.Value) {
+				return false
+			}
+			continue
+		}
+
+		for _, operator := range operators {
+			if !mongoCompare(operator.Key, value, operator.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mongoCompare(operator string, value, operand interface{}) bool {
+	if operator == "$in" {
+		candidates, _ := operand.(bsonArray)
+		for _, candidate := range candidates {
+			if mongoEqual(value, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch operator {
+	case "$eq":
+		return mongoEqual(value, operand)
+	case "$ne":
+		return !mongoEqual(value, operand)
+	}
+
+	var cmp int
+	if a, ok := bsonNumber(value); ok {
+		b, ok := bsonNumber(operand)
+		if !ok {
+			return false
+		}
+		cmp = compareOrdered(a, b)
+	} else if a, ok := value.(string); ok {
+		b, ok := operand.(string)
+		if !ok {
+			return false
+		}
+		cmp = compareOrdered(a, b)
+	} else {
+		return false
+	}
+
+	switch operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+func compareOrdered[T float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func mongoEqual(a, b interface{}) bool {
+	if x, ok := bsonNumber(a); ok {
+		y, ok := bsonNumber(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// mongoApplyUpdate applies $set, $unset and $inc operators, or replaces
+// everything but _id when change contains no operators.
+func mongoApplyUpdate(doc, change bsonDoc) (bsonDoc, error) {
+	updated := append(bsonDoc(nil), doc...)
+
+	if len(change) == 0 || !strings.HasPrefix(change[0].Key, "$") {
+		id, _ := doc.Lookup("_id")
+		replacement := bsonDoc{{Key: "_id", Value: id}}
+		for _, element := range change {
+			if element.Key != "_id" {
+				replacement = append(replacement, element)
+			}
+		}
+		return replacement, nil
+	}
+
+	for _, operator := range change {
+		fields, _ := operator.Value.(bsonDoc)
+		for _, field := range fields {
+			switch operator.Key {
+			case "$set":
+				updated = updated.Set(field.Key, field.Value)
+			case "$unset":
+				var kept bsonDoc
+				for _, element := range updated {
+					if element.Key != field.Key {
+						kept = append(kept, element)
+					}
+				}
+				updated = kept
+			case "$inc":
+				current, _ := updated.Lookup(field.Key)
+				sum, err := mongoAdd(current, field.Value)
+				if err != nil {
+					return nil, err
+				}
+				updated = updated.Set(field.Key, sum)
+			default:
+				return nil, &mongoCommandError{code: 9, codeName: "FailedToParse", message: fmt.Sprintf("Unknown modifier: %s", operator.Key)}
+			}
+		}
+	}
+	return updated, nil
+}
+
+func mongoAdd(current, delta interface{}) (interface{}, error) {
+	if current == nil {
+		return delta, nil
+	}
+	switch c := current.(type) {
+	case int32:
+		if d, ok := delta.(int32); ok {
+			return c + d, nil
+		}
+	case int64:
+		switch d := delta.(type) {
+		case int32:
+			return c + int64(d), nil
+		case int64:
+			return c + d, nil
+		}
+	}
+
+	a, ok1 := bsonNumber(current)
+	b, ok2 := bsonNumber(delta)
+	if !ok1 || !ok2 {
+		return nil, &mongoCommandError{code: 14, codeName: "TypeMismatch", message: "Cannot apply $inc to a value of non-numeric type"}
+	}
+	return a + b, nil
+}
+
+func readMongoMessage(reader *bufio.Reader) (mongoHeader, []byte, error) {
+	raw := make([]byte, 16)
+	if _, err := io.ReadFull(reader, raw); err != nil {
+		return mongoHeader{}, nil, err
+	}
+
+	header := mongoHeader{
+		length:     int32(binary.LittleEndian.Uint32(raw[0:4])),
+		requestID:  int32(binary.LittleEndian.Uint32(raw[4:8])),
+		responseTo: int32(binary.LittleEndian.Uint32(raw[8:12])),
+		opCode:     int32(binary.LittleEndian.Uint32(raw[12:16])),
+	}
+	if header.length < 16 || header.length > mongoMaxMessageSize {
+		return header, nil, fmt.Errorf("invalid message length %d", header.length)
+	}
+
+	body := make([]byte, header.length-16)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return header, nil, err
+	}
+	return header, body, nil
+}
+
+// parseMongoOpMsg returns the body section of an OP_MSG, with any document
+// sequence sections (kind 1) folded in as arrays under their identifier.
+func parseMongoOpMsg(body []byte) (bsonDoc, error) {
+	if len(body) < 5 {
+		return nil, errors.New("truncated OP_MSG")
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	sections := body[4:]
+	if flags&1 != 0 {
+		// Drop the trailing CRC-32C checksum
+		if len(sections) < 4 {
+			return nil, errors.New("truncated OP_MSG checksum")
+		}
+		sections = sections[:len(sections)-4]
+	}
+
+	var command bsonDoc
+	var sequences []bsonElement
+	for len(sections) > 0 {
+		kind := sections[0]
+		sections = sections[1:]
+
+		switch kind {
+		case 0:
+			doc, rest, err := unmarshalBSON(sections)
+			if err != nil {
+				return nil, err
+			}
+			command, sections = doc, rest
+		case 1:
+			if len(sections) < 4 {
+				return nil, errors.New("truncated document sequence")
+			}
+			size := int(binary.LittleEndian.Uint32(sections))
+			if size < 4 || size > len(sections) {
+				return nil, errors.New("invalid document sequence size")
+			}
+			identifier, payload, err := readCString(sections[4:size])
+			if err != nil {
+				return nil, err
+			}
+			var documents bsonArray
+			for len(payload) > 0 {
+				var doc bsonDoc
+				if doc, payload, err = unmarshalBSON(payload); err != nil {
+					return nil, err
+				}
+				documents = append(documents, doc)
+			}
+			sequences = append(sequences, bsonElement{Key: identifier, Value: documents})
+			sections = sections[size:]
+		default:
+			return nil, fmt.Errorf("unsupported OP_MSG section kind %d", kind)
+		}
+	}
+
+	if command == nil {
+		return nil, errors.New("OP_MSG without body section")
+	}
+	return append(command, sequences...), nil
+}
+
+// parseMongoOpQuery handles the legacy OP_QUERY that drivers still use for
+// the initial handshake. Only commands against <db>.$cmd are supported.
+func parseMongoOpQuery(body []byte) (bsonDoc, error) {
+	if len(body) < 4 {
+		return nil, errors.New("truncated OP_QUERY")
+	}
+	collection, rest, err := readCString(body[4:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < 8 {
+		return nil, errors.New("truncated OP_QUERY")
+	}
+	query, _, err := unmarshalBSON(rest[8:]) // skip numberToSkip and numberToReturn
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands may be wrapped as {$query: {...}}
+	if wrapped := query.Doc("$query"); wrapped != nil {
+		query = wrapped
+	}
+	database, _, _ := strings.Cut(collection, ".")
+	return query.Set("$db", database), nil
+}
+
+func writeMongoOpMsg(w io.Writer, requestID, responseTo int32, doc bsonDoc) error {
+	encoded, err := marshalBSON(doc)
+	if err != nil {
+		return err
+	}
+	payload := binary.LittleEndian.AppendUint32(nil, 0) // flagBits
+	payload = append(payload, 0)                        // body section
+	payload = append(payload, encoded...)
+	return writeMongoMessage(w, requestID, responseTo, mongoOpMsg, payload)
+}
+
+func writeMongoOpReply(w io.Writer, requestID, responseTo int32, doc bsonDoc) error {
+	encoded, err := marshalBSON(doc)
+	if err != nil {
+		return err
+	}
+	payload := binary.LittleEndian.AppendUint32(nil, 0) // responseFlags
+	payload = binary.LittleEndian.AppendUint64(payload, 0)
+	payload = binary.LittleEndian.AppendUint32(payload, 0) // startingFrom
+	payload = binary.LittleEndian.AppendUint32(payload, 1) // numberReturned
+	payload = append(payload, encoded...)
+	return writeMongoMessage(w, requestID, responseTo, mongoOpReply, payload)
+}
+
+func writeMongoMessage(w io.Writer, requestID, responseTo, opCode int32, payload []byte) error {
+	message := binary.LittleEndian.AppendUint32(nil, uint32(16+len(payload)))
+	message = binary.LittleEndian.AppendUint32(message, uint32(requestID))
+	message = binary.LittleEndian.AppendUint32(message, uint32(responseTo))
+	message = binary.LittleEndian.AppendUint32(message, uint32(opCode))
+	message = append(message, payload...)
+
+	_, err := w.Write(message)
+	return err
+}
+
+// mongoClient runs commands over OP_MSG on a single connection.
+type mongoClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	requestID int32
+}
+
+func (c *mongoClient) run(command bsonDoc) (bsonDoc, error) {
+	c.requestID++
+	if err := writeMongoOpMsg(c.conn, c.requestID, 0, command); err != nil {
+		return nil, err
+	}
+
+	header, body, err := readMongoMessage(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if header.opCode != mongoOpMsg || header.responseTo != c.requestID {
+		return nil, fmt.Errorf("unexpected reply opcode %d for request %d", header.opCode, header.responseTo)
+	}
+	reply, err := parseMongoOpMsg(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := reply.Lookup("ok"); ok != 1.0 {
+		return reply, fmt.Errorf("command %s failed: %s", command[0].Key, reply.String("errmsg"))
+	}
+	return reply, nil
+}
+
+// mongoCommand is one command of a periodic MongoDB run.
+type mongoCommand struct {
+	name string
+	body bsonDoc
+}
+
+// mongoCommands lists the commands of a periodic run in order, for sending
+// them and for the dry run: a hello, then MONGO_OPERATIONS on the documents
+// of sequence.
+func (a *App) mongoCommands(sequence int64) []mongoCommand {
+	database, collection := a.config.MongoDatabase, a.config.MongoCollection
+	commands := []mongoCommand{{name: "hello", body: bsonDoc{{Key: "hello", Value: int32(1)}, {Key: "$db", Value: "admin"}}}}
+	for _, operation := range a.config.MongoOperations {
+		var command bsonDoc
+		switch operation {
+		case "insert":
+			command = bsonDoc{
+				{Key: "insert", Value: collection},
+				{Key: "documents", Value: bsonArray{bsonDoc{
+					{Key: "service", Value: a.config.ServiceName},
+					{Key: "sequence", Value: sequence},
+					{Key: "count", Value: int32(0)},
+					{Key: "created", Value: time.Now().UTC()},
+				}}},
+			}
+		case "find":
+			command = bsonDoc{
+				{Key: "find", Value: collection},
+				{Key: "filter", Value: bsonDoc{{Key: "service", Value: a.config.ServiceName}, {Key: "sequence", Value: sequence}}},
+			}
+		case "update":
+			command = bsonDoc{
+				{Key: "update", Value: collection},
+				{Key: "updates", Value: bsonArray{bsonDoc{
+					{Key: "q", Value: bsonDoc{{Key: "sequence", Value: sequence}}},
+					{Key: "u", Value: bsonDoc{{Key: "$inc", Value: bsonDoc{{Key: "count", Value: int32(1)}}}}},
+				}}},
+			}
+		case "delete":
+			command = bsonDoc{
+				{Key: "delete", Value: collection},
+				{Key: "deletes", Value: bsonArray{bsonDoc{
+					{Key: "q", Value: bsonDoc{{Key: "sequence", Value: sequence}}},
+					{Key: "limit", Value: int32(0)},
+				}}},
+			}
+		case "aggregate":
+			command = bsonDoc{
+				{Key: "aggregate", Value: collection},
+				{Key: "pipeline", Value: bsonArray{
+					bsonDoc{{Key: "$match", Value: bsonDoc{{Key: "service", Value: a.config.ServiceName}}}},
+					bsonDoc{{Key: "$count", Value: "documents"}},
+				}},
+				{Key: "cursor", Value: bsonDoc{}},
+			}
+		default:
+			continue
+		}
+		command = append(command, bsonElement{Key: "$db", Value: database})
+		commands = append(commands, mongoCommand{name: operation, body: command})
+	}
+	return commands
+}
+
+func (a *App) makeMongoTargetRequest(address string) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		log.Printf("Error connecting to MongoDB target: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client := &mongoClient{conn: conn, reader: bufio.NewReader(conn)}
+	database, collection := a.config.MongoDatabase, a.config.MongoCollection
+
+	log.Printf("Making periodic MongoDB requests to target: %s (%s.%s)", address, database, collection)
+
+	// Operations address documents by a per-request sequence number so the
+	// mix gives the same results regardless of what earlier runs left behind.
+	var results []string
+	for _, command := range a.mongoCommands(time.Now().UnixNano()) {
+		reply, err := client.run(command.body)
+		if err != nil {
+			log.Printf("Error in periodic MongoDB %s: %v", command.name, err)
+			return
+		}
+		if command.name != "hello" {
+			results = append(results, fmt.Sprintf("%s=%s", command.name, mongoReplySummary(reply)))
+		}
+	}
+
+	log.Printf("Periodic MongoDB requests successful - %s", strings.Join(results, ", "))
+}
+
+func mongoReplySummary(reply bsonDoc) string {
+	if cursor := reply.Doc("cursor"); cursor != nil {
+		return fmt.Sprintf("%d docs", len(cursor.Array("firstBatch")))
+	}
+	n, _ := reply.Lookup("n")
+	return fmt.Sprintf("n:%v", n)
+}
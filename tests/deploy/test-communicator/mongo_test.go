@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustMarshalBSON(t *testing.T, doc bsonDoc) []byte {
+	t.Helper()
+	encoded, err := marshalBSON(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func newTestMongoServer() *mongoServer {
+	return &mongoServer{store: &mongoStore{collections: make(map[string][]bsonDoc), random: newSeededRand("test", "")}}
+}
+
+func TestParseMongoOpMsg(t *testing.T) {
+	command := bsonDoc{{Key: "insert", Value: "items"}, {Key: "$db", Value: "test"}}
+	body := mustMarshalBSON(t, command)
+	first := mustMarshalBSON(t, bsonDoc{{Key: "n", Value: int32(1)}})
+	second := mustMarshalBSON(t, bsonDoc{{Key: "n", Value: int32(2)}})
+
+	sequence := []byte("documents\x00")
+	sequence = append(append(sequence, first...), second...)
+	sequence = append(binary.LittleEndian.AppendUint32(nil, uint32(len(sequence)+4)), sequence...)
+
+	message := func(flags uint32, sections ...[]byte) []byte {
+		out := binary.LittleEndian.AppendUint32(nil, flags)
+		for _, section := range sections {
+			out = append(out, section...)
+		}
+		return out
+	}
+	bodySection := append([]byte{0}, body...)
+	sequenceSection := append([]byte{1}, sequence...)
+	checksum := []byte{1, 2, 3, 4}
+
+	tests := []struct {
+		name    string
+		message []byte
+		want    bsonDoc
+		wantErr bool
+	}{
+		{name: "body", message: message(0, bodySection), want: command},
+		{name: "with checksum", message: message(1, bodySection, checksum), want: command},
+		{
+			name:    "document sequence",
+			message: message(0, sequenceSection, bodySection),
+			want:    append(command, bsonElement{Key: "documents", Value: bsonArray{bsonDoc{{Key: "n", Value: int32(1)}}, bsonDoc{{Key: "n", Value: int32(2)}}}}),
+		},
+		{name: "empty", message: nil, wantErr: true},
+		{name: "flags only", message: message(0), wantErr: true},
+		{name: "truncated checksum", message: message(1, []byte{0}), wantErr: true},
+		{name: "checksum only", message: message(1, checksum), wantErr: true},
+		{name: "no body section", message: message(0, sequenceSection), wantErr: true},
+		{name: "unknown section kind", message: message(0, []byte{2, 0, 0, 0, 0}), wantErr: true},
+		{name: "truncated body", message: message(0, bodySection[:len(bodySection)-3]), wantErr: true},
+		{name: "truncated sequence size", message: message(0, []byte{1, 9}), wantErr: true},
+		{name: "sequence size too small", message: message(0, []byte{1, 2, 0, 0, 0}), wantErr: true},
+		{name: "sequence beyond input", message: message(0, []byte{1, 0xff, 0, 0, 0}), wantErr: true},
+		{name: "sequence without identifier end", message: message(0, []byte{1, 6, 0, 0, 0, 'a', 'b'}), wantErr: true},
+		{name: "sequence with bad document", message: message(0, []byte{1, 11, 0, 0, 0, 'a', 0, 9, 0, 0, 0}), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseMongoOpMsg(test.message)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMongoOpQuery(t *testing.T) {
+	query := func(collection string, doc bsonDoc) []byte {
+		out := append(binary.LittleEndian.AppendUint32(nil, 0), collection...)
+		out = append(out, 0)
+		out = append(out, make([]byte, 8)...)
+		return append(out, mustMarshalBSON(t, doc)...)
+	}
+	hello := bsonDoc{{Key: "isMaster", Value: int32(1)}}
+
+	tests := []struct {
+		name    string
+		body    []byte
+		want    bsonDoc
+		wantErr bool
+	}{
+		{name: "command", body: query("admin.$cmd", hello), want: append(hello, bsonElement{Key: "$db", Value: "admin"})},
+		{name: "wrapped", body: query("app.$cmd", bsonDoc{{Key: "$query", Value: hello}}), want: append(hello, bsonElement{Key: "$db", Value: "app"})},
+		{name: "empty", body: nil, wantErr: true},
+		{name: "unterminated collection", body: []byte{0, 0, 0, 0, 'a'}, wantErr: true},
+		{name: "missing skip and return", body: []byte{0, 0, 0, 0, 'a', 0, 1, 2}, wantErr: true},
+		{name: "missing query", body: []byte{0, 0, 0, 0, 'a', 0, 0, 0, 0, 0, 0, 0, 0, 0}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseMongoOpQuery(test.body)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMongoMessage(t *testing.T) {
+	var valid bytes.Buffer
+	if err := writeMongoOpMsg(&valid, 7, 3, bsonDoc{{Key: "ping", Value: int32(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	header := func(length int32) []byte {
+		return binary.LittleEndian.AppendUint32(make([]byte, 0, 16), uint32(length))
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+	}{
+		{name: "valid", input: valid.Bytes()},
+		{name: "short header", input: []byte{1, 2, 3}, wantErr: true},
+		{name: "length below header", input: append(header(15), make([]byte, 12)...), wantErr: true},
+		{name: "negative length", input: append(header(-1), make([]byte, 12)...), wantErr: true},
+		{name: "length above maximum", input: append(header(mongoMaxMessageSize+1), make([]byte, 12)...), wantErr: true},
+		{name: "truncated body", input: valid.Bytes()[:valid.Len()-1], wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, body, err := readMongoMessage(bufio.NewReader(bytes.NewReader(test.input)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.requestID != 7 || got.responseTo != 3 || got.opCode != mongoOpMsg || int(got.length) != valid.Len() {
+				t.Errorf("header = %+v", got)
+			}
+			if _, err := parseMongoOpMsg(body); err != nil {
+				t.Errorf("body: %v", err)
+			}
+		})
+	}
+}
+
+func TestMongoAggregate(t *testing.T) {
+	server := newTestMongoServer()
+	for i := range 5 {
+		server.store.collections["test.items"] = append(server.store.collections["test.items"], bsonDoc{{Key: "n", Value: int32(i)}})
+	}
+	aggregate := func(stages ...bsonDoc) bsonDoc {
+		pipeline := make(bsonArray, len(stages))
+		for i, stage := range stages {
+			pipeline[i] = stage
+		}
+		return bsonDoc{{Key: "aggregate", Value: "items"}, {Key: "pipeline", Value: pipeline}, {Key: "$db", Value: "test"}}
+	}
+	stage := func(name string, value interface{}) bsonDoc { return bsonDoc{{Key: name, Value: value}} }
+
+	tests := []struct {
+		name     string
+		command  bsonDoc
+		want     []int32 // Values of n in the batch
+		wantCode int32
+	}{
+		{name: "all", command: aggregate(), want: []int32{0, 1, 2, 3, 4}},
+		{name: "match", command: aggregate(stage("$match", bsonDoc{{Key: "n", Value: bsonDoc{{Key: "$gt", Value: 2.0}}}})), want: []int32{3, 4}},
+		{name: "skip and limit", command: aggregate(stage("$skip", int32(1)), stage("$limit", int64(2))), want: []int32{1, 2}},
+		{name: "skip past end", command: aggregate(stage("$skip", 100.0)), want: nil},
+		{name: "limit past end", command: aggregate(stage("$limit", int32(100))), want: []int32{0, 1, 2, 3, 4}},
+		{name: "skip zero", command: aggregate(stage("$skip", int32(0))), want: []int32{0, 1, 2, 3, 4}},
+		{name: "negative skip", command: aggregate(stage("$skip", int32(-1))), wantCode: 15956},
+		{name: "NaN skip", command: aggregate(stage("$skip", math.NaN())), wantCode: 15956},
+		{name: "non-numeric skip", command: aggregate(stage("$skip", "one")), wantCode: 15972},
+		{name: "negative limit", command: aggregate(stage("$limit", int64(-3))), wantCode: 15958},
+		{name: "zero limit", command: aggregate(stage("$limit", int32(0))), wantCode: 15958},
+		{name: "NaN limit", command: aggregate(stage("$limit", math.NaN())), wantCode: 15958},
+		{name: "non-numeric limit", command: aggregate(stage("$limit", nil)), wantCode: 15957},
+		{name: "two fields in a stage", command: aggregate(bsonDoc{{Key: "$skip", Value: int32(1)}, {Key: "$limit", Value: int32(1)}}), wantCode: 40323},
+		{name: "unknown stage", command: aggregate(stage("$group", bsonDoc{})), wantCode: 40324},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := server.execute(test.command, 1)
+			if test.wantCode != 0 {
+				if code, _ := reply.Lookup("code"); code != test.wantCode {
+					t.Fatalf("reply %v, want code %d", reply, test.wantCode)
+				}
+				return
+			}
+			if ok, _ := reply.Lookup("ok"); ok != 1.0 {
+				t.Fatalf("reply %v", reply)
+			}
+			var got []int32
+			for _, doc := range reply.Doc("cursor").Array("firstBatch") {
+				n, _ := doc.(bsonDoc).Lookup("n")
+				got = append(got, n.(int32))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("batch n = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	reply := server.execute(aggregate(stage("$skip", int32(3)), stage("$count", "total")), 1)
+	batch := reply.Doc("cursor").Array("firstBatch")
+	if len(batch) != 1 || !reflect.DeepEqual(batch[0], bsonDoc{{Key: "total", Value: int32(2)}}) {
+		t.Errorf("$count batch = %v", batch)
+	}
+}
+
+func TestMongoClientRoundTrip(t *testing.T) {
+	server := newTestMongoServer()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+	client := &mongoClient{conn: clientConn, reader: bufio.NewReader(clientConn)}
+
+	steps := []struct {
+		command bsonDoc
+		check   func(reply bsonDoc) bool
+	}{
+		{bsonDoc{{Key: "hello", Value: int32(1)}, {Key: "$db", Value: "admin"}}, func(r bsonDoc) bool {
+			ok, _ := r.Lookup("isWritablePrimary")
+			return ok == true
+		}},
+		{bsonDoc{{Key: "insert", Value: "items"}, {Key: "documents", Value: bsonArray{bsonDoc{{Key: "k", Value: "a"}}, bsonDoc{{Key: "k", Value: "b"}}}}, {Key: "$db", Value: "test"}}, func(r bsonDoc) bool {
+			n, _ := r.Lookup("n")
+			return n == int32(2)
+		}},
+		{bsonDoc{{Key: "update", Value: "items"}, {Key: "updates", Value: bsonArray{bsonDoc{{Key: "q", Value: bsonDoc{{Key: "k", Value: "a"}}}, {Key: "u", Value: bsonDoc{{Key: "$inc", Value: bsonDoc{{Key: "hits", Value: int32(1)}}}}}}}}, {Key: "$db", Value: "test"}}, func(r bsonDoc) bool {
+			n, _ := r.Lookup("nModified")
+			return n == int32(1)
+		}},
+		{bsonDoc{{Key: "find", Value: "items"}, {Key: "filter", Value: bsonDoc{{Key: "hits", Value: int32(1)}}}, {Key: "$db", Value: "test"}}, func(r bsonDoc) bool {
+			batch := r.Doc("cursor").Array("firstBatch")
+			return len(batch) == 1 && batch[0].(bsonDoc).String("k") == "a"
+		}},
+		{bsonDoc{{Key: "delete", Value: "items"}, {Key: "deletes", Value: bsonArray{bsonDoc{{Key: "q", Value: bsonDoc{}}, {Key: "limit", Value: int32(0)}}}}, {Key: "$db", Value: "test"}}, func(r bsonDoc) bool {
+			n, _ := r.Lookup("n")
+			return n == int32(2)
+		}},
+	}
+	for _, step := range steps {
+		reply, err := client.run(step.command)
+		if err != nil {
+			t.Fatalf("%s: %v", step.command[0].Key, err)
+		}
+		if !step.check(reply) {
+			t.Errorf("%s: unexpected reply %v", step.command[0].Key, reply)
+		}
+	}
+
+	if _, err := client.run(bsonDoc{{Key: "shutdown", Value: int32(1)}}); err == nil {
+		t.Error("unknown command: want an error")
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types (MQTT 3.1.1 section 2.2.1, unchanged in MQTT 5)
+const (
+	mqttConnect     byte = 1
+	mqttConnAck     byte = 2
+	mqttPublish     byte = 3
+	mqttPubAck      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSubAck      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsubAck    byte = 11
+	mqttPingReq     byte = 12
+	mqttPingResp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+const (
+	mqttVersion311 byte = 4
+	mqttVersion5   byte = 5
+)
+
+// mqttMaxPacketSize bounds the packets either end reads, so a bad remaining
+// length cannot make it allocate up to the protocol's 256 MB.
+const mqttMaxPacketSize = 1 << 20
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+type mqttMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+// mqttBroker is a minimal in-memory broker. It keeps no sessions across
+// reconnects, no retained messages and does not redeliver unacknowledged
+// QoS 1 messages; it only needs to produce realistic broker-mediated traffic.
+type mqttBroker struct {
+	mu       sync.Mutex
+	sessions map[*mqttSession]struct{}
+	conns    *connTracker // Marks sessions idle between packets for draining
+}
+
+type mqttSession struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex // guards subs and nextID
+	clientID string
+	version  byte
+	subs     map[string]byte // topic filter -> granted QoS
+	nextID   uint16
+}
+
+func newMQTTBroker(conns *connTracker) *mqttBroker {
+	return &mqttBroker{sessions: make(map[*mqttSession]struct{}), conns: conns}
+}
+
+func (a *App) startMQTTServer() error {
+	broker := newMQTTBroker(a.tcpConns)
+	if err := a.serveTCP("MQTT", func(conn net.Conn) {
+		a.requests.Inc()
+		broker.handleConnection(conn)
+	}); err != nil {
+		return err
+	}
+
+	// Start the publisher/subscriber client if a broker target is configured
+	if a.config.TargetHost != "" {
+		go a.startMQTTClient()
+	}
+
+	return nil
+}
+
+func (b *mqttBroker) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	packet, err := readMQTTPacket(reader)
+	if err != nil {
+		log.Printf("MQTT error reading CONNECT: %v", err)
+		return
+	}
+	if packet.kind != mqttConnect {
+		log.Printf("MQTT expected CONNECT, got packet type %d", packet.kind)
+		return
+	}
+
+	session := &mqttSession{conn: conn, subs: make(map[string]byte)}
+	if err := session.handleConnect(packet.body); err != nil {
+		log.Printf("MQTT invalid CONNECT: %v", err)
+		return
+	}
+	log.Printf("MQTT client connected: %s (protocol level %d)", session.clientID, session.version)
+
+	b.mu.Lock()
+	b.sessions[session] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.sessions, session)
+		b.mu.Unlock()
+		log.Printf("MQTT client disconnected: %s", session.clientID)
+	}()
+
+	for {
+		b.conns.setIdle(conn, reader.Buffered() == 0)
+		packet, err := readMQTTPacket(reader)
+		b.conns.setIdle(conn, false)
+		if err != nil {
+			if b.conns.woken(err) {
+				log.Printf("MQTT client %s closed for shutdown", session.clientID)
+			} else if err != io.EOF {
+				log.Printf("MQTT error reading from %s: %v", session.clientID, err)
+			}
+			return
+		}
+
+		switch packet.kind {
+		case mqttPublish:
+			msg, packetID, err := session.decodePublish(packet)
+			if err != nil {
+				log.Printf("MQTT invalid PUBLISH from %s: %v", session.clientID, err)
+				return
+			}
+			if msg.qos > 0 {
+				session.write(mqttPubAck, 0, binary.BigEndian.AppendUint16(nil, packetID))
+			}
+			b.route(msg)
+		case mqttPubAck:
+			// Deliveries are fire-and-forget; nothing to release
+		case mqttSubscribe:
+			if err := session.handleSubscribe(packet.body); err != nil {
+				log.Printf("MQTT invalid SUBSCRIBE from %s: %v", session.clientID, err)
+				return
+			}
+		case mqttUnsubscribe:
+			if err := session.handleUnsubscribe(packet.body); err != nil {
+				log.Printf("MQTT invalid UNSUBSCRIBE from %s: %v", session.clientID, err)
+				return
+			}
+		case mqttPingReq:
+			session.write(mqttPingResp, 0, nil)
+		case mqttDisconnect:
+			return
+		default:
+			log.Printf("MQTT unsupported packet type %d from %s", packet.kind, session.clientID)
+			return
+		}
+	}
+}
+
+func (b *mqttBroker) route(msg mqttMessage) {
+	b.mu.Lock()
+	var targets []*mqttSession
+	var qos []byte
+	for session := range b.sessions {
+		if granted, ok := session.matches(msg.topic); ok {
+			targets = append(targets, session)
+			qos = append(qos, min(granted, msg.qos))
+		}
+	}
+	b.mu.Unlock()
+
+	for i, session := range targets {
+		if err := session.deliver(mqttMessage{topic: msg.topic, qos: qos[i], payload: msg.payload}); err != nil {
+			log.Printf("MQTT error delivering to %s: %v", session.clientID, err)
+		}
+	}
+}
+
+func (s *mqttSession) handleConnect(body []byte) error {
+	protocolName, rest, err := readMQTTString(body)
+	if err != nil {
+		return err
+	}
+	if protocolName != "MQTT" || len(rest) < 4 {
+		return fmt.Errorf("unsupported protocol %q", protocolName)
+	}
+
+	// Will, username and password flags are accepted but ignored
+	s.version = rest[0]
+	rest = rest[4:] // level, flags, keep alive
+	if s.version != mqttVersion311 && s.version != mqttVersion5 {
+		// Return code 0x01: unacceptable protocol version
+		s.write(mqttConnAck, 0, []byte{0, 0x01})
+		return fmt.Errorf("unsupported protocol level %d", s.version)
+	}
+
+	if s.version == mqttVersion5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return err
+		}
+	}
+	if s.clientID, rest, err = readMQTTString(rest); err != nil {
+		return err
+	}
+	if s.clientID == "" {
+		s.clientID = s.conn.RemoteAddr().String()
+	}
+
+	if s.version == mqttVersion5 {
+		return s.write(mqttConnAck, 0, []byte{0, 0, 0})
+	}
+	return s.write(mqttConnAck, 0, []byte{0, 0})
+}
+
+func (s *mqttSession) handleSubscribe(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("missing packet identifier")
+	}
+	packetID, rest := body[:2], body[2:]
+
+	var err error
+	if s.version == mqttVersion5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return err
+		}
+	}
+
+	ack := append([]byte{}, packetID...)
+	if s.version == mqttVersion5 {
+		ack = append(ack, 0)
+	}
+	for len(rest) > 0 {
+		var filter string
+		if filter, rest, err = readMQTTString(rest); err != nil {
+			return err
+		}
+		if len(rest) < 1 {
+			return errors.New("missing subscription options")
+		}
+		granted := min(rest[0]&0x03, 1)
+		rest = rest[1:]
+
+		s.mu.Lock()
+		s.subs[filter] = granted
+		s.mu.Unlock()
+		ack = append(ack, granted)
+		log.Printf("MQTT client %s subscribed to %s (QoS %d)", s.clientID, filter, granted)
+	}
+
+	return s.write(mqttSubAck, 0, ack)
+}
+
+func (s *mqttSession) handleUnsubscribe(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("missing packet identifier")
+	}
+	packetID, rest := body[:2], body[2:]
+
+	var err error
+	if s.version == mqttVersion5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return err
+		}
+	}
+
+	ack := append([]byte{}, packetID...)
+	if s.version == mqttVersion5 {
+		ack = append(ack, 0)
+	}
+	for len(rest) > 0 {
+		var filter string
+		if filter, rest, err = readMQTTString(rest); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		delete(s.subs, filter)
+		s.mu.Unlock()
+		if s.version == mqttVersion5 {
+			ack = append(ack, 0)
+		}
+	}
+
+	return s.write(mqttUnsubAck, 0, ack)
+}
+
+func (s *mqttSession) decodePublish(packet mqttPacket) (mqttMessage, uint16, error) {
+	return decodeMQTTPublish(packet, s.version)
+}
+
+func (s *mqttSession) matches(topic string) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var granted byte
+	matched := false
+	for filter, qos := range s.subs {
+		if mqttTopicMatches(filter, topic) {
+			matched = true
+			granted = max(granted, qos)
+		}
+	}
+	return granted, matched
+}
+
+func (s *mqttSession) deliver(msg mqttMessage) error {
+	s.mu.Lock()
+	s.nextID++
+	if s.nextID == 0 {
+		s.nextID = 1
+	}
+	packetID := s.nextID
+	s.mu.Unlock()
+
+	flags, body := encodeMQTTPublish(msg, packetID, s.version)
+	return s.write(mqttPublish, flags, body)
+}
+
+func (s *mqttSession) write(kind, flags byte, body []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeMQTTPacket(s.conn, kind, flags, body)
+}
+
+func (a *App) startMQTTClient() {
+	log.Printf("Starting MQTT %s client for %s:%d, topics: %v", a.config.MQTTRole, a.config.TargetHost, a.config.TargetPort, a.config.MQTTTopics)
+
+	// Give the broker time to start to avoid startup race conditions
+	time.Sleep(periodicInitialDelay)
+
+	for {
+		if err := a.runMQTTClient(); err != nil {
+			log.Printf("MQTT client error: %v", err)
+		}
+
+		select {
+		case <-a.stopCh:
+			log.Println("Stopping MQTT client")
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// mqttClientKeepAlive is the keep alive the client asks for. It pings at
+// half of it.
+const mqttClientKeepAlive = 30 * time.Second
+
+type mqttOutbound struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// mqttSetupPackets returns the packets that open a client session, for
+// sending them and for the dry run: CONNECT with clean session, then a
+// SUBSCRIBE to all topics when the role subscribes.
+func (a *App) mqttSetupPackets() []mqttOutbound {
+	version := byte(a.config.MQTTVersion)
+	qos := byte(min(max(a.config.MQTTQoS, 0), 1))
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, version, 0x02)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttClientKeepAlive/time.Second))
+	if version == mqttVersion5 {
+		body = append(body, 0)
+	}
+	body = appendMQTTString(body, a.config.ServiceName)
+	packets := []mqttOutbound{{kind: mqttConnect, body: body}}
+
+	if a.config.MQTTRole == "subscriber" || a.config.MQTTRole == "both" {
+		body := binary.BigEndian.AppendUint16(nil, 1)
+		if version == mqttVersion5 {
+			body = append(body, 0)
+		}
+		for _, topic := range a.config.MQTTTopics {
+			body = appendMQTTString(body, topic)
+			body = append(body, qos)
+		}
+		packets = append(packets, mqttOutbound{kind: mqttSubscribe, flags: 0x02, body: body})
+	}
+	return packets
+}
+
+// mqttPublishTopics returns the topics published to on every tick of
+// MQTT_PUBLISH_INTERVAL, none unless the role publishes.
+func (a *App) mqttPublishTopics() []string {
+	if a.config.MQTTRole == "publisher" || a.config.MQTTRole == "both" {
+		return a.config.MQTTTopics
+	}
+	return nil
+}
+
+func (a *App) runMQTTClient() error {
+	address := net.JoinHostPort(a.config.TargetHost, strconv.Itoa(a.config.TargetPort))
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to broker %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	version := byte(a.config.MQTTVersion)
+	qos := byte(min(max(a.config.MQTTQoS, 0), 1))
+	setup := a.mqttSetupPackets()
+	if err := writeMQTTPacket(conn, setup[0].kind, setup[0].flags, setup[0].body); err != nil {
+		return fmt.Errorf("sending CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packet, err := readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("reading CONNACK: %v", err)
+	}
+	if packet.kind != mqttConnAck || len(packet.body) < 2 || packet.body[1] != 0 {
+		return fmt.Errorf("connection refused by broker: %v", packet.body)
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Printf("MQTT client connected to broker %s", address)
+
+	var writeMu sync.Mutex
+	send := func(kind, flags byte, body []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeMQTTPacket(conn, kind, flags, body)
+	}
+
+	for _, packet := range setup[1:] {
+		if err := send(packet.kind, packet.flags, packet.body); err != nil {
+			return fmt.Errorf("sending SUBSCRIBE: %v", err)
+		}
+	}
+
+	// Reader loop: log deliveries and acknowledge QoS 1 messages
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			switch packet.kind {
+			case mqttPublish:
+				msg, packetID, err := decodeMQTTPublish(packet, version)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				log.Printf("MQTT message received on %s (QoS %d): %s", msg.topic, msg.qos, msg.payload)
+				if msg.qos > 0 {
+					send(mqttPubAck, 0, binary.BigEndian.AppendUint16(nil, packetID))
+				}
+			case mqttSubAck:
+				log.Printf("MQTT subscription acknowledged: %v", a.config.MQTTTopics)
+			case mqttPubAck, mqttPingResp:
+			default:
+				log.Printf("MQTT client received unexpected packet type %d", packet.kind)
+			}
+		}
+	}()
+
+	publishTicker := time.NewTicker(a.config.MQTTPublishInterval)
+	defer publishTicker.Stop()
+	pingTicker := time.NewTicker(mqttClientKeepAlive / 2)
+	defer pingTicker.Stop()
+
+	var packetID uint16
+	for {
+		select {
+		case <-publishTicker.C:
+			for _, topic := range a.mqttPublishTopics() {
+				packetID++
+				if packetID == 0 {
+					packetID = 1
+				}
+				payload := fmt.Sprintf(`{"service":"%s","topic":"%s","timestamp":"%s"}`,
+					a.config.ServiceName, topic, time.Now().UTC().Format(time.RFC3339))
+				flags, body := encodeMQTTPublish(mqttMessage{topic: topic, qos: qos, payload: []byte(payload)}, packetID, version)
+				if err := send(mqttPublish, flags, body); err != nil {
+					return fmt.Errorf("sending PUBLISH: %v", err)
+				}
+				log.Printf("MQTT message published to %s (QoS %d)", topic, qos)
+			}
+		case <-pingTicker.C:
+			if err := send(mqttPingReq, 0, nil); err != nil {
+				return fmt.Errorf("sending PINGREQ: %v", err)
+			}
+		case err := <-readErr:
+			return fmt.Errorf("reading from broker: %v", err)
+		case <-a.stopCh:
+			send(mqttDisconnect, 0, nil)
+			return nil
+		}
+	}
+}
+
+func decodeMQTTPublish(packet mqttPacket, version byte) (mqttMessage, uint16, error) {
+	msg := mqttMessage{qos: (packet.flags >> 1) & 0x03}
+	if msg.qos > 2 {
+		return msg, 0, errors.New("invalid QoS 3")
+	}
+
+	var err error
+	var rest []byte
+	if msg.topic, rest, err = readMQTTString(packet.body); err != nil {
+		return msg, 0, err
+	}
+
+	var packetID uint16
+	if msg.qos > 0 {
+		if len(rest) < 2 {
+			return msg, 0, errors.New("missing packet identifier")
+		}
+		packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	if version == mqttVersion5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return msg, 0, err
+		}
+	}
+	msg.payload = rest
+
+	return msg, packetID, nil
+}
+
+func encodeMQTTPublish(msg mqttMessage, packetID uint16, version byte) (byte, []byte) {
+	body := appendMQTTString(nil, msg.topic)
+	if msg.qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	if version == mqttVersion5 {
+		body = append(body, 0)
+	}
+	body = append(body, msg.payload...)
+
+	return msg.qos << 1, body
+}
+
+// mqttTopicMatches reports whether topic matches filter, honouring the
+// single-level (+) and multi-level (#) wildcards.
+func mqttTopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length, err := readMQTTVarInt(r)
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	if length > mqttMaxPacketSize {
+		return mqttPacket{}, fmt.Errorf("packet of %d bytes exceeds the %d byte limit", length, mqttMaxPacketSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+
+	return mqttPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func writeMQTTPacket(w io.Writer, kind, flags byte, body []byte) error {
+	packet := []byte{kind<<4 | flags}
+	packet = appendMQTTVarInt(packet, len(body))
+	packet = append(packet, body...)
+
+	_, err := w.Write(packet)
+	return err
+}
+
+func readMQTTVarInt(r io.ByteReader) (int, error) {
+	value, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed variable byte integer")
+}
+
+func appendMQTTVarInt(b []byte, value int) []byte {
+	for {
+		digit := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if value == 0 {
+			return b
+		}
+	}
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated string length")
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+length {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(b[2 : 2+length]), b[2+length:], nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// skipMQTTProperties drops an MQTT 5 property block; the stand-in broker
+// does not act on any property.
+func skipMQTTProperties(b []byte) ([]byte, error) {
+	reader := bytes.NewReader(b)
+	length, err := readMQTTVarInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	consumed := len(b) - reader.Len()
+	if len(b) < consumed+length {
+		return nil, errors.New("truncated properties")
+	}
+	return b[consumed+length:], nil
+}
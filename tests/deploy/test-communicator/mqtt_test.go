@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMQTTVarIntRoundTrip(t *testing.T) {
+	tests := []struct {
+		value   int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, test := range tests {
+		encoded := appendMQTTVarInt(nil, test.value)
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("appendMQTTVarInt(%d) = %x, want %x", test.value, encoded, test.encoded)
+		}
+		value, err := readMQTTVarInt(bytes.NewReader(encoded))
+		if err != nil || value != test.value {
+			t.Errorf("readMQTTVarInt(%x) = %d, %v; want %d", encoded, value, err, test.value)
+		}
+	}
+
+	for _, input := range [][]byte{{}, {0x80}, {0xff, 0xff, 0xff}, {0xff, 0xff, 0xff, 0xff, 0x01}} {
+		if _, err := readMQTTVarInt(bytes.NewReader(input)); err == nil {
+			t.Errorf("readMQTTVarInt(%x): want an error", input)
+		}
+	}
+}
+
+func TestReadMQTTString(t *testing.T) {
+	tests := []struct {
+		input   []byte
+		want    string
+		rest    []byte
+		wantErr bool
+	}{
+		{input: []byte{0, 0}, want: "", rest: []byte{}},
+		{input: []byte{0, 3, 'a', '/', 'b', 9}, want: "a/b", rest: []byte{9}},
+		{input: nil, wantErr: true},
+		{input: []byte{0}, wantErr: true},
+		{input: []byte{0, 4, 'a'}, wantErr: true},
+		{input: []byte{0xff, 0xff, 'a'}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, rest, err := readMQTTString(test.input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("readMQTTString(%x) = %q, want an error", test.input, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want || !bytes.Equal(rest, test.rest) {
+			t.Errorf("readMQTTString(%x) = %q, %x, %v", test.input, got, rest, err)
+		}
+	}
+}
+
+func TestSkipMQTTProperties(t *testing.T) {
+	tests := []struct {
+		input   []byte
+		rest    []byte
+		wantErr bool
+	}{
+		{input: []byte{0, 'p'}, rest: []byte{'p'}},
+		{input: []byte{3, 0x01, 0x01, 0x00, 'p'}, rest: []byte{'p'}},
+		{input: []byte{3, 0x01}, wantErr: true},
+		{input: []byte{0x80}, wantErr: true},
+		{input: nil, wantErr: true},
+	}
+	for _, test := range tests {
+		rest, err := skipMQTTProperties(test.input)
+		if (err != nil) != test.wantErr || !bytes.Equal(rest, test.rest) {
+			t.Errorf("skipMQTTProperties(%x) = %x, %v", test.input, rest, err)
+		}
+	}
+}
+
+func TestMQTTPublishRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     mqttMessage
+		version byte
+	}{
+		{"3.1.1 QoS 0", mqttMessage{topic: "sensors/a", qos: 0, payload: []byte(`{"v":1}`)}, mqttVersion311},
+		{"3.1.1 QoS 1", mqttMessage{topic: "sensors/a", qos: 1, payload: []byte("data")}, mqttVersion311},
+		{"5 QoS 0", mqttMessage{topic: "t", qos: 0, payload: []byte("data")}, mqttVersion5},
+		{"5 QoS 1", mqttMessage{topic: "t", qos: 1, payload: []byte{}}, mqttVersion5},
+		{"empty topic", mqttMessage{topic: "", qos: 1, payload: []byte("x")}, mqttVersion311},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags, body := encodeMQTTPublish(test.msg, 42, test.version)
+			var buf bytes.Buffer
+			if err := writeMQTTPacket(&buf, mqttPublish, flags, body); err != nil {
+				t.Fatal(err)
+			}
+			packet, err := readMQTTPacket(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet.kind != mqttPublish || packet.flags != test.msg.qos<<1 {
+				t.Errorf("packet type %d flags %d", packet.kind, packet.flags)
+			}
+			msg, packetID, err := decodeMQTTPublish(packet, test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.topic != test.msg.topic || msg.qos != test.msg.qos || !bytes.Equal(msg.payload, test.msg.payload) {
+				t.Errorf("decoded %+v, want %+v", msg, test.msg)
+			}
+			if wantID := uint16(42 * test.msg.qos); packetID != wantID {
+				t.Errorf("packet ID %d, want %d", packetID, wantID)
+			}
+		})
+	}
+}
+
+func TestDecodeMQTTPublishInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  mqttPacket
+		version byte
+	}{
+		{"empty", mqttPacket{kind: mqttPublish}, mqttVersion311},
+		{"truncated topic", mqttPacket{kind: mqttPublish, body: []byte{0, 5, 'a'}}, mqttVersion311},
+		{"missing packet ID", mqttPacket{kind: mqttPublish, flags: 1 << 1, body: []byte{0, 1, 'a', 0}}, mqttVersion311},
+		{"QoS 3", mqttPacket{kind: mqttPublish, flags: 3 << 1, body: []byte{0, 1, 'a', 0, 1}}, mqttVersion311},
+		{"missing properties", mqttPacket{kind: mqttPublish, body: []byte{0, 1, 'a'}}, mqttVersion5},
+		{"truncated properties", mqttPacket{kind: mqttPublish, body: []byte{0, 1, 'a', 5, 1}}, mqttVersion5},
+	}
+	for _, test := range tests {
+		if msg, _, err := decodeMQTTPublish(test.packet, test.version); err == nil {
+			t.Errorf("%s: decoded %+v, want an error", test.name, msg)
+		}
+	}
+}
+
+func TestReadMQTTPacketInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"missing length", []byte{mqttPingReq << 4}},
+		{"malformed length", []byte{mqttPingReq << 4, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"truncated body", []byte{mqttPublish << 4, 5, 0, 1}},
+		{"too large", append([]byte{mqttPublish << 4}, appendMQTTVarInt(nil, mqttMaxPacketSize+1)...)},
+		{"largest length", []byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, test := range tests {
+		if packet, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(test.input))); err == nil {
+			t.Errorf("%s: read %+v, want an error", test.name, packet)
+		}
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/+", "a/b", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true}, // # also matches the parent level
+		{"#", "a/b", true},
+		{"a/+", "a/", true},
+		{"+", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		if got := mqttTopicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("mqttTopicMatches(%q, %q) = %t, want %t", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestMQTTBrokerRoundTrip(t *testing.T) {
+	for _, version := range []byte{mqttVersion311, mqttVersion5} {
+		broker := newMQTTBroker(nil)
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			broker.handleConnection(server)
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(client)
+		expect := func(kind byte, body []byte) mqttPacket {
+			t.Helper()
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				t.Fatalf("version %d: reading packet type %d: %v", version, kind, err)
+			}
+			if packet.kind != kind || (body != nil && !bytes.Equal(packet.body, body)) {
+				t.Fatalf("version %d: got packet type %d %x, want %d %x", version, packet.kind, packet.body, kind, body)
+			}
+			return packet
+		}
+		send := func(kind, flags byte, body []byte) {
+			t.Helper()
+			if err := writeMQTTPacket(client, kind, flags, body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// MQTT 5 acknowledgements carry a property length or reason codes
+		ack := func(body ...byte) []byte {
+			if version == mqttVersion5 {
+				return append(body[:2:2], append([]byte{0}, body[2:]...)...)
+			}
+			return body
+		}
+
+		app := &App{config: Config{ServiceName: "client", MQTTVersion: int(version), MQTTQoS: 1, MQTTRole: "both", MQTTTopics: []string{"sensors/+"}}}
+		setup := app.mqttSetupPackets()
+		send(setup[0].kind, setup[0].flags, setup[0].body)
+		if version == mqttVersion5 {
+			expect(mqttConnAck, []byte{0, 0, 0})
+		} else {
+			expect(mqttConnAck, []byte{0, 0})
+		}
+		send(setup[1].kind, setup[1].flags, setup[1].body)
+		expect(mqttSubAck, ack(0, 1, 1))
+
+		// The publish is acknowledged and routed back to the subscription
+		flags, body := encodeMQTTPublish(mqttMessage{topic: "sensors/a", qos: 1, payload: []byte("21.5")}, 7, version)
+		send(mqttPublish, flags, body)
+		expect(mqttPubAck, []byte{0, 7})
+		delivery := expect(mqttPublish, nil)
+		msg, packetID, err := decodeMQTTPublish(delivery, version)
+		want := mqttMessage{topic: "sensors/a", qos: 1, payload: []byte("21.5")}
+		if err != nil || !reflect.DeepEqual(msg, want) || packetID != 1 {
+			t.Errorf("version %d: delivered %+v with ID %d, %v", version, msg, packetID, err)
+		}
+		send(mqttPubAck, 0, binary.BigEndian.AppendUint16(nil, packetID))
+
+		send(mqttPingReq, 0, nil)
+		expect(mqttPingResp, []byte{})
+
+		unsubscribe := binary.BigEndian.AppendUint16(nil, 2)
+		if version == mqttVersion5 {
+			unsubscribe = append(unsubscribe, 0)
+		}
+		send(mqttUnsubscribe, 0x02, appendMQTTString(unsubscribe, "sensors/+"))
+		if version == mqttVersion5 {
+			expect(mqttUnsubAck, []byte{0, 2, 0, 0})
+		} else {
+			expect(mqttUnsubAck, []byte{0, 2})
+		}
+
+		// Without the subscription, QoS 0 publishes are not delivered back
+		flags, body = encodeMQTTPublish(mqttMessage{topic: "sensors/a", payload: []byte("x")}, 0, version)
+		send(mqttPublish, flags, body)
+		send(mqttPingReq, 0, nil)
+		expect(mqttPingResp, nil)
+
+		send(mqttDisconnect, 0, nil)
+		<-done
+		client.Close()
+		if len(broker.sessions) != 0 {
+			t.Errorf("version %d: %d sessions left", version, len(broker.sessions))
+		}
+	}
+}
+
+func TestMQTTBrokerRejects(t *testing.T) {
+	connect := func(protocol string, level byte) []byte {
+		body := appendMQTTString(nil, protocol)
+		return appendMQTTString(append(body, level, 0x02, 0, 30), "c")
+	}
+	tests := []struct {
+		name    string
+		packets []mqttPacket
+		reply   []byte // CONNACK body expected before the broker closes
+	}{
+		{name: "not CONNECT first", packets: []mqttPacket{{kind: mqttPingReq}}},
+		{name: "wrong protocol", packets: []mqttPacket{{kind: mqttConnect, body: connect("MQIsdp", 3)}}},
+		{name: "unsupported level", packets: []mqttPacket{{kind: mqttConnect, body: connect("MQTT", 3)}}, reply: []byte{0, 1}},
+		{name: "truncated CONNECT", packets: []mqttPacket{{kind: mqttConnect, body: appendMQTTString(nil, "MQTT")}}},
+		{name: "invalid PUBLISH", packets: []mqttPacket{{kind: mqttConnect, body: connect("MQTT", 4)}, {kind: mqttPublish, flags: 3 << 1, body: []byte{0, 1, 'a', 0, 1}}}, reply: []byte{0, 0}},
+		{name: "SUBSCRIBE without options", packets: []mqttPacket{{kind: mqttConnect, body: connect("MQTT", 4)}, {kind: mqttSubscribe, flags: 2, body: appendMQTTString([]byte{0, 1}, "a")}}, reply: []byte{0, 0}},
+		{name: "unsupported packet", packets: []mqttPacket{{kind: mqttConnect, body: connect("MQTT", 4)}, {kind: 15}}, reply: []byte{0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan struct{})
+			go func() {
+				newMQTTBroker(nil).handleConnection(server)
+				close(done)
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(client)
+			go func() {
+				for _, packet := range test.packets {
+					if writeMQTTPacket(client, packet.kind, packet.flags, packet.body) != nil {
+						return
+					}
+				}
+			}()
+			if test.reply != nil {
+				packet, err := readMQTTPacket(reader)
+				if err != nil || packet.kind != mqttConnAck || !bytes.Equal(packet.body, test.reply) {
+					t.Fatalf("reply %+v, %v; want CONNACK %x", packet, err, test.reply)
+				}
+			}
+			if packet, err := readMQTTPacket(reader); err == nil {
+				t.Errorf("read %+v, want the connection closed", packet)
+			}
+			<-done
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Families written as OpenMetrics info and stateset metrics. The client
+// library only knows counters, gauges, summaries and histograms, so they are
+// registered as gauges, which is also how the classic text format shows them.
+const (
+	infoFamily     = "communicator_info"
+	statesetFamily = "traffic_phase"
+)
+
+// metricUnits are the OpenMetrics units recognised from metric name suffixes.
+var metricUnits = []string{"seconds", "bytes"}
+
+// metricsHandler serves the default registry. With OpenMetrics enabled,
+// scrapers asking for it get OpenMetrics with exemplars, _created series,
+// units and info/stateset families; everyone else still gets the classic
+// text format.
+func (a *App) metricsHandler() http.Handler {
+	classic := promhttp.Handler()
+	if !a.config.OpenMetrics {
+		return classic
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if format.FormatType() != expfmt.TypeOpenMetrics {
+			classic.ServeHTTP(w, r)
+			return
+		}
+
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error gathering metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", string(format))
+		out := bufio.NewWriter(w)
+		defer out.Flush()
+
+		encoder := expfmt.NewEncoder(out, format, expfmt.WithCreatedLines(), expfmt.WithUnit())
+		for _, family := range families {
+			switch family.GetName() {
+			case infoFamily:
+				writeInfo(out, family)
+			case statesetFamily:
+				writeStateset(out, family, phaseNames(a.config.Phases, a.config.PhasesRepeat))
+			default:
+				for _, unit := range metricUnits {
+					if strings.HasSuffix(strings.TrimSuffix(family.GetName(), "_total"), "_"+unit) {
+						family.Unit = &unit
+					}
+				}
+				if err := encoder.Encode(family); err != nil {
+					return
+				}
+			}
+		}
+		expfmt.FinalizeOpenMetrics(out)
+	})
+}
+
+// writeInfo writes a gauge family whose samples are always 1 as an
+// OpenMetrics info metric. The family is named without the _info suffix.
+func writeInfo(w *bufio.Writer, family *dto.MetricFamily) {
+	name := strings.TrimSuffix(family.GetName(), "_info")
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s info\n", name, escapeHelp(family.GetHelp()), name)
+	for _, metric := range family.Metric {
+		fmt.Fprintf(w, "%s_info%s 1\n", name, formatLabels(metric.Label))
+	}
+}
+
+// writeStateset writes a gauge family with one "phase" label, set to 1 for
+// the current state only, as an OpenMetrics stateset listing every state.
+// As the specification requires, the state label is named after the family.
+func writeStateset(w *bufio.Writer, family *dto.MetricFamily, states []string) {
+	name := family.GetName()
+	current := map[string]bool{}
+	for _, metric := range family.Metric {
+		for _, label := range metric.Label {
+			if label.GetName() == "phase" && metric.GetGauge().GetValue() == 1 {
+				current[label.GetValue()] = true
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s stateset\n", name, escapeHelp(family.GetHelp()), name)
+	for _, state := range states {
+		value := 0
+		if current[state] {
+			value = 1
+		}
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, name, escapeLabelValue(state), value)
+	}
+}
+
+func formatLabels(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label.GetName(), escapeLabelValue(label.GetValue()))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// requestTrace returns the trace ID of an inbound request when it is
+// sampled. With tracing, that is the trace of the server span, so exemplars
+// point at exported traces. Without tracing, it is the trace of an inbound
+// W3C or B3 context with the sampled flag or, for requests without one, a
+// new trace picked by EXEMPLAR_SAMPLE_RATIO. New traces are returned in a
+// traceparent response header so that clients can find their exemplar.
+func (a *App) requestTrace(w http.ResponseWriter, r *http.Request, s *span) string {
+	if s != nil {
+		if !s.sampled {
+			return ""
+		}
+		traceID := hex.EncodeToString(s.traceID[:])
+		if s.parentID == [8]byte{} {
+			w.Header().Set("traceparent", "00-"+traceID+"-"+hex.EncodeToString(s.spanID[:])+"-01")
+		}
+		return traceID
+	}
+
+	if remote := extractSpanContext(r.Header.Get); remote != nil {
+		if remote.sampled {
+			return hex.EncodeToString(remote.traceID[:])
+		}
+		return ""
+	}
+
+	if a.config.ExemplarSampleRatio <= 0 || a.exemplarRandom.Float64() >= a.config.ExemplarSampleRatio {
+		return ""
+	}
+	var ids [24]byte
+	a.exemplarRandom.Read(ids[:])
+	traceID, spanID := hex.EncodeToString(ids[:16]), hex.EncodeToString(ids[16:])
+	w.Header().Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	return traceID
+}
+
+// statusRecorder keeps the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming handlers working behind the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countRequest counts an inbound HTTP request, with the trace ID as an
+// exemplar when the request is sampled.
+func (a *App) countRequest(traceID string) {
+	if traceID == "" {
+		a.requests.Inc()
+		return
+	}
+	a.requests.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"trace_id": traceID})
+}
+
+// observeRequest records the duration of an inbound HTTP request, with the
+// trace ID as an exemplar when the request is sampled.
+func (a *App) observeRequest(method string, status int, duration time.Duration, traceID string) {
+	observer := a.requestDuration.WithLabelValues(method, strconv.Itoa(status))
+	if traceID == "" {
+		observer.Observe(duration.Seconds())
+		return
+	}
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+}
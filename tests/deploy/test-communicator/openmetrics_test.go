@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// parseSample parses an OpenMetrics sample line written by writeInfo or
+// writeStateset into its name, unescaped labels and value.
+func parseSample(t *testing.T, line string) (string, map[string]string, string) {
+	t.Helper()
+	name, rest, _ := strings.Cut(line, " ")
+	labels := map[string]string{}
+	if open := strings.IndexByte(line, '{'); open >= 0 {
+		end := strings.LastIndex(line, "} ")
+		if end < open {
+			t.Fatalf("unterminated labels in %q", line)
+		}
+		name, rest = line[:open], line[end+2:]
+		pairs := line[open+1 : end]
+		for pairs != "" {
+			key, value, ok := strings.Cut(pairs, `="`)
+			if !ok {
+				t.Fatalf("label without value in %q", line)
+			}
+			// Find the closing quote, skipping escaped characters
+			i := 0
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(value) {
+				t.Fatalf("unterminated label value in %q", line)
+			}
+			unquoted, err := strconv.Unquote(`"` + value[:i] + `"`)
+			if err != nil {
+				t.Fatalf("label value %q in %q: %v", value[:i], line, err)
+			}
+			labels[key] = unquoted
+			pairs = strings.TrimPrefix(value[i+1:], ",")
+		}
+	}
+	return name, labels, rest
+}
+
+func gaugeFamily(name, help string, samples ...map[string]string) *dto.MetricFamily {
+	family := &dto.MetricFamily{Name: proto.String(name), Help: proto.String(help), Type: dto.MetricType_GAUGE.Enum()}
+	for _, labels := range samples {
+		metric := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(0)}}
+		for _, key := range []string{"phase", "service", "version"} {
+			if value, ok := labels[key]; ok {
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(key), Value: proto.String(value)})
+			}
+		}
+		if labels["value"] == "1" {
+			metric.Gauge.Value = proto.Float64(1)
+		}
+		family.Metric = append(family.Metric, metric)
+	}
+	return family
+}
+
+func TestWriteInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		help   string
+		labels map[string]string
+	}{
+		{"plain", "Build information.", map[string]string{"service": "svc", "version": "1.2.3"}},
+		{"escaped", "Help with a \\ and\na newline.", map[string]string{"service": `we"ird\name` + "\nline", "version": "{}=,"}},
+		{"no labels", "Nothing.", map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			w := bufio.NewWriter(&out)
+			writeInfo(w, gaugeFamily(infoFamily, test.help, test.labels))
+			w.Flush()
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != 3 {
+				t.Fatalf("wrote %q, want help, type and one sample", out.String())
+			}
+			if help := strings.TrimPrefix(lines[0], "# HELP communicator "); help == lines[0] || strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(help) != test.help {
+				t.Errorf("help line %q for %q", lines[0], test.help)
+			}
+			if lines[1] != "# TYPE communicator info" {
+				t.Errorf("type line %q", lines[1])
+			}
+			name, labels, value := parseSample(t, lines[2])
+			if name != "communicator_info" || value != "1" || !reflect.DeepEqual(labels, test.labels) {
+				t.Errorf("sample %q parsed as %s %v %s, want labels %v", lines[2], name, labels, value, test.labels)
+			}
+		})
+	}
+}
+
+func TestWriteStateset(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  []string
+		samples []map[string]string
+		want    map[string]string // State to value
+	}{
+		{
+			name:    "current phase",
+			states:  []string{"warmup", "peak", "finished"},
+			samples: []map[string]string{{"phase": "warmup"}, {"phase": "peak", "value": "1"}},
+			want:    map[string]string{"warmup": "0", "peak": "1", "finished": "0"},
+		},
+		{
+			name:    "unknown phases are left out",
+			states:  []string{"steady"},
+			samples: []map[string]string{{"phase": "old", "value": "1"}},
+			want:    map[string]string{"steady": "0"},
+		},
+		{
+			name:    "escaped names",
+			states:  []string{`a"b`, `c\d`, "e\nf"},
+			samples: []map[string]string{{"phase": "e\nf", "value": "1"}},
+			want:    map[string]string{`a"b`: "0", `c\d`: "0", "e\nf": "1"},
+		},
+		{
+			name: "no samples",
+			want: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			w := bufio.NewWriter(&out)
+			writeStateset(w, gaugeFamily(statesetFamily, "Current phase.", test.samples...), test.states)
+			w.Flush()
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) < 2 || lines[0] != "# HELP traffic_phase Current phase." || lines[1] != "# TYPE traffic_phase stateset" {
+				t.Fatalf("wrote %q", out.String())
+			}
+			got := map[string]string{}
+			for _, line := range lines[2:] {
+				name, labels, value := parseSample(t, line)
+				if name != statesetFamily || len(labels) != 1 {
+					t.Errorf("sample %q, want one %s label", line, statesetFamily)
+				}
+				got[labels[statesetFamily]] = value
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("states %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		openMetrics bool
+		accept      string
+		wantType    string
+		wantEOF     bool
+	}{
+		{"classic by default", true, "", "text/plain", false},
+		{"openmetrics requested", true, "application/openmetrics-text;version=1.0.0", "application/openmetrics-text", true},
+		{"openmetrics disabled", false, "application/openmetrics-text;version=1.0.0", "text/plain", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &App{config: Config{OpenMetrics: test.openMetrics}}
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			app.metricsHandler().ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), test.wantType) {
+				t.Errorf("status %d, content type %q, want %s", w.Code, w.Header().Get("Content-Type"), test.wantType)
+			}
+			if got := strings.HasSuffix(w.Body.String(), "# EOF\n"); got != test.wantEOF {
+				t.Errorf("ends with # EOF: %t, want %t", got, test.wantEOF)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phase is one window of the traffic timeline. Phases without a cron
+// expression run back to back from startup; a cron phase takes over for
+// Duration whenever its expression matches.
+type Phase struct {
+	Name     string   `json:"name"`
+	Duration string   `json:"duration"` // Length of the phase, or of every cron window
+	Cron     string   `json:"cron"`     // Five-field cron expression (UTC), empty for the relative timeline
+	Edges    []string `json:"edges"`    // Periodic edges by protocol, all when omitted, none when empty
+	Interval string   `json:"interval"` // Time between requests, defaults to one minute
+
+	duration time.Duration
+	interval time.Duration
+	cron     *cronSchedule
+}
+
+var (
+	// defaultPhase is used when PHASES is not set and keeps the original
+	// once-a-minute behaviour.
+	defaultPhase = Phase{Name: "default", interval: periodicInterval}
+	// idlePhase covers the time outside cron windows when there is no
+	// relative timeline.
+	idlePhase = Phase{Name: "idle", Edges: []string{}}
+	// finishedPhase follows the last relative phase unless PHASES_REPEAT is set.
+	finishedPhase = Phase{Name: "finished", Edges: []string{}}
+)
+
+var phaseEdgeNames = []string{"all", "http", "grpc", "tcp", "memcached", "mongo", "http3", "flow"}
+
+// parsePhases decodes the PHASES JSON array.
+func parsePhases(value string) ([]Phase, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var phases []Phase
+	if err := json.Unmarshal([]byte(value), &phases); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	for i := range phases {
+		phase := &phases[i]
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase-%d", i+1)
+		}
+
+		var err error
+		if phase.duration, err = time.ParseDuration(phase.Duration); err != nil || phase.duration <= 0 {
+			return nil, fmt.Errorf("phase %s needs a positive duration, got %q", phase.Name, phase.Duration)
+		}
+
+		phase.interval = periodicInterval
+		if phase.Interval != "" {
+			if phase.interval, err = time.ParseDuration(phase.Interval); err != nil || phase.interval <= 0 {
+				return nil, fmt.Errorf("phase %s needs a positive interval, got %q", phase.Name, phase.Interval)
+			}
+		}
+
+		if phase.Cron != "" {
+			if phase.cron, err = parseCron(phase.Cron); err != nil {
+				return nil, fmt.Errorf("invalid cron expression for phase %s: %v", phase.Name, err)
+			}
+		}
+
+		for _, edge := range phase.Edges {
+			if !slices.Contains(phaseEdgeNames, edge) {
+				return nil, fmt.Errorf("unknown edge %q in phase %s", edge, phase.Name)
+			}
+		}
+	}
+
+	return phases, nil
+}
+
+// phaseNames lists every phase that can become active, built-in ones
+// included, in timeline order.
+func phaseNames(phases []Phase, repeat bool) []string {
+	if len(phases) == 0 {
+		return []string{defaultPhase.Name}
+	}
+
+	var names []string
+	relative := false
+	for _, phase := range phases {
+		names = append(names, phase.Name)
+		relative = relative || phase.cron == nil
+	}
+	switch {
+	case !relative:
+		names = append(names, idlePhase.Name)
+	case !repeat:
+		names = append(names, finishedPhase.Name)
+	}
+	return names
+}
+
+func (p *Phase) active() bool {
+	return p.Edges == nil || len(p.Edges) > 0
+}
+
+func (p *Phase) runs(protocol string) bool {
+	return p.Edges == nil || slices.Contains(p.Edges, "all") || slices.Contains(p.Edges, protocol)
+}
+
+func (p *Phase) String() string {
+	if !p.active() {
+		return p.Name + " (silent)"
+	}
+	edges := "all edges"
+	if p.Edges != nil {
+		edges = strings.Join(p.Edges, ",")
+	}
+	return fmt.Sprintf("%s (%s every %s)", p.Name, edges, p.interval)
+}
+
+// phaseScheduler decides which phase is active and when requests are due.
+// It is driven by the caller's clock, so the dry run can replay it.
+type phaseScheduler struct {
+	phases      []Phase
+	repeat      bool
+	started     time.Time
+	now         time.Time
+	current     *Phase
+	end         time.Time // End of the current phase, zero when open-ended
+	nextRequest time.Time
+}
+
+func newPhaseScheduler(phases []Phase, repeat bool, started time.Time) *phaseScheduler {
+	return &phaseScheduler{phases: phases, repeat: repeat, started: started}
+}
+
+// advance moves the scheduler to now and reports whether the phase changed
+// and whether a request is due.
+func (s *phaseScheduler) advance(now time.Time) (changed, due bool) {
+	s.now = now
+	phase, end := s.phaseAt(now)
+	s.end = end
+
+	if phase != s.current {
+		s.current = phase
+		changed = true
+		// Requests start with the phase, but never before the initial delay
+		s.nextRequest = now
+		if first := s.started.Add(periodicInitialDelay); first.After(now) {
+			s.nextRequest = first
+		}
+	}
+
+	if s.current.active() && !s.nextRequest.After(now) {
+		due = true
+		for !s.nextRequest.After(now) {
+			s.nextRequest = s.nextRequest.Add(s.current.interval)
+		}
+	}
+	return changed, due
+}
+
+// wake returns when advance must be called next, or the zero time when
+// nothing will happen any more.
+func (s *phaseScheduler) wake() time.Time {
+	next := s.end
+	if s.current.active() {
+		next = earliest(next, s.nextRequest)
+	}
+	if slices.ContainsFunc(s.phases, func(p Phase) bool { return p.cron != nil }) {
+		next = earliest(next, s.now.Truncate(time.Minute).Add(time.Minute))
+	}
+	return next
+}
+
+// phaseAt returns the phase active at t and when it ends.
+func (s *phaseScheduler) phaseAt(t time.Time) (*Phase, time.Time) {
+	var relative []*Phase
+	var total time.Duration
+	for i := range s.phases {
+		phase := &s.phases[i]
+		if phase.cron == nil {
+			relative = append(relative, phase)
+			total += phase.duration
+			continue
+		}
+		for start := t.Truncate(time.Minute); start.Add(phase.duration).After(t); start = start.Add(-time.Minute) {
+			if phase.cron.matches(start) {
+				return phase, start.Add(phase.duration)
+			}
+		}
+	}
+
+	switch {
+	case len(s.phases) == 0:
+		return &defaultPhase, time.Time{}
+	case len(relative) == 0:
+		return &idlePhase, time.Time{}
+	}
+
+	cycleStart := s.started
+	elapsed := t.Sub(s.started)
+	if s.repeat {
+		cycles := elapsed / total
+		cycleStart = cycleStart.Add(cycles * total)
+		elapsed -= cycles * total
+	}
+
+	var offset time.Duration
+	for _, phase := range relative {
+		if offset += phase.duration; elapsed < offset {
+			return phase, cycleStart.Add(offset)
+		}
+	}
+	return &finishedPhase, time.Time{}
+}
+
+// earliest returns the earlier of two times, treating the zero time as never.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week. Fields accept *, values, ranges, lists and steps.
+type cronSchedule struct {
+	fields          [5]uint64
+	anyDay, anyWeek bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	c := &cronSchedule{anyDay: strings.HasPrefix(fields[2], "*"), anyWeek: strings.HasPrefix(fields[4], "*")}
+	for i, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			span, step := part, 1
+			if before, after, ok := strings.Cut(part, "/"); ok {
+				var err error
+				if step, err = strconv.Atoi(after); err != nil || step <= 0 {
+					return nil, fmt.Errorf("invalid step in %q", part)
+				}
+				span = before
+			}
+
+			low, high := cronRanges[i][0], cronRanges[i][1]
+			if span != "*" {
+				first, last, isRange := strings.Cut(span, "-")
+				var err error
+				if low, err = strconv.Atoi(first); err != nil {
+					return nil, fmt.Errorf("invalid value in %q", part)
+				}
+				switch {
+				case isRange:
+					if high, err = strconv.Atoi(last); err != nil {
+						return nil, fmt.Errorf("invalid range in %q", part)
+					}
+				case step == 1:
+					high = low
+				}
+			}
+			if low < cronRanges[i][0] || high > cronRanges[i][1] || low > high {
+				return nil, fmt.Errorf("%q is out of range", part)
+			}
+
+			for v := low; v <= high; v += step {
+				c.fields[i] |= 1 << v
+			}
+		}
+	}
+
+	// Sunday may be written as 0 or 7
+	if c.fields[4]&(1<<7) != 0 {
+		c.fields[4] |= 1
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	t = t.UTC()
+	if c.fields[0]&(1<<t.Minute()) == 0 || c.fields[1]&(1<<t.Hour()) == 0 || c.fields[3]&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	// As in cron, a restricted day of month and day of week match either
+	day := c.fields[2]&(1<<t.Day()) != 0
+	weekday := c.fields[4]&(1<<int(t.Weekday())) != 0
+	if c.anyDay || c.anyWeek {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(value string) time.Time {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	// 2026-01-05 is a Monday
+	tests := []struct {
+		expr    string
+		match   []string
+		noMatch []string
+	}{
+		{"* * * * *", []string{"2026-01-05T00:00:00Z", "2026-12-31T23:59:00Z"}, nil},
+		{"30 9 * * *", []string{"2026-01-05T09:30:00Z"}, []string{"2026-01-05T09:31:00Z", "2026-01-05T10:30:00Z"}},
+		{"*/15 * * * *", []string{"2026-01-05T10:00:00Z", "2026-01-05T10:45:00Z"}, []string{"2026-01-05T10:10:00Z"}},
+		{"5/20 * * * *", []string{"2026-01-05T10:05:00Z", "2026-01-05T10:25:00Z", "2026-01-05T10:45:00Z"}, []string{"2026-01-05T10:00:00Z"}},
+		{"0 9-17/4 * * *", []string{"2026-01-05T09:00:00Z", "2026-01-05T13:00:00Z", "2026-01-05T17:00:00Z"}, []string{"2026-01-05T11:00:00Z", "2026-01-05T21:00:00Z"}},
+		{"0,30 8,20 * * *", []string{"2026-01-05T08:30:00Z", "2026-01-05T20:00:00Z"}, []string{"2026-01-05T12:00:00Z"}},
+		{"0 0 1 1 *", []string{"2026-01-01T00:00:00Z"}, []string{"2026-02-01T00:00:00Z"}},
+		{"0 0 * * 1-5", []string{"2026-01-05T00:00:00Z", "2026-01-09T00:00:00Z"}, []string{"2026-01-10T00:00:00Z", "2026-01-11T00:00:00Z"}},
+		// Sunday is 0 or 7
+		{"0 0 * * 7", []string{"2026-01-11T00:00:00Z"}, []string{"2026-01-10T00:00:00Z"}},
+		{"0 0 * * 0", []string{"2026-01-11T00:00:00Z"}, []string{"2026-01-12T00:00:00Z"}},
+		// A restricted day of month and day of week match either one
+		{"0 0 13 * 5", []string{"2026-01-09T00:00:00Z", "2026-01-13T00:00:00Z"}, []string{"2026-01-14T00:00:00Z"}},
+		// With one of them unrestricted, both must match
+		{"0 0 */2 * 1", []string{"2026-01-05T00:00:00Z"}, []string{"2026-01-12T00:00:00Z", "2026-01-07T00:00:00Z"}},
+		// Cron times are UTC
+		{"0 12 * * *", []string{"2026-01-05T13:00:00+01:00"}, []string{"2026-01-05T12:00:00+01:00"}},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			cron, err := parseCron(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range test.match {
+				if !cron.matches(at(value)) {
+					t.Errorf("does not match %s", value)
+				}
+			}
+			for _, value := range test.noMatch {
+				if cron.matches(at(value)) {
+					t.Errorf("matches %s", value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/-5 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		",5 * * * *",
+		"99999999999999999999 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): want an error", expr)
+		}
+	}
+}
+
+func TestParsePhases(t *testing.T) {
+	phases, err := parsePhases(`[{"duration":"10m"},{"name":"burst","duration":"1m","interval":"5s","edges":["http","tcp"]},{"name":"quiet","duration":"1h","edges":[]},{"name":"nightly","duration":"30m","cron":"0 2 * * *"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name     string
+		duration time.Duration
+		interval time.Duration
+		active   bool
+		cron     bool
+	}{
+		{"phase-1", 10 * time.Minute, periodicInterval, true, false},
+		{"burst", time.Minute, 5 * time.Second, true, false},
+		{"quiet", time.Hour, periodicInterval, false, false},
+		{"nightly", 30 * time.Minute, periodicInterval, true, true},
+	}
+	for i, w := range want {
+		p := phases[i]
+		if p.Name != w.name || p.duration != w.duration || p.interval != w.interval || p.active() != w.active || (p.cron != nil) != w.cron {
+			t.Errorf("phase %d = %s, %s, %s, active %t; want %+v", i, p.Name, p.duration, p.interval, p.active(), w)
+		}
+	}
+	if !phases[1].runs("tcp") || phases[1].runs("grpc") || !phases[0].runs("grpc") {
+		t.Error("edges are not applied")
+	}
+
+	if phases, err := parsePhases(""); err != nil || phases != nil {
+		t.Errorf("empty PHASES = %v, %v", phases, err)
+	}
+}
+
+func TestParsePhasesInvalid(t *testing.T) {
+	for _, value := range []string{
+		`{`,
+		`{"duration":"1m"}`,
+		`[{}]`,
+		`[{"duration":"0s"}]`,
+		`[{"duration":"-1m"}]`,
+		`[{"duration":"soon"}]`,
+		`[{"duration":"1m","interval":"0s"}]`,
+		`[{"duration":"1m","interval":"often"}]`,
+		`[{"duration":"1m","cron":"* * *"}]`,
+		`[{"duration":"1m","edges":["smtp"]}]`,
+	} {
+		if _, err := parsePhases(value); err == nil {
+			t.Errorf("parsePhases(%s): want an error", value)
+		}
+	}
+}
+
+func TestPhaseNames(t *testing.T) {
+	relative := []Phase{{Name: "a"}, {Name: "b"}}
+	cron := []Phase{{Name: "c", cron: &cronSchedule{}}}
+	tests := []struct {
+		name   string
+		phases []Phase
+		repeat bool
+		want   []string
+	}{
+		{"default", nil, false, []string{"default"}},
+		{"relative", relative, false, []string{"a", "b", "finished"}},
+		{"repeating", relative, true, []string{"a", "b"}},
+		{"cron only", cron, false, []string{"c", "idle"}},
+	}
+	for _, test := range tests {
+		if got := phaseNames(test.phases, test.repeat); !slices.Equal(got, test.want) {
+			t.Errorf("%s: phaseNames = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// schedulerRun advances a scheduler from start in steps until end and
+// returns the phase at every step and the offsets at which requests were due.
+func schedulerRun(s *phaseScheduler, start time.Time, step, end time.Duration) (phases []string, due []time.Duration) {
+	for offset := time.Duration(0); offset <= end; offset += step {
+		_, isDue := s.advance(start.Add(offset))
+		if len(phases) == 0 || phases[len(phases)-1] != s.current.Name {
+			phases = append(phases, s.current.Name)
+		}
+		if isDue {
+			due = append(due, offset)
+		}
+	}
+	return phases, due
+}
+
+func TestPhaseScheduler(t *testing.T) {
+	start := time.Date(2026, 1, 5, 1, 0, 0, 0, time.UTC)
+	parse := func(value string) []Phase {
+		phases, err := parsePhases(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return phases
+	}
+
+	t.Run("relative", func(t *testing.T) {
+		s := newPhaseScheduler(parse(`[{"name":"a","duration":"2m","interval":"20s"},{"name":"b","duration":"1m","edges":[]}]`), false, start)
+		phases, due := schedulerRun(s, start, 10*time.Second, 5*time.Minute)
+		if want := []string{"a", "b", "finished"}; !slices.Equal(phases, want) {
+			t.Errorf("phases %v, want %v", phases, want)
+		}
+		// The first request waits for the initial delay
+		want := []time.Duration{30 * time.Second, 50 * time.Second, 70 * time.Second, 90 * time.Second, 110 * time.Second}
+		if !slices.Equal(due, want) {
+			t.Errorf("due at %v, want %v", due, want)
+		}
+		if !s.wake().IsZero() {
+			t.Errorf("finished scheduler wakes at %s", s.wake())
+		}
+	})
+
+	t.Run("repeat", func(t *testing.T) {
+		s := newPhaseScheduler(parse(`[{"name":"a","duration":"1m"},{"name":"b","duration":"1m"}]`), true, start)
+		phases, _ := schedulerRun(s, start, 30*time.Second, 5*time.Minute)
+		if want := []string{"a", "b", "a", "b", "a", "b"}; !slices.Equal(phases, want) {
+			t.Errorf("phases %v, want %v", phases, want)
+		}
+	})
+
+	t.Run("cron", func(t *testing.T) {
+		s := newPhaseScheduler(parse(`[{"name":"window","duration":"2m","cron":"5 1 * * *"}]`), false, start)
+		phases, _ := schedulerRun(s, start, time.Minute, 10*time.Minute)
+		if want := []string{"idle", "window", "idle"}; !slices.Equal(phases, want) {
+			t.Errorf("phases %v, want %v", phases, want)
+		}
+
+		s.advance(start.Add(6*time.Minute + 30*time.Second))
+		if s.current.Name != "window" || !s.end.Equal(start.Add(7*time.Minute)) {
+			t.Errorf("at 01:06:30 phase %s ends %s, want window ending 01:07", s.current.Name, s.end)
+		}
+	})
+
+	t.Run("cron over relative", func(t *testing.T) {
+		s := newPhaseScheduler(parse(`[{"name":"base","duration":"1h"},{"name":"window","duration":"1m","cron":"2 * * * *"}]`), true, start)
+		phases, _ := schedulerRun(s, start, time.Minute, 4*time.Minute)
+		if want := []string{"base", "window", "base"}; !slices.Equal(phases, want) {
+			t.Errorf("phases %v, want %v", phases, want)
+		}
+	})
+}
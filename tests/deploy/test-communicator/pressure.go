@@ -0,0 +1,550 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pressureActions are the resource-pressure actions available as admin
+// endpoints and as scheduled actions.
+var pressureActions = []string{"memory", "cpu", "goroutines", "fds", "disk", "panic", "exit", "release"}
+
+// pressureResources can be released again with DELETE or the "release" action.
+var pressureResources = []string{"memory", "goroutines", "fds", "disk"}
+
+// ScheduledAction runs a pressure action once, After the given time since
+// startup. Params are the admin endpoint's query parameters.
+type ScheduledAction struct {
+	After  string            `json:"after"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params"`
+
+	after time.Duration
+}
+
+// PressureState reports the simulated resource usage held by the process.
+type PressureState struct {
+	MemoryBytes int64  `json:"memory_bytes"`
+	CPUWorkers  int    `json:"cpu_workers"`
+	Goroutines  int    `json:"leaked_goroutines"`
+	Files       int    `json:"leaked_fds"`
+	DiskBytes   int64  `json:"disk_bytes"`
+	Message     string `json:"message,omitempty"`
+	Service     string `json:"service"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// pressure holds everything allocated by the pressure actions so it can be
+// reported and released.
+type pressure struct {
+	mu          sync.Mutex
+	memory      [][]byte
+	memoryBytes int64
+	memoryRamp  int // Incremented on release to stop a running ramp
+	cpuWorkers  int
+	leak        chan struct{}
+	goroutines  int
+	files       []*os.File
+	disk        map[string]int64 // Bytes written so far to each fill file
+	diskStop    chan struct{}    // Closed on release to stop running fills
+	usage       *prometheus.GaugeVec
+}
+
+func newPressure(usage *prometheus.GaugeVec) *pressure {
+	return &pressure{leak: make(chan struct{}), disk: make(map[string]int64), diskStop: make(chan struct{}), usage: usage}
+}
+
+// parseScheduledActions decodes the ACTIONS JSON array.
+func parseScheduledActions(value string) ([]ScheduledAction, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var actions []ScheduledAction
+	if err := json.Unmarshal([]byte(value), &actions); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	for i := range actions {
+		action := &actions[i]
+		if !slices.Contains(pressureActions, action.Action) {
+			return nil, fmt.Errorf("unknown action %q", action.Action)
+		}
+		var err error
+		if action.after, err = time.ParseDuration(action.After); err != nil {
+			return nil, fmt.Errorf("invalid delay for action %d: %v", i, err)
+		}
+		if _, err := parsePressureParams(action.Action, action.values()); err != nil {
+			return nil, fmt.Errorf("invalid params for action %d: %v", i, err)
+		}
+	}
+	slices.SortStableFunc(actions, func(a, b ScheduledAction) int { return cmp.Compare(a.after, b.after) })
+	return actions, nil
+}
+
+// values returns the params as the query parameters of the admin endpoint.
+func (action ScheduledAction) values() url.Values {
+	params := url.Values{}
+	for key, value := range action.Params {
+		params.Set(key, value)
+	}
+	return params
+}
+
+func (a *App) runScheduledActions() {
+	started := time.Now()
+	for _, action := range a.config.Actions {
+		select {
+		case <-time.After(time.Until(started.Add(action.after))):
+		case <-a.stopCh:
+			return
+		}
+
+		params := action.values()
+		log.Printf("Running scheduled action %s %s", action.Action, params.Encode())
+		if message, err := a.runPressureAction(action.Action, params); err != nil {
+			log.Printf("Scheduled action %s failed: %v", action.Action, err)
+		} else {
+			log.Printf("Scheduled action %s: %s", action.Action, message)
+		}
+	}
+}
+
+// pressureHandler serves POST /admin/{action} to start an action and
+// DELETE /admin/{resource} to release what it holds.
+func (a *App) pressureHandler(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+	params := r.URL.Query()
+	if r.Method == http.MethodDelete {
+		params.Set("resource", action)
+		action = "release"
+	}
+
+	if !slices.Contains(pressureActions, action) {
+		http.Error(w, fmt.Sprintf("Unknown action: %s", action), http.StatusNotFound)
+		return
+	}
+	if _, err := parsePressureParams(action, params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin action %s %s", action, params.Encode())
+
+	// Answer before the process goes away
+	if action == "panic" || action == "exit" {
+		a.writePressureState(w, http.StatusAccepted, fmt.Sprintf("%s scheduled", action))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			a.runPressureAction(action, params)
+		}()
+		return
+	}
+
+	message, err := a.runPressureAction(action, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.writePressureState(w, http.StatusAccepted, message)
+}
+
+func (a *App) pressureStateHandler(w http.ResponseWriter, r *http.Request) {
+	a.writePressureState(w, http.StatusOK, "")
+}
+
+func (a *App) writePressureState(w http.ResponseWriter, status int, message string) {
+	p := a.pressure
+	p.mu.Lock()
+	state := PressureState{
+		MemoryBytes: p.memoryBytes,
+		CPUWorkers:  p.cpuWorkers,
+		Goroutines:  p.goroutines,
+		Files:       len(p.files),
+		Message:     message,
+		Service:     a.config.ServiceName,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, size := range p.disk {
+		state.DiskBytes += size
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(state)
+}
+
+// pressureParams are the parsed parameters of a pressure action.
+type pressureParams struct {
+	bytes    int64
+	step     int64
+	interval time.Duration
+	cores    int
+	duration time.Duration
+	count    int
+	path     string
+	code     int
+	resource string
+}
+
+// parsePressureParams checks the parameters of action and fills in the
+// defaults. Scheduled actions are checked this way when the configuration
+// is loaded.
+func parsePressureParams(action string, params url.Values) (pressureParams, error) {
+	var pp pressureParams
+	var err error
+	positive := func(name string) (int, error) {
+		n, err := strconv.Atoi(params.Get(name))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("%s needs a positive %s parameter", action, name)
+		}
+		return n, nil
+	}
+
+	switch action {
+	case "memory":
+		if pp.bytes, err = parseByteSize(params.Get("bytes"), 0); err != nil || pp.bytes <= 0 {
+			return pp, fmt.Errorf("memory needs a positive bytes parameter")
+		}
+		if pp.step, err = parseByteSize(params.Get("step"), pp.bytes); err != nil || pp.step <= 0 {
+			return pp, fmt.Errorf("invalid step")
+		}
+		pp.interval, err = parseDurationParam(params.Get("interval"), time.Second)
+
+	case "cpu":
+		pp.cores = 1
+		if params.Get("cores") != "" {
+			if pp.cores, err = positive("cores"); err != nil {
+				return pp, err
+			}
+		}
+		if pp.duration, err = parseDurationParam(params.Get("duration"), time.Minute); err == nil && pp.duration == 0 {
+			err = fmt.Errorf("cpu needs a positive duration")
+		}
+
+	case "goroutines", "fds":
+		pp.count, err = positive("count")
+
+	case "disk":
+		if pp.bytes, err = parseByteSize(params.Get("bytes"), 0); err != nil || pp.bytes <= 0 {
+			return pp, fmt.Errorf("disk needs a positive bytes parameter")
+		}
+		pp.path = cmp.Or(params.Get("path"), os.TempDir())
+
+	case "exit":
+		pp.code = 1
+		if code := params.Get("code"); code != "" {
+			if pp.code, err = strconv.Atoi(code); err != nil || pp.code < 0 || pp.code > 255 {
+				return pp, fmt.Errorf("exit code must be between 0 and 255")
+			}
+		}
+
+	case "release":
+		pp.resource = cmp.Or(params.Get("resource"), "all")
+		if pp.resource != "all" && !slices.Contains(pressureResources, pp.resource) {
+			return pp, fmt.Errorf("cannot release %q", pp.resource)
+		}
+	}
+	return pp, err
+}
+
+// runPressureAction starts action and returns a short description of what
+// it did. Long-running actions continue in the background.
+func (a *App) runPressureAction(action string, params url.Values) (string, error) {
+	pp, err := parsePressureParams(action, params)
+	if err != nil {
+		return "", err
+	}
+
+	p := a.pressure
+	switch action {
+	case "memory":
+		go p.allocateMemory(pp.bytes, pp.step, pp.interval)
+		return fmt.Sprintf("allocating %d bytes in steps of %d every %s", pp.bytes, pp.step, pp.interval), nil
+
+	case "cpu":
+		p.burnCPU(pp.cores, pp.duration)
+		return fmt.Sprintf("burning %d cores for %s", pp.cores, pp.duration), nil
+
+	case "goroutines":
+		p.leakGoroutines(pp.count)
+		return fmt.Sprintf("leaked %d goroutines", pp.count), nil
+
+	case "fds":
+		opened, err := p.leakFiles(pp.count)
+		if err != nil {
+			return "", fmt.Errorf("opened %d of %d files: %v", opened, pp.count, err)
+		}
+		return fmt.Sprintf("leaked %d file descriptors", opened), nil
+
+	case "disk":
+		f, err := createFillFile(pp.path)
+		if err != nil {
+			return "", err
+		}
+		go p.fillDisk(f, pp.bytes, p.trackFill(f.Name()))
+		return fmt.Sprintf("writing %d bytes to %s", pp.bytes, f.Name()), nil
+
+	case "panic":
+		a.crash("panic action")
+
+	case "exit":
+		log.Printf("Exiting with code %d (exit action)", pp.code)
+		os.Exit(pp.code)
+
+	case "release":
+		if pp.resource == "all" {
+			for _, resource := range pressureResources {
+				p.release(resource)
+			}
+			return "released all resources", nil
+		}
+		p.release(pp.resource)
+		return "released " + pp.resource, nil
+	}
+	return "", nil
+}
+
+// allocateMemory grows the heap by step every interval until size bytes are
+// held. Every page is written so the memory counts as resident.
+func (p *pressure) allocateMemory(size, step int64, interval time.Duration) {
+	p.mu.Lock()
+	ramp := p.memoryRamp
+	p.mu.Unlock()
+
+	for allocated := int64(0); allocated < size; allocated += step {
+		chunk := make([]byte, min(step, size-allocated))
+		for i := 0; i < len(chunk); i += 4096 {
+			chunk[i] = 1
+		}
+
+		p.mu.Lock()
+		if p.memoryRamp != ramp {
+			p.mu.Unlock()
+			return
+		}
+		p.memory = append(p.memory, chunk)
+		p.memoryBytes += int64(len(chunk))
+		p.usage.WithLabelValues("memory_bytes").Set(float64(p.memoryBytes))
+		p.mu.Unlock()
+
+		if allocated+step < size {
+			time.Sleep(interval)
+		}
+	}
+	log.Printf("Memory pressure: holding %d bytes", size)
+}
+
+func (p *pressure) burnCPU(cores int, duration time.Duration) {
+	p.mu.Lock()
+	p.cpuWorkers += cores
+	p.usage.WithLabelValues("cpu_workers").Set(float64(p.cpuWorkers))
+	p.mu.Unlock()
+
+	deadline := time.Now().Add(duration)
+	for i := 0; i < cores; i++ {
+		go func() {
+			for x := uint64(0); time.Now().Before(deadline); x++ {
+				for j := 0; j < 100000; j++ {
+					x ^= x<<13 ^ x>>7
+				}
+			}
+
+			p.mu.Lock()
+			p.cpuWorkers--
+			p.usage.WithLabelValues("cpu_workers").Set(float64(p.cpuWorkers))
+			p.mu.Unlock()
+		}()
+	}
+}
+
+func (p *pressure) leakGoroutines(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		go func(leak chan struct{}) {
+			<-leak
+		}(p.leak)
+	}
+	p.goroutines += count
+	p.usage.WithLabelValues("leaked_goroutines").Set(float64(p.goroutines))
+}
+
+// leakFiles opens count descriptors and keeps them open. It stops at the
+// first failure, such as reaching the process limit.
+func (p *pressure) leakFiles(count int) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer func() { p.usage.WithLabelValues("leaked_fds").Set(float64(len(p.files))) }()
+
+	for i := 0; i < count; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			return i, err
+		}
+		p.files = append(p.files, f)
+	}
+	return count, nil
+}
+
+// createFillFile creates the file the disk action fills: a new temporary
+// file when path is a directory, otherwise path itself, which must not
+// exist yet so that no existing file is ever overwritten or later removed.
+func createFillFile(path string) (*os.File, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return os.CreateTemp(path, "test-communicator-fill-*")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	return f, err
+}
+
+// trackFill records path as a fill file before anything is written to it,
+// so that releasing the disk removes it even while it is being filled. The
+// returned channel is closed by that release.
+func (p *pressure) trackFill(path string) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disk[path] = 0
+	return p.diskStop
+}
+
+// fillDisk writes size bytes to f in 1 MiB chunks, stopping when the device
+// is full or the disk is released.
+func (p *pressure) fillDisk(f *os.File, size int64, stop <-chan struct{}) {
+	defer f.Close()
+	path := f.Name()
+
+	chunk := make([]byte, 1<<20)
+	var written int64
+	for written < size {
+		n, err := f.Write(chunk[:min(int64(len(chunk)), size-written)])
+		written += int64(n)
+		if !p.recordFill(path, int64(n), stop) {
+			log.Printf("Disk pressure: released while writing %s, stopped after %d bytes", path, written)
+			return
+		}
+		if err != nil {
+			log.Printf("Disk pressure: stopped after %d bytes: %v", written, err)
+			break
+		}
+	}
+	f.Sync()
+	log.Printf("Disk pressure: wrote %d bytes to %s", written, path)
+}
+
+// recordFill adds n bytes written to path, unless the fill was stopped.
+func (p *pressure) recordFill(path string, n int64, stop <-chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	p.disk[path] += n
+	var total int64
+	for _, size := range p.disk {
+		total += size
+	}
+	p.usage.WithLabelValues("disk_bytes").Set(float64(total))
+	return true
+}
+
+func (p *pressure) release(resource string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch resource {
+	case "memory":
+		p.memory = nil
+		p.memoryBytes = 0
+		p.memoryRamp++
+		p.usage.WithLabelValues("memory_bytes").Set(0)
+	case "goroutines":
+		close(p.leak)
+		p.leak = make(chan struct{})
+		p.goroutines = 0
+		p.usage.WithLabelValues("leaked_goroutines").Set(0)
+	case "fds":
+		for _, f := range p.files {
+			f.Close()
+		}
+		p.files = nil
+		p.usage.WithLabelValues("leaked_fds").Set(0)
+	case "disk":
+		close(p.diskStop)
+		p.diskStop = make(chan struct{})
+		for path := range p.disk {
+			os.Remove(path)
+		}
+		p.disk = make(map[string]int64)
+		p.usage.WithLabelValues("disk_bytes").Set(0)
+	}
+}
+
+// parseByteSize parses sizes such as "512", "512B", "64K", "256Mi" or "1G".
+// Both decimal and binary suffixes mean powers of 1024.
+func parseByteSize(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number := strings.TrimRight(value, "KMGIBkmgib")
+	multiplier := int64(1)
+	switch strings.ToUpper(strings.TrimPrefix(value, number)) {
+	case "", "B":
+	case "K", "KI", "KB", "KIB":
+		multiplier = 1 << 10
+	case "M", "MI", "MB", "MIB":
+		multiplier = 1 << 20
+	case "G", "GI", "GB", "GIB":
+		multiplier = 1 << 30
+	default:
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if n > math.MaxInt64/multiplier || n < math.MinInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return n * multiplier, nil
+}
+
+func parseDurationParam(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestPressure() *pressure {
+	return newPressure(prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pressure_usage"}, []string{"resource"}))
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: 7},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "512b", want: 512},
+		{value: "64K", want: 64 << 10},
+		{value: "64KiB", want: 64 << 10},
+		{value: "256Mi", want: 256 << 20},
+		{value: "256MB", want: 256 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: "1gib", want: 1 << 30},
+		{value: "8589934591G", want: 8589934591 << 30},
+		{value: "8589934592G", wantErr: true},
+		{value: "9223372036854775807K", wantErr: true},
+		{value: "99999999999999999999", wantErr: true},
+		{value: "12T", wantErr: true},
+		{value: "5iB", wantErr: true},
+		{value: "K", wantErr: true},
+		{value: "1.5G", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseByteSize(test.value, 7)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %d, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParsePressureParams(t *testing.T) {
+	tests := []struct {
+		action  string
+		params  string
+		wantErr bool
+	}{
+		{action: "memory", params: "bytes=64M&step=8M&interval=500ms"},
+		{action: "memory", params: "bytes=64M&interval=0s"},
+		{action: "memory", params: "bytes=64M&interval=-1s", wantErr: true},
+		{action: "memory", params: "bytes=64M&step=-8M", wantErr: true},
+		{action: "memory", params: "bytes=0", wantErr: true},
+		{action: "cpu", params: "cores=2&duration=30s"},
+		{action: "cpu", params: ""},
+		{action: "cpu", params: "duration=-30s", wantErr: true},
+		{action: "cpu", params: "duration=0s", wantErr: true},
+		{action: "cpu", params: "cores=0", wantErr: true},
+		{action: "goroutines", params: "count=10"},
+		{action: "fds", params: "count=-1", wantErr: true},
+		{action: "disk", params: "bytes=512B"},
+		{action: "disk", params: "bytes=99999999999G", wantErr: true},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.params)
+		_, err := parsePressureParams(test.action, params)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parsePressureParams(%s, %q) error %v, want error %t", test.action, test.params, err, test.wantErr)
+		}
+	}
+}
+
+func TestFillDisk(t *testing.T) {
+	p := newTestPressure()
+	f, err := createFillFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(3<<20 + 5)
+	p.fillDisk(f, size, p.trackFill(f.Name()))
+
+	if info, err := os.Stat(f.Name()); err != nil || info.Size() != size {
+		t.Fatalf("fill file %v, %v, want %d bytes", info, err, size)
+	}
+	if p.disk[f.Name()] != size {
+		t.Errorf("recorded %d bytes, want %d", p.disk[f.Name()], size)
+	}
+
+	p.release("disk")
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("fill file still exists after release: %v", err)
+	}
+}
+
+func TestReleaseDuringFill(t *testing.T) {
+	p := newTestPressure()
+	dir := t.TempDir()
+	f, err := createFillFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is tracked before the fill writes anything
+	stop := p.trackFill(f.Name())
+	if _, ok := p.disk[f.Name()]; !ok {
+		t.Fatal("fill file not tracked before the fill starts")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.fillDisk(f, math.MaxInt64, stop)
+		close(done)
+	}()
+	p.release("disk")
+	<-done
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("directory has %v, %v after release, want it empty", entries, err)
+	}
+	if len(p.disk) != 0 {
+		t.Errorf("fill recorded %v after release", p.disk)
+	}
+
+	// Later fills are not stopped by the earlier release
+	f, err = createFillFile(filepath.Join(dir, "next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.fillDisk(f, 1<<20, p.trackFill(f.Name()))
+	if p.disk[f.Name()] != 1<<20 {
+		t.Errorf("next fill recorded %d bytes, want %d", p.disk[f.Name()], 1<<20)
+	}
+}
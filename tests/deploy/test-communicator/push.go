@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// PushConfig controls pushing metrics to a Prometheus remote-write receiver
+// and to a Pushgateway, each enabled by setting its URL.
+type PushConfig struct {
+	RemoteWriteURL string        `json:"remote_write_url"`
+	PushgatewayURL string        `json:"pushgateway_url"`
+	PushgatewayJob string        `json:"pushgateway_job"` // Defaults to SERVICE_NAME
+	Source         string        `json:"source"`          // "default" (the communicator's metrics) or "synthetic"
+	Interval       time.Duration `json:"interval"`
+	Timeout        time.Duration `json:"timeout"`
+	BearerToken    string        `json:"bearer_token"`
+	Username       string        `json:"username"` // Basic auth, used when no bearer token is set
+	Password       string        `json:"password"`
+}
+
+// metricsPusher sends the gathered metrics every interval. Every push also
+// carries communicator_push_sequence, which counts pushes from 1, so a
+// receiver can check that none were lost.
+type metricsPusher struct {
+	config   PushConfig
+	gatherer prometheus.Gatherer
+	sequence prometheus.Gauge
+	pushes   *prometheus.CounterVec
+	client   *http.Client
+	job      string
+	instance string
+}
+
+func newMetricsPusher(config PushConfig, job string, source prometheus.Gatherer, pushes *prometheus.CounterVec) *metricsPusher {
+	sequence := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "communicator_push_sequence",
+		Help: "Number of this push, counted from 1",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sequence)
+
+	if config.PushgatewayJob != "" {
+		job = config.PushgatewayJob
+	}
+	instance, _ := os.Hostname()
+	return &metricsPusher{
+		config:   config,
+		gatherer: prometheus.Gatherers{source, registry},
+		sequence: sequence,
+		pushes:   pushes,
+		client:   &http.Client{Timeout: config.Timeout},
+		job:      job,
+		instance: instance,
+	}
+}
+
+func (p *metricsPusher) String() string {
+	var targets []string
+	if p.config.RemoteWriteURL != "" {
+		targets = append(targets, "remote-write to "+redactUserinfo(p.config.RemoteWriteURL))
+	}
+	if p.config.PushgatewayURL != "" {
+		targets = append(targets, "Pushgateway "+redactUserinfo(p.config.PushgatewayURL))
+	}
+	return fmt.Sprintf("%s metrics by %s", p.config.Source, strings.Join(targets, " and "))
+}
+
+// run pushes every interval until stop is closed.
+func (p *metricsPusher) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		p.sequence.Set(float64(n))
+		if p.config.RemoteWriteURL != "" {
+			p.push("remote-write", n, p.remoteWrite)
+		}
+		if p.config.PushgatewayURL != "" {
+			p.push("pushgateway", n, p.pushgateway)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *metricsPusher) push(mode string, n int, send func() (int, error)) {
+	series, err := send()
+	if err != nil {
+		p.pushes.WithLabelValues(mode, "error").Inc()
+		log.Printf("Push %d by %s failed: %v", n, mode, err)
+		return
+	}
+	p.pushes.WithLabelValues(mode, "success").Inc()
+	log.Printf("Push %d by %s sent %d series", n, mode, series)
+}
+
+// pushgateway replaces the metrics of the job/instance group.
+func (p *metricsPusher) pushgateway() (int, error) {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return 0, err
+	}
+	pusher := push.New(p.config.PushgatewayURL, p.job).
+		Grouping("instance", p.instance).
+		Gatherer(p.gatherer).
+		Client(p.client)
+	if p.config.BearerToken != "" {
+		pusher = pusher.Header(http.Header{"Authorization": {"Bearer " + p.config.BearerToken}})
+	} else if p.config.Username != "" {
+		pusher = pusher.BasicAuth(p.config.Username, p.config.Password)
+	}
+	if err := pusher.Push(); err != nil {
+		return 0, err
+	}
+	return len(remoteWriteSeries(families, nil)), nil
+}
+
+// remoteWrite sends one Prometheus remote-write 1.0 request: a snappy
+// compressed WriteRequest protobuf with every sample and the metadata of
+// every family. Series get the job and instance labels a scrape would add.
+func (p *metricsPusher) remoteWrite() (int, error) {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().UnixMilli()
+	target := []*dto.LabelPair{
+		{Name: stringPtr("job"), Value: &p.job},
+		{Name: stringPtr("instance"), Value: &p.instance},
+	}
+	series := remoteWriteSeries(families, target)
+
+	var request []byte
+	for _, s := range series {
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, s.encode(timestamp))
+	}
+	for _, family := range families {
+		request = protowire.AppendTag(request, 3, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodeMetadata(family))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.RemoteWriteURL, bytes.NewReader(snappy.Encode(nil, request)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "test-communicator")
+	if p.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.BearerToken)
+	} else if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return len(series), nil
+}
+
+// remoteWriteSample is one series with its current value.
+type remoteWriteSample struct {
+	labels [][2]string // Sorted by name, starting with __name__
+	value  float64
+}
+
+// remoteWriteSeries flattens families into series the way they appear in
+// the text format: histograms become _bucket, _sum and _count series and
+// summaries quantile, _sum and _count series. Native histogram buckets are
+// not sent.
+func remoteWriteSeries(families []*dto.MetricFamily, target []*dto.LabelPair) []remoteWriteSample {
+	var series []remoteWriteSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.Metric {
+			labels := append(slices.Clone(metric.Label), target...)
+			add := func(suffix string, value float64, extra ...string) {
+				sample := remoteWriteSample{labels: [][2]string{{"__name__", name + suffix}}, value: value}
+				for _, label := range labels {
+					sample.labels = append(sample.labels, [2]string{label.GetName(), label.GetValue()})
+				}
+				if len(extra) == 2 {
+					sample.labels = append(sample.labels, [2]string{extra[0], extra[1]})
+				}
+				slices.SortFunc(sample.labels[1:], func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+				series = append(series, sample)
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.Quantile {
+					add("", quantile.GetValue(), "quantile", formatFloat(quantile.GetQuantile()))
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					// The +Inf bucket is added below from the sample count
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						continue
+					}
+					add("_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				add("_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// encode returns the TimeSeries message of a sample.
+func (s remoteWriteSample) encode(timestamp int64) []byte {
+	var message []byte
+	for _, label := range s.labels {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, label[0])
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, label[1])
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendBytes(message, pair)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	message = protowire.AppendTag(message, 2, protowire.BytesType)
+	return protowire.AppendBytes(message, sample)
+}
+
+// remoteWriteTypes maps family types to the MetricMetadata type enum.
+var remoteWriteTypes = map[dto.MetricType]uint64{
+	dto.MetricType_COUNTER:         1,
+	dto.MetricType_GAUGE:           2,
+	dto.MetricType_HISTOGRAM:       3,
+	dto.MetricType_GAUGE_HISTOGRAM: 4,
+	dto.MetricType_SUMMARY:         5,
+}
+
+// encodeMetadata returns the MetricMetadata message of a family.
+func encodeMetadata(family *dto.MetricFamily) []byte {
+	var message []byte
+	message = protowire.AppendTag(message, 1, protowire.VarintType)
+	message = protowire.AppendVarint(message, remoteWriteTypes[family.GetType()])
+	message = protowire.AppendTag(message, 2, protowire.BytesType)
+	message = protowire.AppendString(message, family.GetName())
+	message = protowire.AppendTag(message, 4, protowire.BytesType)
+	message = protowire.AppendString(message, family.GetHelp())
+	if family.GetUnit() != "" {
+		message = protowire.AppendTag(message, 5, protowire.BytesType)
+		message = protowire.AppendString(message, family.GetUnit())
+	}
+	return message
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+)
+
+// seededRand is a source of randomness derived from SEED. All random choices
+// (jitter, generated IDs, sequence numbers) are drawn from seeded streams, so
+// the same SEED and SERVICE_NAME reproduce the same choices in the same order.
+type seededRand struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	seed     string
+	instance string
+}
+
+// newSeededRand mixes seed with the instance name, so services sharing a
+// seed still make different choices from each other.
+func newSeededRand(seed, instance string) *seededRand {
+	return &seededRand{rand: rand.New(rand.NewPCG(hashSeed(seed), hashSeed(instance))), seed: seed, instance: instance}
+}
+
+// stream returns the generator of one consumer, such as "tracing" or
+// "discovery/orders". Consumers running concurrently, like hedged calls and
+// trace sampling, each draw from their own stream, so their sequences do not
+// depend on how their goroutines interleave.
+func (r *seededRand) stream(name string) *seededRand {
+	return newSeededRand(r.seed, r.instance+"/"+name)
+}
+
+// randomSeed picks a seed for runs without SEED. It is logged so that a run
+// can be reproduced afterwards.
+func randomSeed() string {
+	var b [8]byte
+	crand.Read(b[:])
+	return strconv.FormatUint(binary.BigEndian.Uint64(b[:])>>1, 10)
+}
+
+// hashSeed accepts any string as a seed, such as a CI run ID.
+func hashSeed(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+func (r *seededRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Float64()
+}
+
+func (r *seededRand) IntN(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.IntN(n)
+}
+
+func (r *seededRand) Int64() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Int64()
+}
+
+// Read fills p with random bytes.
+func (r *seededRand) Read(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < len(p); i += 8 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], r.rand.Uint64())
+		copy(p[i:], b[:])
+	}
+}
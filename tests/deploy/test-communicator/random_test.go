@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// draws returns n values drawn from r.
+func draws(r *seededRand, n int) []int64 {
+	values := make([]int64, n)
+	for i := range values {
+		values[i] = r.Int64()
+	}
+	return values
+}
+
+func TestSeededRandReproducible(t *testing.T) {
+	names := []string{"tracing", "statsd", "resilience", "discovery/orders"}
+
+	// The first instance draws from its streams one after the other
+	first := newSeededRand("42", "svc")
+	want := map[string][]int64{}
+	for _, name := range names {
+		want[name] = draws(first.stream(name), 100)
+	}
+
+	// The second draws from them concurrently and interleaved, and gets the
+	// same sequences
+	second := newSeededRand("42", "svc")
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	got := map[string][]int64{}
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream := second.stream(name)
+			var values []int64
+			for range 100 {
+				values = append(values, draws(stream, 1)...)
+				second.Int64()
+			}
+			mu.Lock()
+			got[name] = values
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if !reflect.DeepEqual(got, want) {
+		t.Error("instances with the same seed drew different sequences")
+	}
+
+	for _, other := range []*seededRand{newSeededRand("43", "svc"), newSeededRand("42", "other")} {
+		if reflect.DeepEqual(draws(other.stream("tracing"), 100), want["tracing"]) {
+			t.Errorf("seed %q and instance %q drew the same sequence as seed 42 and svc", other.seed, other.instance)
+		}
+	}
+	if reflect.DeepEqual(want["tracing"], want["statsd"]) {
+		t.Error("two streams of one instance drew the same sequence")
+	}
+}
+
+func TestRetryJitterReproducible(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+	delays := func(edges []string) map[string][]time.Duration {
+		app := newTestApp(Config{})
+		got := map[string][]time.Duration{}
+		for _, edge := range edges {
+			random := app.resilience.breaker(edge).random
+			for retry := 1; retry <= 5; retry++ {
+				got[edge] = append(got[edge], policy.backoff(retry, random))
+			}
+		}
+		return got
+	}
+
+	// The jitter of an edge does not depend on the calls to other edges
+	want := delays([]string{"a", "b"})
+	if got := delays([]string{"b", "a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("delays %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls retries, deadlines and hedging for the calls on one
+// edge.
+type RetryPolicy struct {
+	MaxAttempts    int           `json:"max_attempts"`    // Attempts including the first, 1 disables retries
+	Backoff        time.Duration `json:"backoff"`         // Delay before the first retry, doubled for every further retry
+	MaxBackoff     time.Duration `json:"max_backoff"`     // Upper bound for the retry delay
+	Jitter         float64       `json:"jitter"`          // Fraction of the delay randomised in either direction
+	RetryOn        []string      `json:"retry_on"`        // Status codes, "4xx", "5xx", gRPC codes, "error", or "timeout"
+	AttemptTimeout time.Duration `json:"attempt_timeout"` // Deadline for a single attempt, 0 disables
+	Deadline       time.Duration `json:"deadline"`        // Deadline across all attempts and backoff, 0 disables
+	HedgeDelay     time.Duration `json:"hedge_delay"`     // Wait before sending a hedged attempt, 0 disables hedging
+	MaxHedges      int           `json:"max_hedges"`      // Hedged attempts sent alongside each attempt
+}
+
+// retrySpec is the per-edge override of the default RetryPolicy accepted in
+// CALL_TARGETS. Unset fields keep the default.
+type retrySpec struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	Backoff        string   `json:"backoff"`
+	MaxBackoff     string   `json:"max_backoff"`
+	Jitter         *float64 `json:"jitter"`
+	RetryOn        []string `json:"retry_on"`
+	AttemptTimeout string   `json:"attempt_timeout"`
+	Deadline       string   `json:"deadline"`
+	HedgeDelay     string   `json:"hedge_delay"`
+	MaxHedges      int      `json:"max_hedges"`
+}
+
+func (s *retrySpec) apply(policy RetryPolicy) (RetryPolicy, error) {
+	if s == nil {
+		return policy, nil
+	}
+	if s.MaxAttempts > 0 {
+		policy.MaxAttempts = s.MaxAttempts
+	}
+	if s.Jitter != nil {
+		policy.Jitter = *s.Jitter
+	}
+	if len(s.RetryOn) > 0 {
+		policy.RetryOn = s.RetryOn
+	}
+	if s.MaxHedges > 0 {
+		policy.MaxHedges = s.MaxHedges
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"backoff", s.Backoff, &policy.Backoff},
+		{"max_backoff", s.MaxBackoff, &policy.MaxBackoff},
+		{"attempt_timeout", s.AttemptTimeout, &policy.AttemptTimeout},
+		{"deadline", s.Deadline, &policy.Deadline},
+		{"hedge_delay", s.HedgeDelay, &policy.HedgeDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retry %s: %v", d.name, err)
+		}
+		*d.field = duration
+	}
+	return policy, nil
+}
+
+// retries reports whether an attempt that ended with outcome is retried.
+func (p RetryPolicy) retries(outcome string) bool {
+	for _, code := range p.RetryOn {
+		switch {
+		case code == outcome:
+			return true
+		case len(code) == 3 && strings.HasSuffix(code, "xx") && len(outcome) == 3 && outcome[0] == code[0]:
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, counting from 1. The
+// doubling stops at a quarter of the largest duration, so that neither it
+// nor the jitter overflows when no MaxBackoff bounds it.
+func (p RetryPolicy) backoff(retry int, random *seededRand) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay <= math.MaxInt64/8; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (2*random.Float64() - 1))
+	}
+	return max(delay, 0)
+}
+
+// BreakerPolicy configures the circuit breaker kept for every edge.
+type BreakerPolicy struct {
+	FailureThreshold int           `json:"failure_threshold"`  // Consecutive failures that open the breaker, 0 disables
+	OpenDuration     time.Duration `json:"open_duration"`      // Time spent open before probing
+	HalfOpenRequests int           `json:"half_open_requests"` // Probes allowed at once while half-open
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half-open"
+	breakerOpen     = "open"
+)
+
+var breakerStateValues = map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	edge     string
+	policy   BreakerPolicy
+	state    string
+	failures int
+	openedAt time.Time
+	probes   int
+	metrics  *outboundResilience
+	random   *seededRand // Retry jitter
+}
+
+// allow reports whether an attempt may be sent. Once the open duration has
+// passed, an open breaker lets HalfOpenRequests probes through.
+func (b *circuitBreaker) allow() error {
+	if b.policy.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.policy.OpenDuration {
+		b.transition(breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerOpen:
+		return errCircuitOpen
+	case breakerHalfOpen:
+		if b.probes >= max(b.policy.HalfOpenRequests, 1) {
+			return errCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// record feeds the result of an allowed attempt back into the breaker. A
+// successful probe closes it, a failed probe opens it again.
+func (b *circuitBreaker) record(success bool) {
+	if b.policy.FailureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.policy.FailureThreshold {
+			b.transition(breakerOpen)
+		}
+	case breakerHalfOpen:
+		if success {
+			b.transition(breakerClosed)
+		} else {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// release returns the probe slot of an attempt that was cancelled before it
+// produced a result.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// transition must be called with b.mu held.
+func (b *circuitBreaker) transition(state string) {
+	log.Printf("Circuit breaker for %s: %s -> %s", b.edge, b.state, state)
+	b.metrics.transitions.WithLabelValues(b.edge, b.state, state).Inc()
+	b.metrics.state.WithLabelValues(b.edge).Set(breakerStateValues[state])
+
+	b.state = state
+	b.failures = 0
+	b.probes = 0
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// outboundResilience holds the circuit breakers of all edges and the metrics
+// for outbound attempts.
+type outboundResilience struct {
+	policy      BreakerPolicy
+	random      *seededRand // Parent of the retry jitter streams of the edges
+	mu          sync.Mutex
+	breakers    map[string]*circuitBreaker
+	attempts    *prometheus.CounterVec
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+func newOutboundResilience(policy BreakerPolicy, random *seededRand, attempts *prometheus.CounterVec, state *prometheus.GaugeVec, transitions *prometheus.CounterVec) *outboundResilience {
+	return &outboundResilience{
+		policy:      policy,
+		random:      random,
+		breakers:    make(map[string]*circuitBreaker),
+		attempts:    attempts,
+		state:       state,
+		transitions: transitions,
+	}
+}
+
+func (o *outboundResilience) breaker(edge string) *circuitBreaker {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	b, ok := o.breakers[edge]
+	if !ok {
+		b = &circuitBreaker{edge: edge, policy: o.policy, state: breakerClosed, metrics: o, random: o.random.stream(edge)}
+		o.breakers[edge] = b
+		o.state.WithLabelValues(edge).Set(breakerStateValues[breakerClosed])
+	}
+	return b
+}
+
+// attemptFunc makes one attempt of an outbound call. It returns an outcome
+// code for retry-on matching, such as an HTTP status or a gRPC code; failed
+// attempts may leave it empty to be classified as "error" or "timeout".
+type attemptFunc[T any] func(ctx context.Context) (T, string, error)
+
+// callWithPolicy runs attempt on edge under policy, retrying with backoff and
+// hedging slow attempts, while the edge's circuit breaker allows it. The value
+// of the last attempt is returned even when it failed.
+func callWithPolicy[T any](ctx context.Context, o *outboundResilience, edge string, policy RetryPolicy, attempt attemptFunc[T]) (T, error) {
+	if policy.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Deadline)
+		defer cancel()
+	}
+	breaker := o.breaker(edge)
+	attempts := max(policy.MaxAttempts, 1)
+
+	var value T
+	var outcome string
+	var err error
+	for i := 1; i <= attempts; i++ {
+		kind := "first"
+		if i > 1 {
+			kind = "retry"
+		}
+
+		value, outcome, err = hedgedAttempt(ctx, o, breaker, edge, policy, kind, attempt)
+		if err == nil || errors.Is(err, errCircuitOpen) || i == attempts || !policy.retries(outcome) {
+			break
+		}
+
+		delay := policy.backoff(i, breaker.random)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			log.Printf("Not retrying call to %s: deadline expires before the next attempt", edge)
+			break
+		}
+		log.Printf("Retrying call to %s in %s after %s (attempt %d of %d)", edge, delay, outcome, i+1, attempts)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return value, err
+		}
+	}
+	return value, err
+}
+
+// hedgedAttempt sends an attempt and, while it is outstanding, up to
+// MaxHedges further copies HedgeDelay apart. The first success wins and the
+// others are cancelled.
+func hedgedAttempt[T any](ctx context.Context, o *outboundResilience, breaker *circuitBreaker, edge string, policy RetryPolicy, kind string, attempt attemptFunc[T]) (T, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		value   T
+		outcome string
+		err     error
+	}
+	results := make(chan result, 1+max(policy.MaxHedges, 0))
+	launch := func(kind string) {
+		go func() {
+			value, outcome, err := singleAttempt(ctx, o, breaker, edge, policy, kind, attempt)
+			results <- result{value, outcome, err}
+		}()
+	}
+
+	launch(kind)
+	inFlight := 1
+
+	var hedge <-chan time.Time
+	var timer *time.Timer
+	if policy.HedgeDelay > 0 && policy.MaxHedges > 0 {
+		timer = time.NewTimer(policy.HedgeDelay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	var last result
+	for hedges := 0; inFlight > 0; {
+		select {
+		case r := <-results:
+			inFlight--
+			if r.err == nil {
+				return r.value, r.outcome, nil
+			}
+			last = r
+		case <-hedge:
+			hedges++
+			log.Printf("No response from %s after %s, sending hedged request %d of %d", edge, policy.HedgeDelay, hedges, policy.MaxHedges)
+			launch("hedge")
+			inFlight++
+			if hedges < policy.MaxHedges {
+				timer.Reset(policy.HedgeDelay)
+			} else {
+				hedge = nil
+			}
+		}
+	}
+	return last.value, last.outcome, last.err
+}
+
+func singleAttempt[T any](ctx context.Context, o *outboundResilience, breaker *circuitBreaker, edge string, policy RetryPolicy, kind string, attempt attemptFunc[T]) (T, string, error) {
+	if err := breaker.allow(); err != nil {
+		o.attempts.WithLabelValues(edge, kind, "circuit-open").Inc()
+		var zero T
+		return zero, "circuit-open", err
+	}
+
+	attemptCtx := ctx
+	if policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, policy.AttemptTimeout)
+		defer cancel()
+	}
+
+	value, outcome, err := attempt(attemptCtx)
+	switch {
+	case err == nil:
+		breaker.record(true)
+		if outcome == "" {
+			outcome = "ok"
+		}
+	case ctx.Err() == context.Canceled:
+		// Lost to a hedged attempt or abandoned by the caller
+		breaker.release()
+		outcome = "cancelled"
+	default:
+		breaker.record(false)
+		if outcome == "" {
+			outcome = "error"
+			if attemptCtx.Err() == context.DeadlineExceeded {
+				outcome = "timeout"
+			}
+		}
+	}
+
+	o.attempts.WithLabelValues(edge, kind, outcome).Inc()
+	return value, outcome, err
+}
+
+// grpcOutcome maps a failed gRPC call to the retry-on code of its status,
+// such as "unavailable" or "resource_exhausted". Local deadlines and
+// cancellations are left to the caller's classification.
+func grpcOutcome(ctx context.Context, err error) string {
+	if err == nil || ctx.Err() != nil {
+		return ""
+	}
+	name := status.Code(err).String()
+	var outcome strings.Builder
+	for i, r := range name {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			outcome.WriteByte('_')
+		}
+		outcome.WriteRune(r)
+	}
+	return strings.ToLower(outcome.String())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{"doubling", RetryPolicy{Backoff: 100 * time.Millisecond}},
+		{"capped", RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}},
+		{"jitter", RetryPolicy{Backoff: 100 * time.Millisecond, Jitter: 0.5}},
+		{"capped with full jitter", RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 1}},
+		{"large backoff", RetryPolicy{Backoff: time.Hour, Jitter: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			random := newSeededRand("test", "test")
+			base := test.policy.Backoff
+			for retry := 1; retry <= 100; retry++ {
+				if retry > 1 && base <= math.MaxInt64/8 {
+					base *= 2
+				}
+				if test.policy.MaxBackoff > 0 {
+					base = min(base, test.policy.MaxBackoff)
+				}
+				low := base - time.Duration(float64(base)*test.policy.Jitter)
+				high := base + time.Duration(float64(base)*test.policy.Jitter)
+
+				delay := test.policy.backoff(retry, random)
+				if delay < low || delay > high || (delay <= 0 && test.policy.Jitter < 1) {
+					t.Fatalf("retry %d waits %s, want between %s and %s", retry, delay, low, high)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	policy := RetryPolicy{RetryOn: []string{"5xx", "429", "unavailable", "timeout"}}
+	for outcome, want := range map[string]bool{
+		"500": true, "503": true, "429": true, "unavailable": true, "timeout": true,
+		"404": false, "200": false, "error": false, "5": false, "internal": false,
+	} {
+		if got := policy.retries(outcome); got != want {
+			t.Errorf("retries(%q) = %t, want %t", outcome, got, want)
+		}
+	}
+}
+
+func TestCallWithPolicyRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		outcomes []string // Outcome of every attempt, "ok" for success
+		want     map[string]float64
+		wantErr  bool
+	}{
+		{
+			name:     "retried until success",
+			policy:   RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []string{"503"}},
+			outcomes: []string{"503", "503", "ok"},
+			want:     map[string]float64{"first/503": 1, "retry/503": 1, "retry/ok": 1},
+		},
+		{
+			name:     "attempts run out",
+			policy:   RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, RetryOn: []string{"5xx"}},
+			outcomes: []string{"500", "502", "ok"},
+			want:     map[string]float64{"first/500": 1, "retry/502": 1},
+			wantErr:  true,
+		},
+		{
+			name:     "outcome not retried",
+			policy:   RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []string{"503"}},
+			outcomes: []string{"404", "ok"},
+			want:     map[string]float64{"first/404": 1},
+			wantErr:  true,
+		},
+		{
+			name:     "deadline before the next attempt",
+			policy:   RetryPolicy{MaxAttempts: 3, Backoff: time.Hour, Deadline: time.Second, RetryOn: []string{"503"}},
+			outcomes: []string{"503", "ok"},
+			want:     map[string]float64{"first/503": 1},
+			wantErr:  true,
+		},
+		{
+			name:     "attempt timeout",
+			policy:   RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, AttemptTimeout: 10 * time.Millisecond, RetryOn: []string{"timeout"}},
+			outcomes: []string{"hang", "ok"},
+			want:     map[string]float64{"first/timeout": 1, "retry/ok": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(defaultConfig())
+			attempt := 0
+			_, err := callWithPolicy(context.Background(), app.resilience, "edge", test.policy, func(ctx context.Context) (int, string, error) {
+				outcome := test.outcomes[attempt]
+				attempt++
+				switch outcome {
+				case "ok":
+					return attempt, "", nil
+				case "hang":
+					<-ctx.Done()
+					return attempt, "", ctx.Err()
+				}
+				return attempt, outcome, errors.New("failed with " + outcome)
+			})
+			if (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %t", err, test.wantErr)
+			}
+
+			total := 0.0
+			for key, want := range test.want {
+				kind, outcome, _ := strings.Cut(key, "/")
+				if got := counterValue(app.resilience.attempts.WithLabelValues("edge", kind, outcome)); got != want {
+					t.Errorf("outbound_attempts_total{kind=%q,outcome=%q} = %g, want %g", kind, outcome, got, want)
+				}
+				total += want
+			}
+			if float64(attempt) != total {
+				t.Errorf("made %d attempts, want %g", attempt, total)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	config := defaultConfig()
+	config.Breaker = BreakerPolicy{FailureThreshold: 2, OpenDuration: 50 * time.Millisecond, HalfOpenRequests: 1}
+	app := newTestApp(config)
+	policy := RetryPolicy{MaxAttempts: 1}
+
+	calls := 0
+	call := func(fail bool) error {
+		_, err := callWithPolicy(context.Background(), app.resilience, "edge", policy, func(ctx context.Context) (struct{}, string, error) {
+			calls++
+			if fail {
+				return struct{}{}, "503", errors.New("unavailable")
+			}
+			return struct{}{}, "200", nil
+		})
+		return err
+	}
+	state := func() string {
+		b := app.resilience.breaker("edge")
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state
+	}
+	transitions := func(from, to string) float64 {
+		return counterValue(app.resilience.transitions.WithLabelValues("edge", from, to))
+	}
+
+	// Consecutive failures open the breaker, a success in between resets them
+	call(true)
+	call(false)
+	call(true)
+	if state() != breakerClosed {
+		t.Fatalf("breaker %s after non-consecutive failures", state())
+	}
+	call(true)
+	if state() != breakerOpen || transitions(breakerClosed, breakerOpen) != 1 {
+		t.Fatalf("breaker %s after %d consecutive failures, want open", state(), config.Breaker.FailureThreshold)
+	}
+
+	// While open, calls fail without an attempt
+	calls = 0
+	if err := call(false); !errors.Is(err, errCircuitOpen) || calls != 0 {
+		t.Errorf("call to an open breaker: %v after %d attempts", err, calls)
+	}
+	if got := counterValue(app.resilience.attempts.WithLabelValues("edge", "first", "circuit-open")); got != 1 {
+		t.Errorf("%g circuit-open attempts, want 1", got)
+	}
+
+	// After the open duration a failed probe opens it again
+	time.Sleep(config.Breaker.OpenDuration)
+	if err := call(true); errors.Is(err, errCircuitOpen) || calls != 1 {
+		t.Errorf("probe not sent: %v", err)
+	}
+	if state() != breakerOpen || transitions(breakerOpen, breakerHalfOpen) != 1 || transitions(breakerHalfOpen, breakerOpen) != 1 {
+		t.Errorf("breaker %s after a failed probe, want open again", state())
+	}
+
+	// Only HalfOpenRequests probes are let through at once
+	time.Sleep(config.Breaker.OpenDuration)
+	b := app.resilience.breaker("edge")
+	if err := b.allow(); err != nil {
+		t.Fatalf("first probe refused: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second concurrent probe allowed: %v", err)
+	}
+	b.release()
+
+	// A successful probe closes it
+	if err := call(false); err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+	if state() != breakerClosed || transitions(breakerHalfOpen, breakerClosed) != 1 {
+		t.Errorf("breaker %s after a successful probe, want closed", state())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	periodicInitialDelay = 30 * time.Second // Avoids startup race conditions
+	periodicInterval     = time.Minute
+)
+
+// periodicEdge is one outbound edge served by the periodic requests. The
+// same list drives the real requests and the dry-run schedule.
+type periodicEdge struct {
+	protocol string
+	target   string // Description of the target for the dry run
+	url      bool   // Targets are base URLs rather than host:port addresses
+	requests int    // Requests sent on every run
+	run      func(target string)
+	fixed    bool // Target is the only target, never discovered
+}
+
+func (a *App) periodicEdges() []periodicEdge {
+	var edges []periodicEdge
+	urlTarget := a.config.TargetURL + "/health"
+	hostTarget := net.JoinHostPort(a.config.TargetHost, strconv.Itoa(a.config.TargetPort))
+	if a.discovery != nil {
+		urlTarget = "discovered: " + a.discovery.String()
+		hostTarget = urlTarget
+	}
+
+	httpEdge := func(protocol string, requests int, run func(string)) {
+		if a.hasURLTarget() {
+			edges = append(edges, periodicEdge{protocol: protocol, target: urlTarget, url: true, requests: requests, run: run})
+		}
+	}
+	hostEdge := func(protocol string, requests int, run func(string)) {
+		if a.hasHostTarget() {
+			edges = append(edges, periodicEdge{protocol: protocol, target: hostTarget, requests: requests, run: run})
+		}
+	}
+	tcpRequests := a.config.TCPRequestsPerConnection
+	if a.config.TCPFraming == "stream" {
+		tcpRequests = 1
+	}
+
+	switch a.config.Protocol {
+	case "http":
+		httpEdge("http", a.config.HTTPClient.RequestsPerInterval, a.makeHTTPTargetRequest)
+	case "grpc":
+		hostEdge("grpc", 1, a.makeGRPCTargetRequest)
+	case "tcp":
+		hostEdge("tcp", tcpRequests, a.makeTCPTargetRequest)
+	case "memcached":
+		hostEdge("memcached", len(a.memcachedOperations()), a.makeMemcachedTargetRequest)
+	case "mongo":
+		hostEdge("mongo", len(a.mongoCommands(0)), a.makeMongoTargetRequest)
+	case "http3":
+		httpEdge("http3", 1, a.makeHTTP3TargetRequest)
+	case "all":
+		httpEdge("http", a.config.HTTPClient.RequestsPerInterval, a.makeHTTPTargetRequest)
+		hostEdge("grpc", 1, a.makeGRPCTargetRequest)
+		hostEdge("tcp", tcpRequests, a.makeTCPTargetRequest)
+	}
+	for _, flow := range a.config.Flows {
+		run := func(string) { a.makeFlowRequest(flow) }
+		edges = append(edges, periodicEdge{protocol: "flow", target: flow.Name + " " + flow.URL, url: true, requests: 1, run: run, fixed: true})
+	}
+	return edges
+}
+
+// plannedRequest is one line of the dry run.
+type plannedRequest struct {
+	offset   time.Duration
+	kind     string // Protocol, "phase" or "action"
+	target   string
+	requests int
+}
+
+// sessionPlan lists what a persistent MQTT or AMQP client sends during the
+// dry run: the session setup after the initial delay, then the messages
+// published on every tick and, for MQTT, the keep-alive pings.
+func (a *App) sessionPlan() []plannedRequest {
+	target := net.JoinHostPort(a.config.TargetHost, strconv.Itoa(a.config.TargetPort))
+	var setup, published int
+	var interval, ping time.Duration
+	switch a.config.Protocol {
+	case "mqtt":
+		setup, published, interval, ping = len(a.mqttSetupPackets()), len(a.mqttPublishTopics()), a.config.MQTTPublishInterval, mqttClientKeepAlive/2
+	case "amqp":
+		setup, interval = amqpHandshakeMethods+len(a.amqpSetupSteps()), a.config.AMQPPublishInterval
+		if a.amqpPublishes() {
+			published = 1
+		}
+	default:
+		return nil
+	}
+
+	plan := []plannedRequest{{offset: periodicInitialDelay, kind: a.config.Protocol, target: target + " session setup", requests: setup}}
+	for at := periodicInitialDelay + interval; published > 0 && at <= a.config.DryRunDuration; at += interval {
+		plan = append(plan, plannedRequest{offset: at, kind: a.config.Protocol, target: target + " publish", requests: published})
+	}
+	for at := periodicInitialDelay + ping; ping > 0 && at <= a.config.DryRunDuration; at += ping {
+		plan = append(plan, plannedRequest{offset: at, kind: a.config.Protocol, target: target + " ping", requests: 1})
+	}
+	return plan
+}
+
+// printSchedule writes the phases and requests the periodic client would
+// produce during DryRunDuration, without sending anything, in chronological
+// order. MQTT and AMQP clients count the packets and methods they send.
+// Cron phases are evaluated from the current time. Retries, hedged attempts,
+// acknowledgements of received messages and the set a text Memcached incr
+// sends when the counter does not exist yet depend on the targets' answers
+// and are not part of the plan, and so are the targets found by discovery.
+func (a *App) printSchedule(w io.Writer) {
+	fmt.Fprintf(w, "Dry run for %s (seed %s): protocol %s, %s\n", a.config.ServiceName, a.config.Seed, a.config.Protocol, a.config.DryRunDuration)
+
+	edges := a.periodicEdges()
+	started := time.Now().Truncate(time.Second)
+	scheduler := newPhaseScheduler(a.config.Phases, a.config.PhasesRepeat, started)
+	var plan []plannedRequest
+	for at := started; !at.IsZero() && at.Sub(started) <= a.config.DryRunDuration; at = scheduler.wake() {
+		offset := at.Sub(started)
+		changed, due := scheduler.advance(at)
+		if changed {
+			plan = append(plan, plannedRequest{offset: offset, kind: "phase", target: scheduler.current.String()})
+		}
+		if !due {
+			continue
+		}
+		for _, edge := range edges {
+			if scheduler.current.runs(edge.protocol) {
+				plan = append(plan, plannedRequest{offset: offset, kind: edge.protocol, target: edge.target, requests: edge.requests})
+			}
+		}
+	}
+	var sessions []plannedRequest
+	if a.config.TargetHost != "" {
+		sessions = a.sessionPlan()
+	}
+	plan = append(plan, sessions...)
+	for _, action := range a.config.Actions {
+		if action.after <= a.config.DryRunDuration {
+			plan = append(plan, plannedRequest{offset: action.after, kind: "action", target: fmt.Sprintf("%s %v", action.Action, action.Params)})
+		}
+	}
+	slices.SortStableFunc(plan, func(x, y plannedRequest) int { return cmp.Compare(x.offset, y.offset) })
+
+	total := 0
+	for _, p := range plan {
+		if p.kind == "phase" || p.kind == "action" {
+			fmt.Fprintf(w, "+%-8s %-10s %s\n", p.offset, p.kind, p.target)
+			continue
+		}
+		fmt.Fprintf(w, "+%-8s %-10s %-40s x%d\n", p.offset, p.kind, p.target, p.requests)
+		total += p.requests
+	}
+
+	if len(edges) == 0 && len(sessions) == 0 {
+		fmt.Fprintln(w, "No periodic requests: no target configured for this protocol")
+	}
+	fmt.Fprintf(w, "Total: %d requests\n", total)
+}
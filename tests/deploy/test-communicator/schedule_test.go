@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(*Config)
+		phases  string
+		actions string
+		want    []string
+	}{
+		{
+			name:    "default phase with an action",
+			config:  func(c *Config) { c.Protocol, c.TargetURL = "http", "http://target:8080" },
+			actions: `[{"after":"90s","action":"cpu","params":{"duration":"10s"}},{"after":"1h","action":"exit"}]`,
+			want: []string{
+				"+0s       phase      default (all edges every 1m0s)",
+				"+30s      http       http://target:8080/health                x1",
+				"+1m30s    http       http://target:8080/health                x1",
+				"+1m30s    action     cpu map[duration:10s]",
+				"+2m30s    http       http://target:8080/health                x1",
+				"Total: 3 requests",
+			},
+		},
+		{
+			name:   "phases",
+			config: func(c *Config) { c.Protocol, c.TargetURL = "http", "http://target:8080" },
+			phases: `[{"name":"warmup","duration":"1m","interval":"20s"},{"name":"quiet","duration":"1m","edges":[]}]`,
+			want: []string{
+				"+0s       phase      warmup (all edges every 20s)",
+				"+30s      http       http://target:8080/health                x1",
+				"+50s      http       http://target:8080/health                x1",
+				"+1m0s     phase      quiet (silent)",
+				"+2m0s     phase      finished (silent)",
+				"Total: 2 requests",
+			},
+		},
+		{
+			name: "tcp requests per connection",
+			config: func(c *Config) {
+				c.Protocol, c.TargetHost, c.TargetPort, c.TCPRequestsPerConnection = "tcp", "target", 9000, 4
+				c.DryRunDuration = time.Minute
+			},
+			want: []string{
+				"+0s       phase      default (all edges every 1m0s)",
+				"+30s      tcp        target:9000                              x4",
+				"Total: 4 requests",
+			},
+		},
+		{
+			name:   "no target",
+			config: func(c *Config) { c.Protocol = "grpc" },
+			want: []string{
+				"+0s       phase      default (all edges every 1m0s)",
+				"No periodic requests: no target configured for this protocol",
+				"Total: 0 requests",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.ServiceName, config.Seed, config.DryRunDuration = "svc", "42", 3*time.Minute
+			test.config(&config)
+			var err error
+			if config.Phases, err = parsePhases(test.phases); err != nil {
+				t.Fatal(err)
+			}
+			if test.actions != "" {
+				if config.Actions, err = parseScheduledActions(test.actions); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var out strings.Builder
+			newTestApp(config).printSchedule(&out)
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if header := "Dry run for svc (seed 42): protocol " + config.Protocol + ", " + config.DryRunDuration.String(); lines[0] != header {
+				t.Errorf("header %q, want %q", lines[0], header)
+			}
+			if got := strings.Join(lines[1:], "\n"); got != strings.Join(test.want, "\n") {
+				t.Errorf("schedule:\n%s\nwant:\n%s", got, strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connTracker keeps the accepted TCP connections of serveTCP so shutdown
+// can drain them. Connections count as busy unless their handler marks them
+// idle while it waits for the next request.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]bool // Value is true while idle
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]bool)}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn] = false
+	t.wg.Add(1)
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	t.wg.Done()
+}
+
+// setIdle marks conn as waiting for a request. Idle connections are woken
+// up and closed as soon as draining starts.
+func (t *connTracker) setIdle(conn net.Conn, idle bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; !ok {
+		return
+	}
+	t.conns[conn] = idle
+	if idle && t.draining {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// woken reports whether err is the wake-up of an idle connection for
+// draining, which handlers treat as a normal end of the connection.
+func (t *connTracker) woken(err error) bool {
+	if t == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain wakes idle connections and waits for all handlers to return. When
+// ctx expires first, the remaining connections are closed; closing them is
+// the point of the deadline, so it is logged rather than reported as an
+// error.
+func (t *connTracker) drain(ctx context.Context) {
+	t.mu.Lock()
+	t.draining = true
+	for conn, idle := range t.conns {
+		if idle {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	active := len(t.conns)
+	t.mu.Unlock()
+
+	if active > 0 {
+		log.Printf("Draining %d TCP connections", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	log.Printf("Closed %d TCP connections still active at the shutdown deadline", len(t.conns))
+}
+
+// crashMidRequest arms the crash-mid-request termination behaviour: the
+// next request handled crashes the process. Without a request before the
+// shutdown deadline, the process crashes anyway.
+func (a *App) crashMidRequest() {
+	log.Printf("Crashing on the next request (TERMINATION_BEHAVIOR=crash-mid-request)")
+	a.crashArmed.Store(true)
+
+	time.Sleep(a.config.ShutdownTimeout)
+	a.crash("no request before the shutdown deadline")
+}
+
+// crashIfArmed crashes the process in the middle of handling a request when
+// the crash-mid-request behaviour has been armed.
+func (a *App) crashIfArmed(request string) {
+	if a.crashArmed.Load() {
+		a.crash(request)
+	}
+}
+
+// crash panics on a new goroutine, which nothing can recover, so the
+// process dies with a stack trace and exit code 2 like a real crash.
+func (a *App) crash(during string) {
+	log.Printf("Crashing during %s", during)
+	go func() {
+		panic(fmt.Sprintf("test-communicator crashed during %s", during))
+	}()
+	select {}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trackedConn serves one side of a pipe like a TCP handler: idle while it
+// waits for a line, busy for work after each line. It returns the error that
+// ended the connection.
+func trackedConn(t *testing.T, tracker *connTracker, work time.Duration) (net.Conn, <-chan error) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	tracker.add(server)
+	ended := make(chan error, 1)
+	go func() {
+		defer tracker.remove(server)
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		for {
+			tracker.setIdle(server, true)
+			_, err := reader.ReadString('\n')
+			tracker.setIdle(server, false)
+			if err != nil {
+				if tracker.woken(err) {
+					err = nil
+				}
+				ended <- err
+				return
+			}
+			// Busy until work has passed or the connection is closed
+			server.SetReadDeadline(time.Now().Add(work))
+			if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+				ended <- err
+				return
+			}
+			server.SetReadDeadline(time.Time{})
+		}
+	}()
+	return client, ended
+}
+
+func TestConnTrackerDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		work      time.Duration // Handling time of a request
+		request   bool          // Whether a request is running when draining starts
+		deadline  time.Duration
+		wantClean bool // Handler ended by the drain wake-up rather than a close
+		wantWait  time.Duration
+	}{
+		{name: "idle is woken", work: time.Second, deadline: 5 * time.Second, wantClean: true},
+		{name: "busy is waited for", work: 200 * time.Millisecond, request: true, deadline: 5 * time.Second, wantClean: true, wantWait: 150 * time.Millisecond},
+		{name: "busy is closed at the deadline", work: time.Minute, request: true, deadline: 200 * time.Millisecond, wantWait: 150 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newConnTracker()
+			client, ended := trackedConn(t, tracker, test.work)
+			if test.request {
+				if _, err := io.WriteString(client, "request\n"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.deadline)
+			defer cancel()
+			start := time.Now()
+			tracker.drain(ctx)
+			waited := time.Since(start)
+
+			select {
+			case err := <-ended:
+				if (err == nil) != test.wantClean {
+					t.Errorf("handler ended with %v, want a clean end %t", err, test.wantClean)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler still running after the drain")
+			}
+			if limit := test.deadline + 500*time.Millisecond; waited < test.wantWait || waited > limit {
+				t.Errorf("drain took %s, want between %s and %s", waited, test.wantWait, limit)
+			}
+		})
+	}
+}
+
+func TestConnTrackerWoken(t *testing.T) {
+	var nilTracker *connTracker
+	if nilTracker.woken(os.ErrDeadlineExceeded) {
+		t.Error("a nil tracker reports a wake-up")
+	}
+	tracker := newConnTracker()
+	if tracker.woken(os.ErrDeadlineExceeded) {
+		t.Error("a deadline before draining is reported as a wake-up")
+	}
+	tracker.drain(context.Background())
+	if !tracker.woken(os.ErrDeadlineExceeded) {
+		t.Error("a deadline while draining is not reported as a wake-up")
+	}
+	if tracker.woken(io.EOF) {
+		t.Error("EOF while draining is reported as a wake-up")
+	}
+}
+
+func TestShutdownFlushBudget(t *testing.T) {
+	tests := []struct {
+		timeout, want time.Duration
+	}{
+		{0, 0},
+		{time.Second, 200 * time.Millisecond},
+		{10 * time.Second, 2 * time.Second},
+		{25 * time.Second, 5 * time.Second},
+		{2 * time.Minute, 5 * time.Second},
+	}
+	for _, test := range tests {
+		if got := shutdownFlushBudget(test.timeout); got != test.want {
+			t.Errorf("shutdownFlushBudget(%s) = %s, want %s", test.timeout, got, test.want)
+		}
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	tests := []struct {
+		name        string
+		behavior    string
+		exitCode    int
+		work        time.Duration // Handling time of the request in flight
+		wantCode    int
+		wantRequest bool // Whether the request in flight completes
+	}{
+		{name: "graceful", behavior: "graceful", work: 100 * time.Millisecond, wantRequest: true},
+		{name: "exit nonzero", behavior: "exit-nonzero", exitCode: 3, work: 100 * time.Millisecond, wantCode: 3, wantRequest: true},
+		{name: "forced close still exits normally", behavior: "graceful", work: time.Minute},
+		{name: "forced close with exit nonzero", behavior: "exit-nonzero", exitCode: 7, work: time.Minute, wantCode: 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.ShutdownTimeout = time.Second
+			config.PreStopDelay = 0
+			config.TerminationBehavior = test.behavior
+			config.TerminationExitCode = test.exitCode
+			app := newTestApp(config)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			started := make(chan struct{})
+			app.httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(test.work):
+				case <-r.Context().Done():
+				}
+			})}
+			go app.httpServer.Serve(listener)
+
+			var completed atomic.Bool
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				resp, err := http.Get("http://" + listener.Addr().String() + "/")
+				if err == nil {
+					resp.Body.Close()
+					completed.Store(resp.StatusCode == http.StatusOK)
+				}
+			}()
+			<-started
+
+			start := time.Now()
+			if got := app.terminate(); got != test.wantCode {
+				t.Errorf("exit code %d, want %d", got, test.wantCode)
+			}
+			if took := time.Since(start); took > config.ShutdownTimeout {
+				t.Errorf("shutdown took %s, longer than the %s deadline", took, config.ShutdownTimeout)
+			}
+			<-done
+			if completed.Load() != test.wantRequest {
+				t.Errorf("request in flight completed %t, want %t", completed.Load(), test.wantRequest)
+			}
+			if !app.draining.Load() {
+				t.Error("app is not draining after the shutdown")
+			}
+			select {
+			case <-app.stopCh:
+			default:
+				t.Error("periodic requests were not stopped")
+			}
+		})
+	}
+}
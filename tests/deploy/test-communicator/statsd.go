@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatsDConfig controls the StatsD emitter, which sends per-request metrics
+// over UDP when Address is set.
+type StatsDConfig struct {
+	Address    string   `json:"address"`     // host:port of the StatsD or DogStatsD agent
+	Flavor     string   `json:"flavor"`      // "dogstatsd" or "statsd"
+	Prefix     string   `json:"prefix"`      // Prepended with a dot to every metric name
+	Tags       []string `json:"tags"`        // Extra DogStatsD tags, such as "env:test"
+	SampleRate float64  `json:"sample_rate"` // Client-side sample rate of counters, timers, histograms and distributions
+}
+
+// statsdEmitter writes the metrics of one request as a single datagram, one
+// metric per line. Plain StatsD has no tags, histograms or distributions, so
+// in that flavor tags are dropped and histograms and distributions are sent
+// as timers.
+type statsdEmitter struct {
+	config   StatsDConfig
+	conn     net.Conn
+	random   *seededRand
+	tags     []string
+	inFlight atomic.Int64
+	packets  *prometheus.CounterVec
+}
+
+func newStatsdEmitter(config StatsDConfig, service string, random *seededRand, packets *prometheus.CounterVec) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{
+		config:  config,
+		conn:    conn,
+		random:  random,
+		tags:    append([]string{"service:" + service}, config.Tags...),
+		packets: packets,
+	}, nil
+}
+
+func (s *statsdEmitter) String() string {
+	return fmt.Sprintf("%s to %s", s.config.Flavor, s.config.Address)
+}
+
+// start counts a request in flight and returns the function that emits its
+// metrics once it finishes. client is the remote address of the request.
+func (s *statsdEmitter) start(protocol, client string) func(method, status string) {
+	started := time.Now()
+	s.inFlight.Add(1)
+	return func(method, status string) {
+		inFlight := s.inFlight.Add(-1)
+		duration := float64(time.Since(started).Microseconds()) / 1000
+		tags := []string{"protocol:" + protocol, "method:" + method, "status:" + status}
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+
+		var packet strings.Builder
+		sampled := s.random.Float64() < s.config.SampleRate
+		if sampled {
+			s.write(&packet, "requests", "1", "c", true, tags)
+			s.write(&packet, "request.duration", formatFloat(duration), "ms", true, tags)
+			s.write(&packet, "request.duration.histogram", formatFloat(duration), "h", true, tags)
+			s.write(&packet, "request.duration.distribution", formatFloat(duration), "d", true, tags)
+		}
+		s.write(&packet, "requests.in_flight", strconv.FormatInt(inFlight, 10), "g", false, nil)
+		if client != "" {
+			s.write(&packet, "clients", client, "s", false, []string{"protocol:" + protocol})
+		}
+		s.send(packet.String())
+	}
+}
+
+// write appends one metric line. Sampled metrics carry the sample rate, so
+// the agent scales them back up.
+func (s *statsdEmitter) write(packet *strings.Builder, name, value, kind string, sampled bool, tags []string) {
+	if s.config.Flavor == "statsd" && (kind == "h" || kind == "d") {
+		kind = "ms"
+	}
+	if packet.Len() > 0 {
+		packet.WriteByte('\n')
+	}
+	if s.config.Prefix != "" {
+		packet.WriteString(s.config.Prefix + ".")
+	}
+	fmt.Fprintf(packet, "%s:%s|%s", name, value, kind)
+	if sampled && s.config.SampleRate < 1 {
+		packet.WriteString("|@" + formatFloat(s.config.SampleRate))
+	}
+	if s.config.Flavor == "dogstatsd" {
+		packet.WriteString("|#" + strings.Join(append(slices.Clone(s.tags), tags...), ","))
+	}
+}
+
+func (s *statsdEmitter) send(packet string) {
+	if _, err := s.conn.Write([]byte(packet)); err != nil {
+		s.packets.WithLabelValues("error").Inc()
+		return
+	}
+	s.packets.WithLabelValues("sent").Inc()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsdLine is one metric line of a StatsD or DogStatsD datagram.
+type statsdLine struct {
+	name, value, kind string
+	rate              float64 // 1 when the line has no sample rate
+	tags              []string
+}
+
+// parseStatsdLine parses name:value|type[|@rate][|#tag,...].
+func parseStatsdLine(t *testing.T, line string) statsdLine {
+	t.Helper()
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		t.Fatalf("no value in %q", line)
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		t.Fatalf("no type in %q", line)
+	}
+	parsed := statsdLine{name: name, value: fields[0], kind: fields[1], rate: 1}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil {
+				t.Fatalf("sample rate in %q: %v", line, err)
+			}
+			parsed.rate = rate
+		case strings.HasPrefix(field, "#"):
+			parsed.tags = strings.Split(field[1:], ",")
+		default:
+			t.Fatalf("unexpected field %q in %q", field, line)
+		}
+	}
+	return parsed
+}
+
+func TestStatsdWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  StatsDConfig
+		kind    string
+		sampled bool
+		want    statsdLine
+	}{
+		{
+			name:    "dogstatsd counter",
+			config:  StatsDConfig{Flavor: "dogstatsd", SampleRate: 1},
+			kind:    "c",
+			sampled: true,
+			want:    statsdLine{"requests", "2.5", "c", 1, []string{"service:svc", "protocol:http"}},
+		},
+		{
+			name:    "dogstatsd sampled with extra tags",
+			config:  StatsDConfig{Flavor: "dogstatsd", Prefix: "app", Tags: []string{"env:test"}, SampleRate: 0.25},
+			kind:    "d",
+			sampled: true,
+			want:    statsdLine{"app.requests", "2.5", "d", 0.25, []string{"service:svc", "env:test", "protocol:http"}},
+		},
+		{
+			name:   "unsampled gauge has no rate",
+			config: StatsDConfig{Flavor: "dogstatsd", SampleRate: 0.5},
+			kind:   "g",
+			want:   statsdLine{"requests", "2.5", "g", 1, []string{"service:svc", "protocol:http"}},
+		},
+		{
+			name:    "statsd histogram as timer",
+			config:  StatsDConfig{Flavor: "statsd", Prefix: "app", Tags: []string{"env:test"}, SampleRate: 0.1},
+			kind:    "h",
+			sampled: true,
+			want:    statsdLine{"app.requests", "2.5", "ms", 0.1, nil},
+		},
+		{
+			name:   "statsd distribution as timer",
+			config: StatsDConfig{Flavor: "statsd", SampleRate: 1},
+			kind:   "d",
+			want:   statsdLine{"requests", "2.5", "ms", 1, nil},
+		},
+		{
+			name:   "statsd set",
+			config: StatsDConfig{Flavor: "statsd", SampleRate: 1},
+			kind:   "s",
+			want:   statsdLine{"requests", "2.5", "s", 1, nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &statsdEmitter{config: test.config, tags: append([]string{"service:svc"}, test.config.Tags...)}
+			var packet strings.Builder
+			s.write(&packet, "requests", "2.5", test.kind, test.sampled, []string{"protocol:http"})
+			s.write(&packet, "requests", "2.5", test.kind, test.sampled, []string{"protocol:http"})
+			lines := strings.Split(packet.String(), "\n")
+			if len(lines) != 2 || lines[0] != lines[1] {
+				t.Fatalf("packet %q, want two identical lines", packet.String())
+			}
+			if got := parseStatsdLine(t, lines[0]); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrote %q, parsed %+v, want %+v", lines[0], got, test.want)
+			}
+			if len(s.tags) != 1+len(test.config.Tags) {
+				t.Errorf("writing changed the emitter tags to %q", s.tags)
+			}
+		})
+	}
+}
+
+func TestStatsdEmitterSends(t *testing.T) {
+	tests := []struct {
+		name       string
+		flavor     string
+		sampleRate float64
+		client     string
+		want       map[string]string // Metric name to type
+	}{
+		{
+			name:       "dogstatsd",
+			flavor:     "dogstatsd",
+			sampleRate: 1,
+			client:     "10.0.0.1:5000",
+			want: map[string]string{
+				"app.requests": "c", "app.request.duration": "ms", "app.request.duration.histogram": "h",
+				"app.request.duration.distribution": "d", "app.requests.in_flight": "g", "app.clients": "s",
+			},
+		},
+		{
+			name:       "statsd",
+			flavor:     "statsd",
+			sampleRate: 1,
+			client:     "10.0.0.1",
+			want: map[string]string{
+				"app.requests": "c", "app.request.duration": "ms", "app.request.duration.histogram": "ms",
+				"app.request.duration.distribution": "ms", "app.requests.in_flight": "g", "app.clients": "s",
+			},
+		},
+		{
+			name:   "nothing sampled, no client",
+			flavor: "dogstatsd",
+			want:   map[string]string{"app.requests.in_flight": "g"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer agent.Close()
+
+			packets := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "statsd_packets_total"}, []string{"status"})
+			config := StatsDConfig{Address: agent.LocalAddr().String(), Flavor: test.flavor, Prefix: "app", SampleRate: test.sampleRate}
+			s, err := newStatsdEmitter(config, "svc", newSeededRand("test", "test"), packets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.conn.Close()
+
+			s.start("http", test.client)("GET", "200")
+			agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 65536)
+			n, _, err := agent.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				parsed := parseStatsdLine(t, line)
+				got[parsed.name] = parsed.kind
+				switch parsed.name {
+				case "app.requests.in_flight":
+					if parsed.value != "0" {
+						t.Errorf("%s in flight after the request finished", parsed.value)
+					}
+				case "app.clients":
+					if parsed.value != "10.0.0.1" {
+						t.Errorf("client %q, want the host without the port", parsed.value)
+					}
+				}
+				if test.flavor == "statsd" && parsed.tags != nil {
+					t.Errorf("plain StatsD line %q has tags", line)
+				}
+				if test.flavor == "dogstatsd" && (len(parsed.tags) == 0 || parsed.tags[0] != "service:svc") {
+					t.Errorf("DogStatsD line %q has no service tag", line)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sent %v, want %v", got, test.want)
+			}
+		})
+	}
+}
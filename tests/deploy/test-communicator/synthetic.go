@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// SyntheticMetricsConfig controls the synthetic metrics served on their own
+// port for testing scrape pipelines: how many families and series there are
+// and how the series misbehave over time.
+type SyntheticMetricsConfig struct {
+	Enabled       bool          `json:"enabled"`
+	Port          int           `json:"port"`
+	Path          string        `json:"path"`
+	Prefix        string        `json:"prefix"`         // Prefix of every family name
+	Types         []string      `json:"types"`          // "counter", "gauge", "histogram", "summary", "native-histogram"
+	Families      int           `json:"families"`       // Families of each type
+	Series        int           `json:"series"`         // Series per family
+	Labels        int           `json:"labels"`         // Labels per series, at least 1
+	Interval      time.Duration `json:"interval"`       // Time between value updates
+	Churn         float64       `json:"churn"`          // Share of series replaced by new ones on every update
+	Flap          float64       `json:"flap"`           // Share of series present only on every other update
+	ResetInterval time.Duration `json:"reset_interval"` // Time between counter resets, 0 disables
+	SpecialValues bool          `json:"special_values"` // Gauge series 0-2 report NaN, +Inf and -Inf
+}
+
+var syntheticTypes = []string{"counter", "gauge", "histogram", "summary", "native-histogram"}
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// syntheticMetrics keeps the synthetic families in their own registry, so
+// they never mix with the communicator's own metrics.
+type syntheticMetrics struct {
+	config   SyntheticMetricsConfig
+	random   *seededRand
+	registry *prometheus.Registry
+	server   *http.Server
+	active   prometheus.Gauge
+
+	counters   []*prometheus.CounterVec
+	gauges     []*prometheus.GaugeVec
+	observers  []*prometheus.HistogramVec
+	summaries  []*prometheus.SummaryVec
+	labelNames []string
+
+	series    []int // IDs of the current series, oldest first
+	nextID    int
+	updates   int
+	lastReset time.Time
+}
+
+func newSyntheticMetrics(config SyntheticMetricsConfig, random *seededRand, active prometheus.Gauge) *syntheticMetrics {
+	s := &syntheticMetrics{
+		config:    config,
+		random:    random,
+		registry:  prometheus.NewRegistry(),
+		active:    active,
+		lastReset: time.Now(),
+	}
+
+	for i := 0; i < max(config.Labels, 1); i++ {
+		s.labelNames = append(s.labelNames, fmt.Sprintf("label_%d", i))
+	}
+	for ; s.nextID < config.Series; s.nextID++ {
+		s.series = append(s.series, s.nextID)
+	}
+
+	for i := 0; i < config.Families; i++ {
+		help := fmt.Sprintf("Synthetic %%s %d of %d", i+1, config.Families)
+		for _, kind := range config.Types {
+			name := fmt.Sprintf("%s_%s_%d", config.Prefix, kind, i)
+			switch kind {
+			case "counter":
+				vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name + "_total", Help: fmt.Sprintf(help, kind)}, s.labelNames)
+				s.registry.MustRegister(vec)
+				s.counters = append(s.counters, vec)
+			case "gauge":
+				vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: fmt.Sprintf(help, kind)}, s.labelNames)
+				s.registry.MustRegister(vec)
+				s.gauges = append(s.gauges, vec)
+			case "histogram":
+				vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: fmt.Sprintf("%s_histogram_%d_seconds", config.Prefix, i), Help: fmt.Sprintf(help, kind)}, s.labelNames)
+				s.registry.MustRegister(vec)
+				s.observers = append(s.observers, vec)
+			case "native-histogram":
+				// The native buckets are only exposed in the protobuf format
+				vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+					Name:                        fmt.Sprintf("%s_native_histogram_%d_seconds", config.Prefix, i),
+					Help:                        fmt.Sprintf(help, kind),
+					NativeHistogramBucketFactor: 1.1,
+				}, s.labelNames)
+				s.registry.MustRegister(vec)
+				s.observers = append(s.observers, vec)
+			case "summary":
+				vec := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+					Name:       fmt.Sprintf("%s_summary_%d_seconds", config.Prefix, i),
+					Help:       fmt.Sprintf(help, kind),
+					Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+				}, s.labelNames)
+				s.registry.MustRegister(vec)
+				s.summaries = append(s.summaries, vec)
+			}
+		}
+	}
+	return s
+}
+
+// labels returns the label values of a series. label_0 identifies the
+// series; the other labels repeat with growing periods, like real
+// dimensions of lower cardinality.
+func (s *syntheticMetrics) labels(id int) []string {
+	values := make([]string, len(s.labelNames))
+	values[0] = "series-" + strconv.Itoa(id)
+	for i := 1; i < len(values); i++ {
+		values[i] = "value-" + strconv.Itoa(id%(i+1))
+	}
+	return values
+}
+
+func (s *syntheticMetrics) delete(id int) {
+	values := s.labels(id)
+	for _, vec := range s.counters {
+		vec.DeleteLabelValues(values...)
+	}
+	for _, vec := range s.gauges {
+		vec.DeleteLabelValues(values...)
+	}
+	for _, vec := range s.observers {
+		vec.DeleteLabelValues(values...)
+	}
+	for _, vec := range s.summaries {
+		vec.DeleteLabelValues(values...)
+	}
+}
+
+// update advances the synthetic series by one interval: counters may reset,
+// churned series are replaced, flapping series come and go and every present
+// series gets new values.
+func (s *syntheticMetrics) update(now time.Time) {
+	s.updates++
+
+	if s.config.ResetInterval > 0 && now.Sub(s.lastReset) >= s.config.ResetInterval {
+		for _, vec := range s.counters {
+			vec.Reset()
+		}
+		s.lastReset = now
+		log.Printf("Synthetic counters reset")
+	}
+
+	if churned := int(math.Round(s.config.Churn * float64(len(s.series)))); churned > 0 && s.updates > 1 {
+		for _, id := range s.series[:churned] {
+			s.delete(id)
+		}
+		s.series = slices.Delete(s.series, 0, churned)
+		for ; churned > 0; churned-- {
+			s.series = append(s.series, s.nextID)
+			s.nextID++
+		}
+	}
+
+	// The newest series flap, so churn never removes a flapping series
+	// while it is absent
+	flapping := len(s.series) - int(math.Round(s.config.Flap*float64(len(s.series))))
+	present := 0
+	for i, id := range s.series {
+		if i >= flapping && s.updates%2 == 0 {
+			s.delete(id)
+			continue
+		}
+		present++
+
+		values := s.labels(id)
+		for _, vec := range s.counters {
+			vec.WithLabelValues(values...).Add(float64(s.random.IntN(10) + 1))
+		}
+		for _, vec := range s.gauges {
+			vec.WithLabelValues(values...).Set(s.gaugeValue(i))
+		}
+		for _, vec := range s.observers {
+			vec.WithLabelValues(values...).Observe(s.random.Float64() * s.random.Float64() * 10)
+		}
+		for _, vec := range s.summaries {
+			vec.WithLabelValues(values...).Observe(s.random.Float64() * s.random.Float64() * 10)
+		}
+	}
+	s.active.Set(float64(present * s.config.Families * len(s.config.Types)))
+}
+
+func (s *syntheticMetrics) gaugeValue(index int) float64 {
+	if s.config.SpecialValues {
+		switch index {
+		case 0:
+			return math.NaN()
+		case 1:
+			return math.Inf(1)
+		case 2:
+			return math.Inf(-1)
+		}
+	}
+	return s.random.Float64()*200 - 100
+}
+
+// run updates the series every interval until stop is closed.
+func (s *syntheticMetrics) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	s.update(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			s.update(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startSyntheticMetrics serves the synthetic registry on its own port. The
+// handler negotiates OpenMetrics and protobuf, which native histograms need.
+func (a *App) startSyntheticMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(a.config.SyntheticMetrics.Path, promhttp.HandlerFor(a.synthetic.registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	a.synthetic.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.config.SyntheticMetrics.Port),
+		Handler: mux,
+	}
+
+	go a.synthetic.run(a.stopCh)
+	go func() {
+		log.Printf("Synthetic metrics listening on :%d%s (%d series per family, %d families of %v)",
+			a.config.SyntheticMetrics.Port, a.config.SyntheticMetrics.Path, a.config.SyntheticMetrics.Series, a.config.SyntheticMetrics.Families, a.config.SyntheticMetrics.Types)
+		if err := a.synthetic.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Synthetic metrics server failed to start: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSynthetic returns the synthetic families by name, each with its
+// series by label_0.
+func gatherSynthetic(t *testing.T, s *syntheticMetrics) map[string]map[string]*dto.Metric {
+	t.Helper()
+	families, err := s.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := map[string]map[string]*dto.Metric{}
+	for _, family := range families {
+		series := map[string]*dto.Metric{}
+		for _, metric := range family.Metric {
+			series[metric.Label[0].GetValue()] = metric
+		}
+		gathered[family.GetName()] = series
+	}
+	return gathered
+}
+
+// seriesNames returns the sorted label_0 values of a family.
+func seriesNames(series map[string]*dto.Metric) []string {
+	var names []string
+	for name := range series {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func newTestSynthetic(config SyntheticMetricsConfig) (*syntheticMetrics, prometheus.Gauge) {
+	active := prometheus.NewGauge(prometheus.GaugeOpts{Name: "synthetic_series_active"})
+	return newSyntheticMetrics(config, newSeededRand("test", "test"), active), active
+}
+
+func TestSyntheticMetricsFamilies(t *testing.T) {
+	s, active := newTestSynthetic(SyntheticMetricsConfig{
+		Prefix:   "synthetic",
+		Types:    syntheticTypes,
+		Families: 2,
+		Series:   3,
+		Labels:   3,
+	})
+	s.update(time.Now())
+
+	want := map[string]dto.MetricType{}
+	for _, i := range []string{"0", "1"} {
+		want["synthetic_counter_"+i+"_total"] = dto.MetricType_COUNTER
+		want["synthetic_gauge_"+i] = dto.MetricType_GAUGE
+		want["synthetic_histogram_"+i+"_seconds"] = dto.MetricType_HISTOGRAM
+		want["synthetic_native_histogram_"+i+"_seconds"] = dto.MetricType_HISTOGRAM
+		want["synthetic_summary_"+i+"_seconds"] = dto.MetricType_SUMMARY
+	}
+	families, err := s.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]dto.MetricType{}
+	for _, family := range families {
+		got[family.GetName()] = family.GetType()
+		if len(family.Metric) != 3 {
+			t.Errorf("%s has %d series, want 3", family.GetName(), len(family.Metric))
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, pair := range metric.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			id := labels["label_0"][len("series-"):]
+			wantLabels := map[string]string{
+				"label_0": "series-" + id,
+				"label_1": "value-" + map[string]string{"0": "0", "1": "1", "2": "0"}[id],
+				"label_2": "value-" + id,
+			}
+			if !reflect.DeepEqual(labels, wantLabels) {
+				t.Errorf("%s series has labels %v, want %v", family.GetName(), labels, wantLabels)
+			}
+			native := metric.GetHistogram().GetZeroThreshold() != 0
+			if wantNative := strings.Contains(family.GetName(), "native"); native != wantNative {
+				t.Errorf("%s series has native buckets %t, want %t", family.GetName(), native, wantNative)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("families %v, want %v", got, want)
+	}
+	if got := gaugeValue(active); got != 30 {
+		t.Errorf("active series %g, want 30", got)
+	}
+}
+
+func TestSyntheticMetricsChurnAndFlap(t *testing.T) {
+	tests := []struct {
+		name   string
+		churn  float64
+		flap   float64
+		want   [][]string // Series present after each update
+		active []float64
+	}{
+		{
+			name:   "stable",
+			want:   [][]string{{"series-0", "series-1", "series-2", "series-3"}, {"series-0", "series-1", "series-2", "series-3"}},
+			active: []float64{8, 8},
+		},
+		{
+			name:  "churn replaces the oldest series",
+			churn: 0.25,
+			want: [][]string{
+				{"series-0", "series-1", "series-2", "series-3"},
+				{"series-1", "series-2", "series-3", "series-4"},
+				{"series-2", "series-3", "series-4", "series-5"},
+			},
+			active: []float64{8, 8, 8},
+		},
+		{
+			name: "flapping series are absent on every other update",
+			flap: 0.5,
+			want: [][]string{
+				{"series-0", "series-1", "series-2", "series-3"},
+				{"series-0", "series-1"},
+				{"series-0", "series-1", "series-2", "series-3"},
+			},
+			active: []float64{8, 4, 8},
+		},
+		{
+			name:  "churn and flap",
+			churn: 0.25,
+			flap:  0.25,
+			want: [][]string{
+				{"series-0", "series-1", "series-2", "series-3"},
+				{"series-1", "series-2", "series-3"},
+				{"series-2", "series-3", "series-4", "series-5"},
+			},
+			active: []float64{8, 6, 8},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, active := newTestSynthetic(SyntheticMetricsConfig{
+				Prefix:   "synthetic",
+				Types:    []string{"counter", "gauge"},
+				Families: 1,
+				Series:   4,
+				Labels:   1,
+				Churn:    test.churn,
+				Flap:     test.flap,
+			})
+			now := time.Now()
+			for i, want := range test.want {
+				s.update(now.Add(time.Duration(i) * time.Second))
+				gathered := gatherSynthetic(t, s)
+				for _, family := range []string{"synthetic_counter_0_total", "synthetic_gauge_0"} {
+					if got := seriesNames(gathered[family]); !reflect.DeepEqual(got, want) {
+						t.Errorf("update %d: %s has series %v, want %v", i+1, family, got, want)
+					}
+				}
+				if got := gaugeValue(active); got != test.active[i] {
+					t.Errorf("update %d: active series %g, want %g", i+1, got, test.active[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSyntheticMetricsCounterReset(t *testing.T) {
+	counts := map[time.Duration]float64{}
+	for _, resetInterval := range []time.Duration{0, time.Minute} {
+		s, _ := newTestSynthetic(SyntheticMetricsConfig{
+			Prefix:        "synthetic",
+			Types:         []string{"counter"},
+			Families:      1,
+			Series:        1,
+			Labels:        1,
+			ResetInterval: resetInterval,
+		})
+		start := s.lastReset
+		for _, after := range []time.Duration{10 * time.Second, 20 * time.Second, 61 * time.Second} {
+			s.update(start.Add(after))
+		}
+		counts[resetInterval] = gatherSynthetic(t, s)["synthetic_counter_0_total"]["series-0"].GetCounter().GetValue()
+	}
+	// The counters draw the same increments with and without resets, so a
+	// reset before the last update leaves only its increment
+	if counts[time.Minute] < 1 || counts[time.Minute] > 10 || counts[time.Minute] >= counts[0] {
+		t.Errorf("counter %g with a reset before the last update, %g without, want one increment of 1 to 10", counts[time.Minute], counts[0])
+	}
+}
+
+func TestSyntheticMetricsGaugeValues(t *testing.T) {
+	for _, special := range []bool{false, true} {
+		s, _ := newTestSynthetic(SyntheticMetricsConfig{
+			Prefix:        "synthetic",
+			Types:         []string{"gauge"},
+			Families:      1,
+			Series:        4,
+			Labels:        1,
+			SpecialValues: special,
+		})
+		s.update(time.Now())
+		gauges := gatherSynthetic(t, s)["synthetic_gauge_0"]
+		for i, name := range []string{"series-0", "series-1", "series-2", "series-3"} {
+			value := gauges[name].GetGauge().GetValue()
+			switch {
+			case special && i == 0:
+				if !math.IsNaN(value) {
+					t.Errorf("%s = %g, want NaN", name, value)
+				}
+			case special && i < 3:
+				if !math.IsInf(value, 3-2*i) {
+					t.Errorf("%s = %g, want %gInf", name, value, float64(3-2*i))
+				}
+			case value < -100 || value >= 100 || math.IsNaN(value):
+				t.Errorf("%s = %g with special values %t, want a value from -100 to 100", name, value, special)
+			}
+		}
+	}
+}
+
+// gaugeValue returns the value of a gauge.
+func gaugeValue(g prometheus.Gauge) float64 {
+	var metric dto.Metric
+	g.Write(&metric)
+	return metric.GetGauge().GetValue()
+}
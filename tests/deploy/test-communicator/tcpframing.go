@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const tcpMaxFrameSize = 16 * 1024 * 1024
+
+// tcpFramer splits a raw TCP byte stream into request/response messages.
+// The "stream" framing has no messages and is handled separately.
+type tcpFramer interface {
+	readFrame(r *bufio.Reader) ([]byte, error)
+	writeFrame(w io.Writer, payload []byte) error
+}
+
+func newTCPFramer(framing string, recordSize int) (tcpFramer, error) {
+	switch framing {
+	case "newline":
+		return newlineFramer{}, nil
+	case "length-prefixed":
+		return lengthPrefixedFramer{}, nil
+	case "fixed":
+		if recordSize <= 0 {
+			return nil, fmt.Errorf("fixed framing needs a positive record size, got %d", recordSize)
+		}
+		return fixedSizeFramer{size: recordSize}, nil
+	default:
+		return nil, fmt.Errorf("unsupported TCP framing: %s", framing)
+	}
+}
+
+// newlineFramer sends one message per line, as the original TCP mode did.
+type newlineFramer struct{}
+
+func (newlineFramer) readFrame(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	// A last line without a newline still counts
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func (newlineFramer) writeFrame(w io.Writer, payload []byte) error {
+	_, err := w.Write(append(payload, '\n'))
+	return err
+}
+
+// lengthPrefixedFramer prefixes every message with its length as a 4-byte
+// big-endian integer.
+type lengthPrefixedFramer struct{}
+
+func (lengthPrefixedFramer) readFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > tcpMaxFrameSize {
+		return nil, fmt.Errorf("frame length %d exceeds maximum", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (lengthPrefixedFramer) writeFrame(w io.Writer, payload []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// fixedSizeFramer exchanges records of exactly size bytes. Shorter messages
+// are padded with zero bytes, longer ones are truncated.
+type fixedSizeFramer struct {
+	size int
+}
+
+func (f fixedSizeFramer) readFrame(r *bufio.Reader) ([]byte, error) {
+	record := make([]byte, f.size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(record, "\x00"), nil
+}
+
+func (f fixedSizeFramer) writeFrame(w io.Writer, payload []byte) error {
+	record := make([]byte, f.size)
+	copy(record, payload)
+	_, err := w.Write(record)
+	return err
+}
+
+// tcpClientConn is an outbound connection that may be reused across
+// periodic requests.
+type tcpClientConn struct {
+	conn     net.Conn
+	address  string
+	reader   *bufio.Reader
+	opened   time.Time
+	lastUsed time.Time
+	requests int
+	written  int64
+	read     int64
+}
+
+func (c *tcpClientConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *tcpClientConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// tcpClientPool keeps up to size idle connections for reuse, counted across
+// all targets together. Connections idle for longer than idleTimeout are
+// closed instead of reused.
+type tcpClientPool struct {
+	mu          sync.Mutex
+	size        int
+	idleTimeout time.Duration
+	idle        []*tcpClientConn
+}
+
+// get returns an idle connection to address, if there is one.
+func (p *tcpClientPool) get(address string) *tcpClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		c := p.idle[i]
+		if c.address != address {
+			continue
+		}
+		p.idle = slices.Delete(p.idle, i, i+1)
+		if p.idleTimeout > 0 && time.Since(c.lastUsed) > p.idleTimeout {
+			c.conn.Close()
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+// put returns c to the pool and reports whether it was kept.
+func (p *tcpClientPool) put(c *tcpClientConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= p.size {
+		return false
+	}
+	c.lastUsed = time.Now()
+	p.idle = append(p.idle, c)
+	return true
+}
+
+func (p *tcpClientPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPFramerRoundTrip(t *testing.T) {
+	tests := []struct {
+		framing  string
+		payloads []string
+	}{
+		{"newline", []string{"health", "", "data with spaces", "carriage return\r"}},
+		{"length-prefixed", []string{"health", "", "line\nbreaks\r\n", "\x00binary\x00"}},
+		{"fixed", []string{"health", "", "exactly sixteen!", "data"}},
+	}
+	for _, test := range tests {
+		t.Run(test.framing, func(t *testing.T) {
+			framer, err := newTCPFramer(test.framing, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			for _, payload := range test.payloads {
+				if err := framer.writeFrame(&buf, []byte(payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reader := bufio.NewReader(&buf)
+			for _, payload := range test.payloads {
+				got, err := framer.readFrame(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Newline framing strips line endings
+				want := payload
+				if test.framing == "newline" {
+					want = strings.TrimRight(payload, "\r")
+				}
+				if string(got) != want {
+					t.Errorf("read %q, want %q", got, want)
+				}
+			}
+			if _, err := framer.readFrame(reader); err == nil {
+				t.Error("read past the last frame: want an error")
+			}
+		})
+	}
+}
+
+func TestTCPFramerRead(t *testing.T) {
+	lengthPrefixed := func(length uint32, payload string) string {
+		return string(binary.BigEndian.AppendUint32(nil, length)) + payload
+	}
+	tests := []struct {
+		name    string
+		framing string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "newline CRLF", framing: "newline", input: "health\r\n", want: "health"},
+		{name: "newline without end", framing: "newline", input: "health\r", want: "health"},
+		{name: "newline empty", framing: "newline", input: "", wantErr: true},
+		{name: "length-prefixed empty", framing: "length-prefixed", input: lengthPrefixed(0, ""), want: ""},
+		{name: "length-prefixed short header", framing: "length-prefixed", input: "\x00\x00", wantErr: true},
+		{name: "length-prefixed truncated", framing: "length-prefixed", input: lengthPrefixed(10, "abc"), wantErr: true},
+		{name: "length-prefixed too large", framing: "length-prefixed", input: lengthPrefixed(tcpMaxFrameSize+1, ""), wantErr: true},
+		{name: "length-prefixed largest length", framing: "length-prefixed", input: lengthPrefixed(0xffffffff, ""), wantErr: true},
+		{name: "fixed padded", framing: "fixed", input: "abc" + strings.Repeat("\x00", 13), want: "abc"},
+		{name: "fixed truncated", framing: "fixed", input: "abc", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			framer, err := newTCPFramer(test.framing, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := framer.readFrame(bufio.NewReader(strings.NewReader(test.input)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("read %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("read %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFixedSizeFramerTruncates(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (fixedSizeFramer{size: 4}).writeFrame(&buf, []byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "trun" {
+		t.Errorf("wrote %q, want %q", buf.String(), "trun")
+	}
+}
+
+func TestNewTCPFramerInvalid(t *testing.T) {
+	tests := []struct {
+		framing    string
+		recordSize int
+	}{
+		{"fixed", 0},
+		{"fixed", -1},
+		{"stream", 0},
+		{"bogus", 0},
+	}
+	for _, test := range tests {
+		if _, err := newTCPFramer(test.framing, test.recordSize); err == nil {
+			t.Errorf("newTCPFramer(%q, %d): want an error", test.framing, test.recordSize)
+		}
+	}
+}
+
+func TestTCPClientPool(t *testing.T) {
+	newConn := func(address string) *tcpClientConn {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close(); server.Close() })
+		return &tcpClientConn{conn: client, address: address}
+	}
+
+	pool := &tcpClientPool{size: 2}
+	a, b, c := newConn("a:1"), newConn("b:1"), newConn("a:1")
+	if !pool.put(a) || !pool.put(b) {
+		t.Fatal("pool with room did not keep the connections")
+	}
+	if pool.put(c) {
+		t.Error("full pool kept a connection")
+	}
+	if got := pool.get("c:1"); got != nil {
+		t.Error("got a connection for an unknown address")
+	}
+	if got := pool.get("a:1"); got != a {
+		t.Error("did not get the idle connection to a:1")
+	}
+	if got := pool.get("a:1"); got != nil {
+		t.Error("got a connection to a:1 twice")
+	}
+
+	// Connections idle for too long are closed instead of reused
+	pool = &tcpClientPool{size: 2, idleTimeout: time.Millisecond}
+	pool.put(a)
+	a.lastUsed = time.Now().Add(-time.Second)
+	if got := pool.get("a:1"); got != nil {
+		t.Error("got a connection idle beyond the timeout")
+	}
+	if _, err := a.conn.Write([]byte("x")); err == nil {
+		t.Error("expired connection was not closed")
+	}
+}
+
+func TestStreamTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := closeWrite(client); err == nil {
+		t.Error("closeWrite on a pipe, which cannot half-close: want an error")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read until the client half-closes, then answer
+		var received bytes.Buffer
+		received.ReadFrom(conn)
+		conn.Write([]byte("got " + received.String() + "\n"))
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	response, err := streamTCP(conn, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "got xxxxx" {
+		t.Errorf("response %q, want %q", response, "got xxxxx")
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The exporters encode their wire formats directly, like the protocol
+// clients, so the communicator produces exactly what real instrumented
+// services send: OTLP/HTTP, Zipkin v2 and the Jaeger collector protocols.
+
+// postSpans sends an encoded batch and fails on any status but 2xx.
+func postSpans(ctx context.Context, endpoint, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "test-communicator")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// otlpExporter posts an ExportTraceServiceRequest to an OTLP/HTTP endpoint,
+// such as http://collector:4318/v1/traces.
+type otlpExporter struct {
+	tracer *tracer
+	json   bool
+}
+
+// OTLP span kinds and the error status code. Successful spans leave their
+// status unset, as instrumentation libraries do.
+const (
+	otlpKindServer  = 2
+	otlpKindClient  = 3
+	otlpStatusError = 2
+)
+
+func otlpKind(kind string) int {
+	if kind == "client" {
+		return otlpKindClient
+	}
+	return otlpKindServer
+}
+
+func (e *otlpExporter) export(ctx context.Context, spans []*span) error {
+	if e.json {
+		return postSpans(ctx, e.tracer.config.Endpoint, "application/json", e.encodeJSON(spans))
+	}
+	return postSpans(ctx, e.tracer.config.Endpoint, "application/x-protobuf", e.encodeProtobuf(spans))
+}
+
+func (e *otlpExporter) encodeProtobuf(spans []*span) []byte {
+	keyValue := func(key, value string) []byte {
+		var anyValue, kv []byte
+		anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+		anyValue = protowire.AppendString(anyValue, value)
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, key)
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		return protowire.AppendBytes(kv, anyValue)
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "test-communicator")
+
+	var scopeSpans []byte
+	scopeSpans = protowire.AppendTag(scopeSpans, 1, protowire.BytesType)
+	scopeSpans = protowire.AppendBytes(scopeSpans, scope)
+	for _, s := range spans {
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.traceID[:])
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.spanID[:])
+		if s.parentID != [8]byte{} {
+			message = protowire.AppendTag(message, 4, protowire.BytesType)
+			message = protowire.AppendBytes(message, s.parentID[:])
+		}
+		message = protowire.AppendTag(message, 5, protowire.BytesType)
+		message = protowire.AppendString(message, s.name)
+		message = protowire.AppendTag(message, 6, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(otlpKind(s.kind)))
+		message = protowire.AppendTag(message, 7, protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, uint64(s.start.UnixNano()))
+		message = protowire.AppendTag(message, 8, protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, uint64(s.end.UnixNano()))
+		for _, attribute := range s.attributes {
+			message = protowire.AppendTag(message, 9, protowire.BytesType)
+			message = protowire.AppendBytes(message, keyValue(attribute[0], attribute[1]))
+		}
+
+		if s.err != "" {
+			var status []byte
+			status = protowire.AppendTag(status, 2, protowire.BytesType)
+			status = protowire.AppendString(status, s.err)
+			status = protowire.AppendTag(status, 3, protowire.VarintType)
+			status = protowire.AppendVarint(status, otlpStatusError)
+			message = protowire.AppendTag(message, 15, protowire.BytesType)
+			message = protowire.AppendBytes(message, status)
+		}
+
+		scopeSpans = protowire.AppendTag(scopeSpans, 2, protowire.BytesType)
+		scopeSpans = protowire.AppendBytes(scopeSpans, message)
+	}
+
+	var resource []byte
+	resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+	resource = protowire.AppendBytes(resource, keyValue("service.name", e.tracer.service))
+
+	var resourceSpans []byte
+	resourceSpans = protowire.AppendTag(resourceSpans, 1, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, resource)
+	resourceSpans = protowire.AppendTag(resourceSpans, 2, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, scopeSpans)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	return protowire.AppendBytes(request, resourceSpans)
+}
+
+type otlpJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpJSONSpan struct {
+	TraceID           string             `json:"traceId"`
+	SpanID            string             `json:"spanId"`
+	ParentSpanID      string             `json:"parentSpanId,omitempty"`
+	Name              string             `json:"name"`
+	Kind              int                `json:"kind"`
+	StartTimeUnixNano string             `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string             `json:"endTimeUnixNano"`
+	Attributes        []otlpJSONKeyValue `json:"attributes,omitempty"`
+	Status            *otlpJSONStatus    `json:"status,omitempty"`
+}
+
+type otlpJSONStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code"`
+}
+
+// encodeJSON uses the OTLP JSON mapping: hex IDs, integer enums and 64-bit
+// integers as strings.
+func (e *otlpExporter) encodeJSON(spans []*span) []byte {
+	keyValue := func(key, value string) otlpJSONKeyValue {
+		kv := otlpJSONKeyValue{Key: key}
+		kv.Value.StringValue = value
+		return kv
+	}
+
+	var encoded []otlpJSONSpan
+	for _, s := range spans {
+		js := otlpJSONSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpKind(s.kind),
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			js.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, attribute := range s.attributes {
+			js.Attributes = append(js.Attributes, keyValue(attribute[0], attribute[1]))
+		}
+		if s.err != "" {
+			js.Status = &otlpJSONStatus{Message: s.err, Code: otlpStatusError}
+		}
+		encoded = append(encoded, js)
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpJSONKeyValue{keyValue("service.name", e.tracer.service)}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "test-communicator"},
+				"spans": encoded,
+			}},
+		}},
+	}
+	body, _ := json.Marshal(request)
+	return body
+}
+
+// zipkinExporter posts Zipkin v2 spans, as JSON or as a ListOfSpans
+// protobuf, to an endpoint such as http://collector:9411/api/v2/spans.
+type zipkinExporter struct {
+	tracer *tracer
+	proto  bool
+}
+
+type zipkinJSONSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint map[string]string `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// zipkinTags returns the span attributes, with failed spans tagged "error"
+// as Zipkin expects.
+func zipkinTags(s *span) map[string]string {
+	tags := map[string]string{}
+	for _, attribute := range s.attributes {
+		tags[attribute[0]] = attribute[1]
+	}
+	if s.err != "" {
+		tags["error"] = s.err
+	}
+	return tags
+}
+
+func (e *zipkinExporter) export(ctx context.Context, spans []*span) error {
+	if !e.proto {
+		var encoded []zipkinJSONSpan
+		for _, s := range spans {
+			js := zipkinJSONSpan{
+				TraceID:       hex.EncodeToString(s.traceID[:]),
+				ID:            hex.EncodeToString(s.spanID[:]),
+				Name:          s.name,
+				Kind:          strings.ToUpper(s.kind),
+				Timestamp:     s.start.UnixMicro(),
+				Duration:      max(s.end.Sub(s.start).Microseconds(), 1),
+				LocalEndpoint: map[string]string{"serviceName": e.tracer.service},
+				Tags:          zipkinTags(s),
+			}
+			if s.parentID != [8]byte{} {
+				js.ParentID = hex.EncodeToString(s.parentID[:])
+			}
+			encoded = append(encoded, js)
+		}
+		body, _ := json.Marshal(encoded)
+		return postSpans(ctx, e.tracer.config.Endpoint, "application/json", body)
+	}
+
+	var list []byte
+	for _, s := range spans {
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.traceID[:])
+		if s.parentID != [8]byte{} {
+			message = protowire.AppendTag(message, 2, protowire.BytesType)
+			message = protowire.AppendBytes(message, s.parentID[:])
+		}
+		message = protowire.AppendTag(message, 3, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.spanID[:])
+		kind := uint64(2) // SERVER
+		if s.kind == "client" {
+			kind = 1
+		}
+		message = protowire.AppendTag(message, 4, protowire.VarintType)
+		message = protowire.AppendVarint(message, kind)
+		message = protowire.AppendTag(message, 5, protowire.BytesType)
+		message = protowire.AppendString(message, s.name)
+		message = protowire.AppendTag(message, 6, protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, uint64(s.start.UnixMicro()))
+		message = protowire.AppendTag(message, 7, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(max(s.end.Sub(s.start).Microseconds(), 1)))
+
+		var endpoint []byte
+		endpoint = protowire.AppendTag(endpoint, 1, protowire.BytesType)
+		endpoint = protowire.AppendString(endpoint, e.tracer.service)
+		message = protowire.AppendTag(message, 8, protowire.BytesType)
+		message = protowire.AppendBytes(message, endpoint)
+
+		for key, value := range zipkinTags(s) {
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendString(entry, key)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, value)
+			message = protowire.AppendTag(message, 11, protowire.BytesType)
+			message = protowire.AppendBytes(message, entry)
+		}
+
+		list = protowire.AppendTag(list, 1, protowire.BytesType)
+		list = protowire.AppendBytes(list, message)
+	}
+	return postSpans(ctx, e.tracer.config.Endpoint, "application/x-protobuf", list)
+}
+
+// jaegerTags returns the span attributes as Jaeger tags, with the span kind
+// and, for failed spans, the error flag and message.
+func jaegerTags(s *span) [][2]string {
+	tags := append([][2]string{{"span.kind", s.kind}}, s.attributes...)
+	if s.err != "" {
+		tags = append(tags, [2]string{"error", "true"}, [2]string{"error.message", s.err})
+	}
+	return tags
+}
+
+// jaegerThriftExporter posts a Thrift Batch in the binary protocol to the
+// Jaeger collector's HTTP endpoint, such as http://jaeger:14268/api/traces.
+type jaegerThriftExporter struct {
+	tracer *tracer
+}
+
+// Thrift binary protocol type IDs
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftList   = 15
+)
+
+type thriftWriter struct {
+	bytes.Buffer
+}
+
+func (w *thriftWriter) field(kind byte, id int16) {
+	w.WriteByte(kind)
+	binary.Write(w, binary.BigEndian, id)
+}
+
+func (w *thriftWriter) i32(value int32) { binary.Write(w, binary.BigEndian, value) }
+func (w *thriftWriter) i64(value int64) { binary.Write(w, binary.BigEndian, value) }
+
+func (w *thriftWriter) string(value string) {
+	w.i32(int32(len(value)))
+	w.WriteString(value)
+}
+
+func (w *thriftWriter) list(kind byte, size int) {
+	w.WriteByte(kind)
+	w.i32(int32(size))
+}
+
+// tags writes a list of string or bool Jaeger tags as field id.
+func (w *thriftWriter) tags(id int16, tags [][2]string) {
+	w.field(thriftList, id)
+	w.list(thriftStruct, len(tags))
+	for _, tag := range tags {
+		w.field(thriftString, 1)
+		w.string(tag[0])
+		if tag[0] == "error" {
+			w.field(thriftI32, 2)
+			w.i32(2) // BOOL
+			w.field(thriftBool, 5)
+			w.WriteByte(1)
+		} else {
+			w.field(thriftI32, 2)
+			w.i32(0) // STRING
+			w.field(thriftString, 3)
+			w.string(tag[1])
+		}
+		w.WriteByte(thriftStop)
+	}
+}
+
+func (e *jaegerThriftExporter) export(ctx context.Context, spans []*span) error {
+	var w thriftWriter
+
+	// Batch.process
+	w.field(thriftStruct, 1)
+	w.field(thriftString, 1)
+	w.string(e.tracer.service)
+	w.WriteByte(thriftStop)
+
+	// Batch.spans
+	w.field(thriftList, 2)
+	w.list(thriftStruct, len(spans))
+	for _, s := range spans {
+		w.field(thriftI64, 1)
+		w.i64(int64(binary.BigEndian.Uint64(s.traceID[8:])))
+		w.field(thriftI64, 2)
+		w.i64(int64(binary.BigEndian.Uint64(s.traceID[:8])))
+		w.field(thriftI64, 3)
+		w.i64(int64(binary.BigEndian.Uint64(s.spanID[:])))
+		w.field(thriftI64, 4)
+		w.i64(int64(binary.BigEndian.Uint64(s.parentID[:])))
+		w.field(thriftString, 5)
+		w.string(s.name)
+		w.field(thriftI32, 7)
+		w.i32(1) // Sampled
+		w.field(thriftI64, 8)
+		w.i64(s.start.UnixMicro())
+		w.field(thriftI64, 9)
+		w.i64(max(s.end.Sub(s.start).Microseconds(), 1))
+		w.tags(10, jaegerTags(s))
+		w.WriteByte(thriftStop)
+	}
+	w.WriteByte(thriftStop)
+
+	return postSpans(ctx, e.tracer.config.Endpoint, "application/x-thrift", w.Bytes())
+}
+
+// jaegerGRPCExporter calls jaeger.api_v2.CollectorService/PostSpans, usually
+// on port 14250.
+type jaegerGRPCExporter struct {
+	tracer *tracer
+	conn   *grpc.ClientConn
+}
+
+func newJaegerGRPCExporter(t *tracer) (*jaegerGRPCExporter, error) {
+	conn, err := grpc.NewClient(t.config.Endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &jaegerGRPCExporter{tracer: t, conn: conn}, nil
+}
+
+// rawCodec passes messages that are already encoded.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return v.([]byte), nil }
+func (rawCodec) Name() string                  { return "proto" }
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = data
+	return nil
+}
+
+func (e *jaegerGRPCExporter) export(ctx context.Context, spans []*span) error {
+	protoTime := func(field protowire.Number, seconds int64, nanos int64, message []byte) []byte {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(seconds))
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(nanos))
+		message = protowire.AppendTag(message, field, protowire.BytesType)
+		return protowire.AppendBytes(message, value)
+	}
+
+	var batch []byte
+	for _, s := range spans {
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.traceID[:])
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendBytes(message, s.spanID[:])
+		message = protowire.AppendTag(message, 3, protowire.BytesType)
+		message = protowire.AppendString(message, s.name)
+		if s.parentID != [8]byte{} {
+			var reference []byte
+			reference = protowire.AppendTag(reference, 1, protowire.BytesType)
+			reference = protowire.AppendBytes(reference, s.traceID[:])
+			reference = protowire.AppendTag(reference, 2, protowire.BytesType)
+			reference = protowire.AppendBytes(reference, s.parentID[:])
+			message = protowire.AppendTag(message, 4, protowire.BytesType)
+			message = protowire.AppendBytes(message, reference) // CHILD_OF is the zero value
+		}
+		message = protowire.AppendTag(message, 5, protowire.VarintType)
+		message = protowire.AppendVarint(message, 1) // Sampled
+		message = protoTime(6, s.start.Unix(), int64(s.start.Nanosecond()), message)
+		duration := s.end.Sub(s.start)
+		message = protoTime(7, int64(duration/1e9), int64(duration%1e9), message)
+
+		for _, tag := range jaegerTags(s) {
+			var kv []byte
+			kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+			kv = protowire.AppendString(kv, tag[0])
+			if tag[0] == "error" {
+				kv = protowire.AppendTag(kv, 2, protowire.VarintType)
+				kv = protowire.AppendVarint(kv, 1) // BOOL
+				kv = protowire.AppendTag(kv, 4, protowire.VarintType)
+				kv = protowire.AppendVarint(kv, 1)
+			} else {
+				kv = protowire.AppendTag(kv, 3, protowire.BytesType)
+				kv = protowire.AppendString(kv, tag[1])
+			}
+			message = protowire.AppendTag(message, 8, protowire.BytesType)
+			message = protowire.AppendBytes(message, kv)
+		}
+
+		batch = protowire.AppendTag(batch, 1, protowire.BytesType)
+		batch = protowire.AppendBytes(batch, message)
+	}
+
+	var process []byte
+	process = protowire.AppendTag(process, 1, protowire.BytesType)
+	process = protowire.AppendString(process, e.tracer.service)
+	batch = protowire.AppendTag(batch, 2, protowire.BytesType)
+	batch = protowire.AppendBytes(batch, process)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, batch)
+
+	var response []byte
+	return e.conn.Invoke(ctx, "/jaeger.api_v2.CollectorService/PostSpans", request, &response, grpc.ForceCodec(rawCodec{}))
+}
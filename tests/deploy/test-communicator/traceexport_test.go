@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMessage is a decoded protobuf message: bytes fields as []byte and
+// varint and fixed64 fields as uint64, in the order they appear.
+type protoMessage map[protowire.Number][]any
+
+func decodeProto(t *testing.T, message []byte) protoMessage {
+	t.Helper()
+	m := protoMessage{}
+	protoFields(t, message, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+		if typ == protowire.BytesType {
+			m[num] = append(m[num], value)
+		} else {
+			m[num] = append(m[num], varint)
+		}
+	})
+	return m
+}
+
+func (m protoMessage) bytes(num protowire.Number) []byte {
+	if len(m[num]) == 0 {
+		return nil
+	}
+	return m[num][0].([]byte)
+}
+
+func (m protoMessage) string(num protowire.Number) string { return string(m.bytes(num)) }
+
+func (m protoMessage) uint(num protowire.Number) uint64 {
+	if len(m[num]) == 0 {
+		return 0
+	}
+	return m[num][0].(uint64)
+}
+
+// messages decodes every occurrence of a repeated message field.
+func (m protoMessage) messages(t *testing.T, num protowire.Number) []protoMessage {
+	var messages []protoMessage
+	for _, value := range m[num] {
+		messages = append(messages, decodeProto(t, value.([]byte)))
+	}
+	return messages
+}
+
+// testSpans returns a sampled root server span with attributes and a failed
+// client span that is its child.
+func testSpans(tr *tracer) []*span {
+	start := time.Unix(1700000000, 123456789)
+	root := &span{
+		spanContext: spanContext{traceID: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, spanID: [8]byte{1, 1, 1, 1, 1, 1, 1, 1}, sampled: true},
+		tracer:      tr,
+		name:        "GET /api/data",
+		kind:        "server",
+		start:       start,
+		end:         start.Add(1500 * time.Microsecond),
+		attributes:  [][2]string{{"http.method", "GET"}, {"http.status_code", "200"}},
+	}
+	child := &span{
+		spanContext: spanContext{traceID: root.traceID, spanID: [8]byte{2, 2, 2, 2, 2, 2, 2, 2}, sampled: true},
+		tracer:      tr,
+		parentID:    root.spanID,
+		name:        "call backend",
+		kind:        "client",
+		start:       start,
+		end:         start, // Exported with the minimum duration
+		err:         "connection refused",
+	}
+	return []*span{root, child}
+}
+
+// captureSpans runs an HTTP collector and returns the tracer exporting to
+// it and a function returning the last request's content type and body.
+func captureSpans(t *testing.T, exporter, encoding string) (*tracer, func() (string, []byte)) {
+	var contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	tr := newTestTracer(t, exporter, encoding, server.URL, "w3c")
+	return tr, func() (string, []byte) { return contentType, body }
+}
+
+func TestOTLPProtobufExport(t *testing.T) {
+	tr, received := captureSpans(t, "otlp", "protobuf")
+	spans := testSpans(tr)
+	if err := tr.exporter.export(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	contentType, body := received()
+	if contentType != "application/x-protobuf" {
+		t.Errorf("content type %s", contentType)
+	}
+
+	resourceSpans := decodeProto(t, body).messages(t, 1)
+	if len(resourceSpans) != 1 {
+		t.Fatalf("%d resource spans, want 1", len(resourceSpans))
+	}
+	serviceName := resourceSpans[0].messages(t, 1)[0].messages(t, 1)[0]
+	if serviceName.string(1) != "service.name" || decodeProto(t, serviceName.bytes(2)).string(1) != "svc" {
+		t.Errorf("resource attribute %s=%x, want service.name=svc", serviceName.string(1), serviceName.bytes(2))
+	}
+	scopeSpans := resourceSpans[0].messages(t, 2)[0]
+	if scope := scopeSpans.messages(t, 1)[0]; scope.string(1) != "test-communicator" {
+		t.Errorf("scope %q", scope.string(1))
+	}
+
+	encoded := scopeSpans.messages(t, 2)
+	if len(encoded) != len(spans) {
+		t.Fatalf("%d spans, want %d", len(encoded), len(spans))
+	}
+	for i, s := range spans {
+		m := encoded[i]
+		if !bytes.Equal(m.bytes(1), s.traceID[:]) || !bytes.Equal(m.bytes(2), s.spanID[:]) || m.string(5) != s.name {
+			t.Errorf("span %d: trace %x span %x name %q", i, m.bytes(1), m.bytes(2), m.string(5))
+		}
+		if m.uint(7) != uint64(s.start.UnixNano()) || m.uint(8) != uint64(s.end.UnixNano()) {
+			t.Errorf("span %d: times %d-%d", i, m.uint(7), m.uint(8))
+		}
+	}
+
+	root, child := encoded[0], encoded[1]
+	if root.bytes(4) != nil || root.uint(6) != otlpKindServer || root[15] != nil {
+		t.Errorf("root span: parent %x, kind %d, status %v", root.bytes(4), root.uint(6), root[15])
+	}
+	var attributes [][2]string
+	for _, kv := range root.messages(t, 9) {
+		attributes = append(attributes, [2]string{kv.string(1), decodeProto(t, kv.bytes(2)).string(1)})
+	}
+	if !reflect.DeepEqual(attributes, spans[0].attributes) {
+		t.Errorf("attributes %v, want %v", attributes, spans[0].attributes)
+	}
+	status := child.messages(t, 15)
+	if !bytes.Equal(child.bytes(4), spans[0].spanID[:]) || child.uint(6) != otlpKindClient || len(status) != 1 || status[0].string(2) != "connection refused" || status[0].uint(3) != otlpStatusError {
+		t.Errorf("child span: parent %x, kind %d, status %v", child.bytes(4), child.uint(6), status)
+	}
+}
+
+func TestOTLPJSONExport(t *testing.T) {
+	tr, received := captureSpans(t, "otlp", "json")
+	spans := testSpans(tr)
+	if err := tr.exporter.export(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	contentType, body := received()
+	if contentType != "application/json" {
+		t.Errorf("content type %s", contentType)
+	}
+
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpJSONKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Spans []otlpJSONSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatal(err)
+	}
+	resource := request.ResourceSpans[0]
+	if attribute := resource.Resource.Attributes[0]; attribute.Key != "service.name" || attribute.Value.StringValue != "svc" {
+		t.Errorf("resource attribute %+v", attribute)
+	}
+	encoded := resource.ScopeSpans[0].Spans
+	want := []otlpJSONSpan{
+		{
+			TraceID:           "0102030405060708090a0b0c0d0e0f10",
+			SpanID:            "0101010101010101",
+			Name:              "GET /api/data",
+			Kind:              otlpKindServer,
+			StartTimeUnixNano: "1700000000123456789",
+			EndTimeUnixNano:   "1700000000124956789",
+			Attributes:        encoded[0].Attributes,
+		},
+		{
+			TraceID:           "0102030405060708090a0b0c0d0e0f10",
+			SpanID:            "0202020202020202",
+			ParentSpanID:      "0101010101010101",
+			Name:              "call backend",
+			Kind:              otlpKindClient,
+			StartTimeUnixNano: "1700000000123456789",
+			EndTimeUnixNano:   "1700000000123456789",
+			Status:            &otlpJSONStatus{Message: "connection refused", Code: otlpStatusError},
+		},
+	}
+	if !reflect.DeepEqual(encoded, want) {
+		t.Errorf("spans\n%+v\nwant\n%+v", encoded, want)
+	}
+	if len(encoded[0].Attributes) != 2 || encoded[0].Attributes[1].Key != "http.status_code" || encoded[0].Attributes[1].Value.StringValue != "200" {
+		t.Errorf("attributes %+v", encoded[0].Attributes)
+	}
+}
+
+func TestZipkinJSONExport(t *testing.T) {
+	tr, received := captureSpans(t, "zipkin", "json")
+	if err := tr.exporter.export(context.Background(), testSpans(tr)); err != nil {
+		t.Fatal(err)
+	}
+	contentType, body := received()
+	if contentType != "application/json" {
+		t.Errorf("content type %s", contentType)
+	}
+	var encoded []zipkinJSONSpan
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	want := []zipkinJSONSpan{
+		{
+			TraceID:       "0102030405060708090a0b0c0d0e0f10",
+			ID:            "0101010101010101",
+			Name:          "GET /api/data",
+			Kind:          "SERVER",
+			Timestamp:     1700000000123456,
+			Duration:      1500,
+			LocalEndpoint: map[string]string{"serviceName": "svc"},
+			Tags:          map[string]string{"http.method": "GET", "http.status_code": "200"},
+		},
+		{
+			TraceID:       "0102030405060708090a0b0c0d0e0f10",
+			ID:            "0202020202020202",
+			ParentID:      "0101010101010101",
+			Name:          "call backend",
+			Kind:          "CLIENT",
+			Timestamp:     1700000000123456,
+			Duration:      1,
+			LocalEndpoint: map[string]string{"serviceName": "svc"},
+			Tags:          map[string]string{"error": "connection refused"},
+		},
+	}
+	if !reflect.DeepEqual(encoded, want) {
+		t.Errorf("spans\n%+v\nwant\n%+v", encoded, want)
+	}
+}
+
+func TestZipkinProtoExport(t *testing.T) {
+	tr, received := captureSpans(t, "zipkin", "proto")
+	spans := testSpans(tr)
+	if err := tr.exporter.export(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	contentType, body := received()
+	if contentType != "application/x-protobuf" {
+		t.Errorf("content type %s", contentType)
+	}
+
+	encoded := decodeProto(t, body).messages(t, 1)
+	if len(encoded) != 2 {
+		t.Fatalf("%d spans, want 2", len(encoded))
+	}
+	tests := []struct {
+		kind     uint64
+		parent   []byte
+		duration uint64
+		tags     map[string]string
+	}{
+		{2, nil, 1500, map[string]string{"http.method": "GET", "http.status_code": "200"}},
+		{1, spans[0].spanID[:], 1, map[string]string{"error": "connection refused"}},
+	}
+	for i, test := range tests {
+		m, s := encoded[i], spans[i]
+		if !bytes.Equal(m.bytes(1), s.traceID[:]) || !bytes.Equal(m.bytes(2), test.parent) || !bytes.Equal(m.bytes(3), s.spanID[:]) {
+			t.Errorf("span %d: trace %x parent %x id %x", i, m.bytes(1), m.bytes(2), m.bytes(3))
+		}
+		if m.uint(4) != test.kind || m.string(5) != s.name || m.uint(6) != uint64(s.start.UnixMicro()) || m.uint(7) != test.duration {
+			t.Errorf("span %d: kind %d name %q timestamp %d duration %d", i, m.uint(4), m.string(5), m.uint(6), m.uint(7))
+		}
+		if endpoint := m.messages(t, 8); len(endpoint) != 1 || endpoint[0].string(1) != "svc" {
+			t.Errorf("span %d: local endpoint %v", i, endpoint)
+		}
+		tags := map[string]string{}
+		for _, entry := range m.messages(t, 11) {
+			tags[entry.string(1)] = entry.string(2)
+		}
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("span %d: tags %v, want %v", i, tags, test.tags)
+		}
+	}
+}
+
+// readThrift reads a value of a Thrift binary protocol type: structs as
+// maps by field ID, lists as slices.
+func readThrift(t *testing.T, r *bytes.Reader, kind byte) any {
+	t.Helper()
+	read := func(value any) {
+		if err := binary.Read(r, binary.BigEndian, value); err != nil {
+			t.Fatalf("reading Thrift type %d: %v", kind, err)
+		}
+	}
+	switch kind {
+	case thriftBool:
+		var value byte
+		read(&value)
+		return value == 1
+	case thriftI32:
+		var value int32
+		read(&value)
+		return value
+	case thriftI64:
+		var value int64
+		read(&value)
+		return value
+	case thriftString:
+		var length int32
+		read(&length)
+		value := make([]byte, length)
+		read(value)
+		return string(value)
+	case thriftStruct:
+		fields := map[int16]any{}
+		for {
+			var fieldKind byte
+			read(&fieldKind)
+			if fieldKind == thriftStop {
+				return fields
+			}
+			var id int16
+			read(&id)
+			fields[id] = readThrift(t, r, fieldKind)
+		}
+	case thriftList:
+		var elementKind byte
+		var size int32
+		read(&elementKind)
+		read(&size)
+		list := make([]any, size)
+		for i := range list {
+			list[i] = readThrift(t, r, elementKind)
+		}
+		return list
+	}
+	t.Fatalf("unexpected Thrift type %d", kind)
+	return nil
+}
+
+func TestJaegerThriftExport(t *testing.T) {
+	tr, received := captureSpans(t, "jaeger", "thrift")
+	spans := testSpans(tr)
+	if err := tr.exporter.export(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	contentType, body := received()
+	if contentType != "application/x-thrift" {
+		t.Errorf("content type %s", contentType)
+	}
+
+	r := bytes.NewReader(body)
+	batch := readThrift(t, r, thriftStruct).(map[int16]any)
+	if r.Len() != 0 {
+		t.Errorf("%d bytes after the batch", r.Len())
+	}
+	if process := batch[1].(map[int16]any); process[1] != "svc" {
+		t.Errorf("process %v", process)
+	}
+
+	tag := func(key string, value any) map[int16]any {
+		if b, ok := value.(bool); ok {
+			return map[int16]any{1: key, 2: int32(2), 5: b}
+		}
+		return map[int16]any{1: key, 2: int32(0), 3: value}
+	}
+	want := []any{
+		map[int16]any{
+			1: int64(0x090a0b0c0d0e0f10), 2: int64(0x0102030405060708), 3: int64(0x0101010101010101), 4: int64(0),
+			5: "GET /api/data", 7: int32(1), 8: int64(1700000000123456), 9: int64(1500),
+			10: []any{tag("span.kind", "server"), tag("http.method", "GET"), tag("http.status_code", "200")},
+		},
+		map[int16]any{
+			1: int64(0x090a0b0c0d0e0f10), 2: int64(0x0102030405060708), 3: int64(0x0202020202020202), 4: int64(0x0101010101010101),
+			5: "call backend", 7: int32(1), 8: int64(1700000000123456), 9: int64(1),
+			10: []any{tag("span.kind", "client"), tag("error", true), tag("error.message", "connection refused")},
+		},
+	}
+	if !reflect.DeepEqual(batch[2], want) {
+		t.Errorf("spans\n%v\nwant\n%v", batch[2], want)
+	}
+}
+
+func TestJaegerGRPCExport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan []byte, 1)
+	methods := make(chan string, 1)
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		var request []byte
+		if err := stream.RecvMsg(&request); err != nil {
+			return err
+		}
+		methods <- method
+		requests <- request
+		return stream.SendMsg([]byte{})
+	}))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	tr := newTestTracer(t, "jaeger", "grpc", listener.Addr().String(), "w3c")
+	spans := testSpans(tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.exporter.export(ctx, spans); err != nil {
+		t.Fatal(err)
+	}
+	if method := <-methods; method != "/jaeger.api_v2.CollectorService/PostSpans" {
+		t.Errorf("method %s", method)
+	}
+
+	batch := decodeProto(t, <-requests).messages(t, 1)[0]
+	if process := batch.messages(t, 2); len(process) != 1 || process[0].string(1) != "svc" {
+		t.Errorf("process %v", process)
+	}
+	encoded := batch.messages(t, 1)
+	if len(encoded) != 2 {
+		t.Fatalf("%d spans, want 2", len(encoded))
+	}
+	timestamp := func(m protoMessage) time.Duration {
+		return time.Duration(m.uint(1))*time.Second + time.Duration(m.uint(2))
+	}
+	tests := []struct {
+		duration time.Duration
+		tags     []string
+	}{
+		{1500 * time.Microsecond, []string{"span.kind=server", "http.method=GET", "http.status_code=200"}},
+		{0, []string{"span.kind=client", "error=true", "error.message=connection refused"}},
+	}
+	for i, test := range tests {
+		m, s := encoded[i], spans[i]
+		if !bytes.Equal(m.bytes(1), s.traceID[:]) || !bytes.Equal(m.bytes(2), s.spanID[:]) || m.string(3) != s.name || m.uint(5) != 1 {
+			t.Errorf("span %d: trace %x span %x name %q flags %d", i, m.bytes(1), m.bytes(2), m.string(3), m.uint(5))
+		}
+		if start := timestamp(m.messages(t, 6)[0]); start != time.Duration(s.start.UnixNano()) {
+			t.Errorf("span %d: start %s", i, start)
+		}
+		if duration := timestamp(m.messages(t, 7)[0]); duration != test.duration {
+			t.Errorf("span %d: duration %s, want %s", i, duration, test.duration)
+		}
+		var tags []string
+		for _, kv := range m.messages(t, 8) {
+			value := kv.string(3)
+			if kv.uint(2) == 1 {
+				value = strings.Repeat("true", int(kv.uint(4)))
+			}
+			tags = append(tags, kv.string(1)+"="+value)
+		}
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("span %d: tags %v, want %v", i, tags, test.tags)
+		}
+	}
+	if references := encoded[0].messages(t, 4); len(references) != 0 {
+		t.Errorf("root span has references %v", references)
+	}
+	reference := encoded[1].messages(t, 4)
+	if len(reference) != 1 || !bytes.Equal(reference[0].bytes(1), spans[0].traceID[:]) || !bytes.Equal(reference[0].bytes(2), spans[0].spanID[:]) {
+		t.Errorf("child span references %v", reference)
+	}
+}
+
+func TestPostSpansError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid span", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	err := postSpans(context.Background(), server.URL, "application/json", []byte("[]"))
+	if err == nil || err.Error() != "status 400: invalid span" {
+		t.Errorf("error %v, want the status and body", err)
+	}
+
+	if _, err := newTracer(TracingConfig{Exporter: "otlp", Encoding: "thrift"}, "svc", nil, nil); err == nil {
+		t.Error("otlp with thrift encoding: want an error")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TracingConfig controls the spans created for inbound HTTP, gRPC and TCP
+// requests and for the periodic HTTP and gRPC requests, and how they are
+// exported and propagated.
+type TracingConfig struct {
+	Exporter       string        `json:"exporter"`    // "", "otlp", "zipkin", or "jaeger"
+	Encoding       string        `json:"encoding"`    // "protobuf" or "json" for otlp, "json" or "proto" for zipkin, "thrift" or "grpc" for jaeger
+	Endpoint       string        `json:"endpoint"`    // URL, or host:port for jaeger over gRPC
+	Propagation    string        `json:"propagation"` // Outbound headers: "w3c", "b3" (single header), or "b3multi"
+	SampleRatio    float64       `json:"sample_ratio"`
+	ExportInterval time.Duration `json:"export_interval"`
+}
+
+// traceEncodings lists the encodings of every exporter, the default first.
+var traceEncodings = map[string][]string{
+	"otlp":   {"protobuf", "json"},
+	"zipkin": {"json", "proto"},
+	"jaeger": {"thrift", "grpc"},
+}
+
+// maxPendingSpans bounds the spans kept between exports; later ones are
+// dropped.
+const maxPendingSpans = 4096
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// span is one finished or running operation. Only sampled spans are
+// exported, but every span propagates its context.
+type span struct {
+	spanContext
+	tracer     *tracer
+	parentID   [8]byte // Zero for root spans
+	name       string
+	kind       string // "server" or "client"
+	start      time.Time
+	end        time.Time
+	attributes [][2]string
+	err        string // Status message of failed spans
+}
+
+// tracer creates spans and exports the sampled ones in batches. A nil tracer
+// creates no spans, so tracing calls need no checks when it is disabled.
+type tracer struct {
+	config   TracingConfig
+	service  string
+	random   *seededRand
+	exporter spanExporter
+	spans    *prometheus.CounterVec
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+// spanExporter sends a batch of spans to a tracing backend.
+type spanExporter interface {
+	export(ctx context.Context, spans []*span) error
+}
+
+func newTracer(config TracingConfig, service string, random *seededRand, spans *prometheus.CounterVec) (*tracer, error) {
+	t := &tracer{config: config, service: service, random: random, spans: spans}
+	var err error
+	switch config.Exporter + "/" + config.Encoding {
+	case "otlp/protobuf", "otlp/json":
+		t.exporter = &otlpExporter{tracer: t, json: config.Encoding == "json"}
+	case "zipkin/json", "zipkin/proto":
+		t.exporter = &zipkinExporter{tracer: t, proto: config.Encoding == "proto"}
+	case "jaeger/thrift":
+		t.exporter = &jaegerThriftExporter{tracer: t}
+	case "jaeger/grpc":
+		t.exporter, err = newJaegerGRPCExporter(t)
+	default:
+		err = fmt.Errorf("unsupported trace exporter %s with encoding %s", config.Exporter, config.Encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tracer) String() string {
+	return fmt.Sprintf("%s (%s) to %s, propagating %s", t.config.Exporter, t.config.Encoding, redactUserinfo(t.config.Endpoint), t.config.Propagation)
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span stored in ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// start begins a span. Its parent is the remote context when one is given,
+// otherwise the span in ctx; without either it starts a new trace, sampled
+// by TRACE_SAMPLE_RATIO.
+func (t *tracer) start(ctx context.Context, name, kind string, remote *spanContext) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if remote == nil {
+		if parent := spanFromContext(ctx); parent != nil {
+			remote = &parent.spanContext
+		}
+	}
+	// IDs come from crypto/rand rather than the seeded source, so runs with
+	// the same SEED still produce distinct traces
+	if remote != nil {
+		s.traceID, s.parentID, s.sampled = remote.traceID, remote.spanID, remote.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.random.Float64() < t.config.SampleRatio
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) setAttribute(key, value string) {
+	if s != nil {
+		s.attributes = append(s.attributes, [2]string{key, value})
+	}
+}
+
+// finish ends the span, failed when message is not empty, and queues it for
+// export if it is sampled.
+func (s *span) finish(message string) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), message
+	if !s.sampled {
+		return
+	}
+
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.spans.WithLabelValues("dropped").Inc()
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// inject writes the span context as outbound headers or gRPC metadata in
+// the configured propagation format. Keys are lowercase, as gRPC requires.
+func (s *span) inject(set func(key, value string)) {
+	if s == nil {
+		return
+	}
+	traceID, spanID := hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])
+	sampled := "0"
+	if s.sampled {
+		sampled = "1"
+	}
+	switch s.tracer.config.Propagation {
+	case "b3":
+		set("b3", traceID+"-"+spanID+"-"+sampled)
+	case "b3multi":
+		set("x-b3-traceid", traceID)
+		set("x-b3-spanid", spanID)
+		set("x-b3-sampled", sampled)
+	default:
+		set("traceparent", "00-"+traceID+"-"+spanID+"-0"+sampled)
+	}
+}
+
+// extractSpanContext reads an inbound span context in any of the supported
+// formats: W3C traceparent, B3 single header or B3 multiple headers.
+func extractSpanContext(get func(key string) string) *spanContext {
+	var sc spanContext
+	var traceID, spanID, sampled string
+	if header := get("traceparent"); header != "" {
+		parts := strings.Split(strings.TrimSpace(header), "-")
+		if len(parts) != 4 || len(parts[3]) != 2 {
+			return nil
+		}
+		traceID, spanID = parts[1], parts[2]
+		if flags, err := strconv.ParseUint(parts[3], 16, 8); err == nil && flags&1 == 1 {
+			sampled = "1"
+		}
+	} else if header := get("b3"); header != "" {
+		parts := strings.Split(strings.TrimSpace(header), "-")
+		if len(parts) < 2 {
+			return nil
+		}
+		traceID, spanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else if header := get("x-b3-traceid"); header != "" {
+		traceID, spanID, sampled = header, get("x-b3-spanid"), get("x-b3-sampled")
+	} else {
+		return nil
+	}
+
+	// B3 allows 64-bit trace IDs, which take the low half
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return nil
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(traceID)); err != nil || sc.traceID == [16]byte{} {
+		return nil
+	}
+	// A zero span ID is invalid; the server span would look like a root
+	if _, err := hex.Decode(sc.spanID[:], []byte(spanID)); err != nil || sc.spanID == [8]byte{} {
+		return nil
+	}
+	// B3 "d" is the debug flag, which implies sampling
+	sc.sampled = sampled == "1" || sampled == "d" || sampled == "true"
+	return &sc
+}
+
+// run exports the pending spans every interval until stop is closed.
+func (t *tracer) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.config.ExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t.flush(ctx)
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flush exports the pending spans, giving up when ctx is done.
+func (t *tracer) flush(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.exporter.export(ctx, spans); err != nil {
+		t.spans.WithLabelValues("failed").Add(float64(len(spans)))
+		log.Printf("Exporting %d spans by %s failed: %v", len(spans), t.config.Exporter, err)
+		return
+	}
+	t.spans.WithLabelValues("exported").Add(float64(len(spans)))
+}
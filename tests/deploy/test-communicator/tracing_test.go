@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestTracer returns a tracer exporting to endpoint with the given
+// exporter, encoding and propagation.
+func newTestTracer(t *testing.T, exporter, encoding, endpoint, propagation string) *tracer {
+	t.Helper()
+	spans := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "spans_total"}, []string{"status"})
+	config := TracingConfig{Exporter: exporter, Encoding: encoding, Endpoint: endpoint, Propagation: propagation, SampleRatio: 1}
+	tr, err := newTracer(config, "svc", newSeededRand("test", "test"), spans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestSpanPropagationRoundTrip(t *testing.T) {
+	for _, propagation := range []string{"w3c", "b3", "b3multi"} {
+		for _, sampled := range []bool{true, false} {
+			tr := newTestTracer(t, "otlp", "json", "http://localhost", propagation)
+			tr.config.SampleRatio = 0
+			if sampled {
+				tr.config.SampleRatio = 1
+			}
+			_, s := tr.start(context.Background(), "call", "client", nil)
+
+			headers := map[string]string{}
+			s.inject(func(key, value string) { headers[key] = value })
+			remote := extractSpanContext(func(key string) string { return headers[key] })
+			if remote == nil {
+				t.Fatalf("%s: could not extract %v", propagation, headers)
+			}
+			if remote.traceID != s.traceID || remote.spanID != s.spanID || remote.sampled != sampled {
+				t.Errorf("%s: extracted %+v from %v, want %+v", propagation, remote, headers, s.spanContext)
+			}
+
+			// A server span continues the trace as a child
+			_, child := tr.start(context.Background(), "handle", "server", remote)
+			if child.traceID != s.traceID || child.parentID != s.spanID || child.spanID == s.spanID || child.sampled != sampled {
+				t.Errorf("%s: child %+v of %+v", propagation, child.spanContext, s.spanContext)
+			}
+		}
+	}
+}
+
+func TestExtractSpanContext(t *testing.T) {
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name    string
+		headers map[string]string
+		traceID string // Empty when nothing is extracted
+		sampled bool
+	}{
+		{"w3c sampled", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"}, traceID, true},
+		{"w3c not sampled", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-00"}, traceID, false},
+		{"w3c other flags", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-03"}, traceID, true},
+		{"w3c padded", map[string]string{"traceparent": " 00-" + traceID + "-" + spanID + "-01 "}, traceID, true},
+		{"w3c preferred over b3", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01", "b3": strings.Repeat("1", 32) + "-" + spanID}, traceID, true},
+		{"b3", map[string]string{"b3": traceID + "-" + spanID + "-1"}, traceID, true},
+		{"b3 debug", map[string]string{"b3": traceID + "-" + spanID + "-d"}, traceID, true},
+		{"b3 without sampling", map[string]string{"b3": traceID + "-" + spanID}, traceID, false},
+		{"b3 with parent", map[string]string{"b3": traceID + "-" + spanID + "-0-" + spanID}, traceID, false},
+		{"b3 64-bit trace", map[string]string{"b3": "a3ce929d0e0e4736-" + spanID + "-1"}, "0000000000000000a3ce929d0e0e4736", true},
+		{"b3multi", map[string]string{"x-b3-traceid": traceID, "x-b3-spanid": spanID, "x-b3-sampled": "true"}, traceID, true},
+		{"b3multi not sampled", map[string]string{"x-b3-traceid": traceID, "x-b3-spanid": spanID}, traceID, false},
+		{"none", map[string]string{}, "", false},
+		{"w3c too few parts", map[string]string{"traceparent": "00-" + traceID + "-" + spanID}, "", false},
+		{"w3c long flags", map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-001"}, "", false},
+		{"w3c short trace", map[string]string{"traceparent": "00-" + traceID[:30] + "-" + spanID + "-01"}, "", false},
+		{"w3c zero trace", map[string]string{"traceparent": "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01"}, "", false},
+		{"w3c zero span", map[string]string{"traceparent": "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01"}, "", false},
+		{"w3c not hex", map[string]string{"traceparent": "00-" + strings.Repeat("g", 32) + "-" + spanID + "-01"}, "", false},
+		{"b3 sampling only", map[string]string{"b3": "0"}, "", false},
+		{"b3multi missing span", map[string]string{"x-b3-traceid": traceID}, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := extractSpanContext(func(key string) string { return test.headers[key] })
+			if test.traceID == "" {
+				if sc != nil {
+					t.Errorf("extracted %+v, want nothing", sc)
+				}
+				return
+			}
+			if sc == nil {
+				t.Fatal("extracted nothing")
+			}
+			if got := hex.EncodeToString(sc.traceID[:]); got != test.traceID || hex.EncodeToString(sc.spanID[:]) != spanID || sc.sampled != test.sampled {
+				t.Errorf("extracted trace %s span %x sampled %t, want %s %s %t", got, sc.spanID, sc.sampled, test.traceID, spanID, test.sampled)
+			}
+		})
+	}
+}
+
+func TestTracerPendingSpans(t *testing.T) {
+	tr := newTestTracer(t, "otlp", "json", "http://localhost", "w3c")
+	tr.config.SampleRatio = 0
+	_, s := tr.start(context.Background(), "unsampled", "server", nil)
+	s.finish("")
+	if len(tr.pending) != 0 {
+		t.Errorf("unsampled span is pending")
+	}
+
+	tr.config.SampleRatio = 1
+	for range maxPendingSpans + 3 {
+		_, s := tr.start(context.Background(), "sampled", "server", nil)
+		s.finish("")
+	}
+	if len(tr.pending) != maxPendingSpans {
+		t.Errorf("%d pending spans, want %d", len(tr.pending), maxPendingSpans)
+	}
+	var dropped dto.Metric
+	tr.spans.WithLabelValues("dropped").Write(&dropped)
+	if dropped.GetCounter().GetValue() != 3 {
+		t.Errorf("%g dropped spans, want 3", dropped.GetCounter().GetValue())
+	}
+
+	// A nil tracer creates nil spans, which are safe to use
+	var none *tracer
+	ctx, s := none.start(context.Background(), "off", "server", nil)
+	s.setAttribute("k", "v")
+	s.inject(func(key, value string) { t.Errorf("nil span injected %s", key) })
+	s.finish("error")
+	if spanFromContext(ctx) != nil {
+		t.Error("nil tracer stored a span")
+	}
+}
+
+func TestRequestTraceExemplars(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tr := newTestTracer(t, "otlp", "json", "http://localhost", "w3c")
+
+	tests := []struct {
+		name          string
+		ratio         float64
+		tracing       bool
+		traceSampled  bool
+		header        string
+		wantTrace     string // "new" for a new trace returned in traceparent
+		wantResponded bool
+	}{
+		{name: "inbound sampled", header: traceparent, wantTrace: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "inbound not sampled", header: strings.TrimSuffix(traceparent, "1") + "0"},
+		{name: "no context", ratio: 0},
+		{name: "no context, sampled by ratio", ratio: 1, wantTrace: "new", wantResponded: true},
+		{name: "server span of inbound trace", tracing: true, traceSampled: true, header: traceparent, wantTrace: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "root server span", tracing: true, traceSampled: true, wantTrace: "span", wantResponded: true},
+		{name: "unsampled server span", tracing: true, ratio: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &App{config: Config{ExemplarSampleRatio: test.ratio}, exemplarRandom: newSeededRand("test", "test")}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("traceparent", test.header)
+			}
+			var s *span
+			if test.tracing {
+				tr.config.SampleRatio = 0
+				if test.traceSampled {
+					tr.config.SampleRatio = 1
+				}
+				_, s = tr.start(r.Context(), "GET /", "server", extractSpanContext(r.Header.Get))
+			}
+			w := httptest.NewRecorder()
+			traceID := app.requestTrace(w, r, s)
+
+			responded := w.Header().Get("traceparent")
+			if (responded != "") != test.wantResponded {
+				t.Errorf("traceparent response header %q", responded)
+			}
+			switch test.wantTrace {
+			case "new":
+				if len(traceID) != 32 || !strings.Contains(responded, traceID) {
+					t.Errorf("trace %q not returned in %q", traceID, responded)
+				}
+			case "span":
+				if traceID != hex.EncodeToString(s.traceID[:]) || responded != "00-"+traceID+"-"+hex.EncodeToString(s.spanID[:])+"-01" {
+					t.Errorf("trace %q and traceparent %q, want the server span's", traceID, responded)
+				}
+			default:
+				if traceID != test.wantTrace {
+					t.Errorf("trace %q, want %q", traceID, test.wantTrace)
+				}
+			}
+		})
+	}
+}
@@ -87,3 +87,28 @@ def test_logs_not_collected_from_excluded_namespace() -> None:
     assert_no_data(entity_relationship_states, "entity_relationship_state_event")
 
     print("No records from the excluded namespace were found in ClickHouse.")
+
+def test_flows_not_collected_from_excluded_namespace() -> None:
+    """Verify the flows sent from the excluded namespace are not collected.
+
+    The ignored client sends ignored-to-included to an included Service
+    and ignored-to-external to an unroutable address. Both are tagged at
+    the sender with a log line and flow_requests_total, which must never
+    reach ClickHouse. Runs after the log test above, which waits for the
+    flows to be sent.
+    """
+
+    sender_metrics = clickhouse_client.count_records(
+        "otel.otel_metrics_sum",
+        "MetricName = 'flow_requests_total' AND Attributes['flow'] IN ('ignored-to-included', 'ignored-to-external')",
+    )
+    assert_no_data(sender_metrics, "flow_requests_total")
+
+    for flow in ("ignored-to-included", "ignored-to-external"):
+        sender_logs = clickhouse_client.count_records(
+            "otel.otel_logs",
+            f"Body LIKE 'Flow {flow} from %'",
+        )
+        assert_no_data(sender_logs, f"{flow} flow log")
+
+    print("No flows from the excluded namespace were found in ClickHouse.")